@@ -11,8 +11,9 @@ import (
 type DataContainer struct {
 	Sents                 [][]string
 	SamplingWordSeqs      []context
-	SamplingPosSeqs       [][]int // for PYHSMM
-	SamplingDepthMemories [][]int // for VPYLM
+	SamplingPosSeqs       [][]int           // for PYHSMM
+	SamplingDepthMemories [][]int           // for VPYLM
+	Constraints           []*SentConstraint // partial annotations (see NewDataContainerWithConstraints)
 	Size                  int
 }
 
@@ -39,22 +40,22 @@ type DataContainer struct {
 
 // NewDataContainer returns DataContainer instance.
 // input file is required unsegmented texts (not split space)
-func NewDataContainer(filePath string, splitter string, maxSentLen int) *DataContainer {
+func NewDataContainer(filePath string, splitter string, maxSentLen int) (*DataContainer, error) {
 	dataContainer := new(DataContainer)
 
-	f, ok := os.Open(filePath)
-	if ok != nil {
-		errMsg := fmt.Sprintf("cannot open filePath (%v)", filePath)
-		panic(errMsg)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w. cannot open filePath (%v): %v", ErrFile, filePath, err)
 	}
 	defer f.Close()
 
 	sc := bufio.NewScanner(f)
 	count := 0
+	lineNumber := 0
 	for sc.Scan() {
-		if ok := sc.Err(); ok != nil {
-			errMsg := fmt.Sprintf("read error in filePath (%v): line %v", filePath, count)
-			panic(errMsg)
+		lineNumber++
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("%w. read error in filePath (%v): line %v: %v", ErrFile, filePath, lineNumber, err)
 		}
 
 		loweredStringSent := strings.ToLower(sc.Text())
@@ -71,27 +72,72 @@ func NewDataContainer(filePath string, splitter string, maxSentLen int) *DataCon
 		}
 	}
 	dataContainer.Size = count
-	return dataContainer
+	return dataContainer, nil
+}
+
+// NewDataContainerWithConstraints returns DataContainer instance with partial annotations.
+// input file is required unsegmented texts (not split space) with markups (see parseConstrainedSent)
+// e.g., "これは|[ペン/3]です+か"
+func NewDataContainerWithConstraints(filePath string, splitter string, maxSentLen int) (*DataContainer, error) {
+	dataContainer := new(DataContainer)
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w. cannot open filePath (%v): %v", ErrFile, filePath, err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	count := 0
+	lineNumber := 0
+	for sc.Scan() {
+		lineNumber++
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("%w. read error in filePath (%v): line %v: %v", ErrFile, filePath, lineNumber, err)
+		}
+
+		loweredStringSent := strings.ToLower(sc.Text())
+		sent, constraint, err := parseConstrainedSent(loweredStringSent, splitter)
+		if err != nil {
+			return nil, fmt.Errorf("%w. filePath (%v): line %v", err, filePath, lineNumber)
+		}
+		if len(sent) > maxSentLen {
+			sent = sent[0:maxSentLen]
+			if constraint != nil {
+				constraint.truncate(maxSentLen)
+			}
+		}
+		if len(sent) > 0 {
+			dataContainer.Sents = append(dataContainer.Sents, sent)
+			dataContainer.SamplingWordSeqs = append(dataContainer.SamplingWordSeqs, make(context, 0, len(sent)))
+			dataContainer.SamplingPosSeqs = append(dataContainer.SamplingPosSeqs, make([]int, 0, len(sent)))
+			dataContainer.SamplingDepthMemories = append(dataContainer.SamplingDepthMemories, make([]int, 0, len(sent)))
+			dataContainer.Constraints = append(dataContainer.Constraints, constraint)
+			count++
+		}
+	}
+	dataContainer.Size = count
+	return dataContainer, nil
 }
 
 // NewDataContainerFromAnnotatedData returns DataContainer instance.
 // input file is required segmented texts (split space)
-func NewDataContainerFromAnnotatedData(filePath string) *DataContainer {
+func NewDataContainerFromAnnotatedData(filePath string) (*DataContainer, error) {
 	dataContainer := new(DataContainer)
 
-	f, ok := os.Open(filePath)
-	if ok != nil {
-		errMsg := fmt.Sprintf("cannot open filePath (%v)", filePath)
-		panic(errMsg)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w. cannot open filePath (%v): %v", ErrFile, filePath, err)
 	}
 	defer f.Close()
 
 	sc := bufio.NewScanner(f)
 	count := 0
+	lineNumber := 0
 	for sc.Scan() {
-		if ok := sc.Err(); ok != nil {
-			errMsg := fmt.Sprintf("read error in filePath (%v): line %v", filePath, count)
-			panic(errMsg)
+		lineNumber++
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("%w. read error in filePath (%v): line %v: %v", ErrFile, filePath, lineNumber, err)
 		}
 
 		sentStr := sc.Text()
@@ -110,7 +156,67 @@ func NewDataContainerFromAnnotatedData(filePath string) *DataContainer {
 		}
 	}
 	dataContainer.Size = count
-	return dataContainer
+	return dataContainer, nil
+}
+
+// NewDataContainerFromAnnotatedDataWithPos returns DataContainer instance and POS tag list (id2pos).
+// input file is required segmented texts (split space) whose tokens are word and POS tag joined by posDelimiter
+// e.g., posDelimiter = "/", sent = "this/DT is/VBZ an/DT example/NN"
+func NewDataContainerFromAnnotatedDataWithPos(filePath string, posDelimiter string) (*DataContainer, []string, error) {
+	dataContainer := new(DataContainer)
+	pos2id := make(map[string]int)
+	id2pos := make([]string, 0, 0)
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w. cannot open filePath (%v): %v", ErrFile, filePath, err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	count := 0
+	lineNumber := 0
+	for sc.Scan() {
+		lineNumber++
+		if err := sc.Err(); err != nil {
+			return nil, nil, fmt.Errorf("%w. read error in filePath (%v): line %v: %v", ErrFile, filePath, lineNumber, err)
+		}
+
+		tokens := strings.Fields(sc.Text())
+		if len(tokens) == 0 {
+			continue
+		}
+		wordSeq := make(context, 0, len(tokens))
+		posSeq := make([]int, 0, len(tokens))
+		for _, token := range tokens {
+			i := strings.LastIndex(token, posDelimiter)
+			if i <= 0 {
+				return nil, nil, fmt.Errorf("%w. filePath (%v): line %v. token (%v) does not have POS tag", ErrFormat, filePath, lineNumber, token)
+			}
+			pos := token[i+len(posDelimiter):]
+			posID, ok := pos2id[pos]
+			if !ok {
+				posID = len(id2pos)
+				pos2id[pos] = posID
+				id2pos = append(id2pos, pos)
+			}
+			wordSeq = append(wordSeq, token[:i])
+			posSeq = append(posSeq, posID)
+		}
+		sent := strings.Split(strings.Join(wordSeq, ""), "")
+		dataContainer.Sents = append(dataContainer.Sents, sent)
+		dataContainer.SamplingWordSeqs = append(dataContainer.SamplingWordSeqs, wordSeq)
+		dataContainer.SamplingPosSeqs = append(dataContainer.SamplingPosSeqs, posSeq)
+		dataContainer.SamplingDepthMemories = append(dataContainer.SamplingDepthMemories, make([]int, 0, len(wordSeq)))
+		count++
+	}
+	dataContainer.Size = count
+	return dataContainer, id2pos, nil
+}
+
+// GetConstraint returns i-th constraint. it is nil if the sentence has no partial annotation.
+func (dataContainer *DataContainer) GetConstraint(i int) *SentConstraint {
+	return constraintAt(dataContainer.Constraints, i)
 }
 
 // GetWordSeq returns i-th wordSeq ([]string) for python binding.
@@ -118,12 +224,20 @@ func (dataContainer *DataContainer) GetWordSeq(i int) []string {
 	return dataContainer.SamplingWordSeqs[i]
 }
 
+// GetWordSeqs returns all wordSeqs ([][]string).
+func (dataContainer *DataContainer) GetWordSeqs() [][]string {
+	wordSeqs := make([][]string, dataContainer.Size, dataContainer.Size)
+	for i := 0; i < dataContainer.Size; i++ {
+		wordSeqs[i] = dataContainer.SamplingWordSeqs[i]
+	}
+	return wordSeqs
+}
+
 // GetSentString returns i-th sent (string) for python binding.
 // e.g., sent = "this is an example of sent"
-func (dataContainer *DataContainer) GetSentString(i int) string {
-	if i > dataContainer.Size {
-		errMsg := fmt.Sprintf("GetSentString error. index i (%v) is bigger than size (%v)", i, dataContainer.Size)
-		panic(errMsg)
+func (dataContainer *DataContainer) GetSentString(i int) (string, error) {
+	if i < 0 || i >= dataContainer.Size {
+		return "", fmt.Errorf("%w. GetSentString error. index i (%v) is out of range of size (%v)", ErrInvalidParameter, i, dataContainer.Size)
 	}
-	return strings.Join((dataContainer.Sents[i]), "")
+	return strings.Join((dataContainer.Sents[i]), ""), nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"sort"
 	"strings"
 
 	"github.com/cheggaaa/pb/v3"
@@ -13,24 +14,111 @@ import (
 
 type table newUint // number of customer (input word) in the table
 
+// tableCount is the number of tables which have the same number of customers.
+type tableCount struct {
+	customers newUint // number of customers of each table
+	tables    newUint
+}
+
+// tableHistogram is the histogram of the numbers of customers of tables sorted by the numbers of customers.
+// tables which have the same number of customers are exchangeable in sampling, so the histogram is enough to sample seating arrangements,
+// and its size does not depend on the number of tables.
+type tableHistogram []tableCount
+
+// add adds n tables which have customers customers. n is negative to remove tables.
+func (hist tableHistogram) add(customers newUint, n int) tableHistogram {
+	i := 0
+	for i < len(hist) && hist[i].customers < customers {
+		i++
+	}
+	if i < len(hist) && hist[i].customers == customers {
+		hist[i].tables = newUint(int(hist[i].tables) + n)
+		if hist[i].tables == 0 {
+			hist = append(hist[:i], hist[i+1:]...)
+		}
+		return hist
+	}
+	if n < 0 {
+		panic("tableHistogram error. table does not exist")
+	}
+	hist = append(hist, tableCount{})
+	copy(hist[i+1:], hist[i:])
+	hist[i] = tableCount{customers, newUint(n)}
+	return hist
+}
+
+// tableList returns the numbers of customers of all tables, which are saved in model files.
+func (hist tableHistogram) tableList() []table {
+	tbls := make([]table, 0)
+	for _, count := range hist {
+		for i := newUint(0); i < count.tables; i++ {
+			tbls = append(tbls, table(count.customers))
+		}
+	}
+	return tbls
+}
+
+func newTableHistogram(tbls []table) tableHistogram {
+	hist := make(tableHistogram, 0)
+	for _, tbl := range tbls {
+		hist = hist.add(newUint(tbl), 1)
+	}
+	return hist
+}
+
+// restaurant is keyed by ids of words in the symbol table of HPYLM (see HPYLM.word).
 type restaurant struct {
-	tables map[string][]table // word to tables
+	tables map[int32]tableHistogram // word to histogram of tables
 	// simple p(word|context) = customerCount[word] / totalCustomerCount
-	customerCount              map[string]newUint // word to count int the restaurant.
+	customerCount              map[int32]newUint // word to count int the restaurant.
 	totalCustomerCount         newUint
-	totalTableCountForCustomer map[string]newUint // word to number of word serving tables
-	totalTableCount            newUint            // number of tables
+	totalTableCountForCustomer map[int32]newUint // word to number of word serving tables
+	totalTableCount            newUint           // number of tables
 
 	stop newUint // number of stop for stop probability in n-gram
 	pass newUint // number of pass for stop probability in n-gram
 }
 
-func (rst *restaurant) save() ([]byte, *restaurantJSON) {
+// wordCounts returns counts whose keys are the words of the ids in symbols.
+func wordCounts(counts map[int32]newUint, symbols *symbolTable) map[string]newUint {
+	wordCounts := make(map[string]newUint, len(counts))
+	for word, count := range counts {
+		wordCounts[symbols.words[word]] = count
+	}
+	return wordCounts
+}
+
+// internCounts returns counts whose keys are the ids of the words interned in symbols.
+func internCounts(wordCounts map[string]newUint, symbols *symbolTable) map[int32]newUint {
+	counts := make(map[int32]newUint, len(wordCounts))
+	for word, count := range wordCounts {
+		counts[symbols.intern(word)] = count
+	}
+	return counts
+}
+
+// sortedWords returns the ids of words in tables sorted by the words, so that restaurants are visited in the same order regardless of the ids.
+func sortedWords(tables map[int32]tableHistogram, symbols *symbolTable) []int32 {
+	words := make([]int32, 0, len(tables))
+	for word := range tables {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool { return symbols.words[words[i]] < symbols.words[words[j]] })
+	return words
+}
+
+func (rst *restaurant) save(symbols *symbolTable) ([]byte, *restaurantJSON) {
 	rstJSON := &restaurantJSON{
-		Tables:                     rst.tables,
-		CustomerCount:              rst.customerCount,
+		Tables: func(tables map[int32]tableHistogram) map[string][]table {
+			tablesJSON := make(map[string][]table, len(tables))
+			for word, hist := range tables {
+				tablesJSON[symbols.words[word]] = hist.tableList()
+			}
+			return tablesJSON
+		}(rst.tables),
+		CustomerCount:              wordCounts(rst.customerCount, symbols),
 		TotalCustomerCount:         rst.totalCustomerCount,
-		TotalTableCountForCustomer: rst.totalTableCountForCustomer,
+		TotalTableCountForCustomer: wordCounts(rst.totalTableCountForCustomer, symbols),
 		TotalTableCount:            rst.totalTableCount,
 
 		Stop: rst.stop,
@@ -43,7 +131,7 @@ func (rst *restaurant) save() ([]byte, *restaurantJSON) {
 	return v, rstJSON
 }
 
-func (rst *restaurant) load(v []byte) {
+func (rst *restaurant) load(v []byte, symbols *symbolTable) {
 	rstJSON := new(restaurantJSON)
 
 	err := json.Unmarshal(v, &rstJSON)
@@ -51,10 +139,15 @@ func (rst *restaurant) load(v []byte) {
 		panic("load error in restaurant")
 	}
 
-	rst.tables = rstJSON.Tables
-	rst.customerCount = rstJSON.CustomerCount
+	rst.tables = make(map[int32]tableHistogram, len(rstJSON.Tables))
+	for word, tbls := range rstJSON.Tables {
+		if len(tbls) != 0 {
+			rst.tables[symbols.intern(word)] = newTableHistogram(tbls)
+		}
+	}
+	rst.customerCount = internCounts(rstJSON.CustomerCount, symbols)
 	rst.totalCustomerCount = rstJSON.TotalCustomerCount
-	rst.totalTableCountForCustomer = rstJSON.TotalTableCountForCustomer
+	rst.totalTableCountForCustomer = internCounts(rstJSON.TotalTableCountForCustomer, symbols)
 	rst.totalTableCount = rstJSON.TotalTableCount
 
 	rst.stop = rstJSON.Stop
@@ -62,9 +155,63 @@ func (rst *restaurant) load(v []byte) {
 	return
 }
 
+func (rst *restaurant) saveBinary(bw *binaryWriter, symbols *symbolTable) {
+	words := sortedWords(rst.tables, symbols)
+	bw.writeUvarint(uint64(len(words)))
+	for _, word := range words {
+		// the histogram is written instead of tableList, so the size does not depend on the number of tables
+		hist := rst.tables[word]
+		bw.writeWord(symbols.words[word])
+		bw.writeUvarint(uint64(len(hist)))
+		for _, count := range hist {
+			bw.writeUvarint(uint64(count.customers))
+			bw.writeUvarint(uint64(count.tables))
+		}
+	}
+	bw.writeCounts(wordCounts(rst.customerCount, symbols))
+	bw.writeUvarint(uint64(rst.totalCustomerCount))
+	bw.writeCounts(wordCounts(rst.totalTableCountForCustomer, symbols))
+	bw.writeUvarint(uint64(rst.totalTableCount))
+
+	bw.writeUvarint(uint64(rst.stop))
+	bw.writeUvarint(uint64(rst.pass))
+}
+
+func (rst *restaurant) loadBinary(br *binaryReader, symbols *symbolTable) {
+	n := br.readLength()
+	rst.tables = make(map[int32]tableHistogram, capacityHint(n))
+	for i := 0; i < n && br.err == nil; i++ {
+		word := br.readWord()
+		histLen := br.readLength()
+		hist := make(tableHistogram, 0, capacityHint(histLen))
+		for k := 0; k < histLen && br.err == nil; k++ {
+			count := tableCount{newUint(br.readUvarint()), newUint(br.readUvarint())}
+			// the histogram is sorted by the numbers of customers, and it does not have empty entries
+			if count.customers == 0 || count.tables == 0 || (k > 0 && count.customers <= hist[k-1].customers) {
+				br.setError(fmt.Errorf("broken histogram of tables of word (%v)", word))
+				break
+			}
+			hist = append(hist, count)
+		}
+		if len(hist) != 0 {
+			rst.tables[symbols.intern(word)] = hist
+		}
+	}
+	rst.customerCount = internCounts(br.readCounts(), symbols)
+	rst.totalCustomerCount = newUint(br.readUvarint())
+	rst.totalTableCountForCustomer = internCounts(br.readCounts(), symbols)
+	rst.totalTableCount = newUint(br.readUvarint())
+
+	rst.stop = newUint(br.readUvarint())
+	rst.pass = newUint(br.readUvarint())
+	return
+}
+
 // HPYLM contains n-gram parameters as restaurants.
 type HPYLM struct {
-	restaurants map[string]*restaurant // context to restaurant
+	restaurants     []*restaurant // context id to restaurant. it is nil if the restaurant does not exist
+	contexts        *contextTrie  // context to id
+	restaurantCount int
 
 	maxDepth int
 	theta    []float64 // parameters for Pitman-Yor process
@@ -74,62 +221,107 @@ type HPYLM struct {
 	betaA    []float64 // hyper-parameters using beta distributionfor to estimate d
 	betaB    []float64 // hyper-parameters using beta distributionfor to estimate d
 	Base     float64
+
+	rnd       *rand.Rand  // random number generator for sampling (see SetRandSeed)
+	rndSource *splitMix64 // source of rnd
+
+	frozen *frozenHPYLM // predictive representation made by Freeze. restaurants are empty if it is not nil
+
+	version uint64 // incremented whenever probabilities are changed, so that caches of probabilities are invalidated
 }
 
 func newRestaurant() *restaurant {
 	rst := new(restaurant)
-	rst.tables = make(map[string][]table)
-	rst.customerCount = make(map[string]newUint)
+	rst.tables = make(map[int32]tableHistogram)
+	rst.customerCount = make(map[int32]newUint)
 	rst.totalCustomerCount = 0
-	rst.totalTableCountForCustomer = make(map[string]newUint)
+	rst.totalTableCountForCustomer = make(map[int32]newUint)
 	rst.totalTableCount = 0
 	return rst
 }
 
-func (rst *restaurant) addCustomer(word string, u context, k newUint) bool {
+// addCustomer adds a customer to a table which has customers customers. customers is 0 to add a new table.
+func (rst *restaurant) addCustomer(word int32, customers newUint) bool {
 	addTbl := false
 
-	if rst.totalTableCountForCustomer[word] > k {
-		rst.tables[word][k]++
+	hist := rst.tables[word]
+	if customers > 0 {
+		hist = hist.add(customers, -1)
 	} else {
 		// add new table
-		rst.tables[word] = append(rst.tables[word], 1)
 		rst.totalTableCountForCustomer[word]++
 		rst.totalTableCount++
 		addTbl = true
 	}
+	rst.tables[word] = hist.add(customers+1, 1)
 	rst.customerCount[word]++
 	rst.totalCustomerCount++
 	return addTbl
 }
 
-func (rst *restaurant) removeCustomer(word string, u context, k newUint) (bool, bool) {
+// removeCustomer removes a customer from a table which has customers customers.
+func (rst *restaurant) removeCustomer(word int32, customers newUint) (bool, bool) {
 	removeTbl := false
 	removeRst := false
 
-	rst.tables[word][k]--
+	hist := rst.tables[word].add(customers, -1)
 	rst.customerCount[word]--
 	rst.totalCustomerCount--
-	if rst.tables[word][k] == 0 {
-		// remove k-th table
-		rst.tables[word] = append(rst.tables[word][:k], rst.tables[word][k+1:]...)
+	if customers == 1 {
+		// remove the table
 		rst.totalTableCountForCustomer[word]--
 		rst.totalTableCount--
 		removeTbl = true
 		if rst.totalTableCount == 0 {
 			removeRst = true
 		}
+	} else {
+		hist = hist.add(customers-1, 1)
 	}
-	if len(rst.tables[word]) == 0 {
+	if len(hist) == 0 {
 		delete(rst.tables, word)
+	} else {
+		rst.tables[word] = hist
 	}
 	return removeTbl, removeRst
 }
 
+// renameWords replaces the ids of words with newWords[id] after the symbol table is compacted.
+func (rst *restaurant) renameWords(newWords []int32) {
+	tables := make(map[int32]tableHistogram, len(rst.tables))
+	for word, hist := range rst.tables {
+		tables[newWords[word]] = hist
+	}
+	rst.tables = tables
+	rst.customerCount = renameCounts(rst.customerCount, newWords)
+	rst.totalTableCountForCustomer = renameCounts(rst.totalTableCountForCustomer, newWords)
+}
+
+func renameCounts(counts map[int32]newUint, newWords []int32) map[int32]newUint {
+	renamed := make(map[int32]newUint, len(counts))
+	for word, count := range counts {
+		renamed[newWords[word]] = count
+	}
+	return renamed
+}
+
 // NewHPYLM returns HPYLM instance.
-func NewHPYLM(maxDepth int, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, Base float64) *HPYLM {
+func NewHPYLM(maxDepth int, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, Base float64) (*HPYLM, error) {
+	if maxDepth <= 0 {
+		return nil, fmt.Errorf("%w. range of maxDepth is 0 to 255", ErrInvalidParameter)
+	}
+	if initialD <= 0.0 || initialD >= 1.0 {
+		return nil, fmt.Errorf("%w. range of initialD is 0.0 to 1.0", ErrInvalidParameter)
+	}
+	if initialTheta <= 0.0 {
+		return nil, fmt.Errorf("%w. range of initialTheta is range 0.0 to inf", ErrInvalidParameter)
+	}
+	if Base <= 0.0 || Base >= 1.0 {
+		return nil, fmt.Errorf("%w. range of Base is 0.0 to 1.0", ErrInvalidParameter)
+	}
+
 	hpylm := new(HPYLM)
-	hpylm.restaurants = make(map[string]*restaurant)
+	hpylm.resetRestaurants()
 	hpylm.maxDepth = maxDepth
 	hpylm.theta = make([]float64, hpylm.maxDepth+1, hpylm.maxDepth+1)
 	hpylm.d = make([]float64, hpylm.maxDepth+1, hpylm.maxDepth+1)
@@ -145,44 +337,124 @@ func NewHPYLM(maxDepth int, initialTheta float64, initialD float64, gammaA float
 		hpylm.betaA[i] = float64(betaA)
 		hpylm.betaB[i] = float64(betaB)
 	}
-	if maxDepth <= 0 {
-		panic("range of maxDepth is 0 to 255")
-	}
-	if initialD <= 0.0 || initialD >= 1.0 {
-		panic("range of initialD is 0.0 to 1.0")
-	}
-	if initialTheta <= 0.0 {
-		panic("range of initialTheta is range 0.0 to inf")
-	}
-	if Base <= 0.0 || Base >= 1.0 {
-		panic("range of Base is 0.0 to 1.0")
-	}
 
 	hpylm.Base = float64(Base)
+	hpylm.setRand(newRandSource())
+	return hpylm, nil
+}
+
+// newHPYLMToLoad returns empty HPYLM instance whose parameters are set by load.
+func newHPYLMToLoad() *HPYLM {
+	hpylm := new(HPYLM)
+	hpylm.resetRestaurants()
+	hpylm.setRand(newRandSource())
 	return hpylm
 }
 
 // AddCustomer adds n-gram parameters.
-func (hpylm *HPYLM) AddCustomer(word string, u context, base float64, addBaseFunc func(string)) {
+func (hpylm *HPYLM) AddCustomer(word string, u context, base float64, addBaseFunc func(string)) error {
+	if hpylm.frozen != nil {
+		return fmt.Errorf("%w. AddCustomer of HPYLM", ErrFrozen)
+	}
+	hpylm.addCustomer(word, u, base, addBaseFunc)
+	return nil
+}
+
+// addCustomer is AddCustomer without the check of frozen. callers check it beforehand.
+func (hpylm *HPYLM) addCustomer(word string, u context, base float64, addBaseFunc func(string)) {
 	_, probs := hpylm.CalcProb(word, u, base)
-	hpylm.addCustomerRecursively(word, u, probs, base, addBaseFunc)
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	w := hpylm.contexts.symbols.intern(word)
+	hpylm.contexts.add(u, ids)
+	hpylm.version++
+	hpylm.addCustomerRecursively(word, w, u, ids, probs, base, addBaseFunc)
 	return
 }
 
-func (hpylm *HPYLM) addStopAndPassCount(u context) {
-	rst, ok := hpylm.restaurants[strings.Join(u, concat)]
-	if !ok {
-		errMsg := fmt.Sprintf("addStopAndPassCount error. context u (%v) does not exist", u)
-		panic(errMsg)
+// restaurant returns the restaurant of context id. it returns nil if the restaurant does not exist.
+func (hpylm *HPYLM) restaurant(id contextID) *restaurant {
+	if id == noContext || int(id) >= len(hpylm.restaurants) {
+		return nil
 	}
-	rst.stop++
-	for i := 1; i <= len(u); i++ {
-		rst, ok := hpylm.restaurants[strings.Join(u[i:], concat)]
-		if !ok {
+	return hpylm.restaurants[id]
+}
+
+// restaurantOf returns the restaurant of context u.
+func (hpylm *HPYLM) restaurantOf(u context) (*restaurant, bool) {
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	hpylm.contexts.lookup(u, ids)
+	rst := hpylm.restaurant(ids[len(u)])
+	return rst, rst != nil
+}
+
+// restaurantMap returns restaurants whose keys are strings.Join(u, concat), which are the keys in model files.
+func (hpylm *HPYLM) restaurantMap() map[string]*restaurant {
+	rsts := make(map[string]*restaurant, hpylm.restaurantCount)
+	for id, rst := range hpylm.restaurants {
+		if rst != nil {
+			rsts[hpylm.contexts.key(contextID(id))] = rst
+		}
+	}
+	return rsts
+}
+
+// resetRestaurants removes all restaurants, the context ids and the word ids.
+func (hpylm *HPYLM) resetRestaurants() {
+	hpylm.version++
+	hpylm.contexts = newContextTrie()
+	hpylm.restaurants = make([]*restaurant, 1, 1)
+	hpylm.restaurantCount = 0
+}
+
+// setRestaurantOf sets the restaurant of context whose key is strings.Join(u, concat). words of rst should be interned in hpylm.contexts.symbols.
+func (hpylm *HPYLM) setRestaurantOf(key string, rst *restaurant) {
+	hpylm.version++
+	u := context{}
+	if key != "" {
+		u = strings.Split(key, concat)
+	}
+	ids := make([]contextID, len(u)+1, len(u)+1)
+	hpylm.contexts.add(u, ids)
+	hpylm.setRestaurant(ids[len(u)], rst)
+}
+
+// word returns the word of id in restaurants.
+func (hpylm *HPYLM) word(id int32) string {
+	return hpylm.contexts.symbols.words[id]
+}
+
+// setRestaurant sets the restaurant of context id. rst is nil to remove the restaurant.
+func (hpylm *HPYLM) setRestaurant(id contextID, rst *restaurant) {
+	for len(hpylm.restaurants) < hpylm.contexts.size() {
+		hpylm.restaurants = append(hpylm.restaurants, nil)
+	}
+	if hpylm.restaurants[id] != nil {
+		hpylm.restaurantCount--
+	}
+	if rst != nil {
+		hpylm.restaurantCount++
+	}
+	hpylm.restaurants[id] = rst
+}
+
+func (hpylm *HPYLM) addStopAndPassCount(u context) {
+	hpylm.version++
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	hpylm.contexts.lookup(u, ids)
+	for i := 0; i <= len(u); i++ {
+		rst := hpylm.restaurant(ids[len(u)-i])
+		if rst == nil {
 			errMsg := fmt.Sprintf("addStopAndPassCount error. context u (%v) does not exist", u[i:])
 			panic(errMsg)
 		}
-		rst.pass++
+		if i == 0 {
+			rst.stop++
+		} else {
+			rst.pass++
+		}
 	}
 	return
 }
@@ -192,57 +464,50 @@ func (hpylm *HPYLM) addCustomerBaseNull(word string) {
 	return
 }
 
-func (hpylm *HPYLM) addCustomerRecursively(word string, u context, probs []float64, base float64, addBaseFunc func(string)) {
+// addCustomerRecursively adds word whose id is w in the symbol table of hpylm.contexts.
+func (hpylm *HPYLM) addCustomerRecursively(word string, w int32, u context, ids []contextID, probs []float64, base float64, addBaseFunc func(string)) {
 	theta := hpylm.theta[len(u)]
 	d := hpylm.d[len(u)]
-	rst, ok := hpylm.restaurants[strings.Join(u, concat)]
-	if !ok {
-		hpylm.restaurants[strings.Join(u, concat)] = newRestaurant()
-		rst = hpylm.restaurants[strings.Join(u, concat)]
-	}
-	tbls, ok := rst.tables[word]
-	if !ok {
-		rst.tables[word] = []table{}
-		tbls = rst.tables[word]
+	rst := hpylm.restaurant(ids[len(u)])
+	if rst == nil {
+		rst = newRestaurant()
+		hpylm.setRestaurant(ids[len(u)], rst)
 	}
-	tableNum := rst.totalTableCountForCustomer[word]
-	score := float64(0.0)
-	scoreArray := make([]float64, tableNum+1, tableNum+1)
+	// the tables which have the same number of customers are sampled together
+	hist := rst.tables[w]
 	sumScore := float64(0.0)
-	for k, tbl := range tbls {
-		// score = float64(tbl) - (d * float64(rst.totalTableCountForCustomer[word]))
-		score = float64(tbl) - d
-		scoreArray[k] = math.Max(0.0, float64(score))
-		sumScore += scoreArray[k]
+	for _, count := range hist {
+		sumScore += float64(count.tables) * math.Max(0.0, float64(count.customers)-d)
 	}
 	smoothingCoefficient := (theta + (d * float64(rst.totalTableCount))) / (theta + float64(rst.totalCustomerCount))
+	newTableScore := float64(0.0)
 	if len(u) == 0 {
-		scoreArray[tableNum] = smoothingCoefficient*base + math.SmallestNonzeroFloat64
+		newTableScore = smoothingCoefficient*base + math.SmallestNonzeroFloat64
 	} else {
-		scoreArray[tableNum] = smoothingCoefficient*probs[len(u)-1] + math.SmallestNonzeroFloat64 // hpylm.CalcProb(word, u[1:])
+		newTableScore = smoothingCoefficient*probs[len(u)-1] + math.SmallestNonzeroFloat64 // hpylm.CalcProb(word, u[1:])
 	}
-	sumScore += scoreArray[tableNum]
+	sumScore += newTableScore
 
 	// sampling
-	r := rand.Float64()*sumScore - math.SmallestNonzeroFloat64
+	r := hpylm.rnd.Float64()*sumScore - math.SmallestNonzeroFloat64
 	sumScore = 0.0
-	k := newUint(0)
-	for {
-		sumScore += scoreArray[k]
+	customers := newUint(0) // new table
+	for _, count := range hist {
+		sumScore += float64(count.tables) * math.Max(0.0, float64(count.customers)-d)
 		if sumScore > r {
+			customers = count.customers
 			break
 		}
-		k++
-		if k >= tableNum+1 {
-			panic("sampling error in HPYLM")
-		}
+	}
+	if customers == 0 && sumScore+newTableScore <= r {
+		panic("sampling error in HPYLM")
 	}
 
 	// add and recursive
-	addTbl := rst.addCustomer(word, u, k)
+	addTbl := rst.addCustomer(w, customers)
 	if addTbl {
 		if len(u) > 0 {
-			hpylm.addCustomerRecursively(word, u[1:], probs, base, addBaseFunc)
+			hpylm.addCustomerRecursively(word, w, u[1:], ids, probs, base, addBaseFunc)
 		} else {
 			addBaseFunc(word)
 			// hpylm.addCustomerBase(word)
@@ -252,89 +517,101 @@ func (hpylm *HPYLM) addCustomerRecursively(word string, u context, probs []float
 }
 
 // rewrite this later to a fuction for remove customer in VPYLM  as character level LM's parameters
-func (hpylm *HPYLM) removeCustomerBaseNull(word string) {
-	return
+func (hpylm *HPYLM) removeCustomerBaseNull(word string) error {
+	return nil
 }
 
 // RemoveCustomer removes n-gram parameters.
-func (hpylm *HPYLM) RemoveCustomer(word string, u context, removeBaseFunc func(string)) {
-	rst, ok := hpylm.restaurants[strings.Join(u, concat)]
+func (hpylm *HPYLM) RemoveCustomer(word string, u context, removeBaseFunc func(string) error) error {
+	if hpylm.frozen != nil {
+		return fmt.Errorf("%w. RemoveCustomer of HPYLM", ErrFrozen)
+	}
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	hpylm.contexts.lookup(u, ids)
+	w, ok := hpylm.contexts.symbols.id(word)
 	if !ok {
-		errMsg := fmt.Sprintf("remove error. context u (%v) does not exist in HPYLM", u)
-		panic(errMsg)
+		return fmt.Errorf("%w. word (%v) does not exist in HPYLM", ErrCustomerNotFound, word)
 	}
-	tbls, ok := rst.tables[word]
-	if !ok {
-		errMsg := fmt.Sprintf("remove error. word (%v) does not exist in restaurant u (%v) HPYLM", word, u)
-		panic(errMsg)
+	hpylm.version++
+	if err := hpylm.removeCustomerRecursively(word, w, u, ids, removeBaseFunc); err != nil {
+		return err
 	}
-	tableNum := rst.totalTableCountForCustomer[word]
-	score := float64(0.0)
-	scoreArray := make([]float64, tableNum, tableNum)
-	sumScore := float64(0.0)
-	for k, tbl := range tbls {
-		score = float64(tbl)
-		scoreArray[k] = score
-		sumScore += scoreArray[k]
+	if hpylm.contexts.size() > minCompactedContextSize && hpylm.contexts.size() > 2*hpylm.restaurantCount {
+		// compacted here as well as in estimateHyperPrameters, so that the ids do not grow when customers are added and removed through the API
+		hpylm.compactContexts()
 	}
+	return nil
+}
 
-	// sampling
-	r := rand.Float64() * sumScore
-	sumScore = 0.0
-	k := newUint(0)
-	for {
-		sumScore += scoreArray[k]
+// minCompactedContextSize is the number of context ids under which RemoveCustomer does not compact the ids.
+const minCompactedContextSize = 1024
+
+// removeCustomerRecursively removes word whose id is w in the symbol table of hpylm.contexts.
+func (hpylm *HPYLM) removeCustomerRecursively(word string, w int32, u context, ids []contextID, removeBaseFunc func(string) error) error {
+	rst := hpylm.restaurant(ids[len(u)])
+	if rst == nil {
+		return fmt.Errorf("%w. context u (%v) does not exist in HPYLM", ErrCustomerNotFound, u)
+	}
+	hist, ok := rst.tables[w]
+	if !ok {
+		return fmt.Errorf("%w. word (%v) does not exist in restaurant u (%v) HPYLM", ErrCustomerNotFound, word, u)
+	}
+
+	// sampling. a table is chosen in proportion to its number of customers
+	r := hpylm.rnd.Float64() * float64(rst.customerCount[w])
+	sumScore := float64(0.0)
+	customers := newUint(0)
+	for _, count := range hist {
+		sumScore += float64(count.tables) * float64(count.customers)
 		if sumScore > r {
+			customers = count.customers
 			break
 		}
-		k++
-		if k >= tableNum {
-			panic("sampling error in HPYLM")
-		}
+	}
+	if customers == 0 {
+		panic("sampling error in HPYLM")
 	}
 
 	// remove and recursive
-	removeTbl, removeRst := rst.removeCustomer(word, u, k)
+	removeTbl, removeRst := rst.removeCustomer(w, customers)
+	if removeRst {
+		hpylm.setRestaurant(ids[len(u)], nil)
+	}
 	if removeTbl {
 		if len(u) > 0 {
-			hpylm.RemoveCustomer(word, u[1:], removeBaseFunc)
-		} else {
-			removeBaseFunc(word)
-			// hpylm.removeCustomerBase(word)
+			return hpylm.removeCustomerRecursively(word, w, u[1:], ids, removeBaseFunc)
 		}
-	}
-	if removeRst {
-		delete(hpylm.restaurants, strings.Join(u, concat))
+		return removeBaseFunc(word)
+		// hpylm.removeCustomerBase(word)
 	}
 
-	return
+	return nil
 }
 
-func (hpylm *HPYLM) removeStopAndPassCount(word string, u context) {
-	rst, ok := hpylm.restaurants[strings.Join(u, concat)]
-	if !ok {
-		errMsg := fmt.Sprintf("removeStopAndPassCount error. context u (%v) does not exist", u)
-		panic(errMsg)
-	}
-	if rst.stop == 0 {
-		errMsg := fmt.Sprintf("removeStopAndPassCount error. rst.stop of context u (%v) == 0", u)
-		panic(errMsg)
-	}
-	rst.stop--
-
-	for i := 1; i <= len(u); i++ {
-		rst, ok := hpylm.restaurants[strings.Join(u[i:], concat)]
-		if !ok {
-			errMsg := fmt.Sprintf("removeStopAndPassCount error. context u (%v) does not exist", u[i:])
-			panic(errMsg)
+func (hpylm *HPYLM) removeStopAndPassCount(word string, u context) error {
+	// all restaurants are checked before removing, so that the counts are not changed if this returns error
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	hpylm.contexts.lookup(u, ids)
+	for i := 0; i <= len(u); i++ {
+		rst := hpylm.restaurant(ids[len(u)-i])
+		if rst == nil {
+			return fmt.Errorf("%w. removeStopAndPassCount error. context u (%v) does not exist", ErrCustomerNotFound, u[i:])
 		}
-		if rst.pass == 0 {
-			errMsg := fmt.Sprintf("removeStopAndPassCount error. rst.stop of context u (%v) == 0", u)
-			panic(errMsg)
+		if i == 0 && rst.stop == 0 {
+			return fmt.Errorf("%w. removeStopAndPassCount error. rst.stop of context u (%v) == 0", ErrCustomerNotFound, u)
+		}
+		if i > 0 && rst.pass == 0 {
+			return fmt.Errorf("%w. removeStopAndPassCount error. rst.pass of context u (%v) == 0", ErrCustomerNotFound, u[i:])
 		}
-		rst.pass--
 	}
-	return
+	hpylm.version++
+	hpylm.restaurant(ids[len(u)]).stop--
+	for i := 1; i <= len(u); i++ {
+		hpylm.restaurant(ids[len(u)-i]).pass--
+	}
+	return nil
 }
 
 // CalcProb returns n-gram prrobability.
@@ -343,9 +620,21 @@ func (hpylm *HPYLM) CalcProb(word string, u context, base float64) (float64, []f
 		panic("maximum depth error")
 	}
 
-	probBodies := make([]float64, len(u)+1, len(u)+1)
-	smoothingCoefficients := make([]float64, len(u)+1, len(u)+1)
-	hpylm.calcProbRecursively(word, u, probBodies, smoothingCoefficients)
+	var bodiesBuf, coefficientsBuf [maxDepthOnStack]float64
+	probBodies := bodiesBuf[:0]
+	smoothingCoefficients := coefficientsBuf[:0]
+	if len(u)+1 <= maxDepthOnStack {
+		probBodies = bodiesBuf[:len(u)+1]
+		smoothingCoefficients = coefficientsBuf[:len(u)+1]
+	} else {
+		probBodies = make([]float64, len(u)+1, len(u)+1)
+		smoothingCoefficients = make([]float64, len(u)+1, len(u)+1)
+	}
+	if hpylm.frozen != nil {
+		hpylm.calcProbFrozen(word, u, probBodies, smoothingCoefficients)
+	} else {
+		hpylm.calcProbBodies(word, u, probBodies, smoothingCoefficients)
+	}
 	probs := make([]float64, len(u)+1, len(u)+1)
 	p := base
 	for i, pTmp := range probBodies {
@@ -356,39 +645,106 @@ func (hpylm *HPYLM) CalcProb(word string, u context, base float64) (float64, []f
 	return p + math.SmallestNonzeroFloat64, probs
 }
 
-func (hpylm *HPYLM) calcProbRecursively(word string, u context, probBodies []float64, smoothingCoefficients []float64) {
-	theta := hpylm.theta[len(u)]
-	d := hpylm.d[len(u)]
-	rst, ok := hpylm.restaurants[strings.Join(u, concat)]
-	pTmp := float64(0.0)
-	smoothingCoefficient := float64(1.0)
-	if ok {
-		pTmp = (float64(rst.customerCount[word]) - (d * float64(rst.totalTableCountForCustomer[word]))) / (theta + float64(rst.totalCustomerCount))
-		smoothingCoefficient = (theta + (d * float64(rst.totalTableCount))) / (theta + float64(rst.totalCustomerCount))
+// calcProbBodies sets the probability bodies and smoothing coefficients of all suffixes of u. the n-th values are those of the suffix whose length is n.
+func (hpylm *HPYLM) calcProbBodies(word string, u context, probBodies []float64, smoothingCoefficients []float64) {
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	hpylm.contexts.lookup(u, ids)
+	w, known := hpylm.contexts.symbols.id(word)
+	for n, id := range ids {
+		theta := hpylm.theta[n]
+		d := hpylm.d[n]
+		rst := hpylm.restaurant(id)
+		pTmp := float64(0.0)
+		smoothingCoefficient := float64(1.0)
+		if rst != nil {
+			customerCount, tableCount := newUint(0), newUint(0)
+			if known {
+				customerCount, tableCount = rst.customerCount[w], rst.totalTableCountForCustomer[w]
+			}
+			pTmp = (float64(customerCount) - (d * float64(tableCount))) / (theta + float64(rst.totalCustomerCount))
+			smoothingCoefficient = (theta + (d * float64(rst.totalTableCount))) / (theta + float64(rst.totalCustomerCount))
+		}
+		probBodies[n] = pTmp
+		smoothingCoefficients[n] = smoothingCoefficient
 	}
+	return
+}
 
-	probBodies[len(u)] = pTmp
-	smoothingCoefficients[len(u)] = smoothingCoefficient
-
-	if len(u) != 0 {
-		hpylm.calcProbRecursively(word, u[1:], probBodies, smoothingCoefficients)
+// calcProbFrozen is calcProbBodies for frozen HPYLM.
+func (hpylm *HPYLM) calcProbFrozen(word string, u context, probBodies []float64, smoothingCoefficients []float64) {
+	id, known := hpylm.frozen.vocab.id(word)
+	for n, rst := range hpylm.frozen.restaurants(u) {
+		theta := hpylm.theta[n]
+		d := hpylm.d[n]
+		pTmp := float64(0.0)
+		smoothingCoefficient := float64(1.0)
+		if rst != nil {
+			customerCount, tableCount := newUint(0), newUint(0)
+			if known {
+				customerCount, tableCount = rst.count(id)
+			}
+			pTmp = (float64(customerCount) - (d * float64(tableCount))) / (theta + float64(rst.totalCustomerCount))
+			smoothingCoefficient = (theta + (d * float64(rst.totalTableCount))) / (theta + float64(rst.totalCustomerCount))
+		}
+		probBodies[n] = pTmp
+		smoothingCoefficients[n] = smoothingCoefficient
 	}
 	return
 }
 
+// compactContexts removes the context ids of removed restaurants and the ids of words which are no longer used, so that the ids and the restaurants do not grow during training.
+func (hpylm *HPYLM) compactContexts() {
+	usedWords := make([]bool, len(hpylm.contexts.symbols.words), len(hpylm.contexts.symbols.words))
+	for _, rst := range hpylm.restaurants {
+		if rst != nil {
+			for word := range rst.tables {
+				usedWords[word] = true
+			}
+			for word := range rst.customerCount {
+				usedWords[word] = true
+			}
+			for word := range rst.totalTableCountForCustomer {
+				usedWords[word] = true
+			}
+		}
+	}
+	newIDs, newWords := hpylm.contexts.compact(func(id contextID) bool {
+		return hpylm.restaurant(id) != nil
+	}, func(word int32) bool {
+		return usedWords[word]
+	})
+	restaurants := make([]*restaurant, hpylm.contexts.size(), hpylm.contexts.size())
+	for id, rst := range hpylm.restaurants {
+		if rst != nil {
+			rst.renameWords(newWords)
+			restaurants[newIDs[id]] = rst
+		}
+	}
+	hpylm.restaurants = restaurants
+}
+
 func (hpylm *HPYLM) estimateHyperPrameters() {
-	uSliceEachN := make([][]context, hpylm.maxDepth+1, hpylm.maxDepth+1)
+	hpylm.version++
+	hpylm.compactContexts()
+	rstSliceEachN := make([][]*restaurant, hpylm.maxDepth+1, hpylm.maxDepth+1)
 	for n := 0; n < hpylm.maxDepth+1; n++ {
-		uSlice := make([]context, 0, 0)
-		uSliceEachN[n] = uSlice
-	}
-	for uStr := range hpylm.restaurants {
-		if uStr == "" {
-			uSliceEachN[0] = append(uSliceEachN[0], context{""})
-			continue
+		rstSlice := make([]*restaurant, 0, 0)
+		rstSliceEachN[n] = rstSlice
+	}
+	// restaurants and tables are visited in sorted order of the keys, so the same seed gives the same parameters
+	rsts := hpylm.restaurantMap()
+	uStrs := make([]string, 0, len(rsts))
+	for uStr := range rsts {
+		uStrs = append(uStrs, uStr)
+	}
+	sort.Strings(uStrs)
+	for _, uStr := range uStrs {
+		n := 0
+		if uStr != "" {
+			n = strings.Count(uStr, concat) + 1
 		}
-		u := context(strings.Split(uStr, concat))
-		uSliceEachN[len(u)] = append(uSliceEachN[len(u)], u)
+		rstSliceEachN[n] = append(rstSliceEachN[n], rsts[uStr])
 	}
 
 	for n := 0; n < hpylm.maxDepth+1; n++ {
@@ -396,19 +752,19 @@ func (hpylm *HPYLM) estimateHyperPrameters() {
 		bForTheta := float64(hpylm.gammaB[n])
 		aForD := float64(hpylm.betaA[n])
 		bForD := float64(hpylm.betaB[n])
-		for _, u := range uSliceEachN[n] {
-			totalTableCount := int(hpylm.restaurants[strings.Join(u, concat)].totalTableCount)
+		for _, rst := range rstSliceEachN[n] {
+			totalTableCount := int(rst.totalTableCount)
 			if totalTableCount < 2 {
 				continue
 			}
-			betaDist := distuv.Beta{}
+			betaDist := distuv.Beta{Src: randSource{hpylm.rnd}}
 			thetaTmp := float64(hpylm.theta[n])
 			dTmp := float64(hpylm.d[n])
 			betaDist.Alpha = thetaTmp + 1.0
-			betaDist.Beta = float64(hpylm.restaurants[strings.Join(u, concat)].totalCustomerCount) - 1.0
+			betaDist.Beta = float64(rst.totalCustomerCount) - 1.0
 			xu := betaDist.Rand()
 			for t := 1; t < totalTableCount; t++ {
-				bernoulliDist := distuv.Bernoulli{}
+				bernoulliDist := distuv.Bernoulli{Src: randSource{hpylm.rnd}}
 				bernoulliDist.P = thetaTmp / (thetaTmp + (dTmp * float64(t)))
 				y := bernoulliDist.Rand()
 
@@ -416,24 +772,27 @@ func (hpylm *HPYLM) estimateHyperPrameters() {
 				bForTheta -= math.Log(xu)
 				aForD += (1.0 - y)
 			}
-			for _, tbls := range hpylm.restaurants[strings.Join(u, concat)].tables {
-				for _, customerCount := range tbls {
-					if int(customerCount) < 2 {
+			tables := rst.tables
+			for _, word := range sortedWords(tables, hpylm.contexts.symbols) {
+				for _, count := range tables[word] {
+					if int(count.customers) < 2 {
 						continue
 					}
-					for j := 1; j < int(customerCount); j++ {
-						bernoulliDist := distuv.Bernoulli{}
-						bernoulliDist.P = (float64(j) - 1.0) / (float64(j) - dTmp)
-						z := bernoulliDist.Rand()
-						bForD += (1.0 - z)
+					for i := newUint(0); i < count.tables; i++ {
+						for j := 1; j < int(count.customers); j++ {
+							bernoulliDist := distuv.Bernoulli{Src: randSource{hpylm.rnd}}
+							bernoulliDist.P = (float64(j) - 1.0) / (float64(j) - dTmp)
+							z := bernoulliDist.Rand()
+							bForD += (1.0 - z)
+						}
 					}
 				}
 			}
 		}
-		gammaDist := distuv.Gamma{}
+		gammaDist := distuv.Gamma{Src: randSource{hpylm.rnd}}
 		gammaDist.Alpha = aForTheta
 		gammaDist.Beta = bForTheta
-		betaDist := distuv.Beta{}
+		betaDist := distuv.Beta{Src: randSource{hpylm.rnd}}
 		betaDist.Alpha = aForD
 		betaDist.Beta = bForD
 		hpylm.theta[n] = float64(gammaDist.Rand())
@@ -449,13 +808,16 @@ func (hpylm *HPYLM) estimateHyperPrameters() {
 }
 
 // Train train n-gram parameters from given word sequences.
-func (hpylm *HPYLM) Train(dataContainer *DataContainer) {
+func (hpylm *HPYLM) Train(dataContainer *DataContainer) error {
+	if hpylm.frozen != nil {
+		return fmt.Errorf("%w. Train of HPYLM", ErrFrozen)
+	}
 	removeFlag := true
-	if len(hpylm.restaurants) == 0 { // epoch == 0
+	if hpylm.restaurantCount == 0 { // epoch == 0
 		removeFlag = false
 	}
 	bar := pb.StartNew(dataContainer.Size)
-	randIndexes := rand.Perm(dataContainer.Size)
+	randIndexes := hpylm.rnd.Perm(dataContainer.Size)
 	for i := 0; i < dataContainer.Size; i++ {
 		bar.Add(1)
 		r := randIndexes[i]
@@ -466,7 +828,10 @@ func (hpylm *HPYLM) Train(dataContainer *DataContainer) {
 				u = append(u, bos)
 			}
 			for _, word := range wordSeq {
-				hpylm.RemoveCustomer(word, u, hpylm.removeCustomerBaseNull)
+				if err := hpylm.RemoveCustomer(word, u, hpylm.removeCustomerBaseNull); err != nil {
+					bar.Finish()
+					return err
+				}
 				u = append(u[1:], word)
 			}
 		}
@@ -475,13 +840,13 @@ func (hpylm *HPYLM) Train(dataContainer *DataContainer) {
 			u = append(u, bos)
 		}
 		for _, word := range wordSeq {
-			hpylm.AddCustomer(word, u, hpylm.Base, hpylm.addCustomerBaseNull)
+			hpylm.addCustomer(word, u, hpylm.Base, hpylm.addCustomerBaseNull)
 			u = append(u[1:], word)
 		}
 	}
 	bar.Finish()
 	hpylm.estimateHyperPrameters()
-	return
+	return nil
 }
 
 // ReturnNgramProb returns n-gram probability.
@@ -497,6 +862,39 @@ func (hpylm *HPYLM) ReturnMaxN() int {
 	return hpylm.maxDepth + 1
 }
 
+// Freeze drops seating arrangements of restaurants and keeps only counts to calculate probabilities, which needs much lower memory.
+// frozen model can be used for inference (e.g., ReturnNgramProb), but it cannot be trained or saved.
+func (hpylm *HPYLM) Freeze() {
+	hpylm.freeze(newSymbolTable())
+}
+
+func (hpylm *HPYLM) freeze(vocab *symbolTable) {
+	if hpylm.frozen != nil {
+		return
+	}
+	hpylm.frozen = newFrozenHPYLM(hpylm.restaurantMap(), hpylm.contexts.symbols, vocab)
+	hpylm.resetRestaurants()
+}
+
+// SetRandSeed sets the seed of the random number generator used for sampling.
+func (hpylm *HPYLM) SetRandSeed(seed int64) {
+	hpylm.setRand(newSplitMix64(seed))
+}
+
+func (hpylm *HPYLM) setRand(src *splitMix64) {
+	hpylm.rndSource = src
+	hpylm.rnd = rand.New(src)
+}
+
+// randState returns the state of the random number generator to save checkpoints.
+func (hpylm *HPYLM) randState() uint64 {
+	return hpylm.rndSource.state
+}
+
+func (hpylm *HPYLM) setRandState(state uint64) {
+	hpylm.rndSource.state = state
+}
+
 // Save returns json.Marshal(hpylmJSON) and hpylmJSON.
 // hpylmJSON is struct to save. its variables can be exported.
 func (hpylm *HPYLM) save() ([]byte, interface{}) {
@@ -504,11 +902,11 @@ func (hpylm *HPYLM) save() ([]byte, interface{}) {
 		Restaurants: func(rsts map[string]*restaurant) map[string]*restaurantJSON {
 			rstsJSON := make(map[string]*restaurantJSON)
 			for key, rst := range rsts {
-				_, rstJSON := rst.save()
+				_, rstJSON := rst.save(hpylm.contexts.symbols)
 				rstsJSON[key] = rstJSON
 			}
 			return rstsJSON
-		}(hpylm.restaurants),
+		}(hpylm.restaurantMap()),
 
 		MaxDepth: hpylm.maxDepth,
 		Theta:    hpylm.theta,
@@ -527,25 +925,25 @@ func (hpylm *HPYLM) save() ([]byte, interface{}) {
 }
 
 // Load hpylm.
-func (hpylm *HPYLM) load(v []byte) {
+func (hpylm *HPYLM) load(v []byte) error {
 	hpylmJSON := new(hPYLMJSON)
 	err := json.Unmarshal(v, &hpylmJSON)
 	if err != nil {
-		panic("load error in HPYLM")
-	}
-	hpylm.restaurants = func(hpylmJSON *hPYLMJSON) map[string]*restaurant {
-		rsts := make(map[string]*restaurant)
-		for key, rstJSON := range hpylmJSON.Restaurants {
-			rstV, err := json.Marshal(&rstJSON)
-			if err != nil {
-				panic("load error in load restaurants in HPYLM")
-			}
-			rst := newRestaurant()
-			rst.load(rstV)
-			rsts[key] = rst
+		return fmt.Errorf("%w. load error in HPYLM: %v", ErrFormat, err)
+	}
+	if hpylmJSON == nil {
+		return fmt.Errorf("%w. load error in HPYLM: model is null", ErrFormat)
+	}
+	hpylm.resetRestaurants()
+	for key, rstJSON := range hpylmJSON.Restaurants {
+		rstV, err := json.Marshal(&rstJSON)
+		if err != nil {
+			panic("load error in load restaurants in HPYLM")
 		}
-		return rsts
-	}(hpylmJSON)
+		rst := newRestaurant()
+		rst.load(rstV, hpylm.contexts.symbols)
+		hpylm.setRestaurantOf(key, rst)
+	}
 
 	hpylm.maxDepth = hpylmJSON.MaxDepth
 	hpylm.theta = hpylmJSON.Theta
@@ -556,5 +954,59 @@ func (hpylm *HPYLM) load(v []byte) {
 	hpylm.betaB = hpylmJSON.BetaB
 	hpylm.Base = hpylmJSON.Base
 
-	return
+	return nil
+}
+
+// saveBinary writes hpylm in binary format.
+func (hpylm *HPYLM) saveBinary(bw *binaryWriter) {
+	rsts := hpylm.restaurantMap()
+	keys := make([]string, 0, len(rsts))
+	for key := range rsts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bw.writeUvarint(uint64(len(keys)))
+	for _, key := range keys {
+		bw.writeWord(key)
+		rsts[key].saveBinary(bw, hpylm.contexts.symbols)
+	}
+
+	bw.writeInt(hpylm.maxDepth)
+	bw.writeFloats(hpylm.theta)
+	bw.writeFloats(hpylm.d)
+	bw.writeFloats(hpylm.gammaA)
+	bw.writeFloats(hpylm.gammaB)
+	bw.writeFloats(hpylm.betaA)
+	bw.writeFloats(hpylm.betaB)
+	bw.writeFloat(hpylm.Base)
+}
+
+// loadBinary reads hpylm written by saveBinary.
+func (hpylm *HPYLM) loadBinary(br *binaryReader) error {
+	n := br.readLength()
+	hpylm.resetRestaurants()
+	for i := 0; i < n && br.err == nil; i++ {
+		key := br.readWord()
+		rst := newRestaurant()
+		rst.loadBinary(br, hpylm.contexts.symbols)
+		hpylm.setRestaurantOf(key, rst)
+	}
+
+	hpylm.maxDepth = br.readInt()
+	hpylm.theta = br.readFloats()
+	hpylm.d = br.readFloats()
+	hpylm.gammaA = br.readFloats()
+	hpylm.gammaB = br.readFloats()
+	hpylm.betaA = br.readFloats()
+	hpylm.betaB = br.readFloats()
+	hpylm.Base = br.readFloat()
+	if br.err != nil {
+		return fmt.Errorf("%w. load error in HPYLM: %v", ErrFormat, br.err)
+	}
+	for _, params := range [][]float64{hpylm.theta, hpylm.d, hpylm.gammaA, hpylm.gammaB, hpylm.betaA, hpylm.betaB} {
+		if hpylm.maxDepth < 0 || len(params) != hpylm.maxDepth+1 {
+			return fmt.Errorf("%w. load error in HPYLM: length of parameters (%v) is not maxDepth + 1 (%v)", ErrFormat, len(params), hpylm.maxDepth+1)
+		}
+	}
+	return nil
 }
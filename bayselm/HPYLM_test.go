@@ -1,8 +1,14 @@
 package bayselm
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -17,7 +23,10 @@ func TestHPYLM(t *testing.T) {
 	theta = 1.0
 	d = 0.1
 	epoch = 1000
-	hpylm := NewHPYLM(2, theta, d, 1.0, 1.0, 1.0, 1.0, base)
+	hpylm, err := NewHPYLM(2, theta, d, 1.0, 1.0, 1.0, 1.0, base)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var word string
 	word = "abc"
@@ -32,7 +41,9 @@ func TestHPYLM(t *testing.T) {
 	smoothing := (theta + d*1.0) / (theta + 1.0)
 	pCorrect := body + smoothing*(body+smoothing*(body+smoothing*base))
 
-	hpylm.AddCustomer(word, u, float64(base), hpylm.addCustomerBaseNull)
+	if err := hpylm.AddCustomer(word, u, float64(base), hpylm.addCustomerBaseNull); err != nil {
+		t.Fatal(err)
+	}
 	pAddOne, probsAddOne := hpylm.CalcProb(word, u, float64(base))
 	fmt.Println(pAddOne, probsAddOne)
 	if !(pAddOne == float64(pCorrect)) {
@@ -41,18 +52,19 @@ func TestHPYLM(t *testing.T) {
 	if !(pAddOne >= pAddZero) {
 		t.Error("pAddOne = ", pAddOne, "pAddZero = ", pAddZero)
 	}
-	customerCountRestOFfghde := hpylm.restaurants["fgh<concat>de"].customerCount["abc"]
-	totalCustomerCountRestOFfghde := hpylm.restaurants["fgh<concat>de"].totalCustomerCount
-	totalTableCountForCustomerRestOFfghde := hpylm.restaurants["fgh<concat>de"].totalTableCountForCustomer["abc"]
-	totalTableCountRestOFfghde := hpylm.restaurants["fgh<concat>de"].totalTableCount
-	customerCountRestOFde := hpylm.restaurants["de"].customerCount["abc"]
-	totalCustomerCountRestOFde := hpylm.restaurants["de"].totalCustomerCount
-	totalTableCountForCustomerRestOFde := hpylm.restaurants["de"].totalTableCountForCustomer["abc"]
-	totalTableCountRestOFde := hpylm.restaurants["de"].totalTableCount
-	customerCountRestOF := hpylm.restaurants[""].customerCount["abc"]
-	totalCustomerCountRestOF := hpylm.restaurants[""].totalCustomerCount
-	totalTableCountForCustomerRestOF := hpylm.restaurants[""].totalTableCountForCustomer["abc"]
-	totalTableCountRestOF := hpylm.restaurants[""].totalTableCount
+	abc, _ := hpylm.contexts.symbols.id("abc")
+	customerCountRestOFfghde := hpylm.restaurantMap()["fgh<concat>de"].customerCount[abc]
+	totalCustomerCountRestOFfghde := hpylm.restaurantMap()["fgh<concat>de"].totalCustomerCount
+	totalTableCountForCustomerRestOFfghde := hpylm.restaurantMap()["fgh<concat>de"].totalTableCountForCustomer[abc]
+	totalTableCountRestOFfghde := hpylm.restaurantMap()["fgh<concat>de"].totalTableCount
+	customerCountRestOFde := hpylm.restaurantMap()["de"].customerCount[abc]
+	totalCustomerCountRestOFde := hpylm.restaurantMap()["de"].totalCustomerCount
+	totalTableCountForCustomerRestOFde := hpylm.restaurantMap()["de"].totalTableCountForCustomer[abc]
+	totalTableCountRestOFde := hpylm.restaurantMap()["de"].totalTableCount
+	customerCountRestOF := hpylm.restaurantMap()[""].customerCount[abc]
+	totalCustomerCountRestOF := hpylm.restaurantMap()[""].totalCustomerCount
+	totalTableCountForCustomerRestOF := hpylm.restaurantMap()[""].totalTableCountForCustomer[abc]
+	totalTableCountRestOF := hpylm.restaurantMap()[""].totalTableCount
 	addOnePrams := make([]newUint, 0, 0)
 	addOnePrams = append(addOnePrams, newUint(customerCountRestOFfghde))
 	addOnePrams = append(addOnePrams, newUint(totalCustomerCountRestOFfghde))
@@ -68,7 +80,9 @@ func TestHPYLM(t *testing.T) {
 	addOnePrams = append(addOnePrams, newUint(totalTableCountRestOF))
 
 	for i := 0; i < epoch; i++ {
-		hpylm.AddCustomer(word, u, float64(base), hpylm.addCustomerBaseNull)
+		if err := hpylm.AddCustomer(word, u, float64(base), hpylm.addCustomerBaseNull); err != nil {
+			t.Fatal(err)
+		}
 	}
 	pAddMany, probsAddMany := hpylm.CalcProb(word, u, float64(base))
 	if !(pAddMany >= pAddOne) {
@@ -79,18 +93,18 @@ func TestHPYLM(t *testing.T) {
 			t.Error("probsAddMany[i] = ", probsAddMany[i], "probsAddOne[i] = ", probsAddOne[i], "i = ", i)
 		}
 	}
-	customerCountRestOFfghde = hpylm.restaurants["fgh<concat>de"].customerCount["abc"]
-	totalCustomerCountRestOFfghde = hpylm.restaurants["fgh<concat>de"].totalCustomerCount
-	totalTableCountForCustomerRestOFfghde = hpylm.restaurants["fgh<concat>de"].totalTableCountForCustomer["abc"]
-	totalTableCountRestOFfghde = hpylm.restaurants["fgh<concat>de"].totalTableCount
-	customerCountRestOFde = hpylm.restaurants["de"].customerCount["abc"]
-	totalCustomerCountRestOFde = hpylm.restaurants["de"].totalCustomerCount
-	totalTableCountForCustomerRestOFde = hpylm.restaurants["de"].totalTableCountForCustomer["abc"]
-	totalTableCountRestOFde = hpylm.restaurants["de"].totalTableCount
-	customerCountRestOF = hpylm.restaurants[""].customerCount["abc"]
-	totalCustomerCountRestOF = hpylm.restaurants[""].totalCustomerCount
-	totalTableCountForCustomerRestOF = hpylm.restaurants[""].totalTableCountForCustomer["abc"]
-	totalTableCountRestOF = hpylm.restaurants[""].totalTableCount
+	customerCountRestOFfghde = hpylm.restaurantMap()["fgh<concat>de"].customerCount[abc]
+	totalCustomerCountRestOFfghde = hpylm.restaurantMap()["fgh<concat>de"].totalCustomerCount
+	totalTableCountForCustomerRestOFfghde = hpylm.restaurantMap()["fgh<concat>de"].totalTableCountForCustomer[abc]
+	totalTableCountRestOFfghde = hpylm.restaurantMap()["fgh<concat>de"].totalTableCount
+	customerCountRestOFde = hpylm.restaurantMap()["de"].customerCount[abc]
+	totalCustomerCountRestOFde = hpylm.restaurantMap()["de"].totalCustomerCount
+	totalTableCountForCustomerRestOFde = hpylm.restaurantMap()["de"].totalTableCountForCustomer[abc]
+	totalTableCountRestOFde = hpylm.restaurantMap()["de"].totalTableCount
+	customerCountRestOF = hpylm.restaurantMap()[""].customerCount[abc]
+	totalCustomerCountRestOF = hpylm.restaurantMap()[""].totalCustomerCount
+	totalTableCountForCustomerRestOF = hpylm.restaurantMap()[""].totalTableCountForCustomer[abc]
+	totalTableCountRestOF = hpylm.restaurantMap()[""].totalTableCount
 	addManyPrams := make([]newUint, 0, 0)
 	addManyPrams = append(addManyPrams, newUint(customerCountRestOFfghde))
 	addManyPrams = append(addManyPrams, newUint(totalCustomerCountRestOFfghde))
@@ -111,7 +125,9 @@ func TestHPYLM(t *testing.T) {
 	}
 
 	for i := 0; i < epoch; i++ {
-		hpylm.RemoveCustomer(word, u, hpylm.removeCustomerBaseNull)
+		if err := hpylm.RemoveCustomer(word, u, hpylm.removeCustomerBaseNull); err != nil {
+			t.Fatal(err)
+		}
 	}
 	pRemoveMany, probsRemoveMany := hpylm.CalcProb(word, u, float64(base))
 	if !(pRemoveMany == pAddOne) {
@@ -123,14 +139,16 @@ func TestHPYLM(t *testing.T) {
 		}
 	}
 
-	hpylm.RemoveCustomer(word, u, hpylm.removeCustomerBaseNull)
+	if err := hpylm.RemoveCustomer(word, u, hpylm.removeCustomerBaseNull); err != nil {
+		t.Fatal(err)
+	}
 	pRemoveOne, _ := hpylm.CalcProb(word, u, float64(base))
 	if !(pRemoveOne == pAddZero) {
 		t.Error("pRemoveOne = ", pRemoveOne, "pAddZero = ", pAddZero)
 	}
 
-	if !(len(hpylm.restaurants) == 0) {
-		t.Error("hpylm.restaurants = ", hpylm.restaurants)
+	if !(hpylm.restaurantCount == 0) {
+		t.Error("hpylm.restaurants = ", hpylm.restaurantMap())
 	}
 }
 
@@ -147,19 +165,36 @@ func TestPerformanceOfHPYLM(t *testing.T) {
 	d = 0.1
 	epoch = 10
 	var hpylm NgramLM
-	hpylm = NewHPYLM(maxN-1, theta, d, 1.0, 1.0, 1.0, 1.0, base)
+	var err error
+	hpylm, err = NewHPYLM(maxN-1, theta, d, 1.0, 1.0, 1.0, 1.0, base)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var interporationRates []float64
 	interporationRates = []float64{0.1, 0.1, 0.1}
 	var interporatedNgram NgramLM
-	interporatedNgram = NewNgram(maxN, interporationRates, base)
+	interporatedNgram, err = NewNgram(maxN, interporationRates, base)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	dataContainerForTrain := NewDataContainerFromAnnotatedData("../alice.train.txt")
-	dataContainerForTest := NewDataContainerFromAnnotatedData("../alice.test.txt")
+	dataContainerForTrain, err := NewDataContainerFromAnnotatedData("../alice.train.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataContainerForTest, err := NewDataContainerFromAnnotatedData("../alice.test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
 	for e := 0; e < epoch; e++ {
-		hpylm.Train(dataContainerForTrain)
+		if err := hpylm.Train(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := interporatedNgram.Train(dataContainerForTrain); err != nil {
+		t.Fatal(err)
 	}
-	interporatedNgram.Train(dataContainerForTrain)
 
 	perplexityOfHpylm := CalcPerplexity(hpylm, dataContainerForTest)
 	perplexityOfInterporatedNgram := CalcPerplexity(interporatedNgram, dataContainerForTest)
@@ -167,3 +202,180 @@ func TestPerformanceOfHPYLM(t *testing.T) {
 		t.Error("probably error! a perplexity of HPYLM is expected to be lower than a perplexity of interporated n-gram. ", "perplexityOfHpylm = ", perplexityOfHpylm, "perplexityOfInterporatedNgram = ", perplexityOfInterporatedNgram)
 	}
 }
+
+func TestTableHistogram(t *testing.T) {
+	hpylm, err := NewHPYLM(2, 1.0, 0.5, 1.0, 1.0, 1.0, 1.0, 0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hpylm.SetRandSeed(1)
+
+	// tables of "a" have 3, 1 and 1 customers
+	// the probabilities of seating are proportional to 3-d, 2*(1-d) and (theta+3d)/(theta+5)*base
+	expected := []float64{2.5 / 3.75, 1.0 / 3.75, 0.25 / 3.75}
+	counts := make([]float64, 3, 3)
+	trialSize := 20000
+	a := hpylm.contexts.symbols.intern("a")
+	for i := 0; i < trialSize; i++ {
+		rst := newRestaurant()
+		rst.addCustomer(a, 0)
+		rst.addCustomer(a, 1)
+		rst.addCustomer(a, 2)
+		rst.addCustomer(a, 0)
+		rst.addCustomer(a, 0)
+		hpylm.setRestaurant(rootContext, rst)
+		hpylm.addCustomerRecursively("a", a, context{}, []contextID{rootContext}, []float64{}, hpylm.Base, hpylm.addCustomerBaseNull)
+		switch hist := rst.tables[a]; {
+		case hist[len(hist)-1].customers == 4:
+			counts[0]++
+		case len(hist) == 3:
+			counts[1]++
+		case rst.totalTableCount == 4:
+			counts[2]++
+		default:
+			t.Fatal("unexpected tables", hist)
+		}
+	}
+	for i := range expected {
+		if math.Abs(counts[i]/float64(trialSize)-expected[i]) > 0.02 {
+			t.Error("expected = ", expected, "but return ", counts)
+			break
+		}
+	}
+
+	// counts of restaurants are the same as those of the histograms
+	hpylm.resetRestaurants()
+	words := []string{"a", "b", "c"}
+	for i := 0; i < 1000; i++ {
+		word := words[i%len(words)]
+		u := context{words[(i/3)%len(words)], words[(i/9)%len(words)]}
+		if err := hpylm.AddCustomer(word, u, hpylm.Base, hpylm.addCustomerBaseNull); err != nil {
+			t.Fatal(err)
+		}
+		if i%4 == 0 {
+			if err := hpylm.RemoveCustomer(word, u, hpylm.removeCustomerBaseNull); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for key, rst := range hpylm.restaurantMap() {
+		totalCustomerCount := newUint(0)
+		totalTableCount := newUint(0)
+		for word, hist := range rst.tables {
+			customerCount := newUint(0)
+			tableCount := newUint(0)
+			for _, count := range hist {
+				customerCount += count.customers * count.tables
+				tableCount += count.tables
+			}
+			if customerCount != rst.customerCount[word] || tableCount != rst.totalTableCountForCustomer[word] {
+				t.Error(key, word, "histogram", hist, "does not match counts", rst.customerCount[word], rst.totalTableCountForCustomer[word])
+			}
+			totalCustomerCount += customerCount
+			totalTableCount += tableCount
+		}
+		if totalCustomerCount != rst.totalCustomerCount || totalTableCount != rst.totalTableCount {
+			t.Error(key, "histograms do not match total counts", rst.totalCustomerCount, rst.totalTableCount)
+		}
+	}
+}
+
+func TestCompactContexts(t *testing.T) {
+	hpylm, err := NewHPYLM(2, 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hpylm.SetRandSeed(1)
+	if err := hpylm.AddCustomer("a", context{"b", "c"}, hpylm.Base, hpylm.addCustomerBaseNull); err != nil {
+		t.Fatal(err)
+	}
+	prob, _ := hpylm.CalcProb("a", context{"b", "c"}, hpylm.Base)
+	// restaurants of contexts which are removed do not keep their ids
+	for i := 0; i < 100; i++ {
+		u := context{strconv.Itoa(i), "c"}
+		if err := hpylm.AddCustomer("a", u, hpylm.Base, hpylm.addCustomerBaseNull); err != nil {
+			t.Fatal(err)
+		}
+		if err := hpylm.RemoveCustomer("a", u, hpylm.removeCustomerBaseNull); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hpylm.compactContexts()
+	if hpylm.contexts.size() != 3 || len(hpylm.restaurants) != 3 || hpylm.restaurantCount != 3 {
+		t.Error("expected 3 contexts, but return ", hpylm.contexts.size(), len(hpylm.restaurants), hpylm.restaurantCount)
+	}
+	if compactedProb, _ := hpylm.CalcProb("a", context{"b", "c"}, hpylm.Base); compactedProb != prob {
+		t.Error("expected = ", prob, "but return ", compactedProb)
+	}
+	if _, ok := hpylm.contexts.symbols.id("0"); ok {
+		t.Error("word of removed context is not removed")
+	}
+	if err := hpylm.RemoveCustomer("a", context{"b", "c"}, hpylm.removeCustomerBaseNull); err != nil {
+		t.Fatal(err)
+	}
+
+	// RemoveCustomer also compacts the ids, so they do not grow without estimateHyperPrameters
+	if err := hpylm.AddCustomer("a", context{"b", "c"}, hpylm.Base, hpylm.addCustomerBaseNull); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10*minCompactedContextSize; i++ {
+		u := context{strconv.Itoa(i), "c"}
+		if err := hpylm.AddCustomer("a", u, hpylm.Base, hpylm.addCustomerBaseNull); err != nil {
+			t.Fatal(err)
+		}
+		if err := hpylm.RemoveCustomer("a", u, hpylm.removeCustomerBaseNull); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hpylm.contexts.size() > minCompactedContextSize+3 || len(hpylm.contexts.symbols.words) > minCompactedContextSize+3 {
+		t.Error("expected at most ", minCompactedContextSize+3, "ids, but return ", hpylm.contexts.size(), len(hpylm.contexts.symbols.words))
+	}
+	if compactedProb, _ := hpylm.CalcProb("a", context{"b", "c"}, hpylm.Base); compactedProb != prob {
+		t.Error("expected = ", prob, "but return ", compactedProb)
+	}
+}
+
+func TestHPYLMBinary(t *testing.T) {
+	hpylm, err := NewHPYLM(1, 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hpylm.SetRandSeed(1)
+	// many tables of a frequent word are written as a few pairs of the histogram
+	rst := newRestaurant()
+	a := hpylm.contexts.symbols.intern("a")
+	rst.tables[a] = tableHistogram{{1, 1000}, {2, 500}}
+	rst.customerCount[a] = 2000
+	rst.totalCustomerCount = 2000
+	rst.totalTableCountForCustomer[a] = 1500
+	rst.totalTableCount = 1500
+	hpylm.setRestaurantOf("b", rst)
+
+	save := func(hpylm *HPYLM) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		bw := newBinaryWriter(buf)
+		hpylm.saveBinary(bw)
+		if err := bw.flush(); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	buf := save(hpylm)
+	if buf.Len() > 200 {
+		t.Error("expected the size independent of the number of tables, but return ", buf.Len())
+	}
+	loaded := newHPYLMToLoad()
+	if err := loaded.loadBinary(newBinaryReader(bufio.NewReader(buf))); err != nil {
+		t.Fatal(err)
+	}
+	loadedA, _ := loaded.contexts.symbols.id("a")
+	if !reflect.DeepEqual(loaded.restaurantMap()["b"].tables[loadedA], rst.tables[a]) {
+		t.Error("expected = ", rst.tables[a], "but return ", loaded.restaurantMap()["b"].tables[loadedA])
+	}
+
+	// lengths of parameters are checked
+	hpylm.theta = hpylm.theta[:1]
+	if err := newHPYLMToLoad().loadBinary(newBinaryReader(bufio.NewReader(save(hpylm)))); !errors.Is(err, ErrFormat) {
+		t.Error("expected ErrFormat, but return ", err)
+	}
+}
@@ -5,15 +5,18 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"sync"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/cheggaaa/pb/v3"
 
 	"gonum.org/v1/gonum/stat/distuv"
 )
 
-type forwardScoreType [][]float64
+// forwardScoreType is forwardScore[t][k][h].
+// t is the last character of a word, k+1 is its length, and h encodes the lengths of the maxNgram-2 words before it (see encodeHistory).
+type forwardScoreType [][][]float64
 
 // NPYLM contains HPYLM instance as word-based n-gram parameters and VPYLM instance as character-based n-gram parameters.
 type NPYLM struct {
@@ -33,26 +36,50 @@ type NPYLM struct {
 
 	word2sampledDepthMemory map[string][][]int
 
+	dictionary       map[string]float64 // word to probability in the user dictionary (see SetDictionary)
+	dictionaryWeight float64
+
 	splitter string
+
+	charBaseCache *charBaseCache // cache of calcCharBase. it is nil if the cache is disabled (see SetCharBaseCacheSize)
+
+	metropolisHastings bool            // see SetMetropolisHastings
+	acceptanceStats    AcceptanceStats // statistics of Metropolis-Hastings correction in the last TrainWordSegmentation
+
+	temperature float64 // temperature of sampling (see SetTemperature)
 }
 
 // NewNPYLM returns NPYLM instance.
-func NewNPYLM(initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, splitter string) *NPYLM {
+func NewNPYLM(initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, splitter string) (*NPYLM, error) {
+	if maxNgram < 2 {
+		return nil, fmt.Errorf("%w. range of maxNgram is 2 to inf", ErrInvalidParameter)
+	}
 
 	charBase := float64(1.0 / 2097152.0) // 1 / 2^21 , size of character vocabulary in utf-8 encodeing
 	dummyBase := charBase
-	hpylm := NewHPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, dummyBase)
-	vpylm := NewVPYLM(maxWordLength+2, initialTheta, initialD, gammaA, gammaB, betaA, betaB, charBase, alpha, beta)
-	npylm := &NPYLM{hpylm, vpylm, maxNgram, maxWordLength, bos, "<EOS>", "<BOW>", "<EOW>", distuv.Poisson{}, make([]float64, maxWordLength, maxWordLength), make(map[string][][]int), splitter}
+	hpylm, err := NewHPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, dummyBase)
+	if err != nil {
+		return nil, err
+	}
+	vpylm, err := NewVPYLM(maxWordLength+2, initialTheta, initialD, gammaA, gammaB, betaA, betaB, charBase, alpha, beta)
+	if err != nil {
+		return nil, err
+	}
+	npylm := &NPYLM{hpylm, vpylm, maxNgram, maxWordLength, bos, "<EOS>", "<BOW>", "<EOW>", distuv.Poisson{}, make([]float64, maxWordLength, maxWordLength), make(map[string][][]int), nil, 0.0, splitter, nil, false, AcceptanceStats{}, 1.0}
 
+	npylm.setRand(hpylm.rndSource)
 	npylm.poisson.Lambda = float64(maxWordLength) / 2.0
 	for k := 0; k < maxWordLength; k++ {
 		npylm.length2prob[k] = 1.0 / float64(maxWordLength)
 	}
 
-	if npylm.maxNgram != 2 {
-		panic("range of maxNgram is 2 to 2")
-	}
+	return npylm, nil
+}
+
+// newNPYLMToLoad returns empty NPYLM instance whose parameters are set by load.
+func newNPYLMToLoad() *NPYLM {
+	npylm := &NPYLM{HPYLM: newHPYLMToLoad(), vpylm: newVPYLMToLoad(), word2sampledDepthMemory: make(map[string][][]int), temperature: 1.0}
+	npylm.setRand(npylm.rndSource)
 	return npylm
 }
 
@@ -64,7 +91,7 @@ func (npylm *NPYLM) addCustomerBase(word string) {
 		uChar := make(context, 0, npylm.maxWordLength) // +1 is for bos
 		for i := 0; i < len(sliceWord); i++ {
 			lastChar := sliceWord[i]
-			sampledDepth := npylm.vpylm.AddCustomer(lastChar, uChar)
+			sampledDepth := npylm.vpylm.addCustomer(lastChar, uChar)
 			sampledDepthMemory[i] = sampledDepth
 			start := 0
 			if len(uChar) == npylm.maxWordLength {
@@ -72,7 +99,7 @@ func (npylm *NPYLM) addCustomerBase(word string) {
 			}
 			uChar = append(uChar[start:], sliceWord[i])
 		}
-		sampledDepth := npylm.vpylm.AddCustomer(npylm.eow, uChar)
+		sampledDepth := npylm.vpylm.addCustomer(npylm.eow, uChar)
 		sampledDepthMemory[len(sliceWord)] = sampledDepth
 
 		_, ok := npylm.word2sampledDepthMemory[word]
@@ -86,41 +113,52 @@ func (npylm *NPYLM) addCustomerBase(word string) {
 	return
 }
 
-func (npylm *NPYLM) removeCustomerBase(word string) {
+func (npylm *NPYLM) removeCustomerBase(word string) error {
 	if word != npylm.bos && word != npylm.eos {
 		sliceWord := strings.Split(word, npylm.splitter)
 
 		sampledDepthMemories, ok := npylm.word2sampledDepthMemory[word]
 		if !ok {
-			errMsg := fmt.Sprintf("removeCustomerBase error. sampledDepthMemories of word (%v) does not exist", word)
-			panic(errMsg)
+			return fmt.Errorf("%w. removeCustomerBase error. sampledDepthMemories of word (%v) does not exist", ErrCustomerNotFound, word)
 		}
 		if len(sampledDepthMemories) == 0 {
-			errMsg := fmt.Sprintf("removeCustomerBase error. sampledDepthMemory of word (%v) does not exist", word)
-			panic(errMsg)
+			return fmt.Errorf("%w. removeCustomerBase error. sampledDepthMemory of word (%v) does not exist", ErrCustomerNotFound, word)
 		}
 		sampledDepthMemory := sampledDepthMemories[0]
 		uChar := make(context, 0, npylm.maxWordLength) // +1 is for bos
 		for i := 0; i < len(sliceWord); i++ {
 			lastChar := sliceWord[i]
-			npylm.vpylm.RemoveCustomer(lastChar, uChar, sampledDepthMemory[i])
+			if err := npylm.vpylm.RemoveCustomer(lastChar, uChar, sampledDepthMemory[i]); err != nil {
+				return err
+			}
 			start := 0
 			if len(uChar) == npylm.maxWordLength {
 				start = 1
 			}
 			uChar = append(uChar[start:], sliceWord[i])
 		}
-		npylm.vpylm.RemoveCustomer(npylm.eow, uChar, sampledDepthMemory[len(sliceWord)])
+		if err := npylm.vpylm.RemoveCustomer(npylm.eow, uChar, sampledDepthMemory[len(sliceWord)]); err != nil {
+			return err
+		}
 
 		npylm.word2sampledDepthMemory[word] = sampledDepthMemories[1:]
 		if len(npylm.word2sampledDepthMemory[word]) == 0 {
 			delete(npylm.word2sampledDepthMemory, word)
 		}
 	}
-	return
+	return nil
 }
 
 func (npylm *NPYLM) calcBase(word string) float64 {
+	return npylm.mixDictionaryBase(word, npylm.calcCharBase(word))
+}
+
+// calcCharBase returns the probability of word by the character VPYLM.
+func (npylm *NPYLM) calcCharBase(word string) float64 {
+	version := npylm.vpylm.hpylm.version
+	if _, base, ok := npylm.charBaseCache.get(word, version); ok {
+		return base
+	}
 	p := float64(1.0)
 	sliceWord := strings.Split(word, npylm.splitter)
 
@@ -140,13 +178,86 @@ func (npylm *NPYLM) calcBase(word string) float64 {
 		uChar = append(uChar[start:], sliceWord[i])
 	}
 	pTmpMixed, _, _ := npylm.vpylm.CalcProb(npylm.eow, uChar)
-	p *= pTmpMixed
+	base := p*pTmpMixed + math.SmallestNonzeroFloat64
 
 	// poisson correction
 	// if len(runeWord) <= npylm.maxWordLength {
 	// 	p *= float64(npylm.poisson.Prob(float64(len(runeWord))) / float64(npylm.length2prob[len(runeWord)-1]))
 	// }
-	return p + math.SmallestNonzeroFloat64
+	npylm.charBaseCache.put(word, p, base, version)
+	return base
+}
+
+// calcSpanCharBases returns bases[end][k], which is calcCharBase of the word sent[end-k:end+1].
+// the probability of the characters of sent[start:end+1] is extended to sent[start:end+2] by one character,
+// so the character VPYLM is called twice for each span instead of once for each character of each span.
+func (npylm *NPYLM) calcSpanCharBases(spans spanWords) [][]float64 {
+	sent := spans.sent
+	bases := make([][]float64, len(sent), len(sent))
+	for end := range sent {
+		bases[end] = make([]float64, npylm.maxWordLength, npylm.maxWordLength)
+	}
+	version := npylm.vpylm.hpylm.version
+	uChar := make(context, 0, npylm.maxWordLength)
+	for start := range sent {
+		p := float64(1.0) // probability of the characters without eow
+		uChar = uChar[:0]
+		for k := 0; k < npylm.maxWordLength && start+k < len(sent); k++ {
+			end := start + k
+			word := spans.word(start, end)
+			if prefix, base, ok := npylm.charBaseCache.get(word, version); ok {
+				p = prefix
+				bases[end][k] = base
+				uChar = append(uChar, sent[end])
+				continue
+			}
+			pTmpMixed, _, _ := npylm.vpylm.CalcProb(sent[end], uChar)
+			p *= pTmpMixed
+			uChar = append(uChar, sent[end])
+			pTmpMixed, _, _ = npylm.vpylm.CalcProb(npylm.eow, uChar)
+			bases[end][k] = p*pTmpMixed + math.SmallestNonzeroFloat64
+			npylm.charBaseCache.put(word, p, bases[end][k], version)
+		}
+	}
+	return bases
+}
+
+// SetCharBaseCacheSize enables LRU cache of the probabilities of words by the character VPYLM, which is cleared when the character VPYLM is changed.
+// size is the maximum number of cached words, and size == 0 disables the cache.
+func (npylm *NPYLM) SetCharBaseCacheSize(size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w. size of cache should not be negative", ErrInvalidParameter)
+	}
+	npylm.charBaseCache = nil
+	if size > 0 {
+		npylm.charBaseCache = newCharBaseCache(size)
+	}
+	return nil
+}
+
+// SetDictionary sets the user dictionary as a prior of words. POS tags of entries are ignored.
+// the base measure becomes (1 - weight) * (probability by the character VPYLM) + weight * (probability in the dictionary),
+// so dictionary words are preferred without hard constraints.
+func (npylm *NPYLM) SetDictionary(entries []DictionaryEntry, weight float64) error {
+	if weight < 0.0 || weight >= 1.0 {
+		return fmt.Errorf("%w. weight of dictionary should be in [0, 1)", ErrInvalidParameter)
+	}
+	npylm.dictionary = nil
+	npylm.dictionaryWeight = 0.0
+	if len(entries) == 0 {
+		return nil
+	}
+	npylm.dictionary = makeDictionary(entries)
+	npylm.dictionaryWeight = weight
+	return nil
+}
+
+// mixDictionaryBase returns the base measure of word from the base probability by the character VPYLM.
+func (npylm *NPYLM) mixDictionaryBase(word string, charBase float64) float64 {
+	if len(npylm.dictionary) == 0 {
+		return charBase
+	}
+	return (1.0-npylm.dictionaryWeight)*charBase + npylm.dictionaryWeight*npylm.dictionary[word]
 }
 
 func (npylm *NPYLM) logsumexp(forwardScoreTmp []float64) float64 {
@@ -165,11 +276,25 @@ func (npylm *NPYLM) logsumexp(forwardScoreTmp []float64) float64 {
 }
 
 // TrainWordSegmentation trains word segentation model from unsegmnted texts without labeled data.
-func (npylm *NPYLM) TrainWordSegmentation(dataContainer *DataContainer, threadsNum int, batchSize int) {
+// sentences in a batch are sampled in parallel from the counts without the batch, and the samples are corrected by Metropolis-Hastings if it is enabled (see SetMetropolisHastings).
+func (npylm *NPYLM) TrainWordSegmentation(dataContainer *DataContainer, threadsNum int, batchSize int) error {
+	if npylm.frozen != nil {
+		return fmt.Errorf("%w. TrainWordSegmentation of NPYLM", ErrFrozen)
+	}
+	if threadsNum <= 0 {
+		return fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if batchSize <= 0 {
+		return fmt.Errorf("%w. batchSize should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(dataContainer.Constraints, npylm.maxWordLength, 0); err != nil {
+		return err
+	}
 	ch := make(chan int, threadsNum)
 	wg := sync.WaitGroup{}
 	bar := pb.StartNew(dataContainer.Size)
-	randIndexes := rand.Perm(dataContainer.Size)
+	randIndexes := npylm.rnd.Perm(dataContainer.Size)
+	npylm.acceptanceStats = AcceptanceStats{}
 	for i := 0; i < dataContainer.Size; i += batchSize {
 		end := i + batchSize
 		if end > dataContainer.Size {
@@ -178,24 +303,53 @@ func (npylm *NPYLM) TrainWordSegmentation(dataContainer *DataContainer, threadsN
 		bar.Add(end - i)
 		for j := i; j < end; j++ {
 			r := randIndexes[j]
-			npylm.removeWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r])
+			if err := npylm.removeWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r]); err != nil {
+				bar.Finish()
+				return err
+			}
 		}
 		sampledWordSeqs := make([]context, end-i, end-i)
+		logQNews := make([]float64, end-i, end-i)
+		logQOlds := make([]float64, end-i, end-i)
+		rnds := deriveRands(npylm.rnd, end-i)
 		for j := i; j < end; j++ {
 			ch <- 1
 			wg.Add(1)
 			go func(j int) {
 				r := randIndexes[j]
 				sent := dataContainer.Sents[r]
-				forwardScore := npylm.forward(sent)
-				sampledWordSeqs[j-i] = npylm.backward(sent, forwardScore, true)
+				forwardScore := npylm.forward(sent, dataContainer.GetConstraint(r))
+				sampledWordSeqs[j-i] = npylm.backward(sent, forwardScore, true, rnds[j-i])
+				if npylm.metropolisHastings {
+					logQNews[j-i] = npylm.calcProposalScore(sent, forwardScore, sampledWordSeqs[j-i])
+					logQOlds[j-i] = npylm.calcProposalScore(sent, forwardScore, dataContainer.SamplingWordSeqs[r])
+				}
 				<-ch
 				wg.Done()
 			}(j)
 		}
 		wg.Wait()
+		if npylm.metropolisHastings {
+			// the old segmentations are added again, so that each proposal is rescored with the counts of all the other sentences
+			for j := i; j < end; j++ {
+				npylm.addWordSeqAsCustomer(dataContainer.SamplingWordSeqs[randIndexes[j]])
+			}
+		}
 		for j := i; j < end; j++ {
 			r := randIndexes[j]
+			if npylm.metropolisHastings {
+				oldWordSeq := dataContainer.SamplingWordSeqs[r]
+				if err := npylm.removeWordSeqAsCustomer(oldWordSeq); err != nil {
+					bar.Finish()
+					return err
+				}
+				// the target distribution is also annealed by the temperature
+				logPNew := npylm.calcWordSeqScoreWithEos(sampledWordSeqs[j-i]) / npylm.temperature
+				logPOld := npylm.calcWordSeqScoreWithEos(oldWordSeq) / npylm.temperature
+				if !npylm.acceptanceStats.accept(logPNew, logPOld, logQNews[j-i], logQOlds[j-i], npylm.rnd) {
+					sampledWordSeqs[j-i] = oldWordSeq
+				}
+			}
 			dataContainer.SamplingWordSeqs[r] = sampledWordSeqs[j-i]
 			npylm.addWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r])
 		}
@@ -204,38 +358,150 @@ func (npylm *NPYLM) TrainWordSegmentation(dataContainer *DataContainer, threadsN
 	// npylm.poissonCorrection()
 	npylm.estimateHyperPrameters()
 	npylm.vpylm.hpylm.estimateHyperPrameters()
-	return
+	return nil
+}
+
+// TrainWordSegmentationInShards trains word segentation model by data-sharded parallel Gibbs sampling (see trainInShards).
+// unlike TrainWordSegmentation, each sentence is sampled given the latest segmentations in its own shard, and threadsNum is not limited by batch size.
+// the deltas of shards are merged every mergeInterval sentences of each shard. threadsNum copies of the model are needed.
+func (npylm *NPYLM) TrainWordSegmentationInShards(dataContainer *DataContainer, threadsNum int, mergeInterval int) error {
+	if npylm.frozen != nil {
+		return fmt.Errorf("%w. TrainWordSegmentationInShards of NPYLM", ErrFrozen)
+	}
+	if threadsNum <= 0 {
+		return fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if mergeInterval <= 0 {
+		return fmt.Errorf("%w. mergeInterval should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(dataContainer.Constraints, npylm.maxWordLength, 0); err != nil {
+		return err
+	}
+	if err := trainInShards(npylm, dataContainer, threadsNum, mergeInterval, npylm.rnd); err != nil {
+		return err
+	}
+	npylm.estimateHyperPrameters()
+	npylm.vpylm.hpylm.estimateHyperPrameters()
+	return nil
+}
+
+func (npylm *NPYLM) addShardSample(sample shardSample) {
+	npylm.addWordSeqAsCustomer(sample.wordSeq)
+}
+
+func (npylm *NPYLM) removeShardSample(sample shardSample) error {
+	return npylm.removeWordSeqAsCustomer(sample.wordSeq)
+}
+
+func (npylm *NPYLM) sampleShardSample(sent []string, constraint *SentConstraint) shardSample {
+	forwardScore := npylm.forward(sent, constraint)
+	return shardSample{wordSeq: npylm.backward(sent, forwardScore, true, npylm.rnd)}
+}
+
+func (npylm *NPYLM) cloneShardSampler(seed int64) (shardSampler, error) {
+	clone := newNPYLMToLoad()
+	if err := cloneByBinary(npylm, clone); err != nil {
+		return nil, err
+	}
+	clone.SetRandSeed(seed)
+	clone.temperature = npylm.temperature
+	return clone, nil
 }
 
 // TestWordSegmentation inferences word segmentation from input unsegmented texts.
-func (npylm *NPYLM) TestWordSegmentation(sents [][]string, threadsNum int) [][]string {
+func (npylm *NPYLM) TestWordSegmentation(sents [][]string, threadsNum int) ([][]string, error) {
+	return npylm.TestWordSegmentationWithConstraints(sents, nil, threadsNum)
+}
+
+// TestWordSegmentationWithConstraints inferences word segmentation from input unsegmented texts with their partial annotations.
+// constraints can be nil.
+func (npylm *NPYLM) TestWordSegmentationWithConstraints(sents [][]string, constraints []*SentConstraint, threadsNum int) ([][]string, error) {
 	wordSeqs := make([][]string, len(sents), len(sents))
+	if threadsNum <= 0 {
+		return nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(constraints, npylm.maxWordLength, 0); err != nil {
+		return nil, err
+	}
 	ch := make(chan int, threadsNum)
+	wg := sync.WaitGroup{}
+	for i := 0; i < len(sents); i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			forwardScore := npylm.forward(sents[i], constraintAt(constraints, i))
+			wordSeq := npylm.backward(sents[i], forwardScore, false, nil)
+			wordSeqs[i] = wordSeq
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	return wordSeqs, nil
+}
+
+// SampleWordSegmentation samples word segmentation of input unsegmented texts from the posterior.
+// constraints can be nil.
+func (npylm *NPYLM) SampleWordSegmentation(sents [][]string, constraints []*SentConstraint, threadsNum int) ([][]string, error) {
+	wordSeqs := make([][]string, len(sents), len(sents))
 	if threadsNum <= 0 {
-		panic("threadsNum should be bigger than 0")
+		return nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(constraints, npylm.maxWordLength, 0); err != nil {
+		return nil, err
 	}
+	ch := make(chan int, threadsNum)
 	wg := sync.WaitGroup{}
+	rnds := deriveRands(npylm.rnd, len(sents))
 	for i := 0; i < len(sents); i++ {
 		ch <- 1
 		wg.Add(1)
 		go func(i int) {
-			forwardScore := npylm.forward(sents[i])
-			wordSeq := npylm.backward(sents[i], forwardScore, false)
+			forwardScore := npylm.forward(sents[i], constraintAt(constraints, i))
+			wordSeq := npylm.backward(sents[i], forwardScore, true, rnds[i])
 			wordSeqs[i] = wordSeq
 			<-ch
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
-	return wordSeqs
+	return wordSeqs, nil
 }
 
-// CalcTestScore calculates score of word sequences score like perplixity.
-func (npylm *NPYLM) CalcTestScore(wordSeqs [][]string, threadsNum int) (float64, float64) {
+// TestNbestWordSegmentation inferences the nbest word segmentations from input unsegmented texts.
+// constraints can be nil.
+func (npylm *NPYLM) TestNbestWordSegmentation(sents [][]string, constraints []*SentConstraint, nbest int, threadsNum int) ([][]NbestSegmentation, error) {
+	nbestSegmentations := make([][]NbestSegmentation, len(sents), len(sents))
+	if threadsNum <= 0 {
+		return nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(constraints, npylm.maxWordLength, 0); err != nil {
+		return nil, err
+	}
 	ch := make(chan int, threadsNum)
+	if nbest <= 0 {
+		return nil, fmt.Errorf("%w. nbest should be bigger than 0", ErrInvalidParameter)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < len(sents); i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			nbestSegmentations[i] = npylm.nbestViterbi(sents[i], constraintAt(constraints, i), nbest)
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	return nbestSegmentations, nil
+}
+
+// CalcTestScore calculates score of word sequences score like perplixity.
+func (npylm *NPYLM) CalcTestScore(wordSeqs [][]string, threadsNum int) (float64, float64, error) {
 	if threadsNum <= 0 {
-		panic("threadsNum should be bigger than 0")
+		return 0.0, 0.0, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
 	}
+	ch := make(chan int, threadsNum)
 	wg := sync.WaitGroup{}
 
 	scores := make([]float64, len(wordSeqs), len(wordSeqs))
@@ -261,92 +527,505 @@ func (npylm *NPYLM) CalcTestScore(wordSeqs [][]string, threadsNum int) (float64,
 	corpusScore *= -1.0
 	corpusScoreDivWordSize := corpusScore / float64(wordSize)
 	corpusScoreDivSentSize := corpusScore / float64(len(wordSeqs))
-	return corpusScoreDivWordSize, corpusScoreDivSentSize
+	return corpusScoreDivWordSize, corpusScoreDivSentSize, nil
 }
 
 // CalcWordSeqScore calculates score of given word sequence.
 func (npylm *NPYLM) CalcWordSeqScore(wordSeq context) float64 {
-	word := string("")
-	u := make(context, npylm.maxNgram-1, npylm.maxNgram-1) // now bi-gram only
+	u := make(context, 0, npylm.maxNgram-1)
+	for n := 0; n < npylm.maxNgram-1; n++ {
+		u = append(u, npylm.bos)
+	}
 	base := float64(0.0)
 	seqScore := float64(0.0)
-	for i := 0; i < len(wordSeq); i++ {
-		if i == 0 {
-			u[0] = npylm.bos
-		} else {
-			u[0] = wordSeq[i-1]
-		}
-		word = wordSeq[i]
+	for _, word := range wordSeq {
 		base = npylm.calcBase(word)
 		score, _ := npylm.CalcProb(word, u, base)
 		seqScore += math.Log(score)
+		u = append(u[1:], word)
 	}
 	return seqScore
 }
 
+// calcWordSeqScoreWithEos calculates log probability of given word sequence including eos.
+func (npylm *NPYLM) calcWordSeqScoreWithEos(wordSeq context) float64 {
+	u := make(context, 0, npylm.maxNgram-1)
+	for n := 0; n < npylm.maxNgram-1; n++ {
+		u = append(u, npylm.bos)
+	}
+	for _, word := range wordSeq {
+		u = append(u[1:], word)
+	}
+	score, _ := npylm.CalcProb(npylm.eos, u, npylm.vpylm.hpylm.Base)
+	return npylm.CalcWordSeqScore(wordSeq) + math.Log(score)
+}
+
+// SetMetropolisHastings enables Metropolis-Hastings correction of TrainWordSegmentation.
+// a sampled segmentation is proposed from the counts without its batch and the normalized forward scores, so it is not the exact conditional.
+// if enabled, it is accepted with the probability min(1, p(new) q(old) / (p(old) q(new))), where p is the probability by the current counts of the other sentences
+// and q is the probability of the proposal. otherwise, the previous segmentation is kept.
+func (npylm *NPYLM) SetMetropolisHastings(enabled bool) {
+	npylm.metropolisHastings = enabled
+}
+
+// ReturnAcceptanceStats returns the statistics of Metropolis-Hastings correction in the last TrainWordSegmentation.
+func (npylm *NPYLM) ReturnAcceptanceStats() AcceptanceStats {
+	return npylm.acceptanceStats
+}
+
+// SetTemperature sets the temperature of sampling for simulated annealing (see AnnealingTemperature).
+// the log probabilities of words are divided by temperature in forward filtering and backward sampling, i.e., segmentations are sampled from p^(1/temperature).
+// temperature 1 is the original Gibbs sampling, and the higher temperature gives the flatter distribution to escape local optima.
+func (npylm *NPYLM) SetTemperature(temperature float64) error {
+	if !(temperature > 0.0) || math.IsInf(temperature, 1) {
+		return fmt.Errorf("%w. temperature should be bigger than 0 (%v)", ErrInvalidParameter, temperature)
+	}
+	npylm.temperature = temperature
+	return nil
+}
+
+// CalcSentScore calculates log probability of given unsegmented sentence marginalized over all segmentations.
+// eos is included.
+func (npylm *NPYLM) CalcSentScore(sent []string) float64 {
+	if len(sent) == 0 {
+		return 0.0
+	}
+	forwardScore := npylm.calcForwardScore(sent, nil, false)
+	historySize := npylm.historySize()
+	t := len(sent) - 1
+	scores := make([]float64, 0, npylm.maxWordLength*historySize)
+	for k := 0; k < npylm.maxWordLength; k++ {
+		for h := 0; h < historySize; h++ {
+			prevScore := forwardScore[t][k][h]
+			if math.IsInf(prevScore, -1) {
+				continue
+			}
+			score := npylm.calcEosScore(sent, k, h)
+			if math.IsInf(score, -1) {
+				continue
+			}
+			scores = append(scores, score+prevScore)
+		}
+	}
+	if len(scores) == 0 {
+		return math.Inf(-1)
+	}
+	return npylm.logsumexp(scores)
+}
+
+// calcEosScore returns log probability of eos after the last word of sent whose state is forwardScore[len(sent)-1][k][h].
+// it returns -inf if the state does not match the sentence.
+func (npylm *NPYLM) calcEosScore(sent []string, k int, h int) float64 {
+	u, ok := npylm.makeContext(sent, len(sent)-1, append([]int{k}, npylm.decodeHistory(h)...))
+	if !ok {
+		return math.Inf(-1)
+	}
+	score, _ := npylm.CalcProb(npylm.eos, u, npylm.vpylm.hpylm.Base)
+	return math.Log(score)
+}
+
 // TestWordSegmentationForPython inferences word segmentation, and returns data_container which contain segmented texts.
-func (npylm *NPYLM) TestWordSegmentationForPython(sents [][]string, threadsNum int) *DataContainer {
-	wordSeqs := npylm.TestWordSegmentation(sents, threadsNum)
+func (npylm *NPYLM) TestWordSegmentationForPython(sents [][]string, threadsNum int) (*DataContainer, error) {
+	wordSeqs, err := npylm.TestWordSegmentation(sents, threadsNum)
+	if err != nil {
+		return nil, err
+	}
 	dataContainer := new(DataContainer)
 	for _, wordSeq := range wordSeqs {
 		dataContainer.SamplingWordSeqs = append(dataContainer.SamplingWordSeqs, wordSeq)
 	}
 	dataContainer.Size = len(wordSeqs)
-	return dataContainer
+	return dataContainer, nil
+}
+
+// historySize returns the number of histories h in forwardScore[t][k][h].
+func (npylm *NPYLM) historySize() int {
+	size := 1
+	for n := 0; n < npylm.maxNgram-2; n++ {
+		size *= npylm.maxWordLength + 1
+	}
+	return size
 }
 
-func (npylm *NPYLM) forward(sent []string) forwardScoreType {
+// encodeHistory encodes lengths of previous words into a history index.
+// lengths[0] is the length index (length - 1) of the nearest word, and npylm.maxWordLength means bos.
+func (npylm *NPYLM) encodeHistory(lengths []int) int {
+	h := 0
+	for m := len(lengths) - 1; m >= 0; m-- {
+		h = h*(npylm.maxWordLength+1) + lengths[m]
+	}
+	return h
+}
+
+// decodeHistory is the inverse of encodeHistory.
+// the capacity of returned lengths has room to append the length of one more word.
+func (npylm *NPYLM) decodeHistory(h int) []int {
+	return npylm.decodeLengths(h, npylm.maxNgram-2)
+}
+
+// decodeLengths decodes size lengths encoded by encodeHistory.
+func (npylm *NPYLM) decodeLengths(h int, size int) []int {
+	lengths := make([]int, size, size+1)
+	for m := 0; m < size; m++ {
+		lengths[m] = h % (npylm.maxWordLength + 1)
+		h /= npylm.maxWordLength + 1
+	}
+	return lengths
+}
+
+// makeContext returns the word context u whose nearest word ends at sent[end].
+// lengths are length indexes of the context words from the nearest one (see encodeHistory).
+// ok is false if lengths do not match the sentence, e.g., a word crosses the beginning of the sentence.
+func (npylm *NPYLM) makeContext(sent []string, end int, lengths []int) (context, bool) {
+	return npylm.makeContextFromSpans(spanWords{sent: sent, splitter: npylm.splitter}, end, lengths)
+}
+
+// spanWords joins characters of spans of sent to words. if words is not nil, each word is joined only once for the sentence.
+type spanWords struct {
+	sent     []string
+	splitter string
+	words    [][]string // words[end][k] is the word sent[end-k:end+1]
+}
+
+func (npylm *NPYLM) newSpanWords(sent []string) spanWords {
+	words := make([][]string, len(sent), len(sent))
+	for end := range sent {
+		words[end] = make([]string, npylm.maxWordLength, npylm.maxWordLength)
+		for k := 0; k < npylm.maxWordLength && end-k >= 0; k++ {
+			words[end][k] = strings.Join(sent[end-k:end+1], npylm.splitter)
+		}
+	}
+	return spanWords{sent, npylm.splitter, words}
+}
+
+func (spans spanWords) word(start int, end int) string {
+	if spans.words != nil && end-start < len(spans.words[end]) {
+		return spans.words[end][end-start]
+	}
+	return strings.Join(spans.sent[start:end+1], spans.splitter)
+}
+
+func (npylm *NPYLM) makeContextFromSpans(spans spanWords, end int, lengths []int) (context, bool) {
+	u := make(context, len(lengths), len(lengths))
+	for m, length := range lengths {
+		if length == npylm.maxWordLength {
+			if end != -1 {
+				return u, false
+			}
+			u[len(lengths)-1-m] = npylm.bos
+			continue
+		}
+		start := end - length
+		if start < 0 {
+			return u, false
+		}
+		u[len(lengths)-1-m] = spans.word(start, end)
+		end = start - 1
+	}
+	return u, true
+}
+
+func (npylm *NPYLM) forward(sent []string, constraint *SentConstraint) forwardScoreType {
+	return npylm.calcForwardScore(sent, constraint, true)
+}
+
+// calcForwardScore returns forwardScore[t][k][h].
+// if normalized is true, each sum is divided by the number of its terms for sampling (see memo.md), and the log probabilities of words are divided by the temperature.
+// otherwise, forwardScore[t][k][h] is the exact log probability of sent[:t+1] whose last word is sent[t-k:t+1].
+// words which do not satisfy constraint have -inf, and constraint can be nil.
+func (npylm *NPYLM) calcForwardScore(sent []string, constraint *SentConstraint, normalized bool) forwardScoreType {
 	// initialize forwardScore
+	historySize := npylm.historySize()
 	forwardScore := make(forwardScoreType, len(sent), len(sent))
 	for t := 0; t < len(sent); t++ {
-		forwardScore[t] = make([]float64, npylm.maxWordLength, npylm.maxWordLength)
+		forwardScore[t] = make([][]float64, npylm.maxWordLength, npylm.maxWordLength)
+		for k := 0; k < npylm.maxWordLength; k++ {
+			forwardScore[t][k] = make([]float64, historySize, historySize)
+			for h := 0; h < historySize; h++ {
+				forwardScore[t][k][h] = math.Inf(-1)
+			}
+		}
 	}
 
+	temperature := 1.0
+	if normalized {
+		temperature = npylm.temperature
+	}
+	spans := npylm.newSpanWords(sent)
+	charBases := npylm.calcSpanCharBases(spans)
 	word := string("")
-	u := make(context, npylm.maxNgram-1, npylm.maxNgram-1) // now bi-gram only
 	base := float64(0.0)
 	for t := 0; t < len(sent); t++ {
 		for k := 0; k < npylm.maxWordLength; k++ {
-			if t-k >= 0 {
-				word = strings.Join((sent[(t - k) : t+1]), npylm.splitter)
-				base = npylm.calcBase(word)
+			if t-k >= 0 && constraint.allowWord(t-k, t) {
+				word = spans.word(t-k, t)
+				base = npylm.mixDictionaryBase(word, charBases[t][k])
+			} else {
+				continue
+			}
+			for h := 0; h < historySize; h++ {
+				lengths := npylm.decodeHistory(h)
 				if t-k == 0 {
-					u[0] = npylm.bos
+					u, ok := npylm.makeContextFromSpans(spans, t-k-1, append(lengths, npylm.maxWordLength))
+					if !ok {
+						continue
+					}
 					score, _ := npylm.CalcProb(word, u, base)
-					forwardScore[t][k] = math.Log(score)
+					forwardScore[t][k][h] = math.Log(score) / temperature
 					continue
 				}
-			} else {
-				continue
-			}
-			forwardScore[t][k] = 0.0
-			forwardScoreTmp := make([]float64, 0, npylm.maxWordLength)
-			for j := 0; j < npylm.maxWordLength; j++ {
-				if t-k-(j+1) >= 0 {
-					u[0] = strings.Join(sent[(t-k-(j+1)):(t-k)], npylm.splitter)
+				forwardScoreTmp := make([]float64, 0, npylm.maxWordLength+1)
+				for j := 0; j < npylm.maxWordLength+1; j++ {
+					contextLengths := append(lengths, j)
+					u, ok := npylm.makeContextFromSpans(spans, t-k-1, contextLengths)
+					if !ok {
+						continue
+					}
+					prevScore := forwardScore[t-(k+1)][contextLengths[0]][npylm.encodeHistory(contextLengths[1:])]
+					if math.IsInf(prevScore, -1) {
+						continue
+					}
 					score, _ := npylm.CalcProb(word, u, base)
-					score = math.Log(score) + forwardScore[t-(k+1)][j]
-					forwardScoreTmp = append(forwardScoreTmp, score)
-				} else {
+					forwardScoreTmp = append(forwardScoreTmp, math.Log(score)/temperature+prevScore)
+				}
+				if len(forwardScoreTmp) == 0 {
 					continue
 				}
+				logsumexpScore := npylm.logsumexp(forwardScoreTmp)
+				if normalized {
+					logsumexpScore -= math.Log(float64(len(forwardScoreTmp)))
+				}
+				forwardScore[t][k][h] = logsumexpScore
 			}
-			logsumexpScore := npylm.logsumexp(forwardScoreTmp)
-			forwardScore[t][k] = logsumexpScore - math.Log(float64(len(forwardScoreTmp)))
 		}
 	}
 
 	return forwardScore
 }
 
-func (npylm *NPYLM) backward(sent []string, forwardScore forwardScoreType, sampling bool) context {
+// calcBackwardScore returns backwardScore[t][k][h].
+// backwardScore[t][k][h] is the log probability of sent[t+1:] and eos given the state forwardScore[t][k][h].
+// next words which do not satisfy constraint are ignored, and constraint can be nil.
+func (npylm *NPYLM) calcBackwardScore(sent []string, constraint *SentConstraint) forwardScoreType {
+	// initialize backwardScore
+	historySize := npylm.historySize()
+	backwardScore := make(forwardScoreType, len(sent), len(sent))
+	for t := 0; t < len(sent); t++ {
+		backwardScore[t] = make([][]float64, npylm.maxWordLength, npylm.maxWordLength)
+		for k := 0; k < npylm.maxWordLength; k++ {
+			backwardScore[t][k] = make([]float64, historySize, historySize)
+			for h := 0; h < historySize; h++ {
+				backwardScore[t][k][h] = math.Inf(-1)
+			}
+		}
+	}
+
+	spans := npylm.newSpanWords(sent)
+	charBases := npylm.calcSpanCharBases(spans)
+	nextWords := make([]string, npylm.maxWordLength, npylm.maxWordLength)
+	nextBases := make([]float64, npylm.maxWordLength, npylm.maxWordLength)
+	for t := len(sent) - 1; t >= 0; t-- {
+		for nextK := 0; nextK < npylm.maxWordLength && t+nextK+1 < len(sent); nextK++ {
+			nextWords[nextK] = spans.word(t+1, t+nextK+1)
+			nextBases[nextK] = npylm.mixDictionaryBase(nextWords[nextK], charBases[t+nextK+1][nextK])
+		}
+		for k := 0; k < npylm.maxWordLength; k++ {
+			if t-k < 0 {
+				continue
+			}
+			for h := 0; h < historySize; h++ {
+				if t == len(sent)-1 {
+					backwardScore[t][k][h] = npylm.calcEosScore(sent, k, h)
+					continue
+				}
+				contextLengths := append([]int{k}, npylm.decodeHistory(h)...)
+				u, ok := npylm.makeContext(sent, t, contextLengths)
+				if !ok {
+					continue
+				}
+				nextH := npylm.encodeHistory(contextLengths[:npylm.maxNgram-2])
+				backwardScoreTmp := make([]float64, 0, npylm.maxWordLength)
+				for nextK := 0; nextK < npylm.maxWordLength && t+nextK+1 < len(sent); nextK++ {
+					if !constraint.allowWord(t+1, t+nextK+1) {
+						continue
+					}
+					nextScore := backwardScore[t+nextK+1][nextK][nextH]
+					if math.IsInf(nextScore, -1) {
+						continue
+					}
+					score, _ := npylm.CalcProb(nextWords[nextK], u, nextBases[nextK])
+					backwardScoreTmp = append(backwardScoreTmp, math.Log(score)+nextScore)
+				}
+				if len(backwardScoreTmp) == 0 {
+					continue
+				}
+				backwardScore[t][k][h] = npylm.logsumexp(backwardScoreTmp)
+			}
+		}
+	}
+
+	return backwardScore
+}
+
+// CalcWordMarginals returns the posterior probabilities of words in sent by forward-backward algorithm.
+// wordMarginals[t][k] is the probability that sent[t-k:t+1] is a word.
+func (npylm *NPYLM) CalcWordMarginals(sent []string) [][]float64 {
+	return npylm.calcWordMarginals(sent, nil)
+}
+
+func (npylm *NPYLM) calcWordMarginals(sent []string, constraint *SentConstraint) [][]float64 {
+	wordMarginals := make([][]float64, len(sent), len(sent))
+	for t := 0; t < len(sent); t++ {
+		wordMarginals[t] = make([]float64, npylm.maxWordLength, npylm.maxWordLength)
+	}
+	if len(sent) == 0 {
+		return wordMarginals
+	}
+	forwardScore := npylm.calcForwardScore(sent, constraint, false)
+	backwardScore := npylm.calcBackwardScore(sent, constraint)
+	historySize := npylm.historySize()
+	sentScores := make([]float64, 0, npylm.maxWordLength*historySize)
+	for k := 0; k < npylm.maxWordLength; k++ {
+		for h := 0; h < historySize; h++ {
+			score := forwardScore[len(sent)-1][k][h] + backwardScore[len(sent)-1][k][h]
+			if !math.IsInf(score, -1) {
+				sentScores = append(sentScores, score)
+			}
+		}
+	}
+	if len(sentScores) == 0 {
+		return wordMarginals
+	}
+	sentScore := npylm.logsumexp(sentScores)
+	for t := 0; t < len(sent); t++ {
+		for k := 0; k < npylm.maxWordLength; k++ {
+			for h := 0; h < historySize; h++ {
+				score := forwardScore[t][k][h] + backwardScore[t][k][h]
+				if math.IsInf(score, -1) {
+					continue
+				}
+				wordMarginals[t][k] += math.Exp(score - sentScore)
+			}
+		}
+	}
+	return wordMarginals
+}
+
+// CalcBoundaryMarginals returns the posterior probabilities of word boundaries in sent by forward-backward algorithm.
+// boundaryMarginals[t] is the probability that a word boundary is after sent[t] (t < len(sent)-1).
+func (npylm *NPYLM) CalcBoundaryMarginals(sent []string) []float64 {
+	return wordMarginalsToBoundaryMarginals(npylm.CalcWordMarginals(sent))
+}
+
+// wordMarginalsToBoundaryMarginals sums up wordMarginals[t][k] over k.
+func wordMarginalsToBoundaryMarginals(wordMarginals [][]float64) []float64 {
+	if len(wordMarginals) == 0 {
+		return make([]float64, 0, 0)
+	}
+	boundaryMarginals := make([]float64, len(wordMarginals)-1, len(wordMarginals)-1)
+	for t := range boundaryMarginals {
+		for _, wordMarginal := range wordMarginals[t] {
+			boundaryMarginals[t] += wordMarginal
+		}
+		boundaryMarginals[t] = math.Min(boundaryMarginals[t], 1.0)
+	}
+	return boundaryMarginals
+}
+
+// TestBoundaryMarginals returns the posterior probabilities of word boundaries in input unsegmented texts.
+// constraints can be nil.
+func (npylm *NPYLM) TestBoundaryMarginals(sents [][]string, constraints []*SentConstraint, threadsNum int) ([][]float64, error) {
+	boundaryMarginals := make([][]float64, len(sents), len(sents))
+	if threadsNum <= 0 {
+		return nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(constraints, npylm.maxWordLength, 0); err != nil {
+		return nil, err
+	}
+	ch := make(chan int, threadsNum)
+	wg := sync.WaitGroup{}
+	for i := 0; i < len(sents); i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			boundaryMarginals[i] = wordMarginalsToBoundaryMarginals(npylm.calcWordMarginals(sents[i], constraintAt(constraints, i)))
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	return boundaryMarginals, nil
+}
+
+// backward samples a word segmentation by rnd if sampling is true, otherwise returns the best segmentation (rnd can be nil).
+func (npylm *NPYLM) backward(sent []string, forwardScore forwardScoreType, sampling bool, rnd *rand.Rand) context {
+	wordSeq, _, ok := npylm.walkBackward(sent, forwardScore, func(_ int, scoreArrayLog []float64, logSumScoreArrayLog float64, maxI int) int {
+		if !sampling {
+			return maxI
+		}
+		i := 0
+		r := rnd.Float64()
+		sumScore := 0.0
+		for {
+			score := math.Exp(scoreArrayLog[i] - logSumScoreArrayLog)
+			sumScore += score
+			if sumScore > r {
+				break
+			}
+			i++
+			if i >= len(scoreArrayLog) {
+				panic("sampling error in NPYLM")
+			}
+		}
+		return i
+	})
+	if !ok {
+		panic("sampling error in NPYLM")
+	}
+	return wordSeq
+}
+
+// calcProposalScore returns the log probability that backward samples wordSeq from forwardScore of sent.
+// it returns -inf if wordSeq is never sampled, e.g., it has a word longer than maxWordLength.
+func (npylm *NPYLM) calcProposalScore(sent []string, forwardScore forwardScoreType, wordSeq context) float64 {
+	// lengths[m] is the length index of the mth word from the last one, and the words before the first one are bos
+	lengths := make([]int, len(wordSeq)+npylm.maxNgram-2, len(wordSeq)+npylm.maxNgram-2)
+	for m := range lengths {
+		lengths[m] = npylm.maxWordLength
+		if m < len(wordSeq) {
+			lengths[m] = len(strings.Split(wordSeq[len(wordSeq)-1-m], npylm.splitter)) - 1
+			if lengths[m] >= npylm.maxWordLength {
+				return math.Inf(-1)
+			}
+		}
+	}
+	_, score, ok := npylm.walkBackward(sent, forwardScore, func(step int, _ []float64, _ float64, _ int) int {
+		if step >= len(wordSeq) {
+			return -1
+		}
+		return lengths[step]*npylm.historySize() + npylm.encodeHistory(lengths[step+1:step+1+npylm.maxNgram-2])
+	})
+	if !ok {
+		return math.Inf(-1)
+	}
+	return score
+}
+
+// walkBackward walks from eos to the beginning of sent on forwardScore, and returns the words and the log probability of the choices.
+// the log probabilities of words are divided by the temperature like forward.
+// choose returns the index j*historySize+h of the previous word sent[t-k-(j+1):t-k] and its history h at each step from the scores of the indexes.
+// ok is false if choose returns an index whose score is -inf.
+func (npylm *NPYLM) walkBackward(sent []string, forwardScore forwardScoreType, choose func(step int, scoreArrayLog []float64, logSumScoreArrayLog float64, maxI int) int) (context, float64, bool) {
 	t := len(sent)
 	k := 0
 	prevWord := npylm.eos
-	u := make(context, npylm.maxNgram-1, npylm.maxNgram-1)
+	// lengths of words before prevWord. they are unknown when prevWord is eos.
+	prevLengths := make([]int, 0, npylm.maxNgram-2)
+	historySize := npylm.historySize()
 	base := npylm.vpylm.hpylm.Base
 	samplingWord := string("")
 	samplingWordSeq := make(context, 0, len(sent))
+	walkScore := 0.0
 	for {
 		if (t - k) == 0 {
 			break
@@ -354,51 +1033,49 @@ func (npylm *NPYLM) backward(sent []string, forwardScore forwardScoreType, sampl
 		if prevWord != npylm.eos {
 			base = npylm.calcBase(prevWord)
 		}
-		scoreArrayLog := make([]float64, npylm.maxWordLength, npylm.maxWordLength)
-		for j := 0; j < npylm.maxWordLength; j++ {
-			scoreArrayLog[j] = math.Inf(-1)
+		scoreArrayLog := make([]float64, npylm.maxWordLength*historySize, npylm.maxWordLength*historySize)
+		for i := 0; i < npylm.maxWordLength*historySize; i++ {
+			scoreArrayLog[i] = math.Inf(-1)
 		}
 		maxScore := math.Inf(-1)
-		maxJ := -1
+		maxI := -1
 		for j := 0; j < npylm.maxWordLength; j++ {
-			if t-k-(j+1) >= 0 {
-				u[0] = strings.Join(sent[(t-k-(j+1)):(t-k)], npylm.splitter)
+			if t-k-(j+1) < 0 {
+				continue
+			}
+			for h := 0; h < historySize; h++ {
+				contextLengths := append([]int{j}, npylm.decodeHistory(h)...)
+				if !npylm.matchLengths(contextLengths, prevLengths) {
+					continue
+				}
+				prevScore := forwardScore[t-(k+1)][j][h]
+				if math.IsInf(prevScore, -1) {
+					continue
+				}
+				u, ok := npylm.makeContext(sent, t-(k+1), contextLengths)
+				if !ok {
+					continue
+				}
 				score, _ := npylm.CalcProb(prevWord, u, base)
-				score = math.Log(score) + forwardScore[t-(k+1)][j]
+				score = math.Log(score)/npylm.temperature + prevScore
 				if score > maxScore {
 					maxScore = score
-					maxJ = j
+					maxI = j*historySize + h
 				}
-				scoreArrayLog[j] = score
-			} else {
-				// scoreArray[j] = math.Inf(-1)
+				scoreArrayLog[j*historySize+h] = score
 			}
 		}
 		logSumScoreArrayLog := npylm.logsumexp(scoreArrayLog)
-		j := 0
-		if sampling {
-			r := rand.Float64()
-			sumScore := 0.0
-			for {
-				score := math.Exp(scoreArrayLog[j] - logSumScoreArrayLog)
-				sumScore += score
-				if sumScore > r {
-					break
-				}
-				j++
-				if j >= npylm.maxWordLength {
-					panic("sampling error in NPYLM")
-				}
-			}
-		} else {
-			j = maxJ
-		}
-		if t-k-(j+1) < 0 {
-			panic("sampling error in NPYLM")
+		i := choose(len(samplingWordSeq), scoreArrayLog, logSumScoreArrayLog, maxI)
+		if i < 0 || i >= len(scoreArrayLog) || math.IsInf(scoreArrayLog[i], -1) {
+			return nil, math.Inf(-1), false
 		}
+		walkScore += scoreArrayLog[i] - logSumScoreArrayLog
+		j := i / historySize
 		samplingWord = strings.Join(sent[(t-k-(j+1)):(t-k)], npylm.splitter)
 		samplingWordSeq = append(samplingWordSeq, samplingWord)
 		prevWord = samplingWord
+		prevLengths = npylm.decodeHistory(i % historySize)
 		t = t - (k + 1)
 		k = j
 	}
@@ -407,44 +1084,155 @@ func (npylm *NPYLM) backward(sent []string, forwardScore forwardScoreType, sampl
 	for i, samplingWord := range samplingWordSeq {
 		samplingWordReverse[(len(samplingWordSeq)-1)-i] = samplingWord
 	}
-	return samplingWordReverse
+	return samplingWordReverse, walkScore, true
+}
+
+// nbestViterbi returns the nbest segmentations by k-best Viterbi algorithm.
+// lattice[t][k*historySize+h] is the k-best list of the state forwardScore[t][k][h].
+func (npylm *NPYLM) nbestViterbi(sent []string, constraint *SentConstraint, nbest int) []NbestSegmentation {
+	if len(sent) == 0 {
+		return []NbestSegmentation{{WordSeq: make([]string, 0, 0), Score: 0.0}}
+	}
+	historySize := npylm.historySize()
+	lattice := make([][][]nbestEntry, len(sent), len(sent))
+	spans := npylm.newSpanWords(sent)
+	charBases := npylm.calcSpanCharBases(spans)
+	word := string("")
+	base := float64(0.0)
+	for t := 0; t < len(sent); t++ {
+		lattice[t] = make([][]nbestEntry, npylm.maxWordLength*historySize, npylm.maxWordLength*historySize)
+		for k := 0; k < npylm.maxWordLength; k++ {
+			if t-k >= 0 && constraint.allowWord(t-k, t) {
+				word = spans.word(t-k, t)
+				base = npylm.mixDictionaryBase(word, charBases[t][k])
+			} else {
+				continue
+			}
+			for h := 0; h < historySize; h++ {
+				lengths := npylm.decodeHistory(h)
+				if t-k == 0 {
+					u, ok := npylm.makeContext(sent, t-k-1, append(lengths, npylm.maxWordLength))
+					if !ok {
+						continue
+					}
+					score, _ := npylm.CalcProb(word, u, base)
+					lattice[t][k*historySize+h] = []nbestEntry{{math.Log(score), -1, -1}}
+					continue
+				}
+				entries := make([]nbestEntry, 0, nbest*(npylm.maxWordLength+1))
+				for j := 0; j < npylm.maxWordLength+1; j++ {
+					contextLengths := append(lengths, j)
+					u, ok := npylm.makeContext(sent, t-k-1, contextLengths)
+					if !ok {
+						continue
+					}
+					prevState := contextLengths[0]*historySize + npylm.encodeHistory(contextLengths[1:])
+					prevEntries := lattice[t-(k+1)][prevState]
+					if len(prevEntries) == 0 {
+						continue
+					}
+					score, _ := npylm.CalcProb(word, u, base)
+					for r, prevEntry := range prevEntries {
+						entries = append(entries, nbestEntry{math.Log(score) + prevEntry.score, prevState, r})
+					}
+				}
+				lattice[t][k*historySize+h] = selectNbest(entries, nbest)
+			}
+		}
+	}
+
+	// eos
+	t := len(sent) - 1
+	entries := make([]nbestEntry, 0, nbest*npylm.maxWordLength*historySize)
+	for k := 0; k < npylm.maxWordLength; k++ {
+		for h := 0; h < historySize; h++ {
+			state := k*historySize + h
+			if len(lattice[t][state]) == 0 {
+				continue
+			}
+			score := npylm.calcEosScore(sent, k, h)
+			if math.IsInf(score, -1) {
+				continue
+			}
+			for r, prevEntry := range lattice[t][state] {
+				entries = append(entries, nbestEntry{score + prevEntry.score, state, r})
+			}
+		}
+	}
+	entries = selectNbest(entries, nbest)
+
+	nbestSegmentations := make([]NbestSegmentation, len(entries), len(entries))
+	for n, entry := range entries {
+		wordSeqReverse := make([]string, 0, len(sent))
+		t := len(sent) - 1
+		state := entry.prevState
+		r := entry.prevRank
+		for state != -1 {
+			k := state / historySize
+			wordSeqReverse = append(wordSeqReverse, strings.Join(sent[(t-k):t+1], npylm.splitter))
+			prevEntry := lattice[t][state][r]
+			t = t - (k + 1)
+			state = prevEntry.prevState
+			r = prevEntry.prevRank
+		}
+		wordSeq := make([]string, len(wordSeqReverse), len(wordSeqReverse))
+		for i, w := range wordSeqReverse {
+			wordSeq[(len(wordSeqReverse)-1)-i] = w
+		}
+		nbestSegmentations[n] = NbestSegmentation{WordSeq: wordSeq, Score: entry.score}
+	}
+	return nbestSegmentations
+}
+
+// matchLengths returns whether known lengths are a prefix of contextLengths.
+func (npylm *NPYLM) matchLengths(contextLengths []int, known []int) bool {
+	for m, length := range known {
+		if contextLengths[m] != length {
+			return false
+		}
+	}
+	return true
 }
 
 func (npylm *NPYLM) addWordSeqAsCustomer(wordSeq context) {
-	u := make(context, npylm.maxNgram-1, npylm.maxNgram-1)
+	u := make(context, 0, npylm.maxNgram-1)
+	for n := 0; n < npylm.maxNgram-1; n++ {
+		u = append(u, npylm.bos)
+	}
 	base := float64(0.0)
-	for i, word := range wordSeq {
+	for _, word := range wordSeq {
 		base = npylm.calcBase(word)
-		if i == 0 {
-			u[0] = npylm.bos
-		} else {
-			u[0] = wordSeq[i-1]
-		}
-		npylm.AddCustomer(word, u, base, npylm.addCustomerBase)
+		npylm.addCustomer(word, u, base, npylm.addCustomerBase)
+		u = append(u[1:], word)
 	}
 
-	u[0] = wordSeq[len(wordSeq)-1]
 	base = npylm.vpylm.hpylm.Base
-	npylm.AddCustomer(npylm.eos, u, base, npylm.addCustomerBaseNull)
+	npylm.addCustomer(npylm.eos, u, base, npylm.addCustomerBaseNull)
 }
 
-func (npylm *NPYLM) removeWordSeqAsCustomer(wordSeq context) {
-	u := make(context, npylm.maxNgram-1, npylm.maxNgram-1)
-	for i, word := range wordSeq {
-		if i == 0 {
-			u[0] = npylm.bos
-		} else {
-			u[0] = wordSeq[i-1]
+func (npylm *NPYLM) removeWordSeqAsCustomer(wordSeq context) error {
+	u := make(context, 0, npylm.maxNgram-1)
+	for n := 0; n < npylm.maxNgram-1; n++ {
+		u = append(u, npylm.bos)
+	}
+	for _, word := range wordSeq {
+		if err := npylm.RemoveCustomer(word, u, npylm.removeCustomerBase); err != nil {
+			return err
 		}
-		npylm.RemoveCustomer(word, u, npylm.removeCustomerBase)
+		u = append(u[1:], word)
 	}
 
-	u[0] = wordSeq[len(wordSeq)-1]
-	npylm.RemoveCustomer(npylm.eos, u, npylm.removeCustomerBaseNull)
+	return npylm.RemoveCustomer(npylm.eos, u, npylm.removeCustomerBaseNull)
 }
 
-// Initialize initializes parameters.
-func (npylm *NPYLM) Initialize(dataContainer *DataContainer) {
+// Initialize initializes parameters. it returns ErrFormat if the partial annotations of dataContainer cannot be satisfied (see SentConstraint.check).
+func (npylm *NPYLM) Initialize(dataContainer *DataContainer) error {
+	if npylm.frozen != nil {
+		return fmt.Errorf("%w. Initialize of NPYLM", ErrFrozen)
+	}
+	if err := checkConstraints(dataContainer.Constraints, npylm.maxWordLength, 0); err != nil {
+		return err
+	}
 	sents := dataContainer.Sents
 	samplingWordSeqs := dataContainer.SamplingWordSeqs
 	for i := 0; i < len(sents); i++ {
@@ -463,14 +1251,32 @@ func (npylm *NPYLM) Initialize(dataContainer *DataContainer) {
 		// 	}
 		// }
 		// あとで直す
-		samplingWordSeqs[i] = append(samplingWordSeqs[i], strings.Join(sent, npylm.splitter))
+		// the sentence is split only at forced word boundaries if it has partial annotations
+		constraint := dataContainer.GetConstraint(i)
+		for start := 0; start < len(sent); {
+			end := constraint.nextForcedBoundary(start, len(sent))
+			samplingWordSeqs[i] = append(samplingWordSeqs[i], strings.Join(sent[start:end], npylm.splitter))
+			start = end
+		}
 		npylm.addWordSeqAsCustomer(samplingWordSeqs[i])
 	}
-	return
+	return nil
 }
 
 // InitializeFromAnnotatedData initializes parameters from annotated texts.
-func (npylm *NPYLM) InitializeFromAnnotatedData(dataContainer *DataContainer) {
+func (npylm *NPYLM) InitializeFromAnnotatedData(dataContainer *DataContainer) error {
+	return npylm.InitializeFromAnnotatedDataWithWeight(dataContainer, 1)
+}
+
+// InitializeFromAnnotatedDataWithWeight initializes parameters from annotated texts, and each sentence is added weight times as customers.
+// the annotated texts are not resampled by TrainWordSegmentation of other unsegmented texts, so they can be used for semi-supervised training.
+func (npylm *NPYLM) InitializeFromAnnotatedDataWithWeight(dataContainer *DataContainer, weight int) error {
+	if npylm.frozen != nil {
+		return fmt.Errorf("%w. InitializeFromAnnotatedData of NPYLM", ErrFrozen)
+	}
+	if weight <= 0 {
+		return fmt.Errorf("%w. weight should be bigger than 0", ErrInvalidParameter)
+	}
 	sents := dataContainer.Sents
 	samplingWordSeqs := dataContainer.SamplingWordSeqs
 	for i := 0; i < len(samplingWordSeqs); i++ {
@@ -497,24 +1303,26 @@ func (npylm *NPYLM) InitializeFromAnnotatedData(dataContainer *DataContainer) {
 			}
 		}
 		samplingWordSeqs[i] = adjustedSamplingWordSeq
-		npylm.addWordSeqAsCustomer(samplingWordSeqs[i])
+		for w := 0; w < weight; w++ {
+			npylm.addWordSeqAsCustomer(samplingWordSeqs[i])
+		}
 	}
-	return
+	return nil
 }
 
 func (npylm *NPYLM) poissonCorrection() {
-	_, ok := npylm.restaurants[""]
+	rst, ok := npylm.restaurantOf(context{})
 	if !ok {
 		return
 	}
 	a := float64(1.0)
 	b := float64(1.0)
-	for word, totalTableCount := range npylm.restaurants[""].totalTableCountForCustomer {
-		sliceWord := strings.Split(word, npylm.splitter)
+	for word, totalTableCount := range rst.totalTableCountForCustomer {
+		sliceWord := strings.Split(npylm.word(word), npylm.splitter)
 		a += (float64(totalTableCount) * float64(len(sliceWord)))
 		b += float64(totalTableCount)
 	}
-	g := distuv.Gamma{}
+	g := distuv.Gamma{Src: randSource{npylm.rnd}}
 	g.Alpha = float64(a)
 	g.Beta = float64(b)
 	npylm.poisson.Lambda = g.Rand()
@@ -524,11 +1332,13 @@ func (npylm *NPYLM) poissonCorrection() {
 		length2count[k] = 1
 	}
 
-	charVocabSize := len(npylm.vpylm.hpylm.restaurants[""].totalTableCountForCustomer)
+	charRst, _ := npylm.vpylm.hpylm.restaurantOf(context{})
+	charVocabSize := len(charRst.totalTableCountForCustomer)
 	chars := make([]string, 0, charVocabSize)
-	for char := range npylm.vpylm.hpylm.restaurants[""].totalTableCountForCustomer {
-		chars = append(chars, char)
+	for char := range charRst.totalTableCountForCustomer {
+		chars = append(chars, npylm.vpylm.hpylm.word(char))
 	}
+	sort.Strings(chars)
 	sampleSize := 10000
 	for i := 0; i < sampleSize; i++ {
 		k := -1
@@ -550,7 +1360,7 @@ func (npylm *NPYLM) poissonCorrection() {
 				probArray[charIndex] = prob
 				sumScore += prob
 			}
-			r := rand.Float64() * sumScore
+			r := npylm.rnd.Float64() * sumScore
 			sumScore = 0.0
 			charIndex := 0
 			for _, prob := range probArray {
@@ -584,19 +1394,25 @@ func (npylm *NPYLM) poissonCorrection() {
 }
 
 // Train train n-gram parameters from given word sequences.
-func (npylm *NPYLM) Train(dataContainer *DataContainer) {
+func (npylm *NPYLM) Train(dataContainer *DataContainer) error {
+	if npylm.frozen != nil {
+		return fmt.Errorf("%w. Train of NPYLM", ErrFrozen)
+	}
 	removeFlag := true
-	if len(npylm.vpylm.hpylm.restaurants) == 0 { // epoch == 0
+	if npylm.vpylm.hpylm.restaurantCount == 0 { // epoch == 0
 		removeFlag = false
 	}
 	bar := pb.StartNew(dataContainer.Size)
-	randIndexes := rand.Perm(dataContainer.Size)
+	randIndexes := npylm.rnd.Perm(dataContainer.Size)
 	for i := 0; i < dataContainer.Size; i++ {
 		bar.Add(1)
 		r := randIndexes[i]
 		wordSeq := dataContainer.SamplingWordSeqs[r]
 		if removeFlag {
-			npylm.removeWordSeqAsCustomer(wordSeq)
+			if err := npylm.removeWordSeqAsCustomer(wordSeq); err != nil {
+				bar.Finish()
+				return err
+			}
 		}
 		npylm.addWordSeqAsCustomer(wordSeq)
 	}
@@ -604,7 +1420,7 @@ func (npylm *NPYLM) Train(dataContainer *DataContainer) {
 	// npylm.poissonCorrection()
 	npylm.estimateHyperPrameters()
 	npylm.vpylm.hpylm.estimateHyperPrameters()
-	return
+	return nil
 }
 
 // ReturnNgramProb returns n-gram probability.
@@ -621,6 +1437,29 @@ func (npylm *NPYLM) ReturnMaxN() int {
 	return npylm.maxNgram
 }
 
+// Freeze makes npylm inference-only with much lower memory (see HPYLM.Freeze).
+func (npylm *NPYLM) Freeze() {
+	npylm.freeze(newSymbolTable())
+}
+
+func (npylm *NPYLM) freeze(vocab *symbolTable) {
+	npylm.HPYLM.freeze(vocab)
+	npylm.vpylm.hpylm.freeze(vocab)
+	// sampled depths are used only to remove customers
+	npylm.word2sampledDepthMemory = make(map[string][][]int)
+}
+
+// SetRandSeed sets the seed of the random number generator used for sampling.
+func (npylm *NPYLM) SetRandSeed(seed int64) {
+	npylm.setRand(newSplitMix64(seed))
+}
+
+// the word HPYLM and the character VPYLM share the random source.
+func (npylm *NPYLM) setRand(src *splitMix64) {
+	npylm.HPYLM.setRand(src)
+	npylm.vpylm.setRand(src)
+}
+
 // Save returns json.Marshal(npylmJSON) and npylmJSON.
 // npylmJSON is struct to save. its variables can be exported.
 func (npylm *NPYLM) save() ([]byte, interface{}) {
@@ -628,11 +1467,11 @@ func (npylm *NPYLM) save() ([]byte, interface{}) {
 		hPYLMJSON: &hPYLMJSON{Restaurants: func(rsts map[string]*restaurant) map[string]*restaurantJSON {
 			rstsJSON := make(map[string]*restaurantJSON)
 			for key, rst := range rsts {
-				_, rstJSON := rst.save()
+				_, rstJSON := rst.save(npylm.contexts.symbols)
 				rstsJSON[key] = rstJSON
 			}
 			return rstsJSON
-		}(npylm.restaurants),
+		}(npylm.restaurantMap()),
 
 			MaxDepth: npylm.maxDepth,
 			Theta:    npylm.theta,
@@ -670,6 +1509,9 @@ func (npylm *NPYLM) save() ([]byte, interface{}) {
 			}
 			return word2sampledDepthMemory
 		}(npylm),
+
+		Dictionary:       npylm.dictionary,
+		DictionaryWeight: npylm.dictionaryWeight,
 	}
 	v, err := json.Marshal(&npylmJSON)
 	if err != nil {
@@ -679,22 +1521,23 @@ func (npylm *NPYLM) save() ([]byte, interface{}) {
 }
 
 // Load npylm.
-func (npylm *NPYLM) load(v []byte) {
+func (npylm *NPYLM) load(v []byte) error {
 	npylmJSON := &nPYLMJSON{hPYLMJSON: &hPYLMJSON{Restaurants: make(map[string]*restaurantJSON)}}
 	err := json.Unmarshal(v, &npylmJSON)
 	if err != nil {
-		panic("load error in NPYLM")
+		return fmt.Errorf("%w. load error in NPYLM: %v", ErrFormat, err)
 	}
 	// load npylm.restaurants
 	// 一度map[string]*restaurantJSON を作ってから代入だとエラーになる (nil pointer)
+	npylm.resetRestaurants()
 	for key, rstJSON := range npylmJSON.Restaurants {
 		rstV, err := json.Marshal(&rstJSON)
 		if err != nil {
 			panic("load error in load restaurants in HPYLM")
 		}
 		rst := newRestaurant()
-		rst.load(rstV)
-		npylm.restaurants[key] = rst
+		rst.load(rstV, npylm.contexts.symbols)
+		npylm.setRestaurantOf(key, rst)
 	}
 
 	npylm.maxDepth = npylmJSON.MaxDepth
@@ -710,7 +1553,9 @@ func (npylm *NPYLM) load(v []byte) {
 	if err != nil {
 		panic("load error in load vpylm in NPYLM")
 	}
-	npylm.vpylm.load(vpylmV)
+	if err := npylm.vpylm.load(vpylmV); err != nil {
+		return err
+	}
 
 	npylm.maxNgram = npylmJSON.MaxNgram
 	npylm.maxWordLength = npylmJSON.MaxWordLength
@@ -729,7 +1574,103 @@ func (npylm *NPYLM) load(v []byte) {
 		}
 		return word2sampledDepthMemory
 	}(npylmJSON)
-	return
+
+	npylm.dictionary = npylmJSON.Dictionary
+	npylm.dictionaryWeight = npylmJSON.DictionaryWeight
+	return nil
+}
+
+// saveBinary writes npylm in binary format.
+func (npylm *NPYLM) saveBinary(bw *binaryWriter) {
+	npylm.HPYLM.saveBinary(bw)
+	npylm.vpylm.saveBinary(bw)
+
+	bw.writeInt(npylm.maxNgram)
+	bw.writeInt(npylm.maxWordLength)
+	bw.writeString(npylm.bos)
+	bw.writeString(npylm.eos)
+	bw.writeString(npylm.bow)
+	bw.writeString(npylm.eow)
+	bw.writeString(npylm.splitter)
+
+	bw.writeFloat(npylm.poisson.Lambda)
+	bw.writeFloats(npylm.length2prob)
+	words := make([]string, 0, len(npylm.word2sampledDepthMemory))
+	for word := range npylm.word2sampledDepthMemory {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	bw.writeUvarint(uint64(len(words)))
+	for _, word := range words {
+		bw.writeWord(word)
+		bw.writeUvarint(uint64(len(npylm.word2sampledDepthMemory[word])))
+		for _, sampledDepthMemory := range npylm.word2sampledDepthMemory[word] {
+			bw.writeInts(sampledDepthMemory)
+		}
+	}
+
+	// nil dictionary is distinguished from empty one
+	bw.writeBool(npylm.dictionary != nil)
+	if npylm.dictionary != nil {
+		words := make([]string, 0, len(npylm.dictionary))
+		for word := range npylm.dictionary {
+			words = append(words, word)
+		}
+		sort.Strings(words)
+		bw.writeUvarint(uint64(len(words)))
+		for _, word := range words {
+			bw.writeWord(word)
+			bw.writeFloat(npylm.dictionary[word])
+		}
+	}
+	bw.writeFloat(npylm.dictionaryWeight)
+}
+
+// loadBinary reads npylm written by saveBinary.
+func (npylm *NPYLM) loadBinary(br *binaryReader) error {
+	if err := npylm.HPYLM.loadBinary(br); err != nil {
+		return err
+	}
+	if err := npylm.vpylm.loadBinary(br); err != nil {
+		return err
+	}
+
+	npylm.maxNgram = br.readInt()
+	npylm.maxWordLength = br.readInt()
+	npylm.bos = br.readString()
+	npylm.eos = br.readString()
+	npylm.bow = br.readString()
+	npylm.eow = br.readString()
+	npylm.splitter = br.readString()
+
+	npylm.poisson = distuv.Poisson{Lambda: br.readFloat()}
+	npylm.length2prob = br.readFloats()
+	n := br.readLength()
+	npylm.word2sampledDepthMemory = make(map[string][][]int, capacityHint(n))
+	for i := 0; i < n && br.err == nil; i++ {
+		word := br.readWord()
+		memoriesLen := br.readLength()
+		sampledDepthMemories := make([][]int, 0, capacityHint(memoriesLen))
+		for j := 0; j < memoriesLen && br.err == nil; j++ {
+			sampledDepthMemories = append(sampledDepthMemories, br.readInts())
+		}
+		npylm.word2sampledDepthMemory[word] = sampledDepthMemories
+	}
+
+	npylm.dictionary = nil
+	if br.readBool() {
+		n := br.readLength()
+		npylm.dictionary = make(map[string]float64, capacityHint(n))
+		for i := 0; i < n && br.err == nil; i++ {
+			word := br.readWord()
+			npylm.dictionary[word] = br.readFloat()
+		}
+	}
+	npylm.dictionaryWeight = br.readFloat()
+	if br.err != nil {
+		return fmt.Errorf("%w. load error in NPYLM: %v", ErrFormat, br.err)
+	}
+	return nil
 }
 
 // ShowParameters shows hyperparameters of this model.
@@ -3,6 +3,8 @@ package bayselm
 import (
 	"math"
 	"math/rand"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -25,18 +27,28 @@ func TestNPYLM(t *testing.T) {
 	epoch = 2
 	batch = 128
 	threads = 1
-	npylm := NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 1, "")
+	npylm, err := NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	dataContainerForTrain := NewDataContainer("../data/alice.raw", "", 128)
+	dataContainerForTrain, err := NewDataContainer("../data/alice.raw", "", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
 	npylm.Initialize(dataContainerForTrain)
 	for e := 0; e < epoch; e++ {
-		npylm.TrainWordSegmentation(dataContainerForTrain, threads, batch)
+		if err := npylm.TrainWordSegmentation(dataContainerForTrain, threads, batch); err != nil {
+			t.Fatal(err)
+		}
 	}
 	for i := 0; i < dataContainerForTrain.Size; i++ {
-		npylm.removeWordSeqAsCustomer(dataContainerForTrain.SamplingWordSeqs[i])
+		if err := npylm.removeWordSeqAsCustomer(dataContainerForTrain.SamplingWordSeqs[i]); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if !(len(npylm.restaurants) == 0) {
-		t.Error("len(npylm.restaurants) is not 0", npylm.restaurants)
+	if !(npylm.restaurantCount == 0) {
+		t.Error("len(npylm.restaurants) is not 0", npylm.restaurantMap())
 	}
 	if !(len(npylm.word2sampledDepthMemory) == 0) {
 		t.Error("len(word2sampledDepthMemory) is not 0", npylm.word2sampledDepthMemory)
@@ -62,15 +74,32 @@ func TestPerformanceOfNPYLM(t *testing.T) {
 	d = 0.1
 	epoch = 5
 	var hpylm NgramLM
-	hpylm = NewHPYLM(maxN-1, theta, d, 1.0, 1.0, 1.0, 1.0, base)
+	var err error
+	hpylm, err = NewHPYLM(maxN-1, theta, d, 1.0, 1.0, 1.0, 1.0, base)
+	if err != nil {
+		t.Fatal(err)
+	}
 	var npylm NgramLM
-	npylm = NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 30, "")
+	npylm, err = NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 30, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	dataContainerForTrain := NewDataContainerFromAnnotatedData("../alice.train.txt")
-	dataContainerForTest := NewDataContainerFromAnnotatedData("../alice.test.txt")
+	dataContainerForTrain, err := NewDataContainerFromAnnotatedData("../alice.train.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataContainerForTest, err := NewDataContainerFromAnnotatedData("../alice.test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
 	for e := 0; e < epoch; e++ {
-		hpylm.Train(dataContainerForTrain)
-		npylm.Train(dataContainerForTrain)
+		if err := hpylm.Train(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
+		if err := npylm.Train(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	perplexityOfHpylm := CalcPerplexity(hpylm, dataContainerForTest)
@@ -79,3 +108,417 @@ func TestPerformanceOfNPYLM(t *testing.T) {
 		t.Error("probably error! a perplexity of NPYLM is expected to be lower than a perplexity of HPYLM. ", "perplexityOfNpylm = ", perplexityOfNpylm, "perplexityOfHpylm = ", perplexityOfHpylm)
 	}
 }
+
+func TestNPYLMTrigram(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	var theta float64
+	var d float64
+	var epoch int
+	var maxN int
+	var batch int
+	var threads int
+	var alpha float64
+	var beta float64
+	alpha = 1.0
+	beta = 1.0
+	maxN = 3
+	theta = 1.0
+	d = 0.1
+	epoch = 3
+	batch = 2
+	threads = 2
+	npylm, err := NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	npylm.Initialize(dataContainerForTrain)
+	for e := 0; e < epoch; e++ {
+		if err := npylm.TrainWordSegmentation(dataContainerForTrain, threads, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wordSeqs, err := npylm.TestWordSegmentation(dataContainerForTrain.Sents, threads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, wordSeq := range wordSeqs {
+		if !(strings.Join(wordSeq, "") == strings.Join(dataContainerForTrain.Sents[i], "")) {
+			t.Error("segmentation does not cover the sentence", wordSeq, dataContainerForTrain.Sents[i])
+		}
+		if !(strings.Join(dataContainerForTrain.SamplingWordSeqs[i], "") == strings.Join(dataContainerForTrain.Sents[i], "")) {
+			t.Error("sampled segmentation does not cover the sentence", dataContainerForTrain.SamplingWordSeqs[i], dataContainerForTrain.Sents[i])
+		}
+	}
+	for i := 0; i < dataContainerForTrain.Size; i++ {
+		if err := npylm.removeWordSeqAsCustomer(dataContainerForTrain.SamplingWordSeqs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !(npylm.restaurantCount == 0) {
+		t.Error("len(npylm.restaurants) is not 0", npylm.restaurantMap())
+	}
+	if !(len(npylm.word2sampledDepthMemory) == 0) {
+		t.Error("len(word2sampledDepthMemory) is not 0", npylm.word2sampledDepthMemory)
+	}
+}
+
+func TestNPYLMCalcSentScore(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	for _, maxN := range []int{2, 3} {
+		maxWordLength := 3
+		npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, maxWordLength, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		npylm.Initialize(dataContainerForTrain)
+		if err := npylm.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		// sum of probabilities of all segmentations
+		sent := dataContainerForTrain.Sents[0]
+		if len(sent) > 6 {
+			sent = sent[:6]
+		}
+		scores := make([]float64, 0, 0)
+		for _, wordSeq := range enumerateSegmentations(sent, maxWordLength) {
+			scores = append(scores, calcSegmentationScoreForTest(npylm, wordSeq))
+		}
+		sentScore := npylm.CalcSentScore(sent)
+		if !(math.Abs(sentScore-npylm.logsumexp(scores)) < 1e-6) {
+			t.Error("sentScore = ", sentScore, "sum of segmentations = ", npylm.logsumexp(scores))
+		}
+
+		bitsPerCharacter, err := CalcBitsPerCharacter(npylm, [][]string{sent}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(math.Abs(bitsPerCharacter+sentScore/math.Ln2/float64(len(sent)+1)) < 1e-6) {
+			t.Error("bitsPerCharacter = ", bitsPerCharacter)
+		}
+	}
+}
+
+// enumerateSegmentations returns all segmentations of sent whose words are not longer than maxWordLength.
+func enumerateSegmentations(sent []string, maxWordLength int) []context {
+	wordSeqs := make([]context, 0, 0)
+	for b := 0; b < 1<<uint(len(sent)-1); b++ {
+		wordSeq := make(context, 0, len(sent))
+		start := 0
+		ok := true
+		for i := 1; i <= len(sent); i++ {
+			if i == len(sent) || b&(1<<uint(i-1)) != 0 {
+				if i-start > maxWordLength {
+					ok = false
+				}
+				wordSeq = append(wordSeq, strings.Join(sent[start:i], ""))
+				start = i
+			}
+		}
+		if ok {
+			wordSeqs = append(wordSeqs, wordSeq)
+		}
+	}
+	return wordSeqs
+}
+
+// calcSegmentationScoreForTest returns log probability of wordSeq including eos.
+func calcSegmentationScoreForTest(npylm *NPYLM, wordSeq context) float64 {
+	u := make(context, 0, npylm.maxNgram-1)
+	for n := 0; n < npylm.maxNgram-1; n++ {
+		u = append(u, npylm.bos)
+	}
+	for _, word := range wordSeq {
+		u = append(u[1:], word)
+	}
+	eosScore, _ := npylm.CalcProb(npylm.eos, u, npylm.vpylm.hpylm.Base)
+	return npylm.CalcWordSeqScore(wordSeq) + math.Log(eosScore)
+}
+
+func TestNPYLMNbestWordSegmentation(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	for _, maxN := range []int{2, 3} {
+		maxWordLength := 3
+		nbest := 5
+		npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, maxWordLength, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		npylm.Initialize(dataContainerForTrain)
+		if err := npylm.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		sents := [][]string{dataContainerForTrain.Sents[0][:6], dataContainerForTrain.Sents[1][:2]}
+		nbestSegmentations, err := npylm.TestNbestWordSegmentation(sents, nil, nbest, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, sent := range sents {
+			// the nbest scores equal the best scores of all segmentations
+			scores := make([]float64, 0, 0)
+			for _, wordSeq := range enumerateSegmentations(sent, maxWordLength) {
+				scores = append(scores, calcSegmentationScoreForTest(npylm, wordSeq))
+			}
+			sort.Sort(sort.Reverse(sort.Float64Slice(scores)))
+			if len(scores) > nbest {
+				scores = scores[:nbest]
+			}
+			if !(len(nbestSegmentations[i]) == len(scores)) {
+				t.Error("expected = ", len(scores), "but return ", len(nbestSegmentations[i]))
+				continue
+			}
+			for n, nbestSegmentation := range nbestSegmentations[i] {
+				if !(strings.Join(nbestSegmentation.WordSeq, "") == strings.Join(sent, "")) {
+					t.Error("segmentation does not cover the sentence", nbestSegmentation.WordSeq, sent)
+				}
+				if !(math.Abs(nbestSegmentation.Score-scores[n]) < 1e-6) {
+					t.Error("expected = ", scores[n], "but return ", nbestSegmentation.Score)
+				}
+				if !(math.Abs(nbestSegmentation.Score-calcSegmentationScoreForTest(npylm, nbestSegmentation.WordSeq)) < 1e-6) {
+					t.Error("score of ", nbestSegmentation.WordSeq, "is wrong", nbestSegmentation.Score)
+				}
+			}
+		}
+	}
+}
+
+// segmentationBoundaries returns whether a word boundary is after each character except the last one.
+func segmentationBoundaries(wordSeq context) []bool {
+	boundaries := make([]bool, 0, 0)
+	for _, word := range wordSeq {
+		for i := 0; i < len([]rune(word))-1; i++ {
+			boundaries = append(boundaries, false)
+		}
+		boundaries = append(boundaries, true)
+	}
+	return boundaries[:len(boundaries)-1]
+}
+
+func TestNPYLMCalcBoundaryMarginals(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	for _, maxN := range []int{2, 3} {
+		maxWordLength := 3
+		npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, maxWordLength, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		npylm.Initialize(dataContainerForTrain)
+		if err := npylm.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		sent := dataContainerForTrain.Sents[0][:6]
+		wordSeqs := enumerateSegmentations(sent, maxWordLength)
+		scores := make([]float64, len(wordSeqs), len(wordSeqs))
+		for i, wordSeq := range wordSeqs {
+			scores[i] = calcSegmentationScoreForTest(npylm, wordSeq)
+		}
+		sentScore := npylm.logsumexp(scores)
+		expected := make([]float64, len(sent)-1, len(sent)-1)
+		for i, wordSeq := range wordSeqs {
+			for b, isBoundary := range segmentationBoundaries(wordSeq) {
+				if isBoundary {
+					expected[b] += math.Exp(scores[i] - sentScore)
+				}
+			}
+		}
+		boundaryMarginalsSlice, err := npylm.TestBoundaryMarginals([][]string{sent}, nil, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		boundaryMarginals := boundaryMarginalsSlice[0]
+		if !(len(boundaryMarginals) == len(expected)) {
+			t.Error("expected = ", expected, "but return ", boundaryMarginals)
+			continue
+		}
+		for b := range expected {
+			if !(math.Abs(boundaryMarginals[b]-expected[b]) < 1e-6) {
+				t.Error("expected = ", expected, "but return ", boundaryMarginals)
+				break
+			}
+		}
+	}
+}
+
+func TestNPYLMRandSeed(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	train := func(seed int64) ([]byte, [][]string) {
+		npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		npylm.SetRandSeed(seed)
+		dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		npylm.Initialize(dataContainer)
+		for e := 0; e < 3; e++ {
+			if err := npylm.TrainWordSegmentation(dataContainer, 4, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wordSeqs, err := npylm.SampleWordSegmentation(dataContainer.Sents, nil, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _ := npylm.save()
+		return v, wordSeqs
+	}
+
+	// the same seed and the same number of threads give the same model
+	v1, wordSeqs1 := train(1)
+	v2, wordSeqs2 := train(1)
+	if string(v1) != string(v2) {
+		t.Error("models trained with the same seed are different")
+	}
+	for i := range wordSeqs1 {
+		if strings.Join(wordSeqs1[i], " ") != strings.Join(wordSeqs2[i], " ") {
+			t.Error("expected = ", wordSeqs1[i], "but return ", wordSeqs2[i])
+		}
+	}
+}
+
+func TestNPYLMMetropolisHastings(t *testing.T) {
+	for _, maxN := range []int{2, 3} {
+		maxWordLength := 3
+		npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, maxWordLength, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the seed is fixed, so that the number of accepted samples is the same in every run
+		npylm.SetRandSeed(2)
+		npylm.SetMetropolisHastings(true)
+		dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := npylm.Initialize(dataContainer); err != nil {
+			t.Fatal(err)
+		}
+		for e := 0; e < 2; e++ {
+			if err := npylm.TrainWordSegmentation(dataContainer, 2, 4); err != nil {
+				t.Fatal(err)
+			}
+			stats := npylm.ReturnAcceptanceStats()
+			if !(stats.Proposed == dataContainer.Size && 0 < stats.Accepted && stats.Accepted <= stats.Proposed) {
+				t.Error("wrong acceptance stats ", stats)
+			}
+		}
+
+		// the proposal probabilities of all segmentations sum to 1
+		sent := dataContainer.Sents[0][:6]
+		forwardScore := npylm.forward(sent, nil)
+		sumProb := 0.0
+		for _, wordSeq := range enumerateSegmentations(sent, maxWordLength) {
+			sumProb += math.Exp(npylm.calcProposalScore(sent, forwardScore, wordSeq))
+			if score := npylm.calcWordSeqScoreWithEos(wordSeq); !(math.Abs(score-calcSegmentationScoreForTest(npylm, wordSeq)) < 1e-9) {
+				t.Error("expected = ", calcSegmentationScoreForTest(npylm, wordSeq), "but return ", score)
+			}
+		}
+		if !(math.Abs(sumProb-1.0) < 1e-6) {
+			t.Error("expected = 1, but return ", sumProb)
+		}
+		if score := npylm.calcProposalScore(sent, forwardScore, context{strings.Join(sent, "")}); !math.IsInf(score, -1) {
+			t.Error("expected = -inf, but return ", score)
+		}
+	}
+}
+
+func TestNPYLMCharBaseCache(t *testing.T) {
+	train := func(cacheSize int) (*NPYLM, *DataContainer, []byte) {
+		npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := npylm.SetCharBaseCacheSize(cacheSize); err != nil {
+			t.Fatal(err)
+		}
+		npylm.SetRandSeed(1)
+		dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		npylm.Initialize(dataContainer)
+		for e := 0; e < 2; e++ {
+			if err := npylm.TrainWordSegmentation(dataContainer, 2, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		v, _ := npylm.save()
+		return npylm, dataContainer, v
+	}
+
+	// the cache is invalidated whenever the character VPYLM is changed, so it gives the same model
+	cacheSize := 16
+	_, _, v1 := train(0)
+	npylm, dataContainer, v2 := train(cacheSize)
+	if string(v1) != string(v2) {
+		t.Error("models trained with and without the cache are different")
+	}
+	if npylm.charBaseCache.order.Len() > cacheSize || len(npylm.charBaseCache.words) > cacheSize {
+		t.Error("expected size of the cache <= ", cacheSize, "but return ", npylm.charBaseCache.order.Len())
+	}
+
+	// the probabilities extended character by character are the same as calcCharBase, with and without the cache
+	for _, size := range []int{0, cacheSize} {
+		if err := npylm.SetCharBaseCacheSize(size); err != nil {
+			t.Fatal(err)
+		}
+		for _, sent := range dataContainer.Sents {
+			spans := npylm.newSpanWords(sent)
+			charBases := npylm.calcSpanCharBases(spans)
+			for end := range sent {
+				for k := 0; k < npylm.maxWordLength && end-k >= 0; k++ {
+					word := spans.word(end-k, end)
+					if base := npylm.calcCharBase(word); charBases[end][k] != base {
+						t.Error("expected = ", base, "but return ", charBases[end][k], word)
+					}
+				}
+			}
+		}
+	}
+	if err := npylm.SetCharBaseCacheSize(-1); err == nil {
+		t.Error("expected error for negative size of the cache")
+	}
+}
+
+func BenchmarkNPYLMForward(b *testing.B) {
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 3, 4, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	npylm.SetRandSeed(1)
+	dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+	if err != nil {
+		b.Fatal(err)
+	}
+	npylm.Initialize(dataContainer)
+	if err := npylm.TrainWordSegmentation(dataContainer, 1, 128); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sent := range dataContainer.Sents {
+			npylm.forward(sent, nil)
+		}
+	}
+}
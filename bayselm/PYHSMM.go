@@ -5,14 +5,15 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/cheggaaa/pb/v3"
 )
 
-type forwardScoreForWordAndPosType [][][]float64
+// forwardScoreForWordAndPosType is forwardScore[t][k][pos][h].
+// t is the last character of a word, k+1 is its length, pos is its POS tag and h encodes the lengths and POS tags of the maxNgram-2 words before it (see PYHSMM.decodeHistory).
+type forwardScoreForWordAndPosType [][][][]float64
 
 // GenerativeFeatures .
 type GenerativeFeatures [][][][][]float64
@@ -32,35 +33,77 @@ type PYHSMM struct {
 	PosSize int
 	eosPos  int
 	bosPos  int
+
+	rnd       *rand.Rand  // random number generator for sampling (see SetRandSeed)
+	rndSource *splitMix64 // source of rnd. npylms and posHpylm share it
+
+	metropolisHastings bool            // see SetMetropolisHastings
+	acceptanceStats    AcceptanceStats // statistics of Metropolis-Hastings correction in the last TrainWordSegmentation
+
+	temperature float64 // temperature of sampling (see SetTemperature)
 }
 
 // NewPYHSMM returns PYHSMM instance.
-func NewPYHSMM(initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, PosSize int, splitter string) *PYHSMM {
+func NewPYHSMM(initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, PosSize int, splitter string) (*PYHSMM, error) {
+	if PosSize <= 0 {
+		return nil, fmt.Errorf("%w. range of PosSize is 1 to inf", ErrInvalidParameter)
+	}
+	if err := checkHistorySize(maxNgram, maxWordLength, PosSize); err != nil {
+		return nil, err
+	}
 
 	npylms := make([]*NPYLM, PosSize+1, PosSize+1)
 	for pos := 0; pos < PosSize+1; pos++ {
-		npylms[pos] = NewNPYLM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, splitter)
+		var err error
+		npylms[pos], err = NewNPYLM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, splitter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	posHpylm, err := NewHPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, 1.0/float64(PosSize+1))
+	if err != nil {
+		return nil, err
 	}
-	posHpylm := NewHPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, 1.0/float64(PosSize+1))
 
-	pyhsmm := &PYHSMM{npylms, posHpylm, maxNgram, maxWordLength, bos, "<EOS>", "<BOW>", "<EOW>", PosSize, PosSize, PosSize + 1}
+	pyhsmm := &PYHSMM{npylms, posHpylm, maxNgram, maxWordLength, bos, "<EOS>", "<BOW>", "<EOW>", PosSize, PosSize, PosSize + 1, nil, nil, false, AcceptanceStats{}, 1.0}
+	pyhsmm.setRand(posHpylm.rndSource)
 
+	return pyhsmm, nil
+}
+
+// newPYHSMMToLoad returns empty PYHSMM instance whose parameters are set by load.
+func newPYHSMMToLoad() *PYHSMM {
+	pyhsmm := &PYHSMM{posHpylm: newHPYLMToLoad(), temperature: 1.0}
+	pyhsmm.setRand(pyhsmm.posHpylm.rndSource)
 	return pyhsmm
 }
 
 // TrainWordSegmentation trains word segentation model and POS induction from unsegmnted texts without labeled data.
 // This is used for common interface of NPYLM.
-func (pyhsmm *PYHSMM) TrainWordSegmentation(dataContainer *DataContainer, threadsNum int, batchSize int) {
-	pyhsmm.TrainWordSegmentationAndPOSTagging(dataContainer, threadsNum, batchSize)
-	return
+func (pyhsmm *PYHSMM) TrainWordSegmentation(dataContainer *DataContainer, threadsNum int, batchSize int) error {
+	return pyhsmm.TrainWordSegmentationAndPOSTagging(dataContainer, threadsNum, batchSize)
 }
 
 // TrainWordSegmentationAndPOSTagging trains word segentation model and POS induction from unsegmnted texts without labeled data.
-func (pyhsmm *PYHSMM) TrainWordSegmentationAndPOSTagging(dataContainer *DataContainer, threadsNum int, batchSize int) {
+// the samples are corrected by Metropolis-Hastings if it is enabled (see SetMetropolisHastings).
+func (pyhsmm *PYHSMM) TrainWordSegmentationAndPOSTagging(dataContainer *DataContainer, threadsNum int, batchSize int) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. TrainWordSegmentation of PYHSMM", ErrFrozen)
+	}
+	if threadsNum <= 0 {
+		return fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if batchSize <= 0 {
+		return fmt.Errorf("%w. batchSize should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(dataContainer.Constraints, pyhsmm.maxWordLength, pyhsmm.PosSize); err != nil {
+		return err
+	}
 	ch := make(chan int, threadsNum)
 	wg := sync.WaitGroup{}
 	bar := pb.StartNew(dataContainer.Size)
-	randIndexes := rand.Perm(dataContainer.Size)
+	randIndexes := pyhsmm.rnd.Perm(dataContainer.Size)
+	pyhsmm.acceptanceStats = AcceptanceStats{}
 	for i := 0; i < dataContainer.Size; i += batchSize {
 		end := i + batchSize
 		if end > dataContainer.Size {
@@ -69,25 +112,54 @@ func (pyhsmm *PYHSMM) TrainWordSegmentationAndPOSTagging(dataContainer *DataCont
 		bar.Add(end - i)
 		for j := i; j < end; j++ {
 			r := randIndexes[j]
-			pyhsmm.removeWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r], dataContainer.SamplingPosSeqs[r])
+			if err := pyhsmm.removeWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r], dataContainer.SamplingPosSeqs[r]); err != nil {
+				bar.Finish()
+				return err
+			}
 		}
 		sampledWordSeqs := make([]context, end-i, end-i)
 		sampledPosSeqs := make([][]int, end-i, end-i)
+		logQNews := make([]float64, end-i, end-i)
+		logQOlds := make([]float64, end-i, end-i)
+		rnds := deriveRands(pyhsmm.rnd, end-i)
 		for j := i; j < end; j++ {
 			ch <- 1
 			wg.Add(1)
 			go func(j int) {
 				r := randIndexes[j]
 				sent := dataContainer.Sents[r]
-				forwardScore := pyhsmm.forward(sent)
-				sampledWordSeqs[j-i], sampledPosSeqs[j-i] = pyhsmm.backward(sent, forwardScore, true)
+				forwardScore := pyhsmm.forward(sent, dataContainer.GetConstraint(r))
+				sampledWordSeqs[j-i], sampledPosSeqs[j-i] = pyhsmm.backward(sent, forwardScore, true, rnds[j-i])
+				if pyhsmm.metropolisHastings {
+					logQNews[j-i] = pyhsmm.calcProposalScore(sent, forwardScore, sampledWordSeqs[j-i], sampledPosSeqs[j-i])
+					logQOlds[j-i] = pyhsmm.calcProposalScore(sent, forwardScore, dataContainer.SamplingWordSeqs[r], dataContainer.SamplingPosSeqs[r])
+				}
 				<-ch
 				wg.Done()
 			}(j)
 		}
 		wg.Wait()
+		if pyhsmm.metropolisHastings {
+			// the old segmentations are added again, so that each proposal is rescored with the counts of all the other sentences
+			for j := i; j < end; j++ {
+				r := randIndexes[j]
+				pyhsmm.addWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r], dataContainer.SamplingPosSeqs[r])
+			}
+		}
 		for j := i; j < end; j++ {
 			r := randIndexes[j]
+			if pyhsmm.metropolisHastings {
+				oldWordSeq, oldPosSeq := dataContainer.SamplingWordSeqs[r], dataContainer.SamplingPosSeqs[r]
+				if err := pyhsmm.removeWordSeqAsCustomer(oldWordSeq, oldPosSeq); err != nil {
+					bar.Finish()
+					return err
+				}
+				logPNew := pyhsmm.calcWordAndPosSeqScoreWithEos(sampledWordSeqs[j-i], sampledPosSeqs[j-i]) / pyhsmm.temperature
+				logPOld := pyhsmm.calcWordAndPosSeqScoreWithEos(oldWordSeq, oldPosSeq) / pyhsmm.temperature
+				if !pyhsmm.acceptanceStats.accept(logPNew, logPOld, logQNews[j-i], logQOlds[j-i], pyhsmm.rnd) {
+					sampledWordSeqs[j-i], sampledPosSeqs[j-i] = oldWordSeq, oldPosSeq
+				}
+			}
 			dataContainer.SamplingWordSeqs[r] = sampledWordSeqs[j-i]
 			dataContainer.SamplingPosSeqs[r] = sampledPosSeqs[j-i]
 			pyhsmm.addWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r], dataContainer.SamplingPosSeqs[r])
@@ -101,14 +173,71 @@ func (pyhsmm *PYHSMM) TrainWordSegmentationAndPOSTagging(dataContainer *DataCont
 		pyhsmm.npylms[pos].estimateHyperPrameters()
 	}
 	pyhsmm.posHpylm.estimateHyperPrameters()
-	return
+	return nil
+}
+
+// TrainWordSegmentationInShards trains word segentation model and POS induction by data-sharded parallel Gibbs sampling (see NPYLM.TrainWordSegmentationInShards).
+func (pyhsmm *PYHSMM) TrainWordSegmentationInShards(dataContainer *DataContainer, threadsNum int, mergeInterval int) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. TrainWordSegmentationInShards of PYHSMM", ErrFrozen)
+	}
+	if threadsNum <= 0 {
+		return fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if mergeInterval <= 0 {
+		return fmt.Errorf("%w. mergeInterval should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(dataContainer.Constraints, pyhsmm.maxWordLength, pyhsmm.PosSize); err != nil {
+		return err
+	}
+	if err := trainInShards(pyhsmm, dataContainer, threadsNum, mergeInterval, pyhsmm.rnd); err != nil {
+		return err
+	}
+
+	pyhsmm.npylms[0].vpylm.hpylm.estimateHyperPrameters()
+	for pos := 0; pos < pyhsmm.PosSize+1; pos++ {
+		pyhsmm.npylms[pos].estimateHyperPrameters()
+	}
+	pyhsmm.posHpylm.estimateHyperPrameters()
+	return nil
+}
+
+func (pyhsmm *PYHSMM) addShardSample(sample shardSample) {
+	pyhsmm.addWordSeqAsCustomer(sample.wordSeq, sample.posSeq)
+}
+
+func (pyhsmm *PYHSMM) removeShardSample(sample shardSample) error {
+	return pyhsmm.removeWordSeqAsCustomer(sample.wordSeq, sample.posSeq)
+}
+
+func (pyhsmm *PYHSMM) sampleShardSample(sent []string, constraint *SentConstraint) shardSample {
+	forwardScore := pyhsmm.forward(sent, constraint)
+	wordSeq, posSeq := pyhsmm.backward(sent, forwardScore, true, pyhsmm.rnd)
+	return shardSample{wordSeq, posSeq}
+}
+
+func (pyhsmm *PYHSMM) cloneShardSampler(seed int64) (shardSampler, error) {
+	clone := newPYHSMMToLoad()
+	if err := cloneByBinary(pyhsmm, clone); err != nil {
+		return nil, err
+	}
+	clone.SetRandSeed(seed)
+	clone.temperature = pyhsmm.temperature
+	return clone, nil
 }
 
 // TestWordSegmentation inferences word segmentation and their POS tags from input unsegmented texts, and returns word sequence.
 // This is used for common interface of NPYLM.
-func (pyhsmm *PYHSMM) TestWordSegmentation(sents [][]string, threadsNum int) [][]string {
-	wordSeqs, _ := pyhsmm.TestWordSegmentationAndPOSTagging(sents, threadsNum)
-	return wordSeqs
+func (pyhsmm *PYHSMM) TestWordSegmentation(sents [][]string, threadsNum int) ([][]string, error) {
+	wordSeqs, _, err := pyhsmm.TestWordSegmentationAndPOSTagging(sents, threadsNum)
+	return wordSeqs, err
+}
+
+// TestWordSegmentationWithConstraints inferences word segmentation and their POS tags from input unsegmented texts with their partial annotations, and returns word sequence.
+// This is used for common interface of NPYLM.
+func (pyhsmm *PYHSMM) TestWordSegmentationWithConstraints(sents [][]string, constraints []*SentConstraint, threadsNum int) ([][]string, error) {
+	wordSeqs, _, err := pyhsmm.TestWordSegmentationAndPOSTaggingWithConstraints(sents, constraints, threadsNum)
+	return wordSeqs, err
 }
 
 // TestWordSegmentationForPython inferences word segmentation and their POS tags from input unsegmented texts, and returns data_container which contain segmented texts.
@@ -123,11 +252,20 @@ func (pyhsmm *PYHSMM) TestWordSegmentation(sents [][]string, threadsNum int) [][
 // }
 
 // TestWordSegmentationAndPOSTagging inferences word segmentation and their POS tags from input unsegmented texts.
-func (pyhsmm *PYHSMM) TestWordSegmentationAndPOSTagging(sents [][]string, threadsNum int) ([][]string, [][]int) {
+func (pyhsmm *PYHSMM) TestWordSegmentationAndPOSTagging(sents [][]string, threadsNum int) ([][]string, [][]int, error) {
+	return pyhsmm.TestWordSegmentationAndPOSTaggingWithConstraints(sents, nil, threadsNum)
+}
+
+// TestWordSegmentationAndPOSTaggingWithConstraints inferences word segmentation and their POS tags from input unsegmented texts with their partial annotations.
+// constraints can be nil.
+func (pyhsmm *PYHSMM) TestWordSegmentationAndPOSTaggingWithConstraints(sents [][]string, constraints []*SentConstraint, threadsNum int) ([][]string, [][]int, error) {
 	wordSeqs := make([][]string, len(sents), len(sents))
 	posSeqs := make([][]int, len(sents), len(sents))
 	if threadsNum <= 0 {
-		panic("threadsNum should be bigger than 0")
+		return nil, nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(constraints, pyhsmm.maxWordLength, pyhsmm.PosSize); err != nil {
+		return nil, nil, err
 	}
 	ch := make(chan int, threadsNum)
 	wg := sync.WaitGroup{}
@@ -135,8 +273,8 @@ func (pyhsmm *PYHSMM) TestWordSegmentationAndPOSTagging(sents [][]string, thread
 		ch <- 1
 		wg.Add(1)
 		go func(i int) {
-			forwardScore := pyhsmm.forward(sents[i])
-			wordSeq, posSeq := pyhsmm.backward(sents[i], forwardScore, false)
+			forwardScore := pyhsmm.forward(sents[i], constraintAt(constraints, i))
+			wordSeq, posSeq := pyhsmm.backward(sents[i], forwardScore, false, nil)
 			wordSeqs[i] = wordSeq
 			posSeqs[i] = posSeq
 			<-ch
@@ -144,60 +282,257 @@ func (pyhsmm *PYHSMM) TestWordSegmentationAndPOSTagging(sents [][]string, thread
 		}(i)
 	}
 	wg.Wait()
-	return wordSeqs, posSeqs
+	return wordSeqs, posSeqs, nil
+}
+
+// SampleWordSegmentation samples word segmentation and their POS tags of input unsegmented texts from the posterior, and returns word sequence.
+// This is used for common interface of NPYLM. constraints can be nil.
+func (pyhsmm *PYHSMM) SampleWordSegmentation(sents [][]string, constraints []*SentConstraint, threadsNum int) ([][]string, error) {
+	wordSeqs := make([][]string, len(sents), len(sents))
+	if threadsNum <= 0 {
+		return nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(constraints, pyhsmm.maxWordLength, pyhsmm.PosSize); err != nil {
+		return nil, err
+	}
+	ch := make(chan int, threadsNum)
+	wg := sync.WaitGroup{}
+	rnds := deriveRands(pyhsmm.rnd, len(sents))
+	for i := 0; i < len(sents); i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			forwardScore := pyhsmm.forward(sents[i], constraintAt(constraints, i))
+			wordSeq, _ := pyhsmm.backward(sents[i], forwardScore, true, rnds[i])
+			wordSeqs[i] = wordSeq
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	return wordSeqs, nil
+}
+
+// TestNbestWordSegmentation inferences the nbest word segmentations and their POS tags from input unsegmented texts.
+// constraints can be nil.
+func (pyhsmm *PYHSMM) TestNbestWordSegmentation(sents [][]string, constraints []*SentConstraint, nbest int, threadsNum int) ([][]NbestSegmentation, error) {
+	nbestSegmentations := make([][]NbestSegmentation, len(sents), len(sents))
+	if threadsNum <= 0 {
+		return nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(constraints, pyhsmm.maxWordLength, pyhsmm.PosSize); err != nil {
+		return nil, err
+	}
+	if nbest <= 0 {
+		return nil, fmt.Errorf("%w. nbest should be bigger than 0", ErrInvalidParameter)
+	}
+	ch := make(chan int, threadsNum)
+	wg := sync.WaitGroup{}
+	for i := 0; i < len(sents); i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			nbestSegmentations[i] = pyhsmm.nbestViterbi(sents[i], constraintAt(constraints, i), nbest)
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	return nbestSegmentations, nil
+}
+
+// posHistorySize returns the number of POS histories h in forwardScore[t][pos][h] of forwardForSamplingPosOnly.
+func (pyhsmm *PYHSMM) posHistorySize() int {
+	size := 1
+	for n := 0; n < pyhsmm.maxNgram-2; n++ {
+		size *= pyhsmm.PosSize + 2
+	}
+	return size
+}
+
+// encodePosHistory encodes previous POS tags into a history index.
+// tags[0] is the nearest tag, and pyhsmm.bosPos is used before the beginning of the sentence.
+func (pyhsmm *PYHSMM) encodePosHistory(tags []int) int {
+	h := 0
+	for m := len(tags) - 1; m >= 0; m-- {
+		h = h*(pyhsmm.PosSize+2) + tags[m]
+	}
+	return h
+}
+
+// decodePosHistory decodes size tags encoded by encodePosHistory.
+func (pyhsmm *PYHSMM) decodePosHistory(h int, size int) []int {
+	tags := make([]int, size, size+1)
+	for m := 0; m < size; m++ {
+		tags[m] = h % (pyhsmm.PosSize + 2)
+		h /= pyhsmm.PosSize + 2
+	}
+	return tags
+}
+
+// makePosContext returns the POS context uPos from tags (see encodePosHistory).
+// ok is false if tags can not appear, e.g., a tag is eosPos or a POS tag is before bosPos.
+func (pyhsmm *PYHSMM) makePosContext(tags []int) (context, bool) {
+	uPos := make(context, len(tags), len(tags))
+	for m, tag := range tags {
+		if tag == pyhsmm.eosPos {
+			return uPos, false
+		}
+		if m > 0 && tags[m-1] == pyhsmm.bosPos && tag != pyhsmm.bosPos {
+			return uPos, false
+		}
+		uPos[len(tags)-1-m] = posSymbol(tag)
+	}
+	return uPos, true
+}
+
+// historySize returns the number of histories h in forwardScore[t][k][pos][h].
+// a history is the lengths and POS tags of the maxNgram-2 words before the word.
+func (pyhsmm *PYHSMM) historySize() int {
+	size := 1
+	for n := 0; n < pyhsmm.maxNgram-2; n++ {
+		size *= pyhsmm.historyElementSize()
+	}
+	return size
+}
+
+// maxHistorySize is the limit of historySize. forwardScore has about maxWordLength*PosSize*historySize scores for each character,
+// so maxNgram bigger than 3 needs too much memory except for tiny maxWordLength and PosSize.
+const maxHistorySize = 4096
+
+// checkHistorySize returns ErrInvalidParameter if historySize of PYHSMM with the parameters is bigger than maxHistorySize.
+func checkHistorySize(maxNgram int, maxWordLength int, PosSize int) error {
+	size := 1
+	for n := 0; n < maxNgram-2; n++ {
+		size *= maxWordLength*PosSize + 1
+		if size > maxHistorySize {
+			return fmt.Errorf("%w. (maxWordLength*PosSize+1)^(maxNgram-2) should be %v or less, but maxNgram = %v, maxWordLength = %v and PosSize = %v", ErrInvalidParameter, maxHistorySize, maxNgram, maxWordLength, PosSize)
+		}
+	}
+	return nil
+}
+
+// historyElementSize returns the number of pairs of a length index and a POS tag including bos.
+func (pyhsmm *PYHSMM) historyElementSize() int {
+	return pyhsmm.maxWordLength*pyhsmm.PosSize + 1
 }
 
-func (pyhsmm *PYHSMM) forwardForSamplingPosOnly(goldWordSeq context) [][]float64 {
+// encodeHistoryElement encodes a length index (length - 1) and a POS tag of a word.
+// the pair of maxWordLength and bosPos means bos.
+func (pyhsmm *PYHSMM) encodeHistoryElement(length int, tag int) int {
+	if length == pyhsmm.maxWordLength {
+		return pyhsmm.maxWordLength * pyhsmm.PosSize
+	}
+	return length*pyhsmm.PosSize + tag
+}
+
+// decodeHistory decodes size pairs of length indexes and POS tags from the nearest word.
+func (pyhsmm *PYHSMM) decodeHistory(h int, size int) ([]int, []int) {
+	lengths := make([]int, size, size+1)
+	tags := make([]int, size, size+1)
+	for m := 0; m < size; m++ {
+		element := h % pyhsmm.historyElementSize()
+		h /= pyhsmm.historyElementSize()
+		if element == pyhsmm.maxWordLength*pyhsmm.PosSize {
+			lengths[m] = pyhsmm.maxWordLength
+			tags[m] = pyhsmm.bosPos
+		} else {
+			lengths[m] = element / pyhsmm.PosSize
+			tags[m] = element % pyhsmm.PosSize
+		}
+	}
+	return lengths, tags
+}
+
+// bosHistory returns the history of the first word in a sentence.
+func (pyhsmm *PYHSMM) bosHistory() int {
+	h := 0
+	for n := 0; n < pyhsmm.maxNgram-2; n++ {
+		h = h*pyhsmm.historyElementSize() + pyhsmm.encodeHistoryElement(pyhsmm.maxWordLength, pyhsmm.bosPos)
+	}
+	return h
+}
+
+func (pyhsmm *PYHSMM) forwardForSamplingPosOnly(goldWordSeq context) [][][]float64 {
 	// initialize forwardScore
-	// forwardScore[len(goldWordSeq)][posSize]
-	forwardScore := make([][]float64, len(goldWordSeq), len(goldWordSeq))
+	// forwardScore[len(goldWordSeq)][posSize][posHistorySize]
+	historySize := pyhsmm.posHistorySize()
+	forwardScore := make([][][]float64, len(goldWordSeq), len(goldWordSeq))
 	for t := 0; t < len(goldWordSeq); t++ {
-		forwardScore[t] = make([]float64, pyhsmm.PosSize, pyhsmm.PosSize)
+		forwardScore[t] = make([][]float64, pyhsmm.PosSize, pyhsmm.PosSize)
+		for pos := 0; pos < pyhsmm.PosSize; pos++ {
+			forwardScore[t][pos] = make([]float64, historySize, historySize)
+			for h := 0; h < historySize; h++ {
+				forwardScore[t][pos][h] = math.Inf(-1)
+			}
+		}
 	}
 	word := string("")
-	u := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	uPos := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
+	u := make(context, 0, pyhsmm.maxNgram-1)
+	for n := 0; n < pyhsmm.maxNgram-1; n++ {
+		u = append(u, pyhsmm.bos)
+	}
 	base := float64(0.0)
 	for t := 0; t < len(goldWordSeq); t++ {
+		word = goldWordSeq[t]
+		// base = pyhsmm.npylms[pos].calcBase(word)
+		base = pyhsmm.npylms[0].calcCharBase(word) // 文字レベルのスムージングは一つのVPYLMから
 		for pos := 0; pos < pyhsmm.PosSize; pos++ {
-			word = goldWordSeq[t]
-			if t == 0 {
-				u[0] = pyhsmm.bos
-			} else {
-			}
-			// base = pyhsmm.npylms[pos].calcBase(word)
-			base = pyhsmm.npylms[0].calcBase(word) // 文字レベルのスムージングは一つのVPYLMから
-			p, _ := pyhsmm.npylms[pos].CalcProb(word, u, base)
-			if t == 0 {
-				uPos[0] = strconv.Itoa(pyhsmm.bosPos)
-				posP, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.Base)
-				forwardScore[t][pos] = math.Log(p) + math.Log(posP)
-			} else {
-				forwardScoreTmp := make([]float64, 0, pyhsmm.PosSize)
-				for prevPos := 0; prevPos < pyhsmm.PosSize; prevPos++ {
-					uPos[0] = strconv.Itoa(prevPos)
-					posP, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.Base)
-					score := math.Log(p) + math.Log(posP) + forwardScore[t-1][prevPos]
+			p, _ := pyhsmm.npylms[pos].CalcProb(word, u, pyhsmm.npylms[pos].mixDictionaryBase(word, base))
+			for h := 0; h < historySize; h++ {
+				tags := pyhsmm.decodePosHistory(h, pyhsmm.maxNgram-2)
+				forwardScoreTmp := make([]float64, 0, pyhsmm.PosSize+2)
+				for prevPos := 0; prevPos < pyhsmm.PosSize+2; prevPos++ {
+					contextTags := append(tags, prevPos)
+					uPos, ok := pyhsmm.makePosContext(contextTags)
+					for m, tag := range contextTags {
+						// the tag of the m-th previous word is bosPos only if the word is before the beginning of the sentence
+						if (t-1-m >= 0) != (tag != pyhsmm.bosPos) {
+							ok = false
+						}
+					}
+					if !ok {
+						continue
+					}
+					prevScore := 0.0
+					if t > 0 {
+						prevScore = forwardScore[t-1][contextTags[0]][pyhsmm.encodePosHistory(contextTags[1:])]
+						if math.IsInf(prevScore, -1) {
+							continue
+						}
+					}
+					posP, _ := pyhsmm.posHpylm.CalcProb(posSymbol(pos), uPos, pyhsmm.posHpylm.Base)
+					score := math.Log(p) + math.Log(posP) + prevScore
 					if math.IsNaN(score) {
 						errMsg := fmt.Sprintf("forward error! score is NaN. p (%v), posP, (%v), word (%v)", p, posP, word)
 						panic(errMsg)
 					}
 					forwardScoreTmp = append(forwardScoreTmp, score)
 				}
+				if len(forwardScoreTmp) == 0 {
+					continue
+				}
 				logsumexpScore := pyhsmm.npylms[0].logsumexp(forwardScoreTmp)
 				if math.IsNaN(logsumexpScore) {
 					errMsg := fmt.Sprintf("forward error! logsumexpScore is NaN. forwardScoreTmp (%v), word (%v)", forwardScoreTmp, word)
 					panic(errMsg)
 				}
-				forwardScore[t][pos] = logsumexpScore
+				forwardScore[t][pos][h] = logsumexpScore
 			}
 		}
+		u = append(u[1:], word)
 	}
 	return forwardScore
 }
 
+// calcEachScoreForWord returns eachScoreForWord[t][k][pos][j].
+// j encodes the lengths of the maxNgram-1 words before the word (see NPYLM.encodeHistory).
 func (pyhsmm *PYHSMM) calcEachScoreForWord(sent []string) [][][][]float64 {
 	// initialize eachScore
+	wordHistorySize := 1
+	for n := 0; n < pyhsmm.maxNgram-1; n++ {
+		wordHistorySize *= pyhsmm.maxWordLength + 1 // + 1 is for bos
+	}
 	type eachScoreForWordAndUAndPosType [][][][]float64
 	eachScoreForWord := make(eachScoreForWordAndUAndPosType, len(sent), len(sent))
 	for t := 0; t < len(sent); t++ {
@@ -205,52 +540,39 @@ func (pyhsmm *PYHSMM) calcEachScoreForWord(sent []string) [][][][]float64 {
 		for k := 0; k < pyhsmm.maxWordLength; k++ {
 			eachScoreForWord[t][k] = make([][]float64, pyhsmm.PosSize+2, pyhsmm.PosSize+2)
 			for z := 0; z < pyhsmm.PosSize+2; z++ {
-				eachScoreForWord[t][k][z] = make([]float64, pyhsmm.maxWordLength+1, pyhsmm.maxWordLength+1) // + 1 is for bos
-				for j := 0; j < pyhsmm.maxWordLength+1; j++ {
+				eachScoreForWord[t][k][z] = make([]float64, wordHistorySize, wordHistorySize)
+				for j := 0; j < wordHistorySize; j++ {
 					eachScoreForWord[t][k][z][j] = math.Inf(-1)
 				}
 			}
 		}
 	}
 
+	spans := pyhsmm.npylms[0].newSpanWords(sent)
+	charBases := pyhsmm.npylms[0].calcSpanCharBases(spans) // 文字レベルのスムージングは一つのVPYLMから
 	word := string("")
-	u := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	uPos := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
 	base := float64(0.0)
 	for t := 0; t < len(sent); t++ {
 		for k := 0; k < pyhsmm.maxWordLength; k++ {
 			if t-k >= 0 {
-				word = strings.Join(sent[(t-k):t+1], pyhsmm.npylms[0].splitter)
-				base = pyhsmm.npylms[0].calcBase(word) // 文字レベルのスムージングは一つのVPYLMから
+				word = spans.word(t-k, t)
+				base = charBases[t][k]
 			} else {
 				continue
 			}
-			for pos := 0; pos < pyhsmm.PosSize; pos++ {
-				if t-k == 0 {
-					u[0] = pyhsmm.bos
-					uPos[0] = strconv.Itoa(pyhsmm.bosPos)
-					wordScore, _ := pyhsmm.npylms[pos].CalcProb(word, u, base)
+			for j := 0; j < wordHistorySize; j++ {
+				u, ok := pyhsmm.npylms[0].makeContextFromSpans(spans, t-k-1, pyhsmm.npylms[0].decodeLengths(j, pyhsmm.maxNgram-1))
+				if !ok {
+					continue
+				}
+				for pos := 0; pos < pyhsmm.PosSize; pos++ {
+					wordScore, _ := pyhsmm.npylms[pos].CalcProb(word, u, pyhsmm.npylms[pos].mixDictionaryBase(word, base))
 					score := math.Log(wordScore)
 					if math.IsNaN(score) {
 						errMsg := fmt.Sprintf("forward error! score is NaN. wordScore (%v), word (%v)", wordScore, word)
 						panic(errMsg)
 					}
-					eachScoreForWord[t][k][pos][pyhsmm.maxWordLength] = score
-					continue
-				}
-				for j := 0; j < pyhsmm.maxWordLength; j++ {
-					if t-k-(j+1) >= 0 {
-						u[0] = strings.Join(sent[(t-k-(j+1)):(t-k)], pyhsmm.npylms[0].splitter)
-						wordScore, _ := pyhsmm.npylms[pos].CalcProb(word, u, base)
-						score := math.Log(wordScore)
-						if math.IsNaN(score) {
-							errMsg := fmt.Sprintf("forward error! score is NaN. wordScore (%v), word (%v)", wordScore, word)
-							panic(errMsg)
-						}
-						eachScoreForWord[t][k][pos][j] = score
-					} else {
-						continue
-					}
+					eachScoreForWord[t][k][pos][j] = score
 				}
 			}
 		}
@@ -259,170 +581,465 @@ func (pyhsmm *PYHSMM) calcEachScoreForWord(sent []string) [][][][]float64 {
 	return eachScoreForWord
 }
 
+// calcEachScoreForPos returns eachScoreForPos[pos][r].
+// r encodes the maxNgram-1 POS tags before pos (see encodePosHistory).
 func (pyhsmm *PYHSMM) calcEachScoreForPos() [][]float64 {
+	posHistorySize := pyhsmm.posHistorySize() * (pyhsmm.PosSize + 2)
 	type eachScoreForPosType [][]float64
 	eachScoreForPos := make(eachScoreForPosType, pyhsmm.PosSize+2, pyhsmm.PosSize+2)
 	for pos := 0; pos < pyhsmm.PosSize+2; pos++ {
-		eachScoreForPos[pos] = make([]float64, pyhsmm.PosSize+2, pyhsmm.PosSize+2)
+		eachScoreForPos[pos] = make([]float64, posHistorySize, posHistorySize)
+		for r := 0; r < posHistorySize; r++ {
+			eachScoreForPos[pos][r] = math.Inf(-1)
+		}
 	}
 
-	uPos := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	for pos := 0; pos < pyhsmm.PosSize; pos++ {
-		uPos[0] = strconv.Itoa(pyhsmm.bosPos)
-		posScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.Base)
-		score := math.Log(posScore)
-		if math.IsNaN(score) {
-			errMsg := fmt.Sprintf("forward error! score is NaN. posScore (%v), pos (%v), prevPos (%v)", posScore, pos, pyhsmm.bosPos)
-			panic(errMsg)
-		}
-		eachScoreForPos[pos][pyhsmm.PosSize] = score
-
-		for prevPos := 0; prevPos < pyhsmm.PosSize; prevPos++ {
-			uPos[0] = strconv.Itoa(prevPos)
-			posScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.Base)
+	for r := 0; r < posHistorySize; r++ {
+		uPos, ok := pyhsmm.makePosContext(pyhsmm.decodePosHistory(r, pyhsmm.maxNgram-1))
+		if !ok {
+			continue
+		}
+		for pos := 0; pos < pyhsmm.PosSize+1; pos++ {
+			posScore, _ := pyhsmm.posHpylm.CalcProb(posSymbol(pos), uPos, pyhsmm.posHpylm.Base)
 			score := math.Log(posScore)
 			if math.IsNaN(score) {
-				errMsg := fmt.Sprintf("forward error! score is NaN. posScore (%v), pos (%v), prevPos (%v)", posScore, pos, prevPos)
+				errMsg := fmt.Sprintf("forward error! score is NaN. posScore (%v), pos (%v), uPos (%v)", posScore, pos, uPos)
 				panic(errMsg)
 			}
-			eachScoreForPos[pos][prevPos] = score
+			eachScoreForPos[pos][r] = score
 		}
 	}
 
 	return eachScoreForPos
 }
 
-func (pyhsmm *PYHSMM) forward(sent []string) forwardScoreForWordAndPosType {
+// extendHistory returns indexes for a word whose previous words are given by history h and one more history element before them.
+// wordHistory and posHistory are indexes of eachScoreForWord and eachScoreForPos, and prevK, prevPos and prevH are the state of the previous word.
+func (pyhsmm *PYHSMM) extendHistory(h int, element int) (int, int, int, int, int) {
+	size := pyhsmm.maxNgram - 2
+	lengths, tags := pyhsmm.decodeHistory(h+element*pyhsmm.historySize(), size+1)
+	wordHistory := pyhsmm.npylms[0].encodeHistory(lengths)
+	posHistory := pyhsmm.encodePosHistory(tags)
+	prevH := h / pyhsmm.historyElementSize()
+	if size == 0 {
+		prevH = 0
+	} else {
+		prevH += element * (pyhsmm.historySize() / pyhsmm.historyElementSize())
+	}
+	return wordHistory, posHistory, lengths[0], tags[0], prevH
+}
+
+func (pyhsmm *PYHSMM) forward(sent []string, constraint *SentConstraint) forwardScoreForWordAndPosType {
+	return pyhsmm.calcForwardScore(sent, constraint, true)
+}
 
+// calcForwardScore returns forwardScore[t][k][pos][h].
+// if normalized is true, each sum is divided by the number of its terms for sampling, and the log probabilities are divided by the temperature like NPYLM.calcForwardScore.
+// words and POS tags which do not satisfy constraint have -inf, and constraint can be nil.
+func (pyhsmm *PYHSMM) calcForwardScore(sent []string, constraint *SentConstraint, normalized bool) forwardScoreForWordAndPosType {
 	// initialize forwardScore
+	historySize := pyhsmm.historySize()
 	forwardScore := make(forwardScoreForWordAndPosType, len(sent), len(sent))
 	for t := 0; t < len(sent); t++ {
-		forwardScore[t] = make([][]float64, pyhsmm.maxWordLength, pyhsmm.maxWordLength)
+		forwardScore[t] = make([][][]float64, pyhsmm.maxWordLength, pyhsmm.maxWordLength)
 		for k := 0; k < pyhsmm.maxWordLength; k++ {
-			forwardScore[t][k] = make([]float64, pyhsmm.PosSize, pyhsmm.PosSize)
+			forwardScore[t][k] = make([][]float64, pyhsmm.PosSize, pyhsmm.PosSize)
+			for pos := 0; pos < pyhsmm.PosSize; pos++ {
+				forwardScore[t][k][pos] = make([]float64, historySize, historySize)
+				for h := 0; h < historySize; h++ {
+					forwardScore[t][k][pos][h] = math.Inf(-1)
+				}
+			}
 		}
 	}
 
+	temperature := 1.0
+	if normalized {
+		temperature = pyhsmm.temperature
+	}
 	eachScoreForWord := pyhsmm.calcEachScoreForWord(sent)
 	eachScoreForPos := pyhsmm.calcEachScoreForPos()
+	bosHistory := pyhsmm.bosHistory()
+	bosElement := pyhsmm.encodeHistoryElement(pyhsmm.maxWordLength, pyhsmm.bosPos)
+	elementSize := pyhsmm.historyElementSize()
+	// extendedHistories[h*elementSize+element] caches the result of extendHistory(h, element)
+	extendedHistories := make([][5]int, historySize*elementSize, historySize*elementSize)
+	for h := 0; h < historySize; h++ {
+		for element := 0; element < elementSize; element++ {
+			wordHistory, posHistory, prevK, prevPos, prevH := pyhsmm.extendHistory(h, element)
+			extendedHistories[h*elementSize+element] = [5]int{wordHistory, posHistory, prevK, prevPos, prevH}
+		}
+	}
 
 	for t := 0; t < len(sent); t++ {
 		for k := 0; k < pyhsmm.maxWordLength; k++ {
-			if t-k >= 0 {
+			if t-k >= 0 && constraint.allowWord(t-k, t) {
 				//
 			} else {
 				continue
 			}
 			for pos := 0; pos < pyhsmm.PosSize; pos++ {
-				if t-k == 0 {
-					wordScoreLog := eachScoreForWord[t][k][pos][pyhsmm.maxWordLength]
-					posScoreLog := eachScoreForPos[pos][pyhsmm.PosSize]
-					score := wordScoreLog + posScoreLog
-					if math.IsNaN(score) {
-						errMsg := fmt.Sprintf("forward error! score is NaN. wordScore (%v), posScore, (%v)", wordScoreLog, posScoreLog)
-						panic(errMsg)
-					}
-					forwardScore[t][k][pos] = score
+				if !constraint.allowPos(t, pos) {
 					continue
 				}
-				forwardScore[t][k][pos] = 0.0
-				forwardScoreTmp := make([]float64, 0, pyhsmm.maxWordLength*pyhsmm.PosSize)
-				for j := 0; j < pyhsmm.maxWordLength; j++ {
-					if t-k-(j+1) >= 0 {
-						//
-					} else {
+				for h := 0; h < historySize; h++ {
+					if t-k == 0 {
+						if h != bosHistory {
+							continue
+						}
+						wordHistory, posHistory, _, _, _ := pyhsmm.extendHistory(h, bosElement)
+						wordScoreLog := eachScoreForWord[t][k][pos][wordHistory]
+						posScoreLog := eachScoreForPos[pos][posHistory]
+						score := (wordScoreLog + posScoreLog) / temperature
+						if math.IsNaN(score) {
+							errMsg := fmt.Sprintf("forward error! score is NaN. wordScore (%v), posScore, (%v)", wordScoreLog, posScoreLog)
+							panic(errMsg)
+						}
+						forwardScore[t][k][pos][h] = score
 						continue
 					}
-					for prevPos := 0; prevPos < pyhsmm.PosSize; prevPos++ {
-						wordScoreLog := eachScoreForWord[t][k][pos][j]
-						posScoreLog := eachScoreForPos[pos][prevPos]
-						score := wordScoreLog + posScoreLog + forwardScore[t-(k+1)][j][prevPos]
+					forwardScoreTmp := make([]float64, 0, elementSize)
+					for element := 0; element < elementSize; element++ {
+						extendedHistory := extendedHistories[h*elementSize+element]
+						wordHistory, posHistory, prevK, prevPos, prevH := extendedHistory[0], extendedHistory[1], extendedHistory[2], extendedHistory[3], extendedHistory[4]
+						if prevK == pyhsmm.maxWordLength {
+							continue
+						}
+						wordScoreLog := eachScoreForWord[t][k][pos][wordHistory]
+						posScoreLog := eachScoreForPos[pos][posHistory]
+						prevScore := forwardScore[t-(k+1)][prevK][prevPos][prevH]
+						if math.IsInf(wordScoreLog, -1) || math.IsInf(posScoreLog, -1) || math.IsInf(prevScore, -1) {
+							continue
+						}
+						score := (wordScoreLog+posScoreLog)/temperature + prevScore
 						if math.IsNaN(score) {
 							errMsg := fmt.Sprintf("forward error! score is NaN. wordScore (%v), posScore, (%v)", wordScoreLog, posScoreLog)
 							panic(errMsg)
 						}
 						forwardScoreTmp = append(forwardScoreTmp, score)
 					}
-				}
+					if len(forwardScoreTmp) == 0 {
+						continue
+					}
 
-				logsumexpScore := pyhsmm.npylms[0].logsumexp(forwardScoreTmp)
-				logsumexpScore = logsumexpScore - math.Log(float64(len(forwardScoreTmp)))
-				if math.IsNaN(logsumexpScore) {
-					errMsg := fmt.Sprintf("forward error! logsumexpScore is NaN. forwardScoreTmp (%v)", forwardScoreTmp)
-					panic(errMsg)
+					logsumexpScore := pyhsmm.npylms[0].logsumexp(forwardScoreTmp)
+					if normalized {
+						logsumexpScore = logsumexpScore - math.Log(float64(len(forwardScoreTmp)))
+					}
+					if math.IsNaN(logsumexpScore) {
+						errMsg := fmt.Sprintf("forward error! logsumexpScore is NaN. forwardScoreTmp (%v)", forwardScoreTmp)
+						panic(errMsg)
+					}
+					forwardScore[t][k][pos][h] = logsumexpScore
 				}
-				forwardScore[t][k][pos] = logsumexpScore - math.Log(float64(len(forwardScoreTmp)))
-			}
-		}
-	}
-
-	// word := string("")
-	// u := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	// uPos := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	// base := float64(0.0)
-	// for t := 0; t < len(sent); t++ {
-	// 	for k := 0; k < pyhsmm.maxWordLength; k++ {
-	// 		if t-k >= 0 {
-	// 			word = string(sent[(t - k) : t+1])
-	// 			base = pyhsmm.npylms[0].calcBase(word) // 文字レベルのスムージングは一つのVPYLMから
-	// 		} else {
-	// 			continue
-	// 		}
-	// 		for pos := 0; pos < pyhsmm.PosSize; pos++ {
-	// 			if t-k == 0 {
-	// 				u[0] = pyhsmm.bos
-	// 				uPos[0] = strconv.Itoa(pyhsmm.bosPos)
-	// 				wordScore, _ := pyhsmm.npylms[pos].CalcProb(word, u, base)
-	// 				posScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.Base)
-	// 				score := math.Log(wordScore) + math.Log(posScore)
-	// 				if math.IsNaN(score) {
-	// 					errMsg := fmt.Sprintf("forward error! score is NaN. wordScore (%v), posScore, (%v), word (%v)", wordScore, posScore, word)
-	// 					panic(errMsg)
-	// 				}
-	// 				forwardScore[t][k][pos] = score
-	// 				continue
-	// 			}
-	// 			forwardScore[t][k][pos] = 0.0
-	// 			forwardScoreTmp := make([]float64, 0, pyhsmm.maxWordLength*pyhsmm.PosSize)
-	// 			for j := 0; j < pyhsmm.maxWordLength; j++ {
-	// 				if t-k-(j+1) >= 0 {
-	// 					u[0] = string(sent[(t - k - (j + 1)):(t - k)])
-	// 				} else {
-	// 					continue
-	// 				}
-	// 				for prevPos := 0; prevPos < pyhsmm.PosSize; prevPos++ {
-	// 					wordScore, _ := pyhsmm.npylms[pos].CalcProb(word, u, base)
-	// 					uPos[0] = strconv.Itoa(prevPos)
-	// 					posScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.Base)
-	// 					score := math.Log(wordScore) + math.Log(posScore) + forwardScore[t-(k+1)][j][prevPos]
-	// 					if math.IsNaN(score) {
-	// 						errMsg := fmt.Sprintf("forward error! score is NaN. wordScore (%v), posScore, (%v), word (%v)", wordScore, posScore, word)
-	// 						panic(errMsg)
-	// 					}
-	// 					forwardScoreTmp = append(forwardScoreTmp, score)
-	// 				}
-	// 			}
-
-	// 			logsumexpScore := pyhsmm.npylms[0].logsumexp(forwardScoreTmp)
-	// 			logsumexpScore = logsumexpScore - math.Log(float64(len(forwardScoreTmp)))
-	// 			if math.IsNaN(logsumexpScore) {
-	// 				errMsg := fmt.Sprintf("forward error! logsumexpScore is NaN. forwardScoreTmp (%v), word (%v)", forwardScoreTmp, word)
-	// 				panic(errMsg)
-	// 			}
-	// 			forwardScore[t][k][pos] = logsumexpScore - math.Log(float64(len(forwardScoreTmp)))
-	// 		}
-	// 	}
-	// }
+			}
+		}
+	}
 
 	return forwardScore
 }
 
-func (pyhsmm *PYHSMM) backwardPosOnly(forwardScore [][]float64, sampling bool, goldWordSeq context) []int {
+// calcBackwardScore returns backwardScore[t][k][pos][h].
+// backwardScore[t][k][pos][h] is the log probability of sent[t+1:], their POS tags and eos given the state forwardScore[t][k][pos][h].
+// next words and POS tags which do not satisfy constraint are ignored, and constraint can be nil.
+func (pyhsmm *PYHSMM) calcBackwardScore(sent []string, constraint *SentConstraint) forwardScoreForWordAndPosType {
+	// initialize backwardScore
+	historySize := pyhsmm.historySize()
+	backwardScore := make(forwardScoreForWordAndPosType, len(sent), len(sent))
+	for t := 0; t < len(sent); t++ {
+		backwardScore[t] = make([][][]float64, pyhsmm.maxWordLength, pyhsmm.maxWordLength)
+		for k := 0; k < pyhsmm.maxWordLength; k++ {
+			backwardScore[t][k] = make([][]float64, pyhsmm.PosSize, pyhsmm.PosSize)
+			for pos := 0; pos < pyhsmm.PosSize; pos++ {
+				backwardScore[t][k][pos] = make([]float64, historySize, historySize)
+				for h := 0; h < historySize; h++ {
+					backwardScore[t][k][pos][h] = math.Inf(-1)
+				}
+			}
+		}
+	}
+
+	eachScoreForWord := pyhsmm.calcEachScoreForWord(sent)
+	eachScoreForPos := pyhsmm.calcEachScoreForPos()
+	for t := len(sent) - 1; t >= 0; t-- {
+		for k := 0; k < pyhsmm.maxWordLength; k++ {
+			if t-k < 0 {
+				continue
+			}
+			for pos := 0; pos < pyhsmm.PosSize; pos++ {
+				for h := 0; h < historySize; h++ {
+					if t == len(sent)-1 {
+						backwardScore[t][k][pos][h] = pyhsmm.calcEosScore(sent, k, pos, h)
+						continue
+					}
+					// history of the next word is the nearest maxNgram-1 elements of (k, pos) and h.
+					fullHistory := pyhsmm.encodeHistoryElement(k, pos) + h*pyhsmm.historyElementSize()
+					lengths, tags := pyhsmm.decodeHistory(fullHistory, pyhsmm.maxNgram-1)
+					wordHistory := pyhsmm.npylms[0].encodeHistory(lengths)
+					posHistory := pyhsmm.encodePosHistory(tags)
+					nextH := fullHistory % historySize
+					backwardScoreTmp := make([]float64, 0, pyhsmm.maxWordLength*pyhsmm.PosSize)
+					for nextK := 0; nextK < pyhsmm.maxWordLength && t+nextK+1 < len(sent); nextK++ {
+						if !constraint.allowWord(t+1, t+nextK+1) {
+							continue
+						}
+						for nextPos := 0; nextPos < pyhsmm.PosSize; nextPos++ {
+							if !constraint.allowPos(t+nextK+1, nextPos) {
+								continue
+							}
+							wordScoreLog := eachScoreForWord[t+nextK+1][nextK][nextPos][wordHistory]
+							posScoreLog := eachScoreForPos[nextPos][posHistory]
+							nextScore := backwardScore[t+nextK+1][nextK][nextPos][nextH]
+							if math.IsInf(wordScoreLog, -1) || math.IsInf(posScoreLog, -1) || math.IsInf(nextScore, -1) {
+								continue
+							}
+							backwardScoreTmp = append(backwardScoreTmp, wordScoreLog+posScoreLog+nextScore)
+						}
+					}
+					if len(backwardScoreTmp) == 0 {
+						continue
+					}
+					backwardScore[t][k][pos][h] = pyhsmm.npylms[0].logsumexp(backwardScoreTmp)
+				}
+			}
+		}
+	}
+
+	return backwardScore
+}
+
+// CalcSpanPosMarginals returns the posterior probabilities of words and their POS tags in sent by forward-backward algorithm.
+// spanPosMarginals[t][k][pos] is the probability that sent[t-k:t+1] is a word and its POS tag is pos.
+func (pyhsmm *PYHSMM) CalcSpanPosMarginals(sent []string) [][][]float64 {
+	return pyhsmm.calcSpanPosMarginals(sent, nil)
+}
+
+func (pyhsmm *PYHSMM) calcSpanPosMarginals(sent []string, constraint *SentConstraint) [][][]float64 {
+	spanPosMarginals := make([][][]float64, len(sent), len(sent))
+	for t := 0; t < len(sent); t++ {
+		spanPosMarginals[t] = make([][]float64, pyhsmm.maxWordLength, pyhsmm.maxWordLength)
+		for k := 0; k < pyhsmm.maxWordLength; k++ {
+			spanPosMarginals[t][k] = make([]float64, pyhsmm.PosSize, pyhsmm.PosSize)
+		}
+	}
+	if len(sent) == 0 {
+		return spanPosMarginals
+	}
+	forwardScore := pyhsmm.calcForwardScore(sent, constraint, false)
+	backwardScore := pyhsmm.calcBackwardScore(sent, constraint)
+	historySize := pyhsmm.historySize()
+	sentScores := make([]float64, 0, pyhsmm.maxWordLength*pyhsmm.PosSize*historySize)
+	for k := 0; k < pyhsmm.maxWordLength; k++ {
+		for pos := 0; pos < pyhsmm.PosSize; pos++ {
+			for h := 0; h < historySize; h++ {
+				score := forwardScore[len(sent)-1][k][pos][h] + backwardScore[len(sent)-1][k][pos][h]
+				if !math.IsInf(score, -1) {
+					sentScores = append(sentScores, score)
+				}
+			}
+		}
+	}
+	if len(sentScores) == 0 {
+		return spanPosMarginals
+	}
+	sentScore := pyhsmm.npylms[0].logsumexp(sentScores)
+	for t := 0; t < len(sent); t++ {
+		for k := 0; k < pyhsmm.maxWordLength; k++ {
+			for pos := 0; pos < pyhsmm.PosSize; pos++ {
+				for h := 0; h < historySize; h++ {
+					score := forwardScore[t][k][pos][h] + backwardScore[t][k][pos][h]
+					if math.IsInf(score, -1) {
+						continue
+					}
+					spanPosMarginals[t][k][pos] += math.Exp(score - sentScore)
+				}
+			}
+		}
+	}
+	return spanPosMarginals
+}
+
+// CalcBoundaryMarginals returns the posterior probabilities of word boundaries in sent by forward-backward algorithm.
+// boundaryMarginals[t] is the probability that a word boundary is after sent[t] (t < len(sent)-1).
+func (pyhsmm *PYHSMM) CalcBoundaryMarginals(sent []string) []float64 {
+	boundaryMarginals, _ := pyhsmm.calcMarginals(sent, nil)
+	return boundaryMarginals
+}
+
+func (pyhsmm *PYHSMM) calcMarginals(sent []string, constraint *SentConstraint) ([]float64, [][][]float64) {
+	spanPosMarginals := pyhsmm.calcSpanPosMarginals(sent, constraint)
+	wordMarginals := make([][]float64, len(sent), len(sent))
+	for t := range spanPosMarginals {
+		wordMarginals[t] = make([]float64, pyhsmm.maxWordLength, pyhsmm.maxWordLength)
+		for k := range spanPosMarginals[t] {
+			for _, spanPosMarginal := range spanPosMarginals[t][k] {
+				wordMarginals[t][k] += spanPosMarginal
+			}
+		}
+	}
+	return wordMarginalsToBoundaryMarginals(wordMarginals), spanPosMarginals
+}
+
+// TestBoundaryMarginals returns the posterior probabilities of word boundaries in input unsegmented texts.
+// constraints can be nil.
+func (pyhsmm *PYHSMM) TestBoundaryMarginals(sents [][]string, constraints []*SentConstraint, threadsNum int) ([][]float64, error) {
+	boundaryMarginals, _, err := pyhsmm.TestMarginals(sents, constraints, threadsNum)
+	return boundaryMarginals, err
+}
+
+// TestMarginals returns the posterior probabilities of word boundaries and those of words and their POS tags in input unsegmented texts (see CalcSpanPosMarginals).
+// constraints can be nil.
+func (pyhsmm *PYHSMM) TestMarginals(sents [][]string, constraints []*SentConstraint, threadsNum int) ([][]float64, [][][][]float64, error) {
+	boundaryMarginals := make([][]float64, len(sents), len(sents))
+	spanPosMarginals := make([][][][]float64, len(sents), len(sents))
+	if threadsNum <= 0 {
+		return nil, nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	if err := checkConstraints(constraints, pyhsmm.maxWordLength, pyhsmm.PosSize); err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan int, threadsNum)
+	wg := sync.WaitGroup{}
+	for i := 0; i < len(sents); i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			boundaryMarginals[i], spanPosMarginals[i] = pyhsmm.calcMarginals(sents[i], constraintAt(constraints, i))
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	return boundaryMarginals, spanPosMarginals, nil
+}
+
+// nbestViterbi returns the nbest segmentations and POS sequences by k-best Viterbi algorithm.
+// lattice[t][(k*PosSize+pos)*historySize+h] is the k-best list of the state forwardScore[t][k][pos][h].
+func (pyhsmm *PYHSMM) nbestViterbi(sent []string, constraint *SentConstraint, nbest int) []NbestSegmentation {
+	if len(sent) == 0 {
+		return []NbestSegmentation{{WordSeq: make([]string, 0, 0), PosSeq: make([]int, 0, 0), Score: 0.0}}
+	}
+	historySize := pyhsmm.historySize()
+	stateSize := pyhsmm.maxWordLength * pyhsmm.PosSize * historySize
+	eachScoreForWord := pyhsmm.calcEachScoreForWord(sent)
+	eachScoreForPos := pyhsmm.calcEachScoreForPos()
+	bosHistory := pyhsmm.bosHistory()
+	bosElement := pyhsmm.encodeHistoryElement(pyhsmm.maxWordLength, pyhsmm.bosPos)
+	elementSize := pyhsmm.historyElementSize()
+	// extendedHistories[h*elementSize+element] caches the result of extendHistory(h, element)
+	extendedHistories := make([][5]int, historySize*elementSize, historySize*elementSize)
+	for h := 0; h < historySize; h++ {
+		for element := 0; element < elementSize; element++ {
+			wordHistory, posHistory, prevK, prevPos, prevH := pyhsmm.extendHistory(h, element)
+			extendedHistories[h*elementSize+element] = [5]int{wordHistory, posHistory, prevK, prevPos, prevH}
+		}
+	}
+
+	lattice := make([][][]nbestEntry, len(sent), len(sent))
+	for t := 0; t < len(sent); t++ {
+		lattice[t] = make([][]nbestEntry, stateSize, stateSize)
+		for k := 0; k < pyhsmm.maxWordLength; k++ {
+			if t-k < 0 || !constraint.allowWord(t-k, t) {
+				continue
+			}
+			for pos := 0; pos < pyhsmm.PosSize; pos++ {
+				if !constraint.allowPos(t, pos) {
+					continue
+				}
+				for h := 0; h < historySize; h++ {
+					state := (k*pyhsmm.PosSize+pos)*historySize + h
+					if t-k == 0 {
+						if h != bosHistory {
+							continue
+						}
+						wordHistory, posHistory, _, _, _ := pyhsmm.extendHistory(h, bosElement)
+						score := eachScoreForWord[t][k][pos][wordHistory] + eachScoreForPos[pos][posHistory]
+						lattice[t][state] = []nbestEntry{{score, -1, -1}}
+						continue
+					}
+					entries := make([]nbestEntry, 0, nbest*elementSize)
+					for element := 0; element < elementSize; element++ {
+						extendedHistory := extendedHistories[h*elementSize+element]
+						wordHistory, posHistory, prevK, prevPos, prevH := extendedHistory[0], extendedHistory[1], extendedHistory[2], extendedHistory[3], extendedHistory[4]
+						if prevK == pyhsmm.maxWordLength {
+							continue
+						}
+						prevState := (prevK*pyhsmm.PosSize+prevPos)*historySize + prevH
+						prevEntries := lattice[t-(k+1)][prevState]
+						if len(prevEntries) == 0 {
+							continue
+						}
+						score := eachScoreForWord[t][k][pos][wordHistory] + eachScoreForPos[pos][posHistory]
+						if math.IsInf(score, -1) {
+							continue
+						}
+						for r, prevEntry := range prevEntries {
+							entries = append(entries, nbestEntry{score + prevEntry.score, prevState, r})
+						}
+					}
+					lattice[t][state] = selectNbest(entries, nbest)
+				}
+			}
+		}
+	}
+
+	// eos
+	t := len(sent) - 1
+	entries := make([]nbestEntry, 0, nbest*stateSize)
+	for k := 0; k < pyhsmm.maxWordLength; k++ {
+		for pos := 0; pos < pyhsmm.PosSize; pos++ {
+			for h := 0; h < historySize; h++ {
+				state := (k*pyhsmm.PosSize+pos)*historySize + h
+				if len(lattice[t][state]) == 0 {
+					continue
+				}
+				score := pyhsmm.calcEosScore(sent, k, pos, h)
+				if math.IsInf(score, -1) {
+					continue
+				}
+				for r, prevEntry := range lattice[t][state] {
+					entries = append(entries, nbestEntry{score + prevEntry.score, state, r})
+				}
+			}
+		}
+	}
+	entries = selectNbest(entries, nbest)
+
+	nbestSegmentations := make([]NbestSegmentation, len(entries), len(entries))
+	for n, entry := range entries {
+		wordSeqReverse := make([]string, 0, len(sent))
+		posSeqReverse := make([]int, 0, len(sent))
+		t := len(sent) - 1
+		state := entry.prevState
+		r := entry.prevRank
+		for state != -1 {
+			k := state / (pyhsmm.PosSize * historySize)
+			pos := (state / historySize) % pyhsmm.PosSize
+			wordSeqReverse = append(wordSeqReverse, strings.Join(sent[(t-k):t+1], pyhsmm.npylms[0].splitter))
+			posSeqReverse = append(posSeqReverse, pos)
+			prevEntry := lattice[t][state][r]
+			t = t - (k + 1)
+			state = prevEntry.prevState
+			r = prevEntry.prevRank
+		}
+		wordSeq := make([]string, len(wordSeqReverse), len(wordSeqReverse))
+		posSeq := make([]int, len(posSeqReverse), len(posSeqReverse))
+		for i := range wordSeqReverse {
+			wordSeq[(len(wordSeqReverse)-1)-i] = wordSeqReverse[i]
+			posSeq[(len(posSeqReverse)-1)-i] = posSeqReverse[i]
+		}
+		nbestSegmentations[n] = NbestSegmentation{WordSeq: wordSeq, PosSeq: posSeq, Score: entry.score}
+	}
+	return nbestSegmentations
+}
+
+func (pyhsmm *PYHSMM) backwardPosOnly(forwardScore [][][]float64, sampling bool, goldWordSeq context) []int {
 	t := len(goldWordSeq)
 	prevWord := pyhsmm.eos
 	prevPos := pyhsmm.eosPos
-	u := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	uPos := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
+	// POS tags before prevPos. they are unknown when prevPos is eosPos.
+	prevTags := make([]int, 0, pyhsmm.maxNgram-2)
+	historySize := pyhsmm.posHistorySize()
 	base := pyhsmm.npylms[0].vpylm.hpylm.Base
 	samplingPosSeq := make([]int, 0, len(goldWordSeq))
 	for {
@@ -430,50 +1047,75 @@ func (pyhsmm *PYHSMM) backwardPosOnly(forwardScore [][]float64, sampling bool, g
 			break
 		}
 		if prevWord != pyhsmm.eos {
-			base = pyhsmm.npylms[0].calcBase(prevWord) // 文字レベルのスムージングは一つのVPYLMから
+			base = pyhsmm.npylms[0].calcCharBase(prevWord) // 文字レベルのスムージングは一つのVPYLMから
 		}
-		scoreArrayLog := make([]float64, pyhsmm.PosSize, pyhsmm.PosSize)
-		for i := 0; i < pyhsmm.PosSize; i++ {
+		u := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
+		for n := 0; n < pyhsmm.maxNgram-1; n++ {
+			if t-1-n >= 0 {
+				u[pyhsmm.maxNgram-2-n] = goldWordSeq[t-1-n]
+			} else {
+				u[pyhsmm.maxNgram-2-n] = pyhsmm.bos
+			}
+		}
+		wordScore, _ := pyhsmm.npylms[prevPos].CalcProb(prevWord, u, pyhsmm.npylms[prevPos].mixDictionaryBase(prevWord, base))
+		scoreArrayLog := make([]float64, pyhsmm.PosSize*historySize, pyhsmm.PosSize*historySize)
+		for i := 0; i < pyhsmm.PosSize*historySize; i++ {
 			scoreArrayLog[i] = math.Inf(-1)
 		}
 		maxScore := float64(math.Inf(-1))
-		maxNextPos := -1
+		maxI := -1
 		for nextPos := 0; nextPos < pyhsmm.PosSize; nextPos++ {
-			u[0] = goldWordSeq[t-1]
-			wordScore, _ := pyhsmm.npylms[prevPos].CalcProb(prevWord, u, base)
-			uPos[0] = strconv.Itoa(nextPos)
-			posScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(prevPos), uPos, pyhsmm.posHpylm.Base)
-			score := math.Log(wordScore) + math.Log(posScore) + forwardScore[t-1][nextPos]
-			if score > maxScore {
-				maxScore = score
-				maxNextPos = nextPos
-			}
-			if math.IsNaN(score) {
-				score = math.Inf(-1)
+			for h := 0; h < historySize; h++ {
+				contextTags := append([]int{nextPos}, pyhsmm.decodePosHistory(h, pyhsmm.maxNgram-2)...)
+				if !pyhsmm.npylms[0].matchLengths(contextTags, prevTags) {
+					continue
+				}
+				prevScore := forwardScore[t-1][nextPos][h]
+				if math.IsInf(prevScore, -1) {
+					continue
+				}
+				uPos, ok := pyhsmm.makePosContext(contextTags)
+				if !ok {
+					continue
+				}
+				posScore, _ := pyhsmm.posHpylm.CalcProb(posSymbol(prevPos), uPos, pyhsmm.posHpylm.Base)
+				score := math.Log(wordScore) + math.Log(posScore) + prevScore
+				if math.IsNaN(score) {
+					score = math.Inf(-1)
+				}
+				if score > maxScore {
+					maxScore = score
+					maxI = nextPos*historySize + h
+				}
+				scoreArrayLog[nextPos*historySize+h] = score
 			}
-			scoreArrayLog[nextPos] = score
 		}
-		logSumScoreArrayLog := pyhsmm.npylms[0].logsumexp(scoreArrayLog)
-		nextPos := 0
+		i := 0
 		if sampling {
-			r := rand.Float64()
+			logSumScoreArrayLog := pyhsmm.npylms[0].logsumexp(scoreArrayLog)
+			r := pyhsmm.rnd.Float64()
 			sumScore := 0.0
 			for {
-				sumScore += math.Exp(scoreArrayLog[nextPos] - logSumScoreArrayLog)
+				sumScore += math.Exp(scoreArrayLog[i] - logSumScoreArrayLog)
 				if sumScore > r {
 					break
 				}
-				nextPos++
-				if nextPos >= pyhsmm.PosSize {
+				i++
+				if i >= pyhsmm.PosSize*historySize {
 					panic("sampling error in PYHSMM")
 				}
 			}
 		} else {
-			nextPos = maxNextPos
+			i = maxI
+		}
+		if i < 0 {
+			panic("sampling error in PYHSMM")
 		}
+		nextPos := i / historySize
 		samplingPosSeq = append(samplingPosSeq, nextPos)
 		t--
 		prevPos = nextPos
+		prevTags = pyhsmm.decodePosHistory(i%historySize, pyhsmm.maxNgram-2)
 		prevWord = goldWordSeq[t]
 	}
 	samplingPosReverse := make([]int, len(samplingPosSeq), len(samplingPosSeq))
@@ -483,85 +1125,143 @@ func (pyhsmm *PYHSMM) backwardPosOnly(forwardScore [][]float64, sampling bool, g
 	return samplingPosReverse
 }
 
-func (pyhsmm *PYHSMM) backward(sent []string, forwardScore forwardScoreForWordAndPosType, sampling bool) (context, []int) {
+// backward samples a word segmentation and POS tags by rnd if sampling is true, otherwise returns the best ones (rnd can be nil).
+func (pyhsmm *PYHSMM) backward(sent []string, forwardScore forwardScoreForWordAndPosType, sampling bool, rnd *rand.Rand) (context, []int) {
+	wordSeq, posSeq, _, ok := pyhsmm.walkBackward(sent, forwardScore, func(_ int, scoreArrayLog []float64, logSumScoreArrayLog float64, maxI int) int {
+		if !sampling {
+			return maxI
+		}
+		i := 0
+		r := rnd.Float64()
+		sumScore := 0.0
+		for {
+			sumScore += math.Exp(scoreArrayLog[i] - logSumScoreArrayLog)
+			if sumScore > r {
+				break
+			}
+			i++
+			if i >= len(scoreArrayLog) {
+				panic("sampling error in PYHSMM")
+			}
+		}
+		return i
+	})
+	if !ok {
+		panic("sampling error in PYHSMM")
+	}
+	return wordSeq, posSeq
+}
+
+// calcProposalScore returns the log probability that backward samples wordSeq and posSeq from forwardScore of sent (see NPYLM.calcProposalScore).
+func (pyhsmm *PYHSMM) calcProposalScore(sent []string, forwardScore forwardScoreForWordAndPosType, wordSeq context, posSeq []int) float64 {
+	// elements[m] is the history element of the mth word from the last one, and the words before the first one are bos
+	elements := make([]int, len(wordSeq)+pyhsmm.maxNgram-2, len(wordSeq)+pyhsmm.maxNgram-2)
+	for m := range elements {
+		elements[m] = pyhsmm.encodeHistoryElement(pyhsmm.maxWordLength, pyhsmm.bosPos)
+		if m < len(wordSeq) {
+			length := len(strings.Split(wordSeq[len(wordSeq)-1-m], pyhsmm.npylms[0].splitter)) - 1
+			if length >= pyhsmm.maxWordLength {
+				return math.Inf(-1)
+			}
+			elements[m] = pyhsmm.encodeHistoryElement(length, posSeq[len(wordSeq)-1-m])
+		}
+	}
+	historySize := pyhsmm.historySize()
+	_, _, score, ok := pyhsmm.walkBackward(sent, forwardScore, func(step int, _ []float64, _ float64, _ int) int {
+		if step >= len(wordSeq) {
+			return -1
+		}
+		h := 0
+		for m := step + pyhsmm.maxNgram - 2; m > step; m-- {
+			h = h*pyhsmm.historyElementSize() + elements[m]
+		}
+		// the index is (j*PosSize+nextPos)*historySize + h, and the element of the word is j*PosSize+nextPos
+		return elements[step]*historySize + h
+	})
+	if !ok {
+		return math.Inf(-1)
+	}
+	return score
+}
+
+// walkBackward walks from eos to the beginning of sent on forwardScore, and returns the words, their POS tags and the log probability of the choices (see NPYLM.walkBackward).
+// choose returns the index (j*PosSize+nextPos)*historySize+h of the previous word, its POS tag and its history at each step.
+func (pyhsmm *PYHSMM) walkBackward(sent []string, forwardScore forwardScoreForWordAndPosType, choose func(step int, scoreArrayLog []float64, logSumScoreArrayLog float64, maxI int) int) (context, []int, float64, bool) {
 	t := len(sent)
 	k := 0
 	prevWord := pyhsmm.eos
 	prevPos := pyhsmm.eosPos
-	u := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	uPos := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
+	// history of prevWord. it is unknown when prevWord is eos.
+	prevH := -1
+	historySize := pyhsmm.historySize()
 	base := pyhsmm.npylms[0].vpylm.hpylm.Base
 	samplingWord := string("")
 	samplingWordSeq := make(context, 0, len(sent))
 	samplingPosSeq := make([]int, 0, len(sent))
+	walkScore := 0.0
 	for {
 		if (t - k) == 0 {
 			break
 		}
 		if prevWord != pyhsmm.eos {
-			base = pyhsmm.npylms[0].calcBase(prevWord) // 文字レベルのスムージングは一つのVPYLMから
+			base = pyhsmm.npylms[0].calcCharBase(prevWord) // 文字レベルのスムージングは一つのVPYLMから
 		}
-		scoreArrayLog := make([]float64, pyhsmm.maxWordLength*pyhsmm.PosSize, pyhsmm.maxWordLength*pyhsmm.PosSize)
-		for i := 0; i < pyhsmm.maxWordLength*pyhsmm.PosSize; i++ {
+		scoreArrayLog := make([]float64, pyhsmm.maxWordLength*pyhsmm.PosSize*historySize, pyhsmm.maxWordLength*pyhsmm.PosSize*historySize)
+		for i := 0; i < pyhsmm.maxWordLength*pyhsmm.PosSize*historySize; i++ {
 			scoreArrayLog[i] = math.Inf(-1)
 		}
 		maxScore := math.Inf(-1)
-		maxJ := -1
-		maxNextPos := -1
+		maxI := -1
 		for j := 0; j < pyhsmm.maxWordLength; j++ {
+			if t-k-(j+1) < 0 {
+				continue
+			}
 			for nextPos := 0; nextPos < pyhsmm.PosSize; nextPos++ {
-				if t-k-(j+1) >= 0 {
-					u[0] = strings.Join(sent[(t-k-(j+1)):(t-k)], pyhsmm.npylms[0].splitter)
-					wordScore, _ := pyhsmm.npylms[prevPos].CalcProb(prevWord, u, base)
-					uPos[0] = strconv.Itoa(nextPos)
-					posScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(prevPos), uPos, pyhsmm.posHpylm.Base)
-					score := math.Log(wordScore) + math.Log(posScore) + forwardScore[t-(k+1)][j][nextPos]
+				for h := 0; h < historySize; h++ {
+					// history of prevWord is the nearest maxNgram-2 elements of (j, nextPos) and h.
+					fullHistory := pyhsmm.encodeHistoryElement(j, nextPos) + h*pyhsmm.historyElementSize()
+					if prevH != -1 && fullHistory%historySize != prevH {
+						continue
+					}
+					prevScore := forwardScore[t-(k+1)][j][nextPos][h]
+					if math.IsInf(prevScore, -1) {
+						continue
+					}
+					lengths, tags := pyhsmm.decodeHistory(fullHistory, pyhsmm.maxNgram-1)
+					u, ok := pyhsmm.npylms[0].makeContext(sent, t-(k+1), lengths)
+					if !ok {
+						continue
+					}
+					uPos, ok := pyhsmm.makePosContext(tags)
+					if !ok {
+						continue
+					}
+					wordScore, _ := pyhsmm.npylms[prevPos].CalcProb(prevWord, u, pyhsmm.npylms[prevPos].mixDictionaryBase(prevWord, base))
+					posScore, _ := pyhsmm.posHpylm.CalcProb(posSymbol(prevPos), uPos, pyhsmm.posHpylm.Base)
+					score := (math.Log(wordScore)+math.Log(posScore))/pyhsmm.temperature + prevScore
+					i := (j*pyhsmm.PosSize+nextPos)*historySize + h
 					if score > maxScore {
 						maxScore = score
-						maxJ = j
-						maxNextPos = nextPos
+						maxI = i
 					}
-					scoreArrayLog[j*pyhsmm.PosSize+nextPos] = score
-				} else {
-					// scoreArrayLog[j*pyhsmm.PosSize+nextPos] = math.Inf(-1)
+					scoreArrayLog[i] = score
 				}
 			}
 		}
 		logSumScoreArrayLog := pyhsmm.npylms[0].logsumexp(scoreArrayLog)
-		j := 0
-		nextPos := 0
-		if sampling {
-			r := rand.Float64()
-			sumScore := 0.0
-			for {
-				sumScore += math.Exp(scoreArrayLog[j*pyhsmm.PosSize+nextPos] - logSumScoreArrayLog)
-				if sumScore > r {
-					break
-				}
-				nextPos++
-				if nextPos == pyhsmm.PosSize {
-					nextPos = 0
-					j++
-				}
-				if j >= pyhsmm.maxWordLength {
-					panic("sampling error in PYHSMM")
-				}
-			}
-		} else {
-			j = maxJ
-			nextPos = maxNextPos
-		}
-		if t-k-(j+1) < 0 {
-			panic("sampling error in PYHSMM")
-		}
-		if nextPos >= pyhsmm.PosSize {
-			panic("sampling error in PYHSMM")
+		i := choose(len(samplingWordSeq), scoreArrayLog, logSumScoreArrayLog, maxI)
+		if i < 0 || i >= len(scoreArrayLog) || math.IsInf(scoreArrayLog[i], -1) {
+			return nil, nil, math.Inf(-1), false
 		}
+		walkScore += scoreArrayLog[i] - logSumScoreArrayLog
+		j := i / (pyhsmm.PosSize * historySize)
+		nextPos := (i / historySize) % pyhsmm.PosSize
 		samplingWord = strings.Join(sent[(t-k-(j+1)):(t-k)], pyhsmm.npylms[0].splitter)
 		samplingWordSeq = append(samplingWordSeq, samplingWord)
 		samplingPosSeq = append(samplingPosSeq, nextPos)
 		prevWord = samplingWord
 		prevPos = nextPos
+		prevH = i % historySize
 		t = t - (k + 1)
 		k = j
 	}
@@ -572,76 +1272,119 @@ func (pyhsmm *PYHSMM) backward(sent []string, forwardScore forwardScoreForWordAn
 		samplingWordReverse[(len(samplingWordSeq)-1)-i] = samplingWord
 		samplingPosReverse[(len(samplingPosSeq)-1)-i] = samplingPosSeq[i]
 	}
-	return samplingWordReverse, samplingPosReverse
+	return samplingWordReverse, samplingPosReverse, walkScore, true
 }
 
 func (pyhsmm *PYHSMM) addWordSeqAsCustomer(wordSeq context, posSeq []int) {
-	u := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	uPos := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
+	u := make(context, 0, pyhsmm.maxNgram-1)
+	uPos := make(context, 0, pyhsmm.maxNgram-1)
+	for n := 0; n < pyhsmm.maxNgram-1; n++ {
+		u = append(u, pyhsmm.bos)
+		uPos = append(uPos, posSymbol(pyhsmm.bosPos))
+	}
 	base := float64(0.0)
 	for i, word := range wordSeq {
 		pos := posSeq[i]
 		// base = pyhsmm.npylms[pos].calcBase(word)
-		base = pyhsmm.npylms[0].calcBase(word) // 文字レベルのスムージングは一つのVPYLMから
-		if i == 0 {
-			u[0] = pyhsmm.bos
-			uPos[0] = strconv.Itoa(pyhsmm.bosPos)
-		} else {
-			u[0] = wordSeq[i-1]
-			uPos[0] = strconv.Itoa(posSeq[i-1])
-		}
+		base = pyhsmm.npylms[0].calcCharBase(word) // 文字レベルのスムージングは一つのVPYLMから
 		// pyhsmm.npylms[pos].AddCustomer(word, u, base, pyhsmm.npylms[pos].addCustomerBase)
-		pyhsmm.npylms[pos].AddCustomer(word, u, base, pyhsmm.npylms[0].addCustomerBase) // 文字レベルのスムージングは一つのVPYLMに追加
-		pyhsmm.posHpylm.AddCustomer(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.Base, pyhsmm.posHpylm.addCustomerBaseNull)
+		pyhsmm.npylms[pos].addCustomer(word, u, pyhsmm.npylms[pos].mixDictionaryBase(word, base), pyhsmm.npylms[0].addCustomerBase) // 文字レベルのスムージングは一つのVPYLMに追加
+		pyhsmm.posHpylm.addCustomer(posSymbol(pos), uPos, pyhsmm.posHpylm.Base, pyhsmm.posHpylm.addCustomerBaseNull)
+		u = append(u[1:], word)
+		uPos = append(uPos[1:], posSymbol(pos))
 	}
 
-	u[0] = wordSeq[len(wordSeq)-1]
 	// base = pyhsmm.npylms[pyhsmm.eosPos].vpylm.hpylm.Base
 	base = pyhsmm.npylms[0].vpylm.hpylm.Base
-	pyhsmm.npylms[pyhsmm.eosPos].AddCustomer(pyhsmm.eos, u, base, pyhsmm.npylms[0].addCustomerBaseNull)
-	uPos[0] = strconv.Itoa(posSeq[len(posSeq)-1])
-	pyhsmm.posHpylm.AddCustomer(strconv.Itoa(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base, pyhsmm.posHpylm.addCustomerBaseNull)
+	pyhsmm.npylms[pyhsmm.eosPos].addCustomer(pyhsmm.eos, u, base, pyhsmm.npylms[0].addCustomerBaseNull)
+	pyhsmm.posHpylm.addCustomer(posSymbol(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base, pyhsmm.posHpylm.addCustomerBaseNull)
 	return
 }
 
-func (pyhsmm *PYHSMM) removeWordSeqAsCustomer(wordSeq context, posSeq []int) {
-	u := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
-	uPos := make(context, pyhsmm.maxNgram-1, pyhsmm.maxNgram-1)
+func (pyhsmm *PYHSMM) removeWordSeqAsCustomer(wordSeq context, posSeq []int) error {
+	u := make(context, 0, pyhsmm.maxNgram-1)
+	uPos := make(context, 0, pyhsmm.maxNgram-1)
+	for n := 0; n < pyhsmm.maxNgram-1; n++ {
+		u = append(u, pyhsmm.bos)
+		uPos = append(uPos, posSymbol(pyhsmm.bosPos))
+	}
 	for i, word := range wordSeq {
 		pos := posSeq[i]
-		if i == 0 {
-			u[0] = pyhsmm.bos
-			uPos[0] = strconv.Itoa(pyhsmm.bosPos)
-		} else {
-			u[0] = wordSeq[i-1]
-			uPos[0] = strconv.Itoa(posSeq[i-1])
+		if err := pyhsmm.npylms[pos].RemoveCustomer(word, u, pyhsmm.npylms[0].removeCustomerBase); err != nil {
+			return err
 		}
-		pyhsmm.npylms[pos].RemoveCustomer(word, u, pyhsmm.npylms[0].removeCustomerBase)
-		pyhsmm.posHpylm.RemoveCustomer(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.addCustomerBaseNull)
+		if err := pyhsmm.posHpylm.RemoveCustomer(posSymbol(pos), uPos, pyhsmm.posHpylm.removeCustomerBaseNull); err != nil {
+			return err
+		}
+		u = append(u[1:], word)
+		uPos = append(uPos[1:], posSymbol(pos))
 	}
 
-	u[0] = wordSeq[len(wordSeq)-1]
-	pyhsmm.npylms[pyhsmm.eosPos].RemoveCustomer(pyhsmm.eos, u, pyhsmm.npylms[0].removeCustomerBaseNull)
-	uPos[0] = strconv.Itoa(posSeq[len(posSeq)-1])
-	pyhsmm.posHpylm.RemoveCustomer(strconv.Itoa(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.addCustomerBaseNull)
-	return
+	if err := pyhsmm.npylms[pyhsmm.eosPos].RemoveCustomer(pyhsmm.eos, u, pyhsmm.npylms[0].removeCustomerBaseNull); err != nil {
+		return err
+	}
+	return pyhsmm.posHpylm.RemoveCustomer(posSymbol(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.removeCustomerBaseNull)
+}
+
+// SetDictionary sets the user dictionary as a prior of words for each POS tag (see NPYLM.SetDictionary).
+// entries without POS tags are used for all POS tags.
+func (pyhsmm *PYHSMM) SetDictionary(entries []DictionaryEntry, weight float64) error {
+	entriesForPos := make([][]DictionaryEntry, pyhsmm.PosSize, pyhsmm.PosSize)
+	for _, entry := range entries {
+		if entry.Pos >= pyhsmm.PosSize {
+			return fmt.Errorf("%w. POS of %v (%v) should be smaller than PosSize (%v)", ErrInvalidParameter, entry.Word, entry.Pos, pyhsmm.PosSize)
+		}
+		for pos := 0; pos < pyhsmm.PosSize; pos++ {
+			if entry.Pos == -1 || entry.Pos == pos {
+				entriesForPos[pos] = append(entriesForPos[pos], entry)
+			}
+		}
+	}
+	for pos := 0; pos < pyhsmm.PosSize; pos++ {
+		if err := pyhsmm.npylms[pos].SetDictionary(entriesForPos[pos], weight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCharBaseCacheSize enables LRU cache of the probabilities of words by the character VPYLM (see NPYLM.SetCharBaseCacheSize).
+// the cache is shared by all POS tags, because they share the character VPYLM.
+func (pyhsmm *PYHSMM) SetCharBaseCacheSize(size int) error {
+	return pyhsmm.npylms[0].SetCharBaseCacheSize(size)
 }
 
-// Initialize initializes parameters.
-func (pyhsmm *PYHSMM) Initialize(dataContainer *DataContainer) {
+// Initialize initializes parameters. it returns ErrFormat if the partial annotations of dataContainer cannot be satisfied (see SentConstraint.check).
+func (pyhsmm *PYHSMM) Initialize(dataContainer *DataContainer) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. Initialize of PYHSMM", ErrFrozen)
+	}
+	if err := checkConstraints(dataContainer.Constraints, pyhsmm.maxWordLength, pyhsmm.PosSize); err != nil {
+		return err
+	}
 	sents := dataContainer.Sents
 	samplingWordSeqs := dataContainer.SamplingWordSeqs
 	samplingPosSeqs := dataContainer.SamplingPosSeqs
 	for i := 0; i < len(sents); i++ {
 		sent := sents[i]
+		constraint := dataContainer.GetConstraint(i)
 		start := 0
 		for {
-			r := rand.Intn(pyhsmm.maxWordLength) + 1
+			r := pyhsmm.rnd.Intn(pyhsmm.maxWordLength) + 1
 			end := start + r
 			if end > len(sent) {
 				end = len(sent)
 			}
-			pos := rand.Intn(pyhsmm.PosSize)
+			// if the sentence has partial annotations, forced word boundaries are kept and forbidden ones are skipped, so fixed words are whole words.
+			// fixed POS tags are used only for the fixed words themselves
+			if forcedEnd := constraint.nextForcedBoundary(start, len(sent)); end > forcedEnd {
+				end = forcedEnd
+			}
+			end = constraint.nextAllowedBoundary(end, len(sent))
+			pos := pyhsmm.rnd.Intn(pyhsmm.PosSize)
+			if constraint != nil && constraint.FixedPos[end-1] != -1 && constraint.allowWord(start, end-1) {
+				pos = constraint.FixedPos[end-1]
+			}
 			samplingWordSeqs[i] = append(samplingWordSeqs[i], strings.Join(sent[start:end], pyhsmm.npylms[0].splitter))
 			samplingPosSeqs[i] = append(samplingPosSeqs[i], pos)
 			start = end
@@ -651,11 +1394,23 @@ func (pyhsmm *PYHSMM) Initialize(dataContainer *DataContainer) {
 		}
 		pyhsmm.addWordSeqAsCustomer(samplingWordSeqs[i], samplingPosSeqs[i])
 	}
-	return
+	return nil
 }
 
 // InitializeFromAnnotatedData initializes parameters from annotated texts.
-func (pyhsmm *PYHSMM) InitializeFromAnnotatedData(dataContainer *DataContainer) {
+func (pyhsmm *PYHSMM) InitializeFromAnnotatedData(dataContainer *DataContainer) error {
+	return pyhsmm.InitializeFromAnnotatedDataWithWeight(dataContainer, 1)
+}
+
+// InitializeFromAnnotatedDataWithWeight initializes parameters from annotated texts and their POS tags (SamplingPosSeqs), and each sentence is added weight times as customers.
+// the annotated texts are not resampled by TrainWordSegmentation of other unsegmented texts, so they can be used for semi-supervised training.
+func (pyhsmm *PYHSMM) InitializeFromAnnotatedDataWithWeight(dataContainer *DataContainer, weight int) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. InitializeFromAnnotatedData of PYHSMM", ErrFrozen)
+	}
+	if weight <= 0 {
+		return fmt.Errorf("%w. weight should be bigger than 0", ErrInvalidParameter)
+	}
 	sents := dataContainer.Sents
 	samplingWordSeqs := dataContainer.SamplingWordSeqs
 	samplingPosSeqs := dataContainer.SamplingPosSeqs
@@ -687,28 +1442,62 @@ func (pyhsmm *PYHSMM) InitializeFromAnnotatedData(dataContainer *DataContainer)
 		}
 		samplingWordSeqs[i] = adjustedSamplingWordSeq
 		samplingPosSeqs[i] = adjustedSamplingPosSeq
-		pyhsmm.addWordSeqAsCustomer(samplingWordSeqs[i], samplingPosSeqs[i])
+		for w := 0; w < weight; w++ {
+			pyhsmm.addWordSeqAsCustomer(samplingWordSeqs[i], samplingPosSeqs[i])
+		}
 	}
-	return
+	return nil
+}
+
+// ResampleAnnotatedPOSTags resamples POS tags of annotated texts added weight times by InitializeFromAnnotatedDataWithWeight, and their segmentations are kept.
+// it is used every epoch for semi-supervised training with annotated texts without POS tags, whose initial POS tags are random.
+func (pyhsmm *PYHSMM) ResampleAnnotatedPOSTags(dataContainer *DataContainer, weight int) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. ResampleAnnotatedPOSTags of PYHSMM", ErrFrozen)
+	}
+	if weight <= 0 {
+		return fmt.Errorf("%w. weight should be bigger than 0", ErrInvalidParameter)
+	}
+	randIndexes := pyhsmm.rnd.Perm(dataContainer.Size)
+	for _, r := range randIndexes {
+		wordSeq := dataContainer.SamplingWordSeqs[r]
+		for w := 0; w < weight; w++ {
+			if err := pyhsmm.removeWordSeqAsCustomer(wordSeq, dataContainer.SamplingPosSeqs[r]); err != nil {
+				return err
+			}
+		}
+		forwardScore := pyhsmm.forwardForSamplingPosOnly(wordSeq)
+		dataContainer.SamplingPosSeqs[r] = pyhsmm.backwardPosOnly(forwardScore, true, wordSeq)
+		for w := 0; w < weight; w++ {
+			pyhsmm.addWordSeqAsCustomer(wordSeq, dataContainer.SamplingPosSeqs[r])
+		}
+	}
+	return nil
 }
 
 // Train train n-gram parameters from given word sequences.
-func (pyhsmm *PYHSMM) Train(dataContainer *DataContainer) {
+func (pyhsmm *PYHSMM) Train(dataContainer *DataContainer) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. Train of PYHSMM", ErrFrozen)
+	}
 	removeFlag := false
 	for pos := 0; pos < pyhsmm.PosSize; pos++ {
-		if len(pyhsmm.npylms[pos].vpylm.hpylm.restaurants) != 0 { // epoch == 0
+		if pyhsmm.npylms[pos].vpylm.hpylm.restaurantCount != 0 { // epoch == 0
 			removeFlag = true
 		}
 	}
 	bar := pb.StartNew(dataContainer.Size)
-	randIndexes := rand.Perm(dataContainer.Size)
+	randIndexes := pyhsmm.rnd.Perm(dataContainer.Size)
 	for i := 0; i < dataContainer.Size; i++ {
 		bar.Add(1)
 		r := randIndexes[i]
 		wordSeq := dataContainer.SamplingWordSeqs[r]
 		posSeq := dataContainer.SamplingPosSeqs[r]
 		if removeFlag {
-			pyhsmm.removeWordSeqAsCustomer(wordSeq, posSeq)
+			if err := pyhsmm.removeWordSeqAsCustomer(wordSeq, posSeq); err != nil {
+				bar.Finish()
+				return err
+			}
 		}
 		forwardScore := pyhsmm.forwardForSamplingPosOnly(wordSeq)
 		sampledPosSeq := pyhsmm.backwardPosOnly(forwardScore, true, wordSeq)
@@ -723,7 +1512,7 @@ func (pyhsmm *PYHSMM) Train(dataContainer *DataContainer) {
 		pyhsmm.npylms[pos].estimateHyperPrameters()
 	}
 	pyhsmm.posHpylm.estimateHyperPrameters()
-	return
+	return nil
 }
 
 // ReturnNgramProb returns n-gram probability.
@@ -732,13 +1521,13 @@ func (pyhsmm *PYHSMM) Train(dataContainer *DataContainer) {
 func (pyhsmm *PYHSMM) ReturnNgramProb(word string, u context) float64 {
 	p := 0.0
 	sumPpos := 0.0
-	base := pyhsmm.npylms[0].calcBase(word) // 文字レベルのスムージングは一つのVPYLMから
+	base := pyhsmm.npylms[0].calcCharBase(word) // 文字レベルのスムージングは一つのVPYLMから
 	uPos := context{""}
-	pPosEos, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base)
+	pPosEos, _ := pyhsmm.posHpylm.CalcProb(posSymbol(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base)
 	for pos := 0; pos < pyhsmm.PosSize; pos++ {
 		// base := pyhsmm.npylms[pos].calcBase(word)
-		pGivenPos, _ := pyhsmm.npylms[pos].CalcProb(word, u, base)
-		pPos, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pos), uPos, pyhsmm.posHpylm.Base)
+		pGivenPos, _ := pyhsmm.npylms[pos].CalcProb(word, u, pyhsmm.npylms[pos].mixDictionaryBase(word, base))
+		pPos, _ := pyhsmm.posHpylm.CalcProb(posSymbol(pos), uPos, pyhsmm.posHpylm.Base)
 		p += pGivenPos * (pPos / (1.0 - pPosEos))
 		sumPpos += pPos
 	}
@@ -751,6 +1540,38 @@ func (pyhsmm *PYHSMM) ReturnMaxN() int {
 	return pyhsmm.maxNgram
 }
 
+// Freeze makes pyhsmm inference-only with much lower memory (see HPYLM.Freeze). all npylms share one vocabulary.
+func (pyhsmm *PYHSMM) Freeze() {
+	vocab := newSymbolTable()
+	for _, npylm := range pyhsmm.npylms {
+		npylm.freeze(vocab)
+	}
+	pyhsmm.posHpylm.freeze(vocab)
+}
+
+// SetRandSeed sets the seed of the random number generator used for sampling.
+func (pyhsmm *PYHSMM) SetRandSeed(seed int64) {
+	pyhsmm.setRand(newSplitMix64(seed))
+}
+
+func (pyhsmm *PYHSMM) setRand(src *splitMix64) {
+	pyhsmm.rndSource = src
+	pyhsmm.rnd = rand.New(src)
+	for _, npylm := range pyhsmm.npylms {
+		npylm.setRand(src)
+	}
+	pyhsmm.posHpylm.setRand(src)
+}
+
+// randState returns the state of the random number generator to save checkpoints.
+func (pyhsmm *PYHSMM) randState() uint64 {
+	return pyhsmm.rndSource.state
+}
+
+func (pyhsmm *PYHSMM) setRandState(state uint64) {
+	pyhsmm.rndSource.state = state
+}
+
 // Save returns json.Marshal(pyhsmmJSON) and pyhsmmJSON.
 // pyhsmmJSON is struct to save. its variables can be exported.
 func (pyhsmm *PYHSMM) save() ([]byte, interface{}) {
@@ -791,42 +1612,37 @@ func (pyhsmm *PYHSMM) save() ([]byte, interface{}) {
 }
 
 // Load pyhsmm.
-func (pyhsmm *PYHSMM) load(v []byte) {
-	// 本当はposSizeだけのnpylmをスライスに格納させて読みこみたいが、面倒なので、適当に大きな値分のnpylmを作ってjsonを読む。
-	// そうしないとエラー、最終的なモデルのnpylmsは適切な大きさで返される
-	tmpPosSize := 100
-	Npylms := make([]*nPYLMJSON, 0, tmpPosSize)
-	for i := 0; i < tmpPosSize; i++ {
-		npylmJSON := &nPYLMJSON{hPYLMJSON: &hPYLMJSON{Restaurants: make(map[string]*restaurantJSON)}}
-		Npylms = append(Npylms, npylmJSON)
-	}
-
-	pyhsmmJSON := &pYHSMMJSON{Npylms: Npylms, PosHpylm: &hPYLMJSON{Restaurants: make(map[string]*restaurantJSON)}}
+func (pyhsmm *PYHSMM) load(v []byte) error {
+	// npylms are loaded one by one by NPYLM.load, because json cannot allocate the embedded *hPYLMJSON of nPYLMJSON
+	pyhsmmJSON := new(struct {
+		pYHSMMJSON
+		Npylms []json.RawMessage
+	})
 	err := json.Unmarshal(v, &pyhsmmJSON)
 	if err != nil {
-		panic("load error in PYHSMM")
+		return fmt.Errorf("%w. load error in PYHSMM: %v", ErrFormat, err)
 	}
-	pyhsmm.npylms = func(pyhsmmJSON *pYHSMMJSON) []*NPYLM {
-		npylms := make([]*NPYLM, 0, 0)
-		for _, npylmJSON := range pyhsmmJSON.Npylms {
-			npylmV, err := json.Marshal(&npylmJSON)
-			if err != nil {
-				panic("load error in load npylm in PYHSMM")
-			}
-			// npylm := NewNPYLM(npylmJSON.Theta[0], npylmJSON.D[0], npylmJSON.GammaA[0], npylmJSON.GammaB[0], npylmJSON.BetaA[0], npylmJSON.BetaB[0], 0.1, 0.1, npylmJSON.MaxNgram, npylmJSON.MaxWordLength)
-			// restaurants まで作ってあげないと、あとで nil pointer にアクセスしてエラーになる
-			npylm := &NPYLM{HPYLM: &HPYLM{restaurants: make(map[string]*restaurant)}, vpylm: &VPYLM{hpylm: &HPYLM{restaurants: make(map[string]*restaurant)}}}
-			npylm.load(npylmV)
-			npylms = append(npylms, npylm)
+	if len(pyhsmmJSON.Npylms) != pyhsmmJSON.PosSize+1 {
+		return fmt.Errorf("%w. load error in PYHSMM: number of npylms (%v) is not PosSize + 1 (%v)", ErrFormat, len(pyhsmmJSON.Npylms), pyhsmmJSON.PosSize+1)
+	}
+	npylms := make([]*NPYLM, 0, len(pyhsmmJSON.Npylms))
+	for _, npylmV := range pyhsmmJSON.Npylms {
+		npylm := newNPYLMToLoad()
+		if err := npylm.load(npylmV); err != nil {
+			return err
 		}
-		return npylms
-	}(pyhsmmJSON)
+		npylms = append(npylms, npylm)
+	}
+	pyhsmm.npylms = npylms
+	pyhsmm.setRand(pyhsmm.rndSource)
 
 	posHpylmV, err := json.Marshal(&pyhsmmJSON.PosHpylm)
 	if err != nil {
 		panic("load error in load posHpylm in PYHSMM")
 	}
-	pyhsmm.posHpylm.load(posHpylmV)
+	if err := pyhsmm.posHpylm.load(posHpylmV); err != nil {
+		return err
+	}
 
 	pyhsmm.maxNgram = pyhsmmJSON.MaxNgram
 	pyhsmm.maxWordLength = pyhsmmJSON.MaxWordLength
@@ -839,7 +1655,61 @@ func (pyhsmm *PYHSMM) load(v []byte) {
 	pyhsmm.eosPos = pyhsmmJSON.EosPos
 	pyhsmm.bosPos = pyhsmmJSON.BosPos
 
-	return
+	return nil
+}
+
+// saveBinary writes pyhsmm in binary format.
+func (pyhsmm *PYHSMM) saveBinary(bw *binaryWriter) {
+	bw.writeInt(pyhsmm.PosSize)
+	bw.writeInt(pyhsmm.eosPos)
+	bw.writeInt(pyhsmm.bosPos)
+	bw.writeUvarint(uint64(len(pyhsmm.npylms)))
+	for _, npylm := range pyhsmm.npylms {
+		npylm.saveBinary(bw)
+	}
+	pyhsmm.posHpylm.saveBinary(bw)
+
+	bw.writeInt(pyhsmm.maxNgram)
+	bw.writeInt(pyhsmm.maxWordLength)
+	bw.writeString(pyhsmm.bos)
+	bw.writeString(pyhsmm.eos)
+	bw.writeString(pyhsmm.bow)
+	bw.writeString(pyhsmm.eow)
+}
+
+// loadBinary reads pyhsmm written by saveBinary.
+func (pyhsmm *PYHSMM) loadBinary(br *binaryReader) error {
+	pyhsmm.PosSize = br.readInt()
+	pyhsmm.eosPos = br.readInt()
+	pyhsmm.bosPos = br.readInt()
+	n := br.readLength()
+	if br.err == nil && n != pyhsmm.PosSize+1 {
+		return fmt.Errorf("%w. load error in PYHSMM: number of npylms (%v) is not PosSize + 1 (%v)", ErrFormat, n, pyhsmm.PosSize+1)
+	}
+	npylms := make([]*NPYLM, 0, capacityHint(n))
+	for i := 0; i < n && br.err == nil; i++ {
+		npylm := newNPYLMToLoad()
+		if err := npylm.loadBinary(br); err != nil {
+			return err
+		}
+		npylms = append(npylms, npylm)
+	}
+	pyhsmm.npylms = npylms
+	pyhsmm.setRand(pyhsmm.rndSource)
+	if err := pyhsmm.posHpylm.loadBinary(br); err != nil {
+		return err
+	}
+
+	pyhsmm.maxNgram = br.readInt()
+	pyhsmm.maxWordLength = br.readInt()
+	pyhsmm.bos = br.readString()
+	pyhsmm.eos = br.readString()
+	pyhsmm.bow = br.readString()
+	pyhsmm.eow = br.readString()
+	if br.err != nil {
+		return fmt.Errorf("%w. load error in PYHSMM: %v", ErrFormat, br.err)
+	}
+	return nil
 }
 
 // // EachScoreForPython is for python bindings.
@@ -969,9 +1839,201 @@ func (pyhsmm *PYHSMM) load(v []byte) {
 // }
 
 // CalcTestScore calculates score of word sequences score like perplixity.
-func (pyhsmm *PYHSMM) CalcTestScore(wordSeqs [][]string, threadsNum int) (float64, float64) {
-	// TODO
-	return 0.0, 0.0
+// POS tags are marginalized out by forward algorithm.
+func (pyhsmm *PYHSMM) CalcTestScore(wordSeqs [][]string, threadsNum int) (float64, float64, error) {
+	return pyhsmm.calcCorpusScore(len(wordSeqs), threadsNum, func(i int) (float64, int) {
+		return pyhsmm.CalcWordSeqScore(wordSeqs[i]), len(wordSeqs[i])
+	})
+}
+
+// CalcTestScoreWithPOS calculates score of word sequences and their POS sequences score like perplixity from their joint probability.
+func (pyhsmm *PYHSMM) CalcTestScoreWithPOS(wordSeqs [][]string, posSeqs [][]int, threadsNum int) (float64, float64, error) {
+	if len(wordSeqs) != len(posSeqs) {
+		return 0.0, 0.0, fmt.Errorf("%w. size of wordSeqs (%v) != size of posSeqs (%v)", ErrInvalidParameter, len(wordSeqs), len(posSeqs))
+	}
+	return pyhsmm.calcCorpusScore(len(wordSeqs), threadsNum, func(i int) (float64, int) {
+		return pyhsmm.CalcWordAndPosSeqScore(wordSeqs[i], posSeqs[i]), len(wordSeqs[i])
+	})
+}
+
+func (pyhsmm *PYHSMM) calcCorpusScore(seqSize int, threadsNum int, calcSeqScore func(int) (float64, int)) (float64, float64, error) {
+	if threadsNum <= 0 {
+		return 0.0, 0.0, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	ch := make(chan int, threadsNum)
+	wg := sync.WaitGroup{}
+
+	scores := make([]float64, seqSize, seqSize)
+	wordSizes := make([]int, seqSize, seqSize)
+	for i := 0; i < seqSize; i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			scores[i], wordSizes[i] = calcSeqScore(i)
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	corpusScore := float64(0.0)
+	wordSize := int(0)
+	for i, seqScore := range scores {
+		corpusScore += seqScore
+		wordSize += wordSizes[i]
+	}
+	corpusScore *= -1.0
+	corpusScoreDivWordSize := corpusScore / float64(wordSize)
+	corpusScoreDivSentSize := corpusScore / float64(seqSize)
+	return corpusScoreDivWordSize, corpusScoreDivSentSize, nil
+}
+
+// CalcWordSeqScore calculates log probability of given word sequence marginalized over POS sequences.
+// eos is not included like NPYLM.CalcWordSeqScore.
+func (pyhsmm *PYHSMM) CalcWordSeqScore(wordSeq context) float64 {
+	if len(wordSeq) == 0 {
+		return 0.0
+	}
+	forwardScore := pyhsmm.forwardForSamplingPosOnly(wordSeq)
+	scores := make([]float64, 0, pyhsmm.PosSize*pyhsmm.posHistorySize())
+	for pos := 0; pos < pyhsmm.PosSize; pos++ {
+		for _, score := range forwardScore[len(wordSeq)-1][pos] {
+			if !math.IsInf(score, -1) {
+				scores = append(scores, score)
+			}
+		}
+	}
+	return pyhsmm.npylms[0].logsumexp(scores)
+}
+
+// CalcSentScore calculates log probability of given unsegmented sentence marginalized over all segmentations and POS sequences.
+// eos is included.
+func (pyhsmm *PYHSMM) CalcSentScore(sent []string) float64 {
+	if len(sent) == 0 {
+		return 0.0
+	}
+	forwardScore := pyhsmm.calcForwardScore(sent, nil, false)
+	historySize := pyhsmm.historySize()
+	t := len(sent) - 1
+	scores := make([]float64, 0, pyhsmm.maxWordLength*pyhsmm.PosSize*historySize)
+	for k := 0; k < pyhsmm.maxWordLength; k++ {
+		for pos := 0; pos < pyhsmm.PosSize; pos++ {
+			for h := 0; h < historySize; h++ {
+				prevScore := forwardScore[t][k][pos][h]
+				if math.IsInf(prevScore, -1) {
+					continue
+				}
+				score := pyhsmm.calcEosScore(sent, k, pos, h)
+				if math.IsInf(score, -1) {
+					continue
+				}
+				scores = append(scores, score+prevScore)
+			}
+		}
+	}
+	if len(scores) == 0 {
+		return math.Inf(-1)
+	}
+	return pyhsmm.npylms[0].logsumexp(scores)
+}
+
+// calcEosScore returns log probability of eos after the last word of sent whose state is forwardScore[len(sent)-1][k][pos][h].
+// it returns -inf if the state does not match the sentence.
+func (pyhsmm *PYHSMM) calcEosScore(sent []string, k int, pos int, h int) float64 {
+	// history of eos is the nearest maxNgram-1 elements of (k, pos) and h.
+	lengths, tags := pyhsmm.decodeHistory(pyhsmm.encodeHistoryElement(k, pos)+h*pyhsmm.historyElementSize(), pyhsmm.maxNgram-1)
+	u, ok := pyhsmm.npylms[0].makeContext(sent, len(sent)-1, lengths)
+	if !ok {
+		return math.Inf(-1)
+	}
+	uPos, ok := pyhsmm.makePosContext(tags)
+	if !ok {
+		return math.Inf(-1)
+	}
+	wordScore, _ := pyhsmm.npylms[pyhsmm.eosPos].CalcProb(pyhsmm.eos, u, pyhsmm.npylms[0].vpylm.hpylm.Base)
+	posScore, _ := pyhsmm.posHpylm.CalcProb(posSymbol(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base)
+	return math.Log(wordScore) + math.Log(posScore)
+}
+
+// CalcWordAndPosSeqScore calculates joint log probability of given word sequence and POS sequence.
+// eos is not included like NPYLM.CalcWordSeqScore.
+func (pyhsmm *PYHSMM) CalcWordAndPosSeqScore(wordSeq context, posSeq []int) float64 {
+	u := make(context, 0, pyhsmm.maxNgram-1)
+	uPos := make(context, 0, pyhsmm.maxNgram-1)
+	for n := 0; n < pyhsmm.maxNgram-1; n++ {
+		u = append(u, pyhsmm.bos)
+		uPos = append(uPos, posSymbol(pyhsmm.bosPos))
+	}
+	seqScore := float64(0.0)
+	for i, word := range wordSeq {
+		pos := posSeq[i]
+		base := pyhsmm.npylms[0].calcCharBase(word) // 文字レベルのスムージングは一つのVPYLMから
+		p, _ := pyhsmm.npylms[pos].CalcProb(word, u, pyhsmm.npylms[pos].mixDictionaryBase(word, base))
+		posP, _ := pyhsmm.posHpylm.CalcProb(posSymbol(pos), uPos, pyhsmm.posHpylm.Base)
+		seqScore += math.Log(p) + math.Log(posP)
+		u = append(u[1:], word)
+		uPos = append(uPos[1:], posSymbol(pos))
+	}
+	return seqScore
+}
+
+// calcWordAndPosSeqScoreWithEos calculates joint log probability of given word sequence and POS sequence including eos.
+func (pyhsmm *PYHSMM) calcWordAndPosSeqScoreWithEos(wordSeq context, posSeq []int) float64 {
+	u := make(context, 0, pyhsmm.maxNgram-1)
+	uPos := make(context, 0, pyhsmm.maxNgram-1)
+	for n := 0; n < pyhsmm.maxNgram-1; n++ {
+		u = append(u, pyhsmm.bos)
+		uPos = append(uPos, posSymbol(pyhsmm.bosPos))
+	}
+	for i, word := range wordSeq {
+		u = append(u[1:], word)
+		uPos = append(uPos[1:], posSymbol(posSeq[i]))
+	}
+	wordScore, _ := pyhsmm.npylms[pyhsmm.eosPos].CalcProb(pyhsmm.eos, u, pyhsmm.npylms[0].vpylm.hpylm.Base)
+	posScore, _ := pyhsmm.posHpylm.CalcProb(posSymbol(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base)
+	return pyhsmm.CalcWordAndPosSeqScore(wordSeq, posSeq) + math.Log(wordScore) + math.Log(posScore)
+}
+
+// SetMetropolisHastings enables Metropolis-Hastings correction of TrainWordSegmentation (see NPYLM.SetMetropolisHastings).
+// the proposals are pairs of segmentations and POS tags.
+func (pyhsmm *PYHSMM) SetMetropolisHastings(enabled bool) {
+	pyhsmm.metropolisHastings = enabled
+}
+
+// ReturnAcceptanceStats returns the statistics of Metropolis-Hastings correction in the last TrainWordSegmentation.
+func (pyhsmm *PYHSMM) ReturnAcceptanceStats() AcceptanceStats {
+	return pyhsmm.acceptanceStats
+}
+
+// SetTemperature sets the temperature of sampling for simulated annealing (see NPYLM.SetTemperature).
+// the log probabilities of both words and POS tags are divided by temperature.
+func (pyhsmm *PYHSMM) SetTemperature(temperature float64) error {
+	if !(temperature > 0.0) || math.IsInf(temperature, 1) {
+		return fmt.Errorf("%w. temperature should be bigger than 0 (%v)", ErrInvalidParameter, temperature)
+	}
+	pyhsmm.temperature = temperature
+	return nil
+}
+
+// TestPOSTagging inferences POS tags of input segmented texts.
+func (pyhsmm *PYHSMM) TestPOSTagging(wordSeqs [][]string, threadsNum int) ([][]int, error) {
+	posSeqs := make([][]int, len(wordSeqs), len(wordSeqs))
+	if threadsNum <= 0 {
+		return nil, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	ch := make(chan int, threadsNum)
+	wg := sync.WaitGroup{}
+	for i := 0; i < len(wordSeqs); i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			forwardScore := pyhsmm.forwardForSamplingPosOnly(wordSeqs[i])
+			posSeqs[i] = pyhsmm.backwardPosOnly(forwardScore, false, wordSeqs[i])
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	return posSeqs, nil
 }
 
 // ShowParameters shows hyperparameters of this model.
@@ -2,7 +2,11 @@ package bayselm
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,19 +31,29 @@ func TestPYHSMM(t *testing.T) {
 	batch = 128
 	threads = 1
 	posSize = 1
-	pyhsmm := NewPYHSMM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 8, posSize, "")
+	pyhsmm, err := NewPYHSMM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 8, posSize, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	dataContainerForTrain := NewDataContainer("../data/alice.raw", "", 128)
+	dataContainerForTrain, err := NewDataContainer("../data/alice.raw", "", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
 	pyhsmm.Initialize(dataContainerForTrain)
 	for e := 0; e < epoch; e++ {
-		pyhsmm.TrainWordSegmentation(dataContainerForTrain, threads, batch)
+		if err := pyhsmm.TrainWordSegmentation(dataContainerForTrain, threads, batch); err != nil {
+			t.Fatal(err)
+		}
 	}
 	for i := 0; i < dataContainerForTrain.Size; i++ {
-		pyhsmm.removeWordSeqAsCustomer(dataContainerForTrain.SamplingWordSeqs[i], dataContainerForTrain.SamplingPosSeqs[i])
+		if err := pyhsmm.removeWordSeqAsCustomer(dataContainerForTrain.SamplingWordSeqs[i], dataContainerForTrain.SamplingPosSeqs[i]); err != nil {
+			t.Fatal(err)
+		}
 	}
 	for i := 0; i < posSize+1; i++ {
-		if !(len(pyhsmm.npylms[i].restaurants) == 0) {
-			t.Error("len(npylm.restaurants) is not 0", pyhsmm.npylms[0].restaurants)
+		if !(pyhsmm.npylms[i].restaurantCount == 0) {
+			t.Error("len(npylm.restaurants) is not 0", pyhsmm.npylms[0].restaurantMap())
 		}
 		if !(len(pyhsmm.npylms[i].word2sampledDepthMemory) == 0) {
 			t.Error("len(word2sampledDepthMemory) is not 0", pyhsmm.npylms[i].word2sampledDepthMemory)
@@ -63,23 +77,477 @@ func TestPerformanceOfPYHSMM(t *testing.T) {
 	epoch = 5
 	posSize = 4
 	var npylm NgramLM
-	npylm = NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 8, "")
+	var err error
+	npylm, err = NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 8, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 	var pyhsmm NgramLM
-	pyhsmm = NewPYHSMM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 8, posSize, "")
+	pyhsmm, err = NewPYHSMM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 8, posSize, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	dataContainerForTrain := NewDataContainerFromAnnotatedData("../alice.train.txt")
-	dataContainerForTest := NewDataContainerFromAnnotatedData("../alice.test.txt")
+	dataContainerForTrain, err := NewDataContainerFromAnnotatedData("../alice.train.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataContainerForTest, err := NewDataContainerFromAnnotatedData("../alice.test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
 	for e := 0; e < epoch; e++ {
 		fmt.Println("epoch = ", e)
-		pyhsmm.Train(dataContainerForTrain)
-		npylm.Train(dataContainerForTrain)
+		if err := pyhsmm.Train(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
+		if err := npylm.Train(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	npylmDummy := NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 8, "")
-	npylmDummy.InitializeFromAnnotatedData(dataContainerForTest)
+	npylmDummy, err := NewNPYLM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 8, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := npylmDummy.InitializeFromAnnotatedData(dataContainerForTest); err != nil {
+		t.Fatal(err)
+	}
 	perplexityOfNpylm := CalcPerplexity(npylm, dataContainerForTest)
 	perplexityOfPyhsmm := CalcPerplexity(pyhsmm, dataContainerForTest)
 	if !(perplexityOfPyhsmm < perplexityOfNpylm) {
 		t.Error("probably error! a perplexity of NPYLM is expected to be lower than a perplexity of HPYLM. ", "perplexityOfPyhsmm = ", perplexityOfPyhsmm, "perplexityOfNpylm = ", perplexityOfNpylm)
 	}
 }
+
+func TestPYHSMMTrigram(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	var theta float64
+	var d float64
+	var epoch int
+	var maxN int
+	var batch int
+	var threads int
+	var alpha float64
+	var beta float64
+	var posSize int
+	alpha = 1.0
+	beta = 1.0
+	maxN = 3
+	theta = 1.0
+	d = 0.1
+	epoch = 2
+	batch = 2
+	threads = 2
+	posSize = 2
+	pyhsmm, err := NewPYHSMM(theta, d, 1.0, 1.0, 1.0, 1.0, alpha, beta, maxN, 3, posSize, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pyhsmm.Initialize(dataContainerForTrain)
+	for e := 0; e < epoch; e++ {
+		if err := pyhsmm.TrainWordSegmentation(dataContainerForTrain, threads, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wordSeqs, posSeqs, err := pyhsmm.TestWordSegmentationAndPOSTagging(dataContainerForTrain.Sents, threads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, wordSeq := range wordSeqs {
+		if !(strings.Join(wordSeq, "") == strings.Join(dataContainerForTrain.Sents[i], "")) {
+			t.Error("segmentation does not cover the sentence", wordSeq, dataContainerForTrain.Sents[i])
+		}
+		if !(len(posSeqs[i]) == len(wordSeq)) {
+			t.Error("len(posSeq) != len(wordSeq)", posSeqs[i], wordSeq)
+		}
+	}
+	for i := 0; i < dataContainerForTrain.Size; i++ {
+		if err := pyhsmm.removeWordSeqAsCustomer(dataContainerForTrain.SamplingWordSeqs[i], dataContainerForTrain.SamplingPosSeqs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < posSize+1; i++ {
+		if !(pyhsmm.npylms[i].restaurantCount == 0) {
+			t.Error("len(npylm.restaurants) is not 0", pyhsmm.npylms[i].restaurantMap())
+		}
+	}
+	if !(pyhsmm.posHpylm.restaurantCount == 0) {
+		t.Error("len(posHpylm.restaurants) is not 0", pyhsmm.posHpylm.restaurantMap())
+	}
+
+	dataContainerForLM, err := NewDataContainerFromAnnotatedData("../data/sample.train.word.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pyhsmm.InitializeFromAnnotatedData(dataContainerForLM); err != nil {
+		t.Fatal(err)
+	}
+	if err := pyhsmm.Train(dataContainerForLM); err != nil {
+		t.Fatal(err)
+	}
+	perplexity := CalcPerplexity(pyhsmm, dataContainerForLM)
+	if math.IsNaN(perplexity) || math.IsInf(perplexity, 0) {
+		t.Error("perplexity = ", perplexity)
+	}
+}
+
+func TestPYHSMMCalcTestScore(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	for _, maxN := range []int{2, 3} {
+		posSize := 2
+		pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, 3, posSize, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pyhsmm.Initialize(dataContainerForTrain)
+		if err := pyhsmm.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+		wordSeqs, err := pyhsmm.TestWordSegmentation(dataContainerForTrain.Sents[:3], 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// marginal over POS sequences equals the sum of joint probabilities of all POS sequences
+		for _, wordSeq := range wordSeqs {
+			if len(wordSeq) > 6 {
+				wordSeq = wordSeq[:6]
+			}
+			jointScores := make([]float64, 0, 0)
+			posSeqNum := int(math.Pow(float64(posSize), float64(len(wordSeq))))
+			for i := 0; i < posSeqNum; i++ {
+				posSeq := make([]int, len(wordSeq), len(wordSeq))
+				for j, c := 0, i; j < len(wordSeq); j, c = j+1, c/posSize {
+					posSeq[j] = c % posSize
+				}
+				jointScores = append(jointScores, pyhsmm.CalcWordAndPosSeqScore(wordSeq, posSeq))
+			}
+			marginal := pyhsmm.CalcWordSeqScore(wordSeq)
+			if !(math.Abs(marginal-pyhsmm.npylms[0].logsumexp(jointScores)) < 1e-6) {
+				t.Error("marginal = ", marginal, "sum of joint = ", pyhsmm.npylms[0].logsumexp(jointScores))
+			}
+		}
+
+		scoreDivWordSize, scoreDivSentSize, err := pyhsmm.CalcTestScore(wordSeqs, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		posSeqs, err := pyhsmm.TestPOSTagging(wordSeqs, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jointScoreDivWordSize, jointScoreDivSentSize, err := pyhsmm.CalcTestScoreWithPOS(wordSeqs, posSeqs, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(scoreDivWordSize > 0.0 && scoreDivSentSize > 0.0) {
+			t.Error("scoreDivWordSize = ", scoreDivWordSize, "scoreDivSentSize = ", scoreDivSentSize)
+		}
+		if !(jointScoreDivWordSize >= scoreDivWordSize && jointScoreDivSentSize >= scoreDivSentSize) {
+			t.Error("joint score is smaller than marginal score", jointScoreDivWordSize, scoreDivWordSize)
+		}
+	}
+}
+
+func TestPYHSMMCalcSentScore(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	for _, maxN := range []int{2, 3} {
+		maxWordLength := 3
+		posSize := 2
+		pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, maxWordLength, posSize, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pyhsmm.Initialize(dataContainerForTrain)
+		if err := pyhsmm.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		// sum of probabilities of all segmentations and POS sequences
+		sent := dataContainerForTrain.Sents[0]
+		if len(sent) > 5 {
+			sent = sent[:5]
+		}
+		scores := make([]float64, 0, 0)
+		for _, wordSeq := range enumerateSegmentations(sent, maxWordLength) {
+			for _, posSeq := range enumeratePosSeqs(len(wordSeq), posSize) {
+				scores = append(scores, calcSegmentationAndPosScoreForTest(pyhsmm, wordSeq, posSeq))
+			}
+		}
+		sentScore := pyhsmm.CalcSentScore(sent)
+		if !(math.Abs(sentScore-pyhsmm.npylms[0].logsumexp(scores)) < 1e-6) {
+			t.Error("sentScore = ", sentScore, "sum of segmentations = ", pyhsmm.npylms[0].logsumexp(scores))
+		}
+	}
+}
+
+// enumeratePosSeqs returns all POS sequences of the length.
+func enumeratePosSeqs(length int, posSize int) [][]int {
+	posSeqNum := int(math.Pow(float64(posSize), float64(length)))
+	posSeqs := make([][]int, posSeqNum, posSeqNum)
+	for c := 0; c < posSeqNum; c++ {
+		posSeqs[c] = make([]int, length, length)
+		for j, r := 0, c; j < length; j, r = j+1, r/posSize {
+			posSeqs[c][j] = r % posSize
+		}
+	}
+	return posSeqs
+}
+
+// calcSegmentationAndPosScoreForTest returns joint log probability of wordSeq and posSeq including eos.
+func calcSegmentationAndPosScoreForTest(pyhsmm *PYHSMM, wordSeq context, posSeq []int) float64 {
+	u := make(context, 0, pyhsmm.maxNgram-1)
+	uPos := make(context, 0, pyhsmm.maxNgram-1)
+	for n := 0; n < pyhsmm.maxNgram-1; n++ {
+		u = append(u, pyhsmm.bos)
+		uPos = append(uPos, strconv.Itoa(pyhsmm.bosPos))
+	}
+	for j, word := range wordSeq {
+		u = append(u[1:], word)
+		uPos = append(uPos[1:], strconv.Itoa(posSeq[j]))
+	}
+	eosScore, _ := pyhsmm.npylms[pyhsmm.eosPos].CalcProb(pyhsmm.eos, u, pyhsmm.npylms[0].vpylm.hpylm.Base)
+	eosPosScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base)
+	return pyhsmm.CalcWordAndPosSeqScore(wordSeq, posSeq) + math.Log(eosScore) + math.Log(eosPosScore)
+}
+
+func TestPYHSMMNbestWordSegmentation(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	for _, maxN := range []int{2, 3} {
+		maxWordLength := 3
+		posSize := 2
+		nbest := 7
+		pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, maxWordLength, posSize, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pyhsmm.Initialize(dataContainerForTrain)
+		if err := pyhsmm.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		sent := dataContainerForTrain.Sents[0][:5]
+		scores := make([]float64, 0, 0)
+		for _, wordSeq := range enumerateSegmentations(sent, maxWordLength) {
+			for _, posSeq := range enumeratePosSeqs(len(wordSeq), posSize) {
+				scores = append(scores, calcSegmentationAndPosScoreForTest(pyhsmm, wordSeq, posSeq))
+			}
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(scores)))
+		nbestSegmentationsSlice, err := pyhsmm.TestNbestWordSegmentation([][]string{sent}, nil, nbest, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nbestSegmentations := nbestSegmentationsSlice[0]
+		if !(len(nbestSegmentations) == nbest) {
+			t.Error("expected = ", nbest, "but return ", len(nbestSegmentations))
+			continue
+		}
+		for n, nbestSegmentation := range nbestSegmentations {
+			if !(len(nbestSegmentation.PosSeq) == len(nbestSegmentation.WordSeq)) {
+				t.Error("len(posSeq) != len(wordSeq)", nbestSegmentation.PosSeq, nbestSegmentation.WordSeq)
+				continue
+			}
+			if !(math.Abs(nbestSegmentation.Score-scores[n]) < 1e-6) {
+				t.Error("expected = ", scores[n], "but return ", nbestSegmentation.Score)
+			}
+			if !(math.Abs(nbestSegmentation.Score-calcSegmentationAndPosScoreForTest(pyhsmm, nbestSegmentation.WordSeq, nbestSegmentation.PosSeq)) < 1e-6) {
+				t.Error("score of ", nbestSegmentation.WordSeq, nbestSegmentation.PosSeq, "is wrong", nbestSegmentation.Score)
+			}
+		}
+	}
+}
+
+func TestPYHSMMCalcMarginals(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	for _, maxN := range []int{2, 3} {
+		maxWordLength := 3
+		posSize := 2
+		pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, maxWordLength, posSize, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pyhsmm.Initialize(dataContainerForTrain)
+		if err := pyhsmm.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		sent := dataContainerForTrain.Sents[0][:5]
+		wordSeqs := make([]context, 0, 0)
+		posSeqs := make([][]int, 0, 0)
+		scores := make([]float64, 0, 0)
+		for _, wordSeq := range enumerateSegmentations(sent, maxWordLength) {
+			for _, posSeq := range enumeratePosSeqs(len(wordSeq), posSize) {
+				wordSeqs = append(wordSeqs, wordSeq)
+				posSeqs = append(posSeqs, posSeq)
+				scores = append(scores, calcSegmentationAndPosScoreForTest(pyhsmm, wordSeq, posSeq))
+			}
+		}
+		sentScore := pyhsmm.npylms[0].logsumexp(scores)
+		expectedBoundary := make([]float64, len(sent)-1, len(sent)-1)
+		expectedSpanPos := make([][][]float64, len(sent), len(sent))
+		for i := range expectedSpanPos {
+			expectedSpanPos[i] = make([][]float64, maxWordLength, maxWordLength)
+			for k := range expectedSpanPos[i] {
+				expectedSpanPos[i][k] = make([]float64, posSize, posSize)
+			}
+		}
+		for i, wordSeq := range wordSeqs {
+			p := math.Exp(scores[i] - sentScore)
+			for b, isBoundary := range segmentationBoundaries(wordSeq) {
+				if isBoundary {
+					expectedBoundary[b] += p
+				}
+			}
+			end := -1
+			for j, word := range wordSeq {
+				k := len([]rune(word)) - 1
+				end += k + 1
+				expectedSpanPos[end][k][posSeqs[i][j]] += p
+			}
+		}
+
+		boundaryMarginals, spanPosMarginals, err := pyhsmm.TestMarginals([][]string{sent}, nil, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for b := range expectedBoundary {
+			if !(math.Abs(boundaryMarginals[0][b]-expectedBoundary[b]) < 1e-6) {
+				t.Error("expected = ", expectedBoundary, "but return ", boundaryMarginals[0])
+				break
+			}
+		}
+		for i := range expectedSpanPos {
+			for k := range expectedSpanPos[i] {
+				for pos := range expectedSpanPos[i][k] {
+					if !(math.Abs(spanPosMarginals[0][i][k][pos]-expectedSpanPos[i][k][pos]) < 1e-6) {
+						t.Error("expected = ", expectedSpanPos[i][k][pos], "but return ", spanPosMarginals[0][i][k][pos], i, k, pos)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPYHSMMMetropolisHastings(t *testing.T) {
+	for _, maxN := range []int{2, 3} {
+		maxWordLength := 3
+		posSize := 2
+		pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, maxN, maxWordLength, posSize, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the seed is fixed, so that the number of accepted samples is the same in every run
+		pyhsmm.SetRandSeed(2)
+		pyhsmm.SetMetropolisHastings(true)
+		dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pyhsmm.Initialize(dataContainer); err != nil {
+			t.Fatal(err)
+		}
+		for e := 0; e < 2; e++ {
+			if err := pyhsmm.TrainWordSegmentation(dataContainer, 2, 4); err != nil {
+				t.Fatal(err)
+			}
+			stats := pyhsmm.ReturnAcceptanceStats()
+			if !(stats.Proposed == dataContainer.Size && 0 < stats.Accepted && stats.Accepted <= stats.Proposed) {
+				t.Error("wrong acceptance stats ", stats)
+			}
+		}
+
+		// the proposal probabilities of all segmentations and POS tags sum to 1
+		sent := dataContainer.Sents[0][:5]
+		forwardScore := pyhsmm.forward(sent, nil)
+		sumProb := 0.0
+		for _, wordSeq := range enumerateSegmentations(sent, maxWordLength) {
+			for _, posSeq := range enumeratePosSeqs(len(wordSeq), posSize) {
+				sumProb += math.Exp(pyhsmm.calcProposalScore(sent, forwardScore, wordSeq, posSeq))
+				if score := pyhsmm.calcWordAndPosSeqScoreWithEos(wordSeq, posSeq); !(math.Abs(score-calcSegmentationAndPosScoreForTest(pyhsmm, wordSeq, posSeq)) < 1e-9) {
+					t.Error("expected = ", calcSegmentationAndPosScoreForTest(pyhsmm, wordSeq, posSeq), "but return ", score)
+				}
+			}
+		}
+		if !(math.Abs(sumProb-1.0) < 1e-6) {
+			t.Error("expected = 1, but return ", sumProb)
+		}
+	}
+}
+
+func TestPYHSMMRandSeed(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	train := func(seed int64) ([]byte, [][]int) {
+		pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pyhsmm.SetRandSeed(seed)
+		dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pyhsmm.Initialize(dataContainer)
+		for e := 0; e < 3; e++ {
+			if err := pyhsmm.TrainWordSegmentation(dataContainer, 4, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		v, _ := pyhsmm.save()
+		return v, dataContainer.SamplingPosSeqs
+	}
+
+	// the same seed and the same number of threads give the same model
+	v1, posSeqs1 := train(1)
+	v2, posSeqs2 := train(1)
+	if string(v1) != string(v2) {
+		t.Error("models trained with the same seed are different")
+	}
+	if fmt.Sprint(posSeqs1) != fmt.Sprint(posSeqs2) {
+		t.Error("expected = ", posSeqs1, "but return ", posSeqs2)
+	}
+}
+
+func BenchmarkPYHSMMForward(b *testing.B) {
+	pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 3, 4, 4, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	pyhsmm.SetRandSeed(1)
+	dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pyhsmm.Initialize(dataContainer)
+	if err := pyhsmm.TrainWordSegmentation(dataContainer, 1, 128); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sent := range dataContainer.Sents {
+			pyhsmm.forward(sent, nil)
+		}
+	}
+}
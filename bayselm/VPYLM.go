@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
-	"math/rand"
-	"strings"
 
 	"github.com/cheggaaa/pb/v3"
 )
@@ -18,18 +16,35 @@ type VPYLM struct {
 }
 
 // NewVPYLM returns VPYLM instance.
-func NewVPYLM(maxDepth int, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, base float64, alpha float64, beta float64) *VPYLM {
+func NewVPYLM(maxDepth int, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, base float64, alpha float64, beta float64) (*VPYLM, error) {
 	vpylm := new(VPYLM)
-	vpylm.hpylm = NewHPYLM(maxDepth, initialTheta, initialD, gammaA, gammaB, betaA, betaB, base)
+	var err error
+	vpylm.hpylm, err = NewHPYLM(maxDepth, initialTheta, initialD, gammaA, gammaB, betaA, betaB, base)
+	if err != nil {
+		return nil, err
+	}
 	vpylm.alpha = float64(alpha)
 	vpylm.beta = float64(beta)
 
-	return vpylm
+	return vpylm, nil
+}
+
+// newVPYLMToLoad returns empty VPYLM instance whose parameters are set by load.
+func newVPYLMToLoad() *VPYLM {
+	return &VPYLM{hpylm: newHPYLMToLoad()}
 }
 
 // AddCustomer adds n-gram parameters.
 // n-gramの深さをサンプリングし、その深さに HPYLM.AddCustomer をしている。
-func (vpylm *VPYLM) AddCustomer(word string, u context) int {
+func (vpylm *VPYLM) AddCustomer(word string, u context) (int, error) {
+	if vpylm.hpylm.frozen != nil {
+		return 0, fmt.Errorf("%w. AddCustomer of VPYLM", ErrFrozen)
+	}
+	return vpylm.addCustomer(word, u), nil
+}
+
+// addCustomer is AddCustomer without the check of frozen. callers check it beforehand.
+func (vpylm *VPYLM) addCustomer(word string, u context) int {
 	depth := 0
 	// if samplingDepth {
 	_, _, probs := vpylm.CalcProb(word, u)
@@ -39,7 +54,7 @@ func (vpylm *VPYLM) AddCustomer(word string, u context) int {
 	}
 
 	// sampling depth
-	r := float64(rand.Float64()) * sumScore
+	r := float64(vpylm.hpylm.rnd.Float64()) * sumScore
 	sumScore = 0.0
 	depth = 0
 	for {
@@ -55,17 +70,21 @@ func (vpylm *VPYLM) AddCustomer(word string, u context) int {
 			panic("sampling error in VPYLM")
 		}
 	}
-	vpylm.hpylm.AddCustomer(word, u[len(u)-depth:], vpylm.hpylm.Base, vpylm.hpylm.addCustomerBaseNull)
+	vpylm.hpylm.addCustomer(word, u[len(u)-depth:], vpylm.hpylm.Base, vpylm.hpylm.addCustomerBaseNull)
 	vpylm.hpylm.addStopAndPassCount(u[len(u)-depth:])
 	return depth
 }
 
 // RemoveCustomer removes n-gram parameters.
-func (vpylm *VPYLM) RemoveCustomer(word string, u context, prevSampledDepth int) {
+func (vpylm *VPYLM) RemoveCustomer(word string, u context, prevSampledDepth int) error {
+	if prevSampledDepth < 0 || prevSampledDepth > len(u) {
+		return fmt.Errorf("%w. prevSampledDepth (%v) is out of context u (%v)", ErrCustomerNotFound, prevSampledDepth, u)
+	}
 	// remove stops and passes
-	vpylm.hpylm.removeStopAndPassCount(word, u[len(u)-prevSampledDepth:])
-	vpylm.hpylm.RemoveCustomer(word, u[len(u)-prevSampledDepth:], vpylm.hpylm.removeCustomerBaseNull)
-	return
+	if err := vpylm.hpylm.removeStopAndPassCount(word, u[len(u)-prevSampledDepth:]); err != nil {
+		return err
+	}
+	return vpylm.hpylm.RemoveCustomer(word, u[len(u)-prevSampledDepth:], vpylm.hpylm.removeCustomerBaseNull)
 }
 
 // CalcProb returns n-gram prrobability.
@@ -103,12 +122,24 @@ func (vpylm *VPYLM) calcStopProbs(u context, stopProbs []float64) {
 		panic("maximum depth error")
 	}
 
+	var frozenRsts []*frozenRestaurant
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	if vpylm.hpylm.frozen != nil {
+		frozenRsts = vpylm.hpylm.frozen.restaurants(u)
+	} else {
+		vpylm.hpylm.contexts.lookup(u, ids)
+	}
 	p := float64(0.0)
 	stop := float64(0.0)
 	pass := float64(0.0)
 	for i := 0; i <= len(u); i++ {
-		rst, ok := vpylm.hpylm.restaurants[strings.Join(u[i:], concat)]
-		if ok {
+		if vpylm.hpylm.frozen != nil {
+			if rst := frozenRsts[len(u)-i]; rst != nil {
+				stop = float64(rst.stop)
+				pass = float64(rst.pass)
+			}
+		} else if rst := vpylm.hpylm.restaurant(ids[len(u)-i]); rst != nil {
 			stop = float64(rst.stop)
 			pass = float64(rst.pass)
 		}
@@ -119,13 +150,16 @@ func (vpylm *VPYLM) calcStopProbs(u context, stopProbs []float64) {
 }
 
 // Train train n-gram parameters from given word sequences.
-func (vpylm *VPYLM) Train(dataContainer *DataContainer) {
+func (vpylm *VPYLM) Train(dataContainer *DataContainer) error {
+	if vpylm.hpylm.frozen != nil {
+		return fmt.Errorf("%w. Train of VPYLM", ErrFrozen)
+	}
 	removeFlag := true
-	if len(vpylm.hpylm.restaurants) == 0 { // epoch == 0
+	if vpylm.hpylm.restaurantCount == 0 { // epoch == 0
 		removeFlag = false
 	}
 	bar := pb.StartNew(dataContainer.Size)
-	randIndexes := rand.Perm(dataContainer.Size)
+	randIndexes := vpylm.hpylm.rnd.Perm(dataContainer.Size)
 	for i := 0; i < dataContainer.Size; i++ {
 		bar.Add(1)
 		r := randIndexes[i]
@@ -136,7 +170,10 @@ func (vpylm *VPYLM) Train(dataContainer *DataContainer) {
 				u = append(u, bos)
 			}
 			for j, word := range wordSeq {
-				vpylm.RemoveCustomer(word, u, dataContainer.SamplingDepthMemories[r][j])
+				if err := vpylm.RemoveCustomer(word, u, dataContainer.SamplingDepthMemories[r][j]); err != nil {
+					bar.Finish()
+					return err
+				}
 				u = append(u[1:], word)
 			}
 		}
@@ -146,7 +183,7 @@ func (vpylm *VPYLM) Train(dataContainer *DataContainer) {
 			u = append(u, bos)
 		}
 		for j, word := range wordSeq {
-			sampledDepth := vpylm.AddCustomer(word, u)
+			sampledDepth := vpylm.addCustomer(word, u)
 			sampledDepthMemory[j] = sampledDepth
 			u = append(u[1:], word)
 		}
@@ -154,7 +191,7 @@ func (vpylm *VPYLM) Train(dataContainer *DataContainer) {
 	}
 	bar.Finish()
 	vpylm.hpylm.estimateHyperPrameters()
-	return
+	return nil
 }
 
 // ReturnNgramProb returns n-gram probability.
@@ -170,6 +207,20 @@ func (vpylm *VPYLM) ReturnMaxN() int {
 	return vpylm.hpylm.maxDepth + 1
 }
 
+// Freeze makes vpylm inference-only with much lower memory (see HPYLM.Freeze).
+func (vpylm *VPYLM) Freeze() {
+	vpylm.hpylm.Freeze()
+}
+
+// SetRandSeed sets the seed of the random number generator used for sampling.
+func (vpylm *VPYLM) SetRandSeed(seed int64) {
+	vpylm.setRand(newSplitMix64(seed))
+}
+
+func (vpylm *VPYLM) setRand(src *splitMix64) {
+	vpylm.hpylm.setRand(src)
+}
+
 // Save returns json.Marshal(vpylmJSON) and vpylmJSON.
 // vpylmJSON is struct to save. its variables can be exported.
 func (vpylm *VPYLM) save() ([]byte, interface{}) {
@@ -194,21 +245,46 @@ func (vpylm *VPYLM) save() ([]byte, interface{}) {
 }
 
 // Load vpylm.
-func (vpylm *VPYLM) load(v []byte) {
+func (vpylm *VPYLM) load(v []byte) error {
 	vpylmJSON := new(vPYLMJSON)
 	err := json.Unmarshal(v, &vpylmJSON)
 	if err != nil {
-		panic("load error in VPYLM")
+		return fmt.Errorf("%w. load error in VPYLM: %v", ErrFormat, err)
+	}
+	if vpylmJSON == nil {
+		return fmt.Errorf("%w. load error in VPYLM: model is null", ErrFormat)
 	}
 
 	hpylmV, err := json.Marshal(&vpylmJSON.Hpylm)
 	if err != nil {
 		panic("load error in load restaurants in VPYLM")
 	}
-	vpylm.hpylm.load(hpylmV)
+	if err := vpylm.hpylm.load(hpylmV); err != nil {
+		return err
+	}
 
 	vpylm.alpha = vpylmJSON.Alpha
 	vpylm.beta = vpylmJSON.Beta
 
-	return
+	return nil
+}
+
+// saveBinary writes vpylm in binary format.
+func (vpylm *VPYLM) saveBinary(bw *binaryWriter) {
+	vpylm.hpylm.saveBinary(bw)
+	bw.writeFloat(vpylm.alpha)
+	bw.writeFloat(vpylm.beta)
+}
+
+// loadBinary reads vpylm written by saveBinary.
+func (vpylm *VPYLM) loadBinary(br *binaryReader) error {
+	if err := vpylm.hpylm.loadBinary(br); err != nil {
+		return err
+	}
+	vpylm.alpha = br.readFloat()
+	vpylm.beta = br.readFloat()
+	if br.err != nil {
+		return fmt.Errorf("%w. load error in VPYLM: %v", ErrFormat, br.err)
+	}
+	return nil
 }
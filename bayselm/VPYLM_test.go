@@ -22,7 +22,10 @@ func TestVPYLM(t *testing.T) {
 	const maxDepth int = 3
 	const alpha float64 = 1.0
 	const beta float64 = 1.0
-	vpylm := NewVPYLM(maxDepth, theta, d, 1.0, 1.0, 1.0, 1.0, base, alpha, beta)
+	vpylm, err := NewVPYLM(maxDepth, theta, d, 1.0, 1.0, 1.0, 1.0, base, alpha, beta)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var word string
 	word = "abc"
@@ -45,7 +48,10 @@ func TestVPYLM(t *testing.T) {
 	smoothing := (theta + d*1.0) / (theta + 1.0)
 	pCorrect := ((body + smoothing*(body+smoothing*(body+smoothing*base))) * (2.0 / 3.0) * (1.0 - (1.0 / 3.0)) * (1.0 - (1.0 / 3.0))) + ((body + smoothing*(body+smoothing*base)) * (1.0 / 3.0) * (1.0 - (1.0 / 3.0))) + ((body + smoothing*base) * (1.0 / 3.0))
 
-	sampledDepth := vpylm.AddCustomer(word, u)
+	sampledDepth, err := vpylm.AddCustomer(word, u)
+	if err != nil {
+		t.Fatal(err)
+	}
 	sampledDepthMemory = append(sampledDepthMemory, sampledDepth)
 	pAddOne, probsAddOne, _ := vpylm.CalcProb(word, u)
 	if !(math.Abs(float64((pAddOne - float64(pCorrect)))) < 0.00001) {
@@ -56,7 +62,10 @@ func TestVPYLM(t *testing.T) {
 	}
 
 	for i := 0; i < epoch; i++ {
-		sampledDepth := vpylm.AddCustomer(word, u)
+		sampledDepth, err := vpylm.AddCustomer(word, u)
+		if err != nil {
+			t.Fatal(err)
+		}
 		sampledDepthMemory = append(sampledDepthMemory, sampledDepth)
 	}
 	pAddMany, probsAddMany, _ := vpylm.CalcProb(word, u)
@@ -70,7 +79,9 @@ func TestVPYLM(t *testing.T) {
 	}
 
 	for i := 0; i < epoch; i++ {
-		vpylm.RemoveCustomer(word, u, sampledDepthMemory[i+1])
+		if err := vpylm.RemoveCustomer(word, u, sampledDepthMemory[i+1]); err != nil {
+			t.Fatal(err)
+		}
 	}
 	pRemoveMany, probsRemoveMany, _ := vpylm.CalcProb(word, u)
 	if !(pRemoveMany == pAddOne) {
@@ -82,14 +93,16 @@ func TestVPYLM(t *testing.T) {
 		}
 	}
 
-	vpylm.RemoveCustomer(word, u, sampledDepthMemory[0])
+	if err := vpylm.RemoveCustomer(word, u, sampledDepthMemory[0]); err != nil {
+		t.Fatal(err)
+	}
 	pRemoveOne, _, _ := vpylm.CalcProb(word, u)
 	if !(pRemoveOne == pAddZero) {
 		t.Error("pRemoveOne = ", pRemoveOne, "pAddZero = ", pAddZero)
 	}
 
-	if !(len(vpylm.hpylm.restaurants) == 0) {
-		t.Error("vpylm.restaurants = ", vpylm.hpylm.restaurants)
+	if !(vpylm.hpylm.restaurantCount == 0) {
+		t.Error("vpylm.restaurants = ", vpylm.hpylm.restaurantMap())
 	}
 }
 
@@ -110,15 +123,32 @@ func TestPerformanceOfVPYLM(t *testing.T) {
 	d = 0.1
 	epoch = 100
 	var hpylm NgramLM
-	hpylm = NewHPYLM(maxN-1, theta, d, 1.0, 1.0, 1.0, 1.0, base)
+	var err error
+	hpylm, err = NewHPYLM(maxN-1, theta, d, 1.0, 1.0, 1.0, 1.0, base)
+	if err != nil {
+		t.Fatal(err)
+	}
 	var vpylm NgramLM
-	vpylm = NewVPYLM(maxN-1, theta, d, 1.0, 1.0, 1.0, 1.0, base, alpha, beta)
+	vpylm, err = NewVPYLM(maxN-1, theta, d, 1.0, 1.0, 1.0, 1.0, base, alpha, beta)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	dataContainerForTrain := NewDataContainerFromAnnotatedData("../alice.train.txt")
-	dataContainerForTest := NewDataContainerFromAnnotatedData("../alice.test.txt")
+	dataContainerForTrain, err := NewDataContainerFromAnnotatedData("../alice.train.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataContainerForTest, err := NewDataContainerFromAnnotatedData("../alice.test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
 	for e := 0; e < epoch; e++ {
-		hpylm.Train(dataContainerForTrain)
-		vpylm.Train(dataContainerForTrain)
+		if err := hpylm.Train(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
+		if err := vpylm.Train(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	perplexityOfHpylm := CalcPerplexity(hpylm, dataContainerForTest)
@@ -0,0 +1,35 @@
+package bayselm
+
+import (
+	"fmt"
+	"math"
+)
+
+// annealing schedules of AnnealingTemperature.
+const (
+	AnnealLinear      = "linear"
+	AnnealExponential = "exponential"
+)
+
+// AnnealingTemperature returns the temperature of epoch e (0 <= e < epochNum) for simulated annealing (see NPYLM.SetTemperature).
+// the temperature changes from start at the first epoch to end at the last epoch, by the same difference every epoch if schedule is AnnealLinear,
+// or by the same ratio if schedule is AnnealExponential. it is end if epochNum is 1.
+func AnnealingTemperature(schedule string, start float64, end float64, e int, epochNum int) (float64, error) {
+	if !(start > 0.0) || !(end > 0.0) || math.IsInf(start, 1) || math.IsInf(end, 1) {
+		return 0.0, fmt.Errorf("%w. temperatures should be bigger than 0 (start = %v, end = %v)", ErrInvalidParameter, start, end)
+	}
+	if e < 0 || e >= epochNum {
+		return 0.0, fmt.Errorf("%w. epoch (%v) should be 0 to epochNum-1 (%v)", ErrInvalidParameter, e, epochNum-1)
+	}
+	progress := 1.0
+	if epochNum > 1 {
+		progress = float64(e) / float64(epochNum-1)
+	}
+	switch schedule {
+	case AnnealLinear:
+		return start + (end-start)*progress, nil
+	case AnnealExponential:
+		return start * math.Pow(end/start, progress), nil
+	}
+	return 0.0, fmt.Errorf("%w. unknown annealing schedule (%v)", ErrInvalidParameter, schedule)
+}
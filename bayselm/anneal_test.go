@@ -0,0 +1,91 @@
+package bayselm
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestAnnealingTemperature(t *testing.T) {
+	testCases := []struct {
+		schedule string
+		start    float64
+		end      float64
+		expected []float64
+	}{
+		{AnnealLinear, 3.0, 1.0, []float64{3.0, 2.5, 2.0, 1.5, 1.0}},
+		{AnnealExponential, 16.0, 1.0, []float64{16.0, 8.0, 4.0, 2.0, 1.0}},
+		{AnnealExponential, 1.0, 1.0, []float64{1.0, 1.0, 1.0, 1.0, 1.0}},
+	}
+	for _, testCase := range testCases {
+		for e, expected := range testCase.expected {
+			temperature, err := AnnealingTemperature(testCase.schedule, testCase.start, testCase.end, e, len(testCase.expected))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !(math.Abs(temperature-expected) < 1e-9) {
+				t.Error(testCase.schedule, "expected = ", expected, "but return ", temperature)
+			}
+		}
+	}
+	if temperature, _ := AnnealingTemperature(AnnealLinear, 3.0, 1.0, 0, 1); temperature != 1.0 {
+		t.Error("expected = 1, but return ", temperature)
+	}
+
+	for _, args := range []struct {
+		schedule   string
+		start, end float64
+		e          int
+	}{{"unknown", 2.0, 1.0, 0}, {AnnealLinear, 0.0, 1.0, 0}, {AnnealLinear, 2.0, math.NaN(), 0}, {AnnealLinear, 2.0, 1.0, 5}} {
+		if _, err := AnnealingTemperature(args.schedule, args.start, args.end, args.e, 5); !errors.Is(err, ErrInvalidParameter) {
+			t.Error("expected ErrInvalidParameter, but return ", err)
+		}
+	}
+}
+
+func TestNPYLMTemperature(t *testing.T) {
+	maxWordLength := 3
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, maxWordLength, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	npylm.SetRandSeed(1)
+	dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	npylm.Initialize(dataContainer)
+	for e := 0; e < 2; e++ {
+		if err := npylm.TrainWordSegmentation(dataContainer, 2, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the proposal probabilities sum to 1 at any temperature, and the higher temperature gives the flatter distribution
+	sent := dataContainer.Sents[0][:6]
+	maxProbs := make([]float64, 0, 2)
+	for _, temperature := range []float64{1.0, 4.0} {
+		if err := npylm.SetTemperature(temperature); err != nil {
+			t.Fatal(err)
+		}
+		forwardScore := npylm.forward(sent, nil)
+		sumProb := 0.0
+		maxProb := 0.0
+		for _, wordSeq := range enumerateSegmentations(sent, maxWordLength) {
+			prob := math.Exp(npylm.calcProposalScore(sent, forwardScore, wordSeq))
+			sumProb += prob
+			maxProb = math.Max(maxProb, prob)
+		}
+		if !(math.Abs(sumProb-1.0) < 1e-6) {
+			t.Error("expected = 1, but return ", sumProb)
+		}
+		maxProbs = append(maxProbs, maxProb)
+	}
+	if !(maxProbs[1] < maxProbs[0]) {
+		t.Error("expected the flatter distribution at the higher temperature, but return ", maxProbs)
+	}
+
+	if err := npylm.SetTemperature(0.0); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected ErrInvalidParameter, but return ", err)
+	}
+}
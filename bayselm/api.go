@@ -3,19 +3,21 @@ package bayselm
 import (
 	"fmt"
 	"math"
-	"math/rand"
-	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/cheggaaa/pb/v3"
 )
 
+// forwardScoreForJESSCMType is forwardScore[t][k][pos] given by the discriminative model.
+// the API supports only bi-gram PYHSMM, so previous words are not included in the state.
+type forwardScoreForJESSCMType [][][]float64
+
 // APIParam .
 type APIParam struct {
 	SentIDs       []int
 	Sents         []string
-	ForwardScores []forwardScoreForWordAndPosType
+	ForwardScores []forwardScoreForJESSCMType
 	LowerBound    float64
 	ThreadsNum    int
 	Lambda0       float64
@@ -24,13 +26,21 @@ type APIParam struct {
 }
 
 // GetPYHSMMFeatsAPI .
-func GetPYHSMMFeatsAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) []GenerativeFeatures {
+func GetPYHSMMFeatsAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) ([]GenerativeFeatures, error) {
+	if err := validAPIModel(pyhsmm); err != nil {
+		return nil, err
+	}
+	if apiParam.ThreadsNum <= 0 {
+		return nil, fmt.Errorf("%w. ThreadsNum should be bigger than 0", ErrInvalidAPIParam)
+	}
+	for _, sentID := range apiParam.SentIDs {
+		if sentID < 0 || sentID >= dataContainer.Size {
+			return nil, fmt.Errorf("%w. sentID (%v) is out of dataContainer (size = %v)", ErrInvalidAPIParam, sentID, dataContainer.Size)
+		}
+	}
 	gFeatsSlice := make([]GenerativeFeatures, len(apiParam.SentIDs), len(apiParam.SentIDs))
 	ch := make(chan int, apiParam.ThreadsNum)
 	wg := sync.WaitGroup{}
-	if apiParam.ThreadsNum == 0 {
-		panic("ThreadsNum == 0")
-	}
 	for i, sentID := range apiParam.SentIDs {
 		ch <- 1
 		wg.Add(1)
@@ -46,14 +56,17 @@ func GetPYHSMMFeatsAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam AP
 		panic("len(gFeatsSlice) != len(apiParam.SentIDs")
 	}
 	adjustGFeatsSlice := adjustGFeatsSlice(pyhsmm, gFeatsSlice, apiParam)
-	return adjustGFeatsSlice
+	return adjustGFeatsSlice, nil
 }
 
 // GetPYHSMMFeatsFromSentsAPI .
-func GetPYHSMMFeatsFromSentsAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) []GenerativeFeatures {
+func GetPYHSMMFeatsFromSentsAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) ([]GenerativeFeatures, error) {
+	if err := validAPIModel(pyhsmm); err != nil {
+		return nil, err
+	}
 	gFeatsSlice := make([]GenerativeFeatures, len(apiParam.Sents), len(apiParam.Sents))
-	if apiParam.ThreadsNum == 0 {
-		panic("ThreadsNum == 0")
+	if apiParam.ThreadsNum <= 0 {
+		return nil, fmt.Errorf("%w. ThreadsNum should be bigger than 0", ErrInvalidAPIParam)
 	}
 	ch := make(chan int, apiParam.ThreadsNum)
 	wg := sync.WaitGroup{}
@@ -73,22 +86,43 @@ func GetPYHSMMFeatsFromSentsAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, ap
 		panic("len(gFeatsSlice) != len(apiParam.Sents")
 	}
 	adjustGFeatsSlice := adjustGFeatsSlice(pyhsmm, gFeatsSlice, apiParam)
-	return adjustGFeatsSlice
+	return adjustGFeatsSlice, nil
 }
 
-func validAPIParam(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) {
+func validAPIModel(pyhsmm *PYHSMM) error {
+	if pyhsmm.maxNgram != 2 {
+		return fmt.Errorf("%w. API supports only maxNgram == 2, but maxNgram of PYHSMM is %v", ErrInvalidAPIParam, pyhsmm.maxNgram)
+	}
+	return nil
+}
+
+func validAPIParam(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) error {
+	if err := validAPIModel(pyhsmm); err != nil {
+		return err
+	}
+	if len(apiParam.ForwardScores) != len(apiParam.SentIDs) || len(apiParam.DiscScores) != len(apiParam.SentIDs) {
+		return fmt.Errorf("%w. len(ForwardScores) (%v) and len(DiscScores) (%v) should be len(SentIDs) (%v)", ErrInvalidAPIParam, len(apiParam.ForwardScores), len(apiParam.DiscScores), len(apiParam.SentIDs))
+	}
 	for i, sentID := range apiParam.SentIDs {
+		if sentID < 0 || sentID >= dataContainer.Size {
+			return fmt.Errorf("%w. sentID (%v) is out of dataContainer (size = %v)", ErrInvalidAPIParam, sentID, dataContainer.Size)
+		}
 		sent := dataContainer.Sents[sentID]
 		if len(sent) != len(apiParam.ForwardScores[i]) {
-			fmt.Println(len(sent), len(apiParam.ForwardScores[i]))
-			panic("len(sent) != len(apiParam.ForwardScores[i])")
+			return fmt.Errorf("%w. len(sent) (%v) != len(apiParam.ForwardScores[i]) (%v)", ErrInvalidAPIParam, len(sent), len(apiParam.ForwardScores[i]))
 		}
 	}
+	return nil
 }
 
 // AddCustomerUsingForwardScoreAPI .
-func AddCustomerUsingForwardScoreAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) {
-	validAPIParam(pyhsmm, dataContainer, apiParam)
+func AddCustomerUsingForwardScoreAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. AddCustomerUsingForwardScoreAPI of PYHSMM", ErrFrozen)
+	}
+	if err := validAPIParam(pyhsmm, dataContainer, apiParam); err != nil {
+		return err
+	}
 	for i, sentID := range apiParam.SentIDs {
 		sent := dataContainer.Sents[sentID]
 		forwardScore := apiParam.ForwardScores[i]
@@ -97,33 +131,50 @@ func AddCustomerUsingForwardScoreAPI(pyhsmm *PYHSMM, dataContainer *DataContaine
 		dataContainer.SamplingPosSeqs[sentID] = sampledPosSeqs
 		pyhsmm.addWordSeqAsCustomer(dataContainer.SamplingWordSeqs[sentID], dataContainer.SamplingPosSeqs[sentID])
 	}
+	return nil
 }
 
 // RemoveCustomerAPI .
-func RemoveCustomerAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) {
+func RemoveCustomerAPI(pyhsmm *PYHSMM, dataContainer *DataContainer, apiParam APIParam) error {
 	for _, sentID := range apiParam.SentIDs {
+		if sentID < 0 || sentID >= dataContainer.Size {
+			return fmt.Errorf("%w. sentID (%v) is out of dataContainer (size = %v)", ErrInvalidAPIParam, sentID, dataContainer.Size)
+		}
 		wordSeq := dataContainer.SamplingWordSeqs[sentID]
 		posSeq := dataContainer.SamplingPosSeqs[sentID]
-		pyhsmm.removeWordSeqAsCustomer(wordSeq, posSeq)
+		if err := pyhsmm.removeWordSeqAsCustomer(wordSeq, posSeq); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // TrainFromAnnotatedCorpus .
-func TrainFromAnnotatedCorpus(pyhsmm *PYHSMM, dataContainer *DataContainer) {
+func TrainFromAnnotatedCorpus(pyhsmm *PYHSMM, dataContainer *DataContainer) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. TrainFromAnnotatedCorpus of PYHSMM", ErrFrozen)
+	}
 	// remove and add
 	bar := pb.StartNew(dataContainer.Size)
 	for i := 0; i < dataContainer.Size; i++ {
 		bar.Add(1)
 		wordSeq := dataContainer.SamplingWordSeqs[i]
 		posSeq := dataContainer.SamplingPosSeqs[i]
-		pyhsmm.removeWordSeqAsCustomer(wordSeq, posSeq)
+		if err := pyhsmm.removeWordSeqAsCustomer(wordSeq, posSeq); err != nil {
+			bar.Finish()
+			return err
+		}
 		pyhsmm.addWordSeqAsCustomer(wordSeq, posSeq)
 	}
 	bar.Finish()
+	return nil
 }
 
 // AddWordSeqAsCustomerAPI .
-func AddWordSeqAsCustomerAPI(pyhsmm *PYHSMM, dataContainer *DataContainer) {
+func AddWordSeqAsCustomerAPI(pyhsmm *PYHSMM, dataContainer *DataContainer) error {
+	if pyhsmm.posHpylm.frozen != nil {
+		return fmt.Errorf("%w. AddWordSeqAsCustomerAPI of PYHSMM", ErrFrozen)
+	}
 	bar := pb.StartNew(dataContainer.Size)
 	for i := 0; i < dataContainer.Size; i++ {
 		bar.Add(1)
@@ -132,6 +183,7 @@ func AddWordSeqAsCustomerAPI(pyhsmm *PYHSMM, dataContainer *DataContainer) {
 		pyhsmm.addWordSeqAsCustomer(wordSeq, posSeq)
 	}
 	bar.Finish()
+	return nil
 }
 
 func adjustGFeatsSlice(pyhsmm *PYHSMM, gFeatsSlice []GenerativeFeatures, apiParam APIParam) []GenerativeFeatures {
@@ -288,8 +340,8 @@ func (pyhsmm *PYHSMM) getGenerativeFeatures(sent []string, lowerBound float64) G
 			if t-k-(j+1) >= 0 {
 				u[0] = strings.Join(sent[(t-k-(j+1)):(t-k)], pyhsmm.npylms[0].splitter)
 				wordScore, _ := pyhsmm.npylms[pyhsmm.eosPos].CalcProb(pyhsmm.eos, u, base)
-				uPos[0] = strconv.Itoa(prevPos)
-				posScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base)
+				uPos[0] = posSymbol(prevPos)
+				posScore, _ := pyhsmm.posHpylm.CalcProb(posSymbol(pyhsmm.eosPos), uPos, pyhsmm.posHpylm.Base)
 				score := math.Log(wordScore) + math.Log(posScore)
 				if score < lowerBound {
 					score = lowerBound
@@ -302,7 +354,7 @@ func (pyhsmm *PYHSMM) getGenerativeFeatures(sent []string, lowerBound float64) G
 	return gFeats
 }
 
-func (pyhsmm *PYHSMM) backwardJESSCM(sent []string, forwardScore forwardScoreForWordAndPosType, sampling bool, lambda0 float64, discScore [][][]float64, discScoreT [][]float64, lowerBound float64) (context, []int) {
+func (pyhsmm *PYHSMM) backwardJESSCM(sent []string, forwardScore forwardScoreForJESSCMType, sampling bool, lambda0 float64, discScore [][][]float64, discScoreT [][]float64, lowerBound float64) (context, []int) {
 	t := len(sent)
 	k := 0
 	prevWord := pyhsmm.eos
@@ -318,7 +370,7 @@ func (pyhsmm *PYHSMM) backwardJESSCM(sent []string, forwardScore forwardScoreFor
 			break
 		}
 		if prevWord != pyhsmm.eos {
-			base = pyhsmm.npylms[0].calcBase(prevWord) // 文字レベルのスムージングは一つのVPYLMから
+			base = pyhsmm.npylms[0].calcCharBase(prevWord) // 文字レベルのスムージングは一つのVPYLMから
 		}
 		scoreArrayLog := make([]float64, pyhsmm.maxWordLength*pyhsmm.PosSize, pyhsmm.maxWordLength*pyhsmm.PosSize)
 		for i := 0; i < pyhsmm.maxWordLength*pyhsmm.PosSize; i++ {
@@ -331,9 +383,9 @@ func (pyhsmm *PYHSMM) backwardJESSCM(sent []string, forwardScore forwardScoreFor
 			for nextPos := 0; nextPos < pyhsmm.PosSize; nextPos++ {
 				if t-k-(j+1) >= 0 {
 					u[0] = strings.Join(sent[(t-k-(j+1)):(t-k)], pyhsmm.npylms[0].splitter)
-					wordScore, _ := pyhsmm.npylms[prevPos].CalcProb(prevWord, u, base)
-					uPos[0] = strconv.Itoa(nextPos)
-					posScore, _ := pyhsmm.posHpylm.CalcProb(strconv.Itoa(prevPos), uPos, pyhsmm.posHpylm.Base)
+					wordScore, _ := pyhsmm.npylms[prevPos].CalcProb(prevWord, u, pyhsmm.npylms[prevPos].mixDictionaryBase(prevWord, base))
+					uPos[0] = posSymbol(nextPos)
+					posScore, _ := pyhsmm.posHpylm.CalcProb(posSymbol(prevPos), uPos, pyhsmm.posHpylm.Base)
 					gScore := math.Log(wordScore) + math.Log(posScore)
 					if gScore < lowerBound {
 						gScore = lowerBound
@@ -359,7 +411,7 @@ func (pyhsmm *PYHSMM) backwardJESSCM(sent []string, forwardScore forwardScoreFor
 		j := 0
 		nextPos := 0
 		if sampling {
-			r := rand.Float64()
+			r := pyhsmm.rnd.Float64()
 			sumScore := 0.0
 			for {
 				sumScore += math.Exp(scoreArrayLog[j*pyhsmm.PosSize+nextPos] - logSumScoreArrayLog)
@@ -0,0 +1,297 @@
+package bayselm
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	arpaBos = "<s>"
+	arpaEos = "</s>"
+	arpaUnk = "<unk>"
+)
+
+// arpaExporter converts restaurants of HPYLM to n-grams in ARPA format.
+// contexts which begin with bos are written with one <s>, e.g., (<BOS>, <BOS>, w) is written as (<s>, w), because decoders use one <s> at the beginning of sentences.
+type arpaExporter struct {
+	hpylm    *HPYLM
+	bos      string // token of the model written as <s>. it is "" if contexts of the model do not have bos
+	eos      string // token of the model written as </s>
+	calcProb func(word string, u context) float64
+	// if exactBow is true, back-off weights are the products of smoothing coefficients of HPYLM, so the probabilities in ARPA format are the same as those of the model.
+	// otherwise they are normalized, because VPYLM mixes the probabilities of all depths and it cannot be written exactly.
+	exactBow bool
+	unkProb  float64
+
+	probs        map[string]float64  // n-gram to log10 probability
+	bows         map[string]float64  // context to log10 back-off weight
+	contextWords map[string][]string // context to words of n-grams
+	err          error
+}
+
+func newARPAExporter(model NgramLM, char bool) (*arpaExporter, error) {
+	var exporter *arpaExporter
+	calcVPYLMProb := func(vpylm *VPYLM) func(string, context) float64 {
+		return func(word string, u context) float64 {
+			p, _, _ := vpylm.CalcProb(word, u)
+			return p
+		}
+	}
+	switch model := model.(type) {
+	case *HPYLM:
+		if char {
+			return nil, fmt.Errorf("%w. hpylm does not have character model", ErrInvalidParameter)
+		}
+		exporter = &arpaExporter{hpylm: model, bos: bos, calcProb: model.ReturnNgramProb, exactBow: true}
+		exporter.unkProb = exporter.smoothingCoefficient(context{}) * model.Base
+	case *VPYLM:
+		if char {
+			return nil, fmt.Errorf("%w. vpylm does not have character model", ErrInvalidParameter)
+		}
+		exporter = &arpaExporter{hpylm: model.hpylm, bos: bos, calcProb: calcVPYLMProb(model)}
+		exporter.unkProb = exporter.smoothingCoefficient(context{}) * model.hpylm.Base
+	case *NPYLM:
+		if char {
+			exporter = &arpaExporter{hpylm: model.vpylm.hpylm, eos: model.eow, calcProb: calcVPYLMProb(model.vpylm)}
+			exporter.unkProb = exporter.smoothingCoefficient(context{}) * model.vpylm.hpylm.Base
+		} else {
+			// <unk> is the probability of new words, and the probability of each new word is multiplied by its base measure
+			calcProb := func(word string, u context) float64 {
+				base := model.vpylm.hpylm.Base // eos is added with this base in addWordSeqAsCustomer
+				if word != model.eos {
+					base = model.calcBase(word)
+				}
+				p, _ := model.CalcProb(word, u, base)
+				return p
+			}
+			exporter = &arpaExporter{hpylm: model.HPYLM, bos: model.bos, eos: model.eos, calcProb: calcProb, exactBow: true}
+			exporter.unkProb = exporter.smoothingCoefficient(context{})
+		}
+	default:
+		return nil, fmt.Errorf("%w. ARPA export of %T", ErrNotImplemented, model)
+	}
+	exporter.probs = make(map[string]float64)
+	exporter.bows = make(map[string]float64)
+	exporter.contextWords = make(map[string][]string)
+	return exporter, nil
+}
+
+// ExportARPA writes n-gram probabilities of model (hpylm, vpylm or npylm) to exportFile in ARPA format.
+// back-off weights of hpylm and npylm are the smoothing coefficients of Pitman-Yor process, so the probabilities in ARPA format are the same as those of the model.
+// for npylm, the probability of <unk> should be multiplied by the probability of the word by the character model (see ExportCharARPA).
+func ExportARPA(model NgramLM, exportFile string) error {
+	return exportARPA(model, exportFile, false)
+}
+
+// ExportCharARPA writes the character VPYLM of npylm to exportFile in ARPA format. a word is a sentence of the character model, and </s> is the end of the word.
+func ExportCharARPA(model NgramLM, exportFile string) error {
+	return exportARPA(model, exportFile, true)
+}
+
+func exportARPA(model NgramLM, exportFile string, char bool) error {
+	if isFrozen(model) {
+		return fmt.Errorf("%w. ARPA export of %v", ErrFrozen, ModelName(model))
+	}
+	exporter, err := newARPAExporter(model, char)
+	if err != nil {
+		return err
+	}
+	if err := exporter.build(); err != nil {
+		return err
+	}
+	f, err := os.Create(exportFile)
+	if err != nil {
+		return fmt.Errorf("%w. cannot write exportFile (%v): %v", ErrFile, exportFile, err)
+	}
+	w := bufio.NewWriter(f)
+	exporter.write(w)
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w. cannot write exportFile (%v): %v", ErrFile, exportFile, err)
+	}
+	return nil
+}
+
+func (exporter *arpaExporter) build() error {
+	for key, rst := range exporter.hpylm.restaurantMap() {
+		u := context{}
+		if key != "" {
+			u = strings.Split(key, concat)
+		}
+		h := exporter.arpaContext(u)
+		for word := range rst.tables {
+			exporter.addNgram(append(h[:len(h):len(h)], exporter.toARPA(exporter.hpylm.word(word))))
+		}
+	}
+	exporter.addNgram([]string{arpaBos})
+	exporter.probs[arpaUnk] = math.Log10(exporter.unkProb)
+	if exporter.err != nil {
+		return exporter.err
+	}
+
+	// back-off weights of shorter contexts are calculated first, because normalized back-off weights depend on them
+	contexts := make([][]string, 0, len(exporter.contextWords))
+	for key := range exporter.contextWords {
+		if key != "" {
+			contexts = append(contexts, strings.Split(key, " "))
+		}
+	}
+	sort.Slice(contexts, func(i, j int) bool {
+		if len(contexts[i]) != len(contexts[j]) {
+			return len(contexts[i]) < len(contexts[j])
+		}
+		return strings.Join(contexts[i], " ") < strings.Join(contexts[j], " ")
+	})
+	for _, h := range contexts {
+		bow := float64(1.0)
+		if exporter.exactBow {
+			for _, u := range exporter.modelContexts(h) {
+				bow *= exporter.smoothingCoefficient(u)
+			}
+		} else {
+			numerator := float64(1.0)
+			denominator := float64(1.0)
+			for _, word := range exporter.contextWords[strings.Join(h, " ")] {
+				numerator -= exporter.arpaProb(h, word)
+				denominator -= exporter.arpaProb(h[1:], word)
+			}
+			bow = math.Max(numerator, math.SmallestNonzeroFloat64) / math.Max(denominator, math.SmallestNonzeroFloat64)
+		}
+		exporter.bows[strings.Join(h, " ")] = math.Log10(bow)
+	}
+	return nil
+}
+
+// addNgram adds n-gram and its prefixes which are required by ARPA format.
+func (exporter *arpaExporter) addNgram(ngram []string) {
+	key := strings.Join(ngram, " ")
+	if _, ok := exporter.probs[key]; ok {
+		return
+	}
+	h := ngram[:len(ngram)-1]
+	word := ngram[len(ngram)-1]
+	if strings.IndexFunc(word, unicode.IsSpace) >= 0 {
+		if exporter.err == nil {
+			exporter.err = fmt.Errorf("%w. word (%q) contains white space, which cannot be written in ARPA format", ErrFormat, word)
+		}
+		return
+	}
+	if word == arpaBos {
+		exporter.probs[key] = -99.0 // <s> is not predicted
+	} else {
+		u := exporter.modelContexts(h)[0]
+		exporter.probs[key] = math.Log10(exporter.calcProb(exporter.fromARPA(word), u))
+	}
+	exporter.contextWords[strings.Join(h, " ")] = append(exporter.contextWords[strings.Join(h, " ")], word)
+	if len(h) > 0 {
+		exporter.addNgram(h)
+	}
+}
+
+// arpaProb returns the probability of word given context h in ARPA format.
+func (exporter *arpaExporter) arpaProb(h []string, word string) float64 {
+	if logProb, ok := exporter.probs[strings.Join(append(h[:len(h):len(h)], word), " ")]; ok {
+		return math.Pow(10.0, logProb)
+	}
+	if len(h) == 0 {
+		return exporter.unkProb
+	}
+	return math.Pow(10.0, exporter.bows[strings.Join(h, " ")]) * exporter.arpaProb(h[1:], word)
+}
+
+func (exporter *arpaExporter) smoothingCoefficient(u context) float64 {
+	rst, ok := exporter.hpylm.restaurantOf(u)
+	if !ok {
+		return 1.0
+	}
+	theta := exporter.hpylm.theta[len(u)]
+	d := exporter.hpylm.d[len(u)]
+	return (theta + (d * float64(rst.totalTableCount))) / (theta + float64(rst.totalCustomerCount))
+}
+
+// arpaContext returns context in ARPA format. the leading bos tokens are written as one <s>.
+func (exporter *arpaExporter) arpaContext(u context) []string {
+	h := make([]string, 0, len(u))
+	for i, word := range u {
+		if exporter.bos != "" && word == exporter.bos {
+			if i == 0 {
+				h = append(h, arpaBos)
+			}
+			continue
+		}
+		h = append(h, exporter.toARPA(word))
+	}
+	return h
+}
+
+// modelContexts returns contexts of the model written as h in ARPA format from the longest one.
+// h which begins with <s> is the contexts which begin with one or more bos, and the longest one is the context at the beginning of sentences.
+func (exporter *arpaExporter) modelContexts(h []string) []context {
+	words := make(context, 0, len(h))
+	for _, token := range h {
+		if token != arpaBos {
+			words = append(words, exporter.fromARPA(token))
+		}
+	}
+	if len(h) == 0 || h[0] != arpaBos {
+		return []context{words}
+	}
+	us := make([]context, 0, exporter.hpylm.maxDepth)
+	for n := exporter.hpylm.maxDepth - len(words); n >= 1; n-- {
+		u := make(context, 0, n+len(words))
+		for i := 0; i < n; i++ {
+			u = append(u, exporter.bos)
+		}
+		us = append(us, append(u, words...))
+	}
+	return us
+}
+
+func (exporter *arpaExporter) toARPA(word string) string {
+	if exporter.eos != "" && word == exporter.eos {
+		return arpaEos
+	}
+	return word
+}
+
+func (exporter *arpaExporter) fromARPA(token string) string {
+	if token == arpaEos && exporter.eos != "" {
+		return exporter.eos
+	}
+	return token
+}
+
+func (exporter *arpaExporter) write(w *bufio.Writer) {
+	ngramsEachN := make([][]string, 0)
+	for key := range exporter.probs {
+		n := strings.Count(key, " ") + 1
+		for len(ngramsEachN) < n {
+			ngramsEachN = append(ngramsEachN, make([]string, 0))
+		}
+		ngramsEachN[n-1] = append(ngramsEachN[n-1], key)
+	}
+	fmt.Fprintf(w, "\\data\\\n")
+	for n, ngrams := range ngramsEachN {
+		fmt.Fprintf(w, "ngram %d=%d\n", n+1, len(ngrams))
+	}
+	for n, ngrams := range ngramsEachN {
+		sort.Strings(ngrams)
+		fmt.Fprintf(w, "\n\\%d-grams:\n", n+1)
+		for _, key := range ngrams {
+			fmt.Fprintf(w, "%.7g\t%s", exporter.probs[key], key)
+			if bow, ok := exporter.bows[key]; ok {
+				fmt.Fprintf(w, "\t%.7g", bow)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+	fmt.Fprintf(w, "\n\\end\\\n")
+}
@@ -0,0 +1,182 @@
+package bayselm
+
+import (
+	"bufio"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type arpaForTest struct {
+	probs map[string]float64
+	bows  map[string]float64
+}
+
+func readARPAForTest(t *testing.T, arpaFile string) *arpaForTest {
+	f, err := os.Open(arpaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	arpa := &arpaForTest{make(map[string]float64), make(map[string]float64)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.Split(scanner.Text(), "\t")
+		if len(line) < 2 {
+			continue
+		}
+		logProb, err := strconv.ParseFloat(line[0], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		arpa.probs[line[1]] = logProb
+		if len(line) == 3 {
+			bow, err := strconv.ParseFloat(line[2], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			arpa.bows[line[1]] = bow
+		}
+	}
+	return arpa
+}
+
+// prob returns the probability of word given h by back-off as decoders do.
+func (arpa *arpaForTest) prob(h []string, word string) float64 {
+	if logProb, ok := arpa.probs[strings.Join(append(h[:len(h):len(h)], word), " ")]; ok {
+		return math.Pow(10.0, logProb)
+	}
+	if len(h) == 0 {
+		return math.Pow(10.0, arpa.probs[arpaUnk])
+	}
+	return math.Pow(10.0, arpa.bows[strings.Join(h, " ")]) * arpa.prob(h[1:], word)
+}
+
+func TestExportARPA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	arpaFile := filepath.Join(dir, "model.arpa")
+	testWordSeqs := [][]string{{"これ", "は", "ペン", "です", "。"}, {"それ", "は", "ペン", "か", "？"}, {"未知語", "です"}}
+
+	hpylm, err := NewHPYLM(2, 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hpylm.SetRandSeed(1)
+	dataContainer, err := NewDataContainerFromAnnotatedData("../data/sample.train.word.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for e := 0; e < 3; e++ {
+		if err := hpylm.Train(dataContainer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ExportARPA(hpylm, arpaFile); err != nil {
+		t.Fatal(err)
+	}
+	arpa := readARPAForTest(t, arpaFile)
+	for _, wordSeq := range testWordSeqs {
+		u := context{bos, bos}
+		h := []string{arpaBos}
+		for _, word := range wordSeq {
+			p := hpylm.ReturnNgramProb(word, u)
+			if pARPA := arpa.prob(h, word); math.Abs(pARPA-p) > 1e-5*p {
+				t.Error(word, u, "expected = ", p, "but return ", pARPA)
+			}
+			u = append(u[1:], word)
+			h = append(h, word)
+			if len(h) > 2 {
+				h = h[1:]
+			}
+		}
+	}
+
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 3, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	npylm.SetRandSeed(1)
+	dataContainer, err = NewDataContainer("../data/sample.txt", "", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	npylm.Initialize(dataContainer)
+	if err := npylm.TrainWordSegmentation(dataContainer, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExportARPA(npylm, arpaFile); err != nil {
+		t.Fatal(err)
+	}
+	arpa = readARPAForTest(t, arpaFile)
+	for _, wordSeq := range dataContainer.SamplingWordSeqs {
+		testWordSeqs = append(testWordSeqs, wordSeq)
+	}
+	for _, wordSeq := range testWordSeqs {
+		u := context{npylm.bos, npylm.bos}
+		h := []string{arpaBos}
+		for _, word := range append(wordSeq[:len(wordSeq):len(wordSeq)], arpaEos) {
+			var p float64
+			if word == arpaEos {
+				p, _ = npylm.CalcProb(npylm.eos, u, npylm.vpylm.hpylm.Base)
+			} else {
+				p = npylm.ReturnNgramProb(word, u)
+			}
+			pARPA := arpa.prob(h, word)
+			if _, ok := arpa.probs[word]; !ok {
+				pARPA *= npylm.calcBase(word)
+			}
+			if math.Abs(pARPA-p) > 1e-5*p {
+				t.Error(word, u, "expected = ", p, "but return ", pARPA)
+			}
+			u = append(u[1:], word)
+			h = append(h, word)
+			if len(h) > 2 {
+				h = h[1:]
+			}
+		}
+	}
+
+	// character model is normalized
+	if err := ExportCharARPA(npylm, arpaFile); err != nil {
+		t.Fatal(err)
+	}
+	arpa = readARPAForTest(t, arpaFile)
+	for key, logProb := range arpa.probs {
+		ngram := strings.Split(key, " ")
+		word := ngram[len(ngram)-1]
+		if word == arpaBos || word == arpaUnk {
+			continue
+		}
+		if word == arpaEos {
+			word = npylm.eow
+		}
+		p, _, _ := npylm.vpylm.CalcProb(word, ngram[:len(ngram)-1])
+		if math.Abs(math.Pow(10.0, logProb)-p) > 1e-5*p {
+			t.Error(key, "expected = ", p, "but return ", math.Pow(10.0, logProb))
+		}
+	}
+	for _, h := range [][]string{{}, {arpaBos}, {"ペ"}, {"ペ", "ン"}} {
+		sumProb := float64(0.0)
+		for key := range arpa.probs {
+			ngram := strings.Split(key, " ")
+			if len(ngram) == 1 && ngram[0] != arpaBos && ngram[0] != arpaUnk {
+				sumProb += arpa.prob(h, ngram[0])
+			}
+		}
+		if !(0.0 < sumProb && sumProb < 1.0+1e-6) {
+			t.Error(h, "sum of probabilities = ", sumProb)
+		}
+	}
+
+	if err := ExportCharARPA(hpylm, arpaFile); err == nil {
+		t.Error("expected error, but return nil")
+	}
+}
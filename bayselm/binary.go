@@ -0,0 +1,257 @@
+package bayselm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// binaryMagic is the first bytes of model files saved in binary format.
+// model files in json format begin with "{", so they are distinguished by the first bytes.
+const binaryMagic = "\x00bayselm"
+
+// maxBinaryLength is the maximum length of strings and slices in binary format, which prevents broken files from allocating huge memory.
+const maxBinaryLength = 1 << 30
+
+// binaryWriter writes models in binary format.
+// words are interned, i.e., each word is written once and then written as its id, and integers are written as varints.
+// the first error is kept in err and the following writes do nothing.
+type binaryWriter struct {
+	w     *bufio.Writer
+	vocab map[string]uint64 // word to id + 1
+	buf   []byte
+	err   error
+}
+
+func newBinaryWriter(w io.Writer) *binaryWriter {
+	return &binaryWriter{bufio.NewWriter(w), make(map[string]uint64), make([]byte, binary.MaxVarintLen64), nil}
+}
+
+func (bw *binaryWriter) write(v []byte) {
+	if bw.err != nil {
+		return
+	}
+	_, bw.err = bw.w.Write(v)
+}
+
+func (bw *binaryWriter) writeUvarint(x uint64) {
+	n := binary.PutUvarint(bw.buf, x)
+	bw.write(bw.buf[:n])
+}
+
+func (bw *binaryWriter) writeInt(x int) {
+	n := binary.PutVarint(bw.buf, int64(x))
+	bw.write(bw.buf[:n])
+}
+
+func (bw *binaryWriter) writeFloat(x float64) {
+	binary.LittleEndian.PutUint64(bw.buf, math.Float64bits(x))
+	bw.write(bw.buf[:8])
+}
+
+func (bw *binaryWriter) writeBool(x bool) {
+	if x {
+		bw.writeUvarint(1)
+	} else {
+		bw.writeUvarint(0)
+	}
+}
+
+// writeString writes s without interning. it is used for strings which appear once, e.g., the header.
+func (bw *binaryWriter) writeString(s string) {
+	bw.writeUvarint(uint64(len(s)))
+	bw.write([]byte(s))
+}
+
+// writeWord writes 0 and word at its first appearance, otherwise id + 1 of word.
+func (bw *binaryWriter) writeWord(word string) {
+	id, ok := bw.vocab[word]
+	if ok {
+		bw.writeUvarint(id)
+		return
+	}
+	bw.writeUvarint(0)
+	bw.writeString(word)
+	bw.vocab[word] = uint64(len(bw.vocab) + 1)
+}
+
+func (bw *binaryWriter) writeFloats(xs []float64) {
+	bw.writeUvarint(uint64(len(xs)))
+	for _, x := range xs {
+		bw.writeFloat(x)
+	}
+}
+
+func (bw *binaryWriter) writeInts(xs []int) {
+	bw.writeUvarint(uint64(len(xs)))
+	for _, x := range xs {
+		bw.writeInt(x)
+	}
+}
+
+// writeCounts writes map of word to count in the order of words, so the same model is always written to the same bytes.
+func (bw *binaryWriter) writeCounts(counts map[string]newUint) {
+	bw.writeUvarint(uint64(len(counts)))
+	for _, word := range sortedKeys(counts) {
+		bw.writeWord(word)
+		bw.writeUvarint(uint64(counts[word]))
+	}
+}
+
+func (bw *binaryWriter) flush() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	return bw.w.Flush()
+}
+
+// binaryReader reads models written by binaryWriter.
+// the first error is kept in err and the following reads return zero values.
+type binaryReader struct {
+	r     *bufio.Reader
+	vocab []string // id to word
+	err   error
+}
+
+func newBinaryReader(r *bufio.Reader) *binaryReader {
+	return &binaryReader{r, make([]string, 0), nil}
+}
+
+func (br *binaryReader) setError(err error) {
+	if br.err != nil {
+		return
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	br.err = err
+}
+
+func (br *binaryReader) readUvarint() uint64 {
+	if br.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(br.r)
+	if err != nil {
+		br.setError(err)
+		return 0
+	}
+	return x
+}
+
+func (br *binaryReader) readInt() int {
+	if br.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(br.r)
+	if err != nil {
+		br.setError(err)
+		return 0
+	}
+	return int(x)
+}
+
+func (br *binaryReader) readFloat() float64 {
+	if br.err != nil {
+		return 0.0
+	}
+	var v [8]byte
+	if _, err := io.ReadFull(br.r, v[:]); err != nil {
+		br.setError(err)
+		return 0.0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(v[:]))
+}
+
+func (br *binaryReader) readBool() bool {
+	return br.readUvarint() != 0
+}
+
+// readLength reads length of strings, slices and maps.
+func (br *binaryReader) readLength() int {
+	n := br.readUvarint()
+	if n > maxBinaryLength {
+		br.setError(fmt.Errorf("length %v is too large", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (br *binaryReader) readString() string {
+	n := br.readLength()
+	if br.err != nil {
+		return ""
+	}
+	v := make([]byte, n, n)
+	if _, err := io.ReadFull(br.r, v); err != nil {
+		br.setError(err)
+		return ""
+	}
+	return string(v)
+}
+
+func (br *binaryReader) readWord() string {
+	id := br.readUvarint()
+	if br.err != nil {
+		return ""
+	}
+	if id == 0 {
+		word := br.readString()
+		br.vocab = append(br.vocab, word)
+		return word
+	}
+	if id > uint64(len(br.vocab)) {
+		br.setError(fmt.Errorf("word id %v is out of vocabulary (size %v)", id, len(br.vocab)))
+		return ""
+	}
+	return br.vocab[id-1]
+}
+
+func (br *binaryReader) readFloats() []float64 {
+	n := br.readLength()
+	xs := make([]float64, 0, capacityHint(n))
+	for i := 0; i < n && br.err == nil; i++ {
+		xs = append(xs, br.readFloat())
+	}
+	return xs
+}
+
+func (br *binaryReader) readInts() []int {
+	n := br.readLength()
+	xs := make([]int, 0, capacityHint(n))
+	for i := 0; i < n && br.err == nil; i++ {
+		xs = append(xs, br.readInt())
+	}
+	return xs
+}
+
+func (br *binaryReader) readCounts() map[string]newUint {
+	n := br.readLength()
+	counts := make(map[string]newUint, capacityHint(n))
+	for i := 0; i < n && br.err == nil; i++ {
+		word := br.readWord()
+		counts[word] = newUint(br.readUvarint())
+	}
+	return counts
+}
+
+// capacityHint returns capacity to allocate for n elements read from files. it is limited because n may be broken.
+func capacityHint(n int) int {
+	if n > 1<<16 {
+		return 1 << 16
+	}
+	return n
+}
+
+func sortedKeys(m map[string]newUint) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,76 @@
+package bayselm
+
+import (
+	"container/list"
+	"sync"
+)
+
+// charBaseCache is LRU cache of the probabilities of words by the character VPYLM (see NPYLM.calcCharBase).
+// it is cleared when version of the VPYLM is changed, i.e., the VPYLM is modified.
+// it is used by goroutines concurrently, so it is locked by mutex. nil cache is empty and ignores put.
+type charBaseCache struct {
+	mu      sync.Mutex
+	size    int
+	version uint64
+	words   map[string]*list.Element
+	order   *list.List // entries from the most recently used one
+}
+
+type charBaseEntry struct {
+	word   string
+	prefix float64 // probability of the characters of word without eow, which is extended to longer words
+	base   float64
+}
+
+func newCharBaseCache(size int) *charBaseCache {
+	return &charBaseCache{size: size, words: make(map[string]*list.Element, size), order: list.New()}
+}
+
+// validate clears cache if version is different from that of the cached probabilities. cache must be locked.
+func (cache *charBaseCache) validate(version uint64) {
+	if cache.version == version {
+		return
+	}
+	cache.version = version
+	cache.words = make(map[string]*list.Element, cache.size)
+	cache.order.Init()
+}
+
+// get returns prefix and base of word cached at version.
+func (cache *charBaseCache) get(word string, version uint64) (float64, float64, bool) {
+	if cache == nil {
+		return 0.0, 0.0, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.validate(version)
+	elem, ok := cache.words[word]
+	if !ok {
+		return 0.0, 0.0, false
+	}
+	cache.order.MoveToFront(elem)
+	entry := elem.Value.(*charBaseEntry)
+	return entry.prefix, entry.base, true
+}
+
+// put caches prefix and base of word at version, and removes the least recently used word if the cache is full.
+func (cache *charBaseCache) put(word string, prefix float64, base float64, version uint64) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.validate(version)
+	if elem, ok := cache.words[word]; ok {
+		entry := elem.Value.(*charBaseEntry)
+		entry.prefix, entry.base = prefix, base
+		cache.order.MoveToFront(elem)
+		return
+	}
+	cache.words[word] = cache.order.PushFront(&charBaseEntry{word, prefix, base})
+	if cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.words, oldest.Value.(*charBaseEntry).word)
+	}
+}
@@ -0,0 +1,109 @@
+package bayselm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// checkpointJSON is struct to save checkpoints.
+// it contains the sampler state which is not saved by Save, i.e., current segmentations, POS tags and the state of the random number generator.
+type checkpointJSON struct {
+	ModelName string
+	Model     json.RawMessage
+	Epoch     int // number of trained epochs
+	RandState uint64
+
+	SamplingWordSeqs      []context
+	SamplingPosSeqs       [][]int
+	SamplingDepthMemories [][]int
+
+	// annotated texts added by InitializeFromAnnotatedDataWithWeight, whose POS tags are resampled (see PYHSMM.ResampleAnnotatedPOSTags)
+	AnnotatedWordSeqs []context `json:",omitempty"`
+	AnnotatedPosSeqs  [][]int   `json:",omitempty"`
+}
+
+// SaveCheckpoint saves model, the sampling state of dataContainer and annotatedDataContainer, the number of trained epochs and the state of the random number generator of model.
+// annotatedDataContainer contains the annotated texts for semi-supervised training, and it can be nil.
+// training resumed by LoadCheckpoint continues exactly as if it were not stopped.
+func SaveCheckpoint(modelName string, model UnsupervisedWSM, dataContainer *DataContainer, annotatedDataContainer *DataContainer, epoch int, checkpointFile string) error {
+	if isFrozen(model) {
+		return fmt.Errorf("%w. checkpoint of %v", ErrFrozen, modelName)
+	}
+	modelJSONByte, modelJSON := model.save()
+	if modelJSON == nil {
+		return fmt.Errorf("%w. save of %T", ErrNotImplemented, model)
+	}
+	checkpoint := &checkpointJSON{
+		ModelName: modelName,
+		Model:     modelJSONByte,
+		Epoch:     epoch,
+		RandState: model.randState(),
+
+		SamplingWordSeqs:      dataContainer.SamplingWordSeqs,
+		SamplingPosSeqs:       dataContainer.SamplingPosSeqs,
+		SamplingDepthMemories: dataContainer.SamplingDepthMemories,
+	}
+	if annotatedDataContainer != nil {
+		checkpoint.AnnotatedWordSeqs = annotatedDataContainer.SamplingWordSeqs
+		checkpoint.AnnotatedPosSeqs = annotatedDataContainer.SamplingPosSeqs
+	}
+	v, err := json.Marshal(checkpoint)
+	if err != nil {
+		panic("save error in checkpoint")
+	}
+	// the previous checkpoint is replaced after the new one is written, so it survives a crash while writing
+	tmpFile := checkpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, v, 0644); err != nil {
+		return fmt.Errorf("%w. cannot write checkpointFile (%v): %v", ErrFile, tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, checkpointFile); err != nil {
+		return fmt.Errorf("%w. cannot write checkpointFile (%v): %v", ErrFile, checkpointFile, err)
+	}
+	return nil
+}
+
+// LoadCheckpoint loads model saved by SaveCheckpoint, restores the sampling state to dataContainer and annotatedDataContainer, and returns the model and the number of trained epochs.
+// dataContainer and annotatedDataContainer should be made from the same files as the checkpoint, and they should not be initialized. annotatedDataContainer can be nil.
+func LoadCheckpoint(modelName string, checkpointFile string, dataContainer *DataContainer, annotatedDataContainer *DataContainer) (UnsupervisedWSM, int, error) {
+	v, err := ioutil.ReadFile(checkpointFile)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w. cannot read checkpointFile (%v): %v", ErrFile, checkpointFile, err)
+	}
+	checkpoint := new(checkpointJSON)
+	if err := json.Unmarshal(v, checkpoint); err != nil {
+		return nil, 0, fmt.Errorf("%w. load error in checkpoint: %v", ErrFormat, err)
+	}
+	if checkpoint.ModelName != modelName {
+		return nil, 0, fmt.Errorf("%w. checkpointFile (%v) is %v, not %v", ErrFormat, checkpointFile, checkpoint.ModelName, modelName)
+	}
+	if len(checkpoint.SamplingWordSeqs) != dataContainer.Size || len(checkpoint.SamplingPosSeqs) != dataContainer.Size || len(checkpoint.SamplingDepthMemories) != dataContainer.Size {
+		return nil, 0, fmt.Errorf("%w. checkpointFile (%v) has %v sentences, but training data has %v sentences", ErrFormat, checkpointFile, len(checkpoint.SamplingWordSeqs), dataContainer.Size)
+	}
+	if annotatedDataContainer != nil && (len(checkpoint.AnnotatedWordSeqs) != annotatedDataContainer.Size || len(checkpoint.AnnotatedPosSeqs) != annotatedDataContainer.Size) {
+		return nil, 0, fmt.Errorf("%w. checkpointFile (%v) has %v annotated sentences, but annotated data has %v sentences", ErrFormat, checkpointFile, len(checkpoint.AnnotatedWordSeqs), annotatedDataContainer.Size)
+	}
+
+	model, err := newModelToLoad(modelName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := model.load(checkpoint.Model); err != nil {
+		return nil, 0, err
+	}
+	modelWSM, ok := model.(UnsupervisedWSM)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w. %v is not unsupervised word segmentation model", ErrUnknownModel, modelName)
+	}
+	modelWSM.setRandState(checkpoint.RandState)
+
+	dataContainer.SamplingWordSeqs = checkpoint.SamplingWordSeqs
+	dataContainer.SamplingPosSeqs = checkpoint.SamplingPosSeqs
+	dataContainer.SamplingDepthMemories = checkpoint.SamplingDepthMemories
+	if annotatedDataContainer != nil {
+		annotatedDataContainer.SamplingWordSeqs = checkpoint.AnnotatedWordSeqs
+		annotatedDataContainer.SamplingPosSeqs = checkpoint.AnnotatedPosSeqs
+	}
+	return modelWSM, checkpoint.Epoch, nil
+}
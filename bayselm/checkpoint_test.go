@@ -0,0 +1,125 @@
+package bayselm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+
+	for _, modelName := range []string{"npylm", "pyhsmm"} {
+		newModel := func() UnsupervisedWSM {
+			model, err := GenerateUnsupervisedWSM(modelName, 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, 2, 0.1, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			model.SetRandSeed(1)
+			return model
+		}
+		newDataContainer := func() *DataContainer {
+			dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return dataContainer
+		}
+		// the annotated texts have random POS tags, which are resampled by PYHSMM every epoch
+		newAnnotatedDataContainer := func() *DataContainer {
+			annotatedDataContainer, err := NewDataContainerFromAnnotatedData("../data/sample.train.word.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range annotatedDataContainer.SamplingPosSeqs {
+				for j := range annotatedDataContainer.SamplingPosSeqs[i] {
+					annotatedDataContainer.SamplingPosSeqs[i][j] = (i + j) % 2
+				}
+			}
+			return annotatedDataContainer
+		}
+		initialize := func(model UnsupervisedWSM, dataContainer *DataContainer, annotatedDataContainer *DataContainer) {
+			if err := model.Initialize(dataContainer); err != nil {
+				t.Fatal(err)
+			}
+			if err := model.InitializeFromAnnotatedData(annotatedDataContainer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		train := func(model UnsupervisedWSM, dataContainer *DataContainer, annotatedDataContainer *DataContainer, start int, end int) {
+			for e := start; e < end; e++ {
+				if err := model.TrainWordSegmentation(dataContainer, 4, 2); err != nil {
+					t.Fatal(err)
+				}
+				if pyhsmm, ok := model.(*PYHSMM); ok {
+					if err := pyhsmm.ResampleAnnotatedPOSTags(annotatedDataContainer, 1); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+
+		// 4 epochs without stopping
+		model := newModel()
+		dataContainer := newDataContainer()
+		annotatedDataContainer := newAnnotatedDataContainer()
+		initialize(model, dataContainer, annotatedDataContainer)
+		train(model, dataContainer, annotatedDataContainer, 0, 4)
+
+		// 2 epochs, stop and resume 2 epochs
+		modelToStop := newModel()
+		dataContainerToStop := newDataContainer()
+		annotatedDataContainerToStop := newAnnotatedDataContainer()
+		initialize(modelToStop, dataContainerToStop, annotatedDataContainerToStop)
+		train(modelToStop, dataContainerToStop, annotatedDataContainerToStop, 0, 2)
+		if err := SaveCheckpoint(modelName, modelToStop, dataContainerToStop, annotatedDataContainerToStop, 2, checkpointFile); err != nil {
+			t.Fatal(err)
+		}
+		dataContainerResumed := newDataContainer()
+		annotatedDataContainerResumed := newAnnotatedDataContainer()
+		modelResumed, epoch, err := LoadCheckpoint(modelName, checkpointFile, dataContainerResumed, annotatedDataContainerResumed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if epoch != 2 {
+			t.Error("expected = 2, but return ", epoch)
+		}
+		train(modelResumed, dataContainerResumed, annotatedDataContainerResumed, epoch, 4)
+
+		v, _ := model.save()
+		vResumed, _ := modelResumed.save()
+		if string(v) != string(vResumed) {
+			t.Error(modelName, "resumed model is different from the model trained without stopping")
+		}
+		for i := 0; i < dataContainer.Size; i++ {
+			if strings.Join(dataContainer.SamplingWordSeqs[i], " ") != strings.Join(dataContainerResumed.SamplingWordSeqs[i], " ") {
+				t.Error("expected = ", dataContainer.SamplingWordSeqs[i], "but return ", dataContainerResumed.SamplingWordSeqs[i])
+			}
+		}
+		for i := 0; i < annotatedDataContainer.Size; i++ {
+			if fmt.Sprint(annotatedDataContainer.SamplingPosSeqs[i]) != fmt.Sprint(annotatedDataContainerResumed.SamplingPosSeqs[i]) {
+				t.Error("expected = ", annotatedDataContainer.SamplingPosSeqs[i], "but return ", annotatedDataContainerResumed.SamplingPosSeqs[i])
+			}
+		}
+	}
+
+	if _, _, err := LoadCheckpoint("npylm", checkpointFile, &DataContainer{}, nil); !errors.Is(err, ErrFormat) {
+		t.Error("expected = ", ErrFormat, "but return ", err)
+	}
+	dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadCheckpoint("pyhsmm", checkpointFile, dataContainer, &DataContainer{Size: 1}); !errors.Is(err, ErrFormat) {
+		t.Error("expected = ", ErrFormat, "but return ", err)
+	}
+}
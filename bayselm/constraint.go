@@ -0,0 +1,281 @@
+package bayselm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// states of a word boundary in SentConstraint.
+const (
+	BoundaryUnknown   = 0
+	BoundaryForced    = 1
+	BoundaryForbidden = 2
+)
+
+// SentConstraint contains partial annotations of a sentence.
+// Boundaries[t] is the state of the word boundary after sent[t] (t < len(sent)-1).
+// FixedPos[t] is the POS tag of the fixed word which ends at sent[t], and -1 means no constraint.
+type SentConstraint struct {
+	Boundaries []int
+	FixedPos   []int
+}
+
+// newSentConstraint returns SentConstraint instance without any constraint.
+func newSentConstraint(sentLen int) *SentConstraint {
+	constraint := new(SentConstraint)
+	if sentLen > 0 {
+		constraint.Boundaries = make([]int, sentLen-1, sentLen-1)
+	}
+	constraint.FixedPos = make([]int, sentLen, sentLen)
+	for t := range constraint.FixedPos {
+		constraint.FixedPos[t] = -1
+	}
+	return constraint
+}
+
+// setBoundary sets the state of the word boundary after sent[t].
+// the boundaries at both ends of the sentence are ignored because they are always word boundaries.
+func (constraint *SentConstraint) setBoundary(t int, state int) error {
+	if t < 0 || t >= len(constraint.Boundaries) {
+		return nil
+	}
+	if constraint.Boundaries[t] != BoundaryUnknown && constraint.Boundaries[t] != state {
+		return fmt.Errorf("%w. the word boundary after %v-th character is both forced and forbidden", ErrFormat, t)
+	}
+	constraint.Boundaries[t] = state
+	return nil
+}
+
+// setFixedWord sets the constraint that sent[start:end] is a word whose POS tag is pos (-1 means any POS).
+func (constraint *SentConstraint) setFixedWord(start int, end int, pos int) error {
+	if err := constraint.setBoundary(start-1, BoundaryForced); err != nil {
+		return err
+	}
+	if err := constraint.setBoundary(end-1, BoundaryForced); err != nil {
+		return err
+	}
+	for t := start; t < end-1; t++ {
+		if err := constraint.setBoundary(t, BoundaryForbidden); err != nil {
+			return err
+		}
+	}
+	constraint.FixedPos[end-1] = pos
+	return nil
+}
+
+// allowWord returns whether sent[start:end+1] can be a word.
+// nil constraint allows any word.
+func (constraint *SentConstraint) allowWord(start int, end int) bool {
+	if constraint == nil {
+		return true
+	}
+	if start > 0 && constraint.Boundaries[start-1] == BoundaryForbidden {
+		return false
+	}
+	if end < len(constraint.Boundaries) && constraint.Boundaries[end] == BoundaryForbidden {
+		return false
+	}
+	for t := start; t < end; t++ {
+		if constraint.Boundaries[t] == BoundaryForced {
+			return false
+		}
+	}
+	return true
+}
+
+// allowPos returns whether the POS tag of the word which ends at sent[end] can be pos.
+// the word is the fixed word itself if allowWord is true.
+func (constraint *SentConstraint) allowPos(end int, pos int) bool {
+	if constraint == nil {
+		return true
+	}
+	return constraint.FixedPos[end] == -1 || constraint.FixedPos[end] == pos
+}
+
+// nextForcedBoundary returns the smallest end (> start) such that a word boundary is forced after sent[end-1], or len(sent).
+func (constraint *SentConstraint) nextForcedBoundary(start int, sentLen int) int {
+	if constraint == nil {
+		return sentLen
+	}
+	for t := start; t < len(constraint.Boundaries); t++ {
+		if constraint.Boundaries[t] == BoundaryForced {
+			return t + 1
+		}
+	}
+	return sentLen
+}
+
+// nextAllowedBoundary returns the smallest end (>= end) such that a word boundary is not forbidden after sent[end-1], or sentLen.
+func (constraint *SentConstraint) nextAllowedBoundary(end int, sentLen int) int {
+	if constraint == nil {
+		return end
+	}
+	for ; end-1 < len(constraint.Boundaries); end++ {
+		if constraint.Boundaries[end-1] != BoundaryForbidden {
+			return end
+		}
+	}
+	return sentLen
+}
+
+// check returns ErrFormat if the sentence has no segmentation which satisfies constraint with words up to maxWordLength characters,
+// e.g., a fixed word or a run of forbidden boundaries is longer than maxWordLength, because forward-backward has no path.
+// it also returns ErrFormat if a fixed POS tag is not smaller than posSize. posSize is 0 for models without POS tags.
+func (constraint *SentConstraint) check(maxWordLength int, posSize int) error {
+	if constraint == nil {
+		return nil
+	}
+	sentLen := len(constraint.FixedPos)
+	if posSize > 0 {
+		for t, pos := range constraint.FixedPos {
+			if pos >= posSize {
+				return fmt.Errorf("%w. POS tag (%v) of the fixed word which ends at %v-th character should be smaller than PosSize (%v)", ErrFormat, pos, t, posSize)
+			}
+		}
+	}
+	// reachable[t] is whether sent[:t] can be segmented
+	reachable := make([]bool, sentLen+1, sentLen+1)
+	reachable[0] = true
+	for end := 1; end <= sentLen; end++ {
+		for start := end - 1; start >= 0 && start >= end-maxWordLength; start-- {
+			if reachable[start] && constraint.allowWord(start, end-1) {
+				reachable[end] = true
+				break
+			}
+		}
+	}
+	if !reachable[sentLen] {
+		return fmt.Errorf("%w. no segmentation satisfies the partial annotations with words up to maxWordLength (%v) characters", ErrFormat, maxWordLength)
+	}
+	return nil
+}
+
+// checkConstraints checks all constraints (see SentConstraint.check). constraints can be nil.
+func checkConstraints(constraints []*SentConstraint, maxWordLength int, posSize int) error {
+	for i, constraint := range constraints {
+		if err := constraint.check(maxWordLength, posSize); err != nil {
+			return fmt.Errorf("%w: sentence %v", err, i)
+		}
+	}
+	return nil
+}
+
+// truncate truncates the constraint to the length of the sentence.
+func (constraint *SentConstraint) truncate(sentLen int) {
+	if sentLen <= 0 {
+		constraint.FixedPos = constraint.FixedPos[:0]
+		constraint.Boundaries = constraint.Boundaries[:0]
+	} else if sentLen < len(constraint.FixedPos) {
+		constraint.FixedPos = constraint.FixedPos[:sentLen]
+		constraint.Boundaries = constraint.Boundaries[:sentLen-1]
+	}
+}
+
+// constraintAt returns i-th constraint. constraints can be nil.
+func constraintAt(constraints []*SentConstraint, i int) *SentConstraint {
+	if constraints == nil {
+		return nil
+	}
+	return constraints[i]
+}
+
+// parseConstrainedSent parses a marked-up unsegmented sentence, and returns the sentence and its constraint.
+// "|" forces a word boundary (e.g., "これは|ペンです"), "+" forbids a word boundary (e.g., "これは+ペンです"),
+// and "[" and "]" fix a word whose POS tag can be given after "/" (e.g., "これは[ペン/3]です").
+// "\" escapes the next character. the constraint is nil if the sentence has no markup.
+func parseConstrainedSent(line string, splitter string) ([]string, *SentConstraint, error) {
+	type fixedWord struct {
+		start int
+		end   int
+		pos   int
+	}
+	sent := make([]string, 0, len(line))
+	boundaries := make([][2]int, 0, 0) // pairs of the number of characters before the markup and the state
+	fixedWords := make([]fixedWord, 0, 0)
+	segment := make([]rune, 0, len(line))
+	escaped := make([]bool, 0, len(line))
+	flush := func() {
+		for _, c := range strings.Split(string(segment), splitter) {
+			if c != "" {
+				sent = append(sent, c)
+			}
+		}
+		segment = segment[:0]
+		escaped = escaped[:0]
+	}
+	hasMarkup := false
+	fixedStart := -1
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			segment = append(segment, runes[i])
+			escaped = append(escaped, true)
+		case r == '|' || r == '+':
+			if fixedStart != -1 {
+				return nil, nil, fmt.Errorf("%w. %q is in a fixed word: %v", ErrFormat, r, line)
+			}
+			flush()
+			state := BoundaryForced
+			if r == '+' {
+				state = BoundaryForbidden
+			}
+			boundaries = append(boundaries, [2]int{len(sent), state})
+			hasMarkup = true
+		case r == '[':
+			if fixedStart != -1 {
+				return nil, nil, fmt.Errorf("%w. nested \"[\": %v", ErrFormat, line)
+			}
+			flush()
+			fixedStart = len(sent)
+			hasMarkup = true
+		case r == ']':
+			if fixedStart == -1 {
+				return nil, nil, fmt.Errorf("%w. \"]\" without \"[\": %v", ErrFormat, line)
+			}
+			pos := -1
+			for j := len(segment) - 1; j >= 0; j-- {
+				if segment[j] == '/' && !escaped[j] {
+					if p, err := strconv.Atoi(string(segment[j+1:])); err == nil && p >= 0 {
+						pos = p
+						segment = segment[:j]
+						escaped = escaped[:j]
+					}
+					break
+				}
+			}
+			flush()
+			if len(sent) == fixedStart {
+				return nil, nil, fmt.Errorf("%w. empty fixed word: %v", ErrFormat, line)
+			}
+			fixedWords = append(fixedWords, fixedWord{fixedStart, len(sent), pos})
+			fixedStart = -1
+		default:
+			segment = append(segment, r)
+			escaped = append(escaped, false)
+		}
+	}
+	flush()
+	if fixedStart != -1 {
+		return nil, nil, fmt.Errorf("%w. \"[\" without \"]\": %v", ErrFormat, line)
+	}
+	if !hasMarkup {
+		return sent, nil, nil
+	}
+
+	constraint := newSentConstraint(len(sent))
+	for _, boundary := range boundaries {
+		if err := constraint.setBoundary(boundary[0]-1, boundary[1]); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", err, line)
+		}
+	}
+	for _, word := range fixedWords {
+		if err := constraint.setFixedWord(word.start, word.end, word.pos); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", err, line)
+		}
+	}
+	return sent, constraint, nil
+}
@@ -0,0 +1,275 @@
+package bayselm
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConstrainedSent(t *testing.T) {
+	sent, constraint, err := parseConstrainedSent("ab|c[de/3]f+g\\|", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(sent, " ") != "a b c d e f g |" {
+		t.Error("expected = a b c d e f g |, but return ", sent)
+	}
+	expectedBoundaries := []int{BoundaryUnknown, BoundaryForced, BoundaryForced, BoundaryForbidden, BoundaryForced, BoundaryForbidden, BoundaryUnknown}
+	for i := range expectedBoundaries {
+		if constraint.Boundaries[i] != expectedBoundaries[i] {
+			t.Error("expected = ", expectedBoundaries, "but return ", constraint.Boundaries)
+			break
+		}
+	}
+	expectedFixedPos := []int{-1, -1, -1, -1, 3, -1, -1, -1}
+	for i := range expectedFixedPos {
+		if constraint.FixedPos[i] != expectedFixedPos[i] {
+			t.Error("expected = ", expectedFixedPos, "but return ", constraint.FixedPos)
+			break
+		}
+	}
+	if !constraint.allowWord(3, 4) || constraint.allowWord(3, 3) || constraint.allowWord(1, 2) || constraint.allowWord(5, 5) {
+		t.Error("allowWord does not follow the constraint ", constraint.Boundaries)
+	}
+	if !constraint.allowPos(4, 3) || constraint.allowPos(4, 0) || !constraint.allowPos(0, 0) {
+		t.Error("allowPos does not follow the constraint ", constraint.FixedPos)
+	}
+	if constraint.nextForcedBoundary(0, len(sent)) != 2 || constraint.nextForcedBoundary(5, len(sent)) != len(sent) {
+		t.Error("nextForcedBoundary does not follow the constraint ", constraint.Boundaries)
+	}
+	if constraint.nextAllowedBoundary(4, len(sent)) != 5 || constraint.nextAllowedBoundary(6, len(sent)) != 7 || constraint.nextAllowedBoundary(2, len(sent)) != 2 {
+		t.Error("nextAllowedBoundary does not follow the constraint ", constraint.Boundaries)
+	}
+
+	sent, constraint, err = parseConstrainedSent("abc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 3 || constraint != nil {
+		t.Error("expected = [a b c] and nil constraint, but return ", sent, constraint)
+	}
+}
+
+// checkConstrainedWordSeq returns whether wordSeq satisfies constraint.
+func checkConstrainedWordSeq(wordSeq []string, posSeq []int, constraint *SentConstraint) bool {
+	start := 0
+	for i, word := range wordSeq {
+		end := start + len([]rune(word)) - 1
+		if !constraint.allowWord(start, end) {
+			return false
+		}
+		if posSeq != nil && !constraint.allowPos(end, posSeq[i]) {
+			return false
+		}
+		start = end + 1
+	}
+	return true
+}
+
+func TestConstrainedSegmentation(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	lines := []string{"これは|ペン+です", "あれ[はペ/1]ンで|す", "[これはペン]です"}
+	sents := make([][]string, len(lines), len(lines))
+	constraints := make([]*SentConstraint, len(lines), len(lines))
+	var err error
+	for i, line := range lines {
+		sents[i], constraints[i], err = parseConstrainedSent(line, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 6, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 6, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []UnsupervisedWSM{npylm, pyhsmm} {
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.Initialize(dataContainerForTrain)
+		if err := model.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+		for _, decode := range []string{DecodeViterbi, DecodeMBR, DecodeSample} {
+			wordSeqs, err := TestWordSegmentationWithDecoding(model, sents, constraints, decode, "", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, wordSeq := range wordSeqs {
+				if !checkConstrainedWordSeq(wordSeq, nil, constraints[i]) {
+					t.Error("segmentation does not satisfy the constraint", decode, wordSeq, lines[i])
+				}
+			}
+		}
+		nbestSegmentations, err := model.TestNbestWordSegmentation(sents, constraints, 3, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range nbestSegmentations {
+			for _, nbestSegmentation := range nbestSegmentations[i] {
+				if !checkConstrainedWordSeq(nbestSegmentation.WordSeq, nbestSegmentation.PosSeq, constraints[i]) {
+					t.Error("nbest segmentation does not satisfy the constraint", nbestSegmentation.WordSeq, nbestSegmentation.PosSeq, lines[i])
+				}
+			}
+		}
+	}
+
+	wordSeqs, posSeqs, err := pyhsmm.TestWordSegmentationAndPOSTaggingWithConstraints(sents, constraints, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range wordSeqs {
+		if !checkConstrainedWordSeq(wordSeqs[i], posSeqs[i], constraints[i]) {
+			t.Error("POS tags do not satisfy the constraint", wordSeqs[i], posSeqs[i], lines[i])
+		}
+	}
+}
+
+func TestTrainWithConstraints(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []UnsupervisedWSM{npylm, pyhsmm} {
+		dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataContainer.Constraints = make([]*SentConstraint, dataContainer.Size, dataContainer.Size)
+		for i, sent := range dataContainer.Sents {
+			if len(sent) < 4 {
+				continue
+			}
+			constraint := newSentConstraint(len(sent))
+			constraint.setBoundary(0, BoundaryForced)
+			constraint.setFixedWord(1, 3, 1)
+			dataContainer.Constraints[i] = constraint
+		}
+		checkSamplingWordSeqs := func(state string) {
+			for i := range dataContainer.Sents {
+				var posSeq []int
+				if _, ok := model.(*PYHSMM); ok {
+					posSeq = dataContainer.SamplingPosSeqs[i]
+				}
+				if !checkConstrainedWordSeq(dataContainer.SamplingWordSeqs[i], posSeq, dataContainer.GetConstraint(i)) {
+					t.Error(state, "segmentation does not satisfy the constraint", dataContainer.SamplingWordSeqs[i], posSeq)
+				}
+			}
+		}
+		if err := model.Initialize(dataContainer); err != nil {
+			t.Fatal(err)
+		}
+		checkSamplingWordSeqs("initialized")
+		for e := 0; e < 2; e++ {
+			if err := model.TrainWordSegmentation(dataContainer, 2, 2); err != nil {
+				t.Fatal(err)
+			}
+			checkSamplingWordSeqs("sampled")
+		}
+	}
+}
+
+func TestCheckConstraints(t *testing.T) {
+	maxWordLength := 3
+	testCases := []struct {
+		line    string
+		posSize int
+		valid   bool
+	}{
+		{"ab[cdf/1]e+f", 2, true},
+		{"ab[cdefg]h", 2, false},
+		{"a+b+c+d", 2, false},
+		{"a+b|c+d+e", 2, true},
+		{"ab[cd/7]e", 2, false},
+		{"ab[cd/7]e", 0, true},
+	}
+	for _, testCase := range testCases {
+		_, constraint, err := parseConstrainedSent(testCase.line, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkConstraints([]*SentConstraint{nil, constraint}, maxWordLength, testCase.posSize)
+		if testCase.valid && err != nil {
+			t.Error(testCase.line, "expected no error, but return ", err)
+		}
+		if !testCase.valid && !errors.Is(err, ErrFormat) {
+			t.Error(testCase.line, "expected ErrFormat, but return ", err)
+		}
+	}
+
+	// models return ErrFormat instead of panicking in sampling
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, maxWordLength, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, maxWordLength, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"ab[cdefg]h", "ab[cd/7]e"} {
+		sent, constraint, err := parseConstrainedSent(line, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, model := range []UnsupervisedWSM{npylm, pyhsmm} {
+			if _, ok := model.(*NPYLM); ok && line == "ab[cd/7]e" {
+				continue
+			}
+			dataContainer := &DataContainer{Sents: [][]string{sent}, SamplingWordSeqs: []context{{}}, SamplingPosSeqs: [][]int{{}}, Constraints: []*SentConstraint{constraint}, Size: 1}
+			if err := model.Initialize(dataContainer); !errors.Is(err, ErrFormat) {
+				t.Error(ModelName(model.(NgramLM)), line, "expected ErrFormat, but return ", err)
+			}
+			if _, err := model.TestWordSegmentationWithConstraints([][]string{sent}, []*SentConstraint{constraint}, 1); !errors.Is(err, ErrFormat) {
+				t.Error(ModelName(model.(NgramLM)), line, "expected ErrFormat, but return ", err)
+			}
+		}
+	}
+}
+
+func TestNewDataContainerWithConstraints(t *testing.T) {
+	f, err := ioutil.TempFile("", "constraint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("これは|ペン\n\n[あれ/1]は\n")
+	f.Close()
+
+	dataContainer, err := NewDataContainerWithConstraints(f.Name(), "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataContainer.Size != 2 || len(dataContainer.Constraints[1].FixedPos) != 2 || len(dataContainer.Constraints[1].Boundaries) != 1 {
+		t.Error("unexpected truncated constraints", dataContainer.Size, dataContainer.Constraints)
+	}
+	// maxSentLen = 0 drops all sentences
+	if dataContainer, err := NewDataContainerWithConstraints(f.Name(), "", 0); err != nil || dataContainer.Size != 0 {
+		t.Error("expected no sentence, but return ", dataContainer, err)
+	}
+
+	// the line number of the error counts blank lines
+	f, err = ioutil.TempFile("", "constraint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("これは|ペン\n\n[あれは\n")
+	f.Close()
+	if _, err := NewDataContainerWithConstraints(f.Name(), "", 100); !errors.Is(err, ErrFormat) || !strings.HasSuffix(err.Error(), "line 3") {
+		t.Error("expected ErrFormat at line 3, but return ", err)
+	}
+}
@@ -0,0 +1,81 @@
+package bayselm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// decoding methods of word segmentation.
+const (
+	DecodeViterbi = "viterbi"
+	DecodeMBR     = "mbr"
+	DecodeSample  = "sample"
+)
+
+// TestWordSegmentationWithDecoding inferences word segmentation from input unsegmented texts by the decoding method.
+// decode is DecodeViterbi, DecodeMBR (minimum Bayes risk decoding for boundary F-score) or DecodeSample (sampling from the posterior).
+// constraints are partial annotations of sents (see NewDataContainerWithConstraints), and can be nil.
+func TestWordSegmentationWithDecoding(model UnsupervisedWSM, sents [][]string, constraints []*SentConstraint, decode string, splitter string, threadsNum int) ([][]string, error) {
+	switch decode {
+	case DecodeViterbi:
+		return model.TestWordSegmentationWithConstraints(sents, constraints, threadsNum)
+	case DecodeMBR:
+		boundaryMarginals, err := model.TestBoundaryMarginals(sents, constraints, threadsNum)
+		if err != nil {
+			return nil, err
+		}
+		wordSeqs := make([][]string, len(sents), len(sents))
+		for i, sent := range sents {
+			wordSeqs[i] = boundariesToWordSeq(sent, mbrBoundaries(boundaryMarginals[i]), splitter)
+		}
+		return wordSeqs, nil
+	case DecodeSample:
+		return model.SampleWordSegmentation(sents, constraints, threadsNum)
+	}
+	return nil, fmt.Errorf("%w. unknown decoding method (%v)", ErrInvalidParameter, decode)
+}
+
+// mbrBoundaries returns word boundaries which maximize expected boundary F-score.
+// expected F-score of boundaries B is approximated by 2 * sum_{b in B} p_b / (|B| + sum_b p_b), and it is maximized by the boundaries of the highest posterior probabilities.
+func mbrBoundaries(boundaryMarginals []float64) []bool {
+	boundaries := make([]bool, len(boundaryMarginals), len(boundaryMarginals))
+	expectedGoldSize := 0.0
+	indexes := make([]int, len(boundaryMarginals), len(boundaryMarginals))
+	for t, boundaryMarginal := range boundaryMarginals {
+		expectedGoldSize += boundaryMarginal
+		indexes[t] = t
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return boundaryMarginals[indexes[i]] > boundaryMarginals[indexes[j]]
+	})
+
+	bestSize := 0
+	bestF := 0.0
+	expectedCorrectSize := 0.0
+	for m, t := range indexes {
+		expectedCorrectSize += boundaryMarginals[t]
+		f := 2.0 * expectedCorrectSize / (float64(m+1) + expectedGoldSize)
+		if f > bestF {
+			bestF = f
+			bestSize = m + 1
+		}
+	}
+	for _, t := range indexes[:bestSize] {
+		boundaries[t] = true
+	}
+	return boundaries
+}
+
+// boundariesToWordSeq splits sent by boundaries. boundaries[t] means a word boundary after sent[t].
+func boundariesToWordSeq(sent []string, boundaries []bool, splitter string) []string {
+	wordSeq := make([]string, 0, len(sent))
+	start := 0
+	for t := 0; t < len(sent); t++ {
+		if t == len(sent)-1 || boundaries[t] {
+			wordSeq = append(wordSeq, strings.Join(sent[start:t+1], splitter))
+			start = t + 1
+		}
+	}
+	return wordSeq
+}
@@ -0,0 +1,62 @@
+package bayselm
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMbrBoundaries(t *testing.T) {
+	// expected F-scores of the top m boundaries are 0.58, 0.73, 0.75 and 0.69
+	boundaries := mbrBoundaries([]float64{0.9, 0.2, 0.6, 0.4})
+	expected := []bool{true, false, true, true}
+	for i := range expected {
+		if boundaries[i] != expected[i] {
+			t.Error("expected = ", expected, "but return ", boundaries)
+			break
+		}
+	}
+	wordSeq := boundariesToWordSeq(strings.Split("abcde", ""), boundaries, "")
+	if strings.Join(wordSeq, " ") != "a bc d e" {
+		t.Error("expected = a bc d e, but return ", wordSeq)
+	}
+
+	boundaries = mbrBoundaries([]float64{0.0, 0.0})
+	if boundaries[0] || boundaries[1] {
+		t.Error("expected = [false false], but return ", boundaries)
+	}
+}
+
+func TestDecoding(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []UnsupervisedWSM{npylm, pyhsmm} {
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.Initialize(dataContainerForTrain)
+		if err := model.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+		for _, decode := range []string{DecodeViterbi, DecodeMBR, DecodeSample} {
+			wordSeqs, err := TestWordSegmentationWithDecoding(model, dataContainerForTrain.Sents, nil, decode, "", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, wordSeq := range wordSeqs {
+				if !(strings.Join(wordSeq, "") == strings.Join(dataContainerForTrain.Sents[i], "")) {
+					t.Error("segmentation does not cover the sentence", decode, wordSeq, dataContainerForTrain.Sents[i])
+				}
+			}
+		}
+	}
+}
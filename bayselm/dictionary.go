@@ -0,0 +1,77 @@
+package bayselm
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DictionaryEntry is a word of the user dictionary.
+// Pos is -1 if the POS tag is not given, and Count is the pseudo-count of the word.
+type DictionaryEntry struct {
+	Word  string
+	Pos   int
+	Count float64
+}
+
+// LoadDictionary returns entries of the user dictionary.
+// each line of input file is "word [POS [count]]" split by space. POS is an integer and "-" means no POS tag. count is 1.0 by default.
+// e.g., "ペン 3 10.0", "ペン - 10.0"
+func LoadDictionary(filePath string) ([]DictionaryEntry, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w. cannot open filePath (%v): %v", ErrFile, filePath, err)
+	}
+	defer f.Close()
+
+	entries := make([]DictionaryEntry, 0, 0)
+	sc := bufio.NewScanner(f)
+	count := 0
+	for sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("%w. read error in filePath (%v): line %v: %v", ErrFile, filePath, count, err)
+		}
+		count++
+
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("%w. filePath (%v): line %v. too many fields", ErrFormat, filePath, count)
+		}
+		entry := DictionaryEntry{Word: strings.ToLower(fields[0]), Pos: -1, Count: 1.0}
+		if len(fields) >= 2 && fields[1] != "-" {
+			pos, err := strconv.Atoi(fields[1])
+			if err != nil || pos < 0 {
+				return nil, fmt.Errorf("%w. filePath (%v): line %v. POS (%v) should be a non-negative integer or \"-\"", ErrFormat, filePath, count, fields[1])
+			}
+			entry.Pos = pos
+		}
+		if len(fields) == 3 {
+			c, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil || c <= 0.0 {
+				return nil, fmt.Errorf("%w. filePath (%v): line %v. count (%v) should be a positive number", ErrFormat, filePath, count, fields[2])
+			}
+			entry.Count = c
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// makeDictionary returns word to probability in the user dictionary, which is proportional to the pseudo-count.
+func makeDictionary(entries []DictionaryEntry) map[string]float64 {
+	dictionary := make(map[string]float64)
+	totalCount := 0.0
+	for _, entry := range entries {
+		dictionary[entry.Word] += entry.Count
+		totalCount += entry.Count
+	}
+	for word := range dictionary {
+		dictionary[word] /= totalCount
+	}
+	return dictionary
+}
@@ -0,0 +1,125 @@
+package bayselm
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadDictionary(t *testing.T) {
+	f, err := ioutil.TempFile("", "dictionary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("ペン\nABC 1\nはペンで - 3.0\n\nです 0 0.5\n")
+	f.Close()
+
+	entries, err := LoadDictionary(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DictionaryEntry{{"ペン", -1, 1.0}, {"abc", 1, 1.0}, {"はペンで", -1, 3.0}, {"です", 0, 0.5}}
+	if len(entries) != len(expected) {
+		t.Fatal("expected = ", expected, "but return ", entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Error("expected = ", expected[i], "but return ", entries[i])
+		}
+	}
+
+	dictionary := makeDictionary(entries)
+	if math.Abs(dictionary["はペンで"]-3.0/5.5) > 1e-10 {
+		t.Error("expected = ", 3.0/5.5, "but return ", dictionary["はペンで"])
+	}
+}
+
+func TestDictionaryPrior(t *testing.T) {
+	word := "はペンで"
+	weight := 0.5
+	entries := []DictionaryEntry{{word, 1, 1.0}}
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dataContainerForTrain *DataContainer
+	for _, model := range []UnsupervisedWSM{npylm, pyhsmm} {
+		model.SetRandSeed(1)
+		dataContainerForTrain, err = NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := model.SetDictionary(entries, weight); err != nil {
+			t.Fatal(err)
+		}
+		if err := model.Initialize(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
+		for e := 0; e < 2; e++ {
+			if err := model.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the base measure of the dictionary word rises by the mixture weight, and those of the other words are discounted
+	charBase := npylm.calcCharBase(word)
+	if expected := (1.0-weight)*charBase + weight; math.Abs(npylm.calcBase(word)-expected) > 1e-12 {
+		t.Error("expected = ", expected, "but return ", npylm.calcBase(word))
+	}
+	otherWord := "ペン"
+	if expected := (1.0 - weight) * npylm.calcCharBase(otherWord); math.Abs(npylm.calcBase(otherWord)-expected) > 1e-12 {
+		t.Error("expected = ", expected, "but return ", npylm.calcBase(otherWord))
+	}
+
+	// so the posterior probability of the dictionary word rises
+	sent := dataContainerForTrain.Sents[0]
+	start := -1
+	end := 0
+	for i := 0; i+len([]rune(word)) <= len(sent); i++ {
+		if strings.Join(sent[i:i+len([]rune(word))], "") == word {
+			start, end = i, i+len([]rune(word))-1
+			break
+		}
+	}
+	if start == -1 {
+		t.Fatal(word, "is not in ", sent)
+	}
+	withDictionary := npylm.CalcWordMarginals(sent)[end][end-start]
+	if err := npylm.SetDictionary(nil, 0.0); err != nil {
+		t.Fatal(err)
+	}
+	withoutDictionary := npylm.CalcWordMarginals(sent)[end][end-start]
+	if !(withDictionary > withoutDictionary) {
+		t.Error("dictionary word is not preferred", withDictionary, withoutDictionary)
+	}
+	if err := npylm.SetDictionary(entries, weight); err != nil {
+		t.Fatal(err)
+	}
+
+	// the base measure of the dictionary word is boosted only for its POS tag
+	charBase = pyhsmm.npylms[0].calcCharBase(word)
+	if expected := (1.0-weight)*charBase + weight; math.Abs(pyhsmm.npylms[1].mixDictionaryBase(word, charBase)-expected) > 1e-12 || pyhsmm.npylms[0].mixDictionaryBase(word, charBase) != charBase {
+		t.Error("base measure of the dictionary word is not boosted for its POS tag")
+	}
+
+	// the dictionary is saved with the model
+	v, _ := npylm.save()
+	loadedNpylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadedNpylm.load(v); err != nil {
+		t.Fatal(err)
+	}
+	if loadedNpylm.calcBase(word) != npylm.calcBase(word) {
+		t.Error("dictionary is not loaded", loadedNpylm.calcBase(word), npylm.calcBase(word))
+	}
+}
@@ -0,0 +1,28 @@
+package bayselm
+
+import (
+	"errors"
+)
+
+// errors returned by bayselm. returned errors wrap one of them, so the cause can be checked by errors.Is.
+// panic is used only for violations of internal invariants, e.g., sampling errors.
+var (
+	// ErrInvalidParameter means that a hyper-parameter or an argument (e.g., threadsNum) is out of range.
+	ErrInvalidParameter = errors.New("invalid parameter")
+	// ErrUnknownModel means that a model name is unknown.
+	ErrUnknownModel = errors.New("unknown model")
+	// ErrFile means that a file cannot be opened, read or written.
+	ErrFile = errors.New("file error")
+	// ErrFormat means that an input text, a user dictionary or a model file is malformed.
+	ErrFormat = errors.New("format error")
+	// ErrVersion means that the format version of a model file is not supported.
+	ErrVersion = errors.New("unsupported format version")
+	// ErrCustomerNotFound means that a customer to be removed does not exist in the model.
+	ErrCustomerNotFound = errors.New("customer not found")
+	// ErrInvalidAPIParam means that APIParam is invalid.
+	ErrInvalidAPIParam = errors.New("invalid API parameter")
+	// ErrNotImplemented means that the function is not implemented for the model.
+	ErrNotImplemented = errors.New("not implemented")
+	// ErrFrozen means that the model is frozen by Freeze, so it cannot be trained or saved.
+	ErrFrozen = errors.New("model is frozen")
+)
@@ -0,0 +1,89 @@
+package bayselm
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	if _, err := NewHPYLM(1, 1.0, 1.5, 1.0, 1.0, 1.0, 1.0, 0.1); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected = ", ErrInvalidParameter, "but return ", err)
+	}
+	if _, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1, 6, ""); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected = ", ErrInvalidParameter, "but return ", err)
+	}
+	if _, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 4, 10, 10, ""); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected = ", ErrInvalidParameter, "but return ", err)
+	}
+	if _, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 3, 10, 10, ""); err != nil {
+		t.Error("expected = nil, but return ", err)
+	}
+	if _, err := GenerateNgramLM("unknown", 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 6, 1, 0.1); !errors.Is(err, ErrUnknownModel) {
+		t.Error("expected = ", ErrUnknownModel, "but return ", err)
+	}
+	if _, err := NewDataContainer("not_exist_file.txt", "", 100); !errors.Is(err, ErrFile) {
+		t.Error("expected = ", ErrFile, "but return ", err)
+	}
+	dataContainer, err := NewDataContainer("../data/sample.txt", "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataContainer.GetSentString(dataContainer.Size - 1); err != nil {
+		t.Error("expected = nil, but return ", err)
+	}
+	if _, err := dataContainer.GetSentString(dataContainer.Size); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected = ", ErrInvalidParameter, "but return ", err)
+	}
+
+	ngram, err := NewNgram(2, []float64{0.5, 0.5}, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ngram.AddCount("a", context{"b", "c"}); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected = ", ErrInvalidParameter, "but return ", err)
+	}
+	if _, err := ngram.CalcProb("a", context{"b", "c"}); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected = ", ErrInvalidParameter, "but return ", err)
+	}
+	if err := ngram.AddCount("a", context{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := ngram.CalcProb("a", context{"b"}); ngram.ReturnNgramProb("a", context{"c", "b"}) != p {
+		t.Error("expected = ", p, "but return ", ngram.ReturnNgramProb("a", context{"c", "b"}))
+	}
+
+	hpylm, err := NewHPYLM(1, 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hpylm.AddCustomer("a", context{"b"}, hpylm.Base, hpylm.addCustomerBaseNull); err != nil {
+		t.Fatal(err)
+	}
+	if err := hpylm.RemoveCustomer("a", context{"c"}, hpylm.removeCustomerBaseNull); !errors.Is(err, ErrCustomerNotFound) {
+		t.Error("expected = ", ErrCustomerNotFound, "but return ", err)
+	}
+	if err := hpylm.RemoveCustomer("a", context{"b"}, hpylm.removeCustomerBaseNull); err != nil {
+		t.Error("expected = nil, but return ", err)
+	}
+
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 6, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := npylm.TestWordSegmentation([][]string{{"a", "b"}}, 0); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected = ", ErrInvalidParameter, "but return ", err)
+	}
+
+	f, err := ioutil.TempFile("", "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("{")
+	f.Close()
+	if _, err := Load(f.Name()); !errors.Is(err, ErrFormat) {
+		t.Error("expected = ", ErrFormat, "but return ", err)
+	}
+}
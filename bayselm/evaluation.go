@@ -0,0 +1,416 @@
+package bayselm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// SegmentationScore contains word-level and boundary-level precision, recall and F-score of word segmentation.
+type SegmentationScore struct {
+	WordPrecision float64
+	WordRecall    float64
+	WordF         float64
+
+	BoundaryPrecision float64
+	BoundaryRecall    float64
+	BoundaryF         float64
+
+	CorrectWordCount     int
+	PredWordCount        int
+	GoldWordCount        int
+	CorrectBoundaryCount int
+	PredBoundaryCount    int
+	GoldBoundaryCount    int
+}
+
+// wordSpans returns [start, end) character spans of words.
+// empty words (e.g., made by continuous spaces) are ignored.
+func wordSpans(wordSeq []string, splitter string) [][2]int {
+	spans := make([][2]int, 0, len(wordSeq))
+	start := 0
+	for _, word := range wordSeq {
+		if word == "" {
+			continue
+		}
+		end := start + len(strings.Split(word, splitter))
+		spans = append(spans, [2]int{start, end})
+		start = end
+	}
+	return spans
+}
+
+// EvaluateWordSegmentation compares predicted word sequences with gold word sequences.
+// boundaries at the beginning and the end of sentences are not counted.
+func EvaluateWordSegmentation(goldWordSeqs [][]string, predWordSeqs [][]string, splitter string) (SegmentationScore, error) {
+	if len(goldWordSeqs) != len(predWordSeqs) {
+		return SegmentationScore{}, fmt.Errorf("%w. number of gold sentences (%v) != number of predicted sentences (%v)", ErrInvalidParameter, len(goldWordSeqs), len(predWordSeqs))
+	}
+	score := SegmentationScore{}
+	for i := range goldWordSeqs {
+		goldSpans := wordSpans(goldWordSeqs[i], splitter)
+		predSpans := wordSpans(predWordSeqs[i], splitter)
+		goldLen := 0
+		if len(goldSpans) != 0 {
+			goldLen = goldSpans[len(goldSpans)-1][1]
+		}
+		predLen := 0
+		if len(predSpans) != 0 {
+			predLen = predSpans[len(predSpans)-1][1]
+		}
+		if goldLen != predLen {
+			return SegmentationScore{}, fmt.Errorf("%w. length of %v-th sentence is different. gold (%v), pred (%v)", ErrInvalidParameter, i, goldWordSeqs[i], predWordSeqs[i])
+		}
+
+		goldSpanSet := make(map[[2]int]bool)
+		goldBoundarySet := make(map[int]bool)
+		for _, span := range goldSpans {
+			goldSpanSet[span] = true
+			if span[1] != goldLen {
+				goldBoundarySet[span[1]] = true
+			}
+		}
+		for _, span := range predSpans {
+			if goldSpanSet[span] {
+				score.CorrectWordCount++
+			}
+			if span[1] != predLen {
+				score.PredBoundaryCount++
+				if goldBoundarySet[span[1]] {
+					score.CorrectBoundaryCount++
+				}
+			}
+		}
+		score.PredWordCount += len(predSpans)
+		score.GoldWordCount += len(goldSpans)
+		score.GoldBoundaryCount += len(goldBoundarySet)
+	}
+	score.WordPrecision, score.WordRecall, score.WordF = calcPRF(score.CorrectWordCount, score.PredWordCount, score.GoldWordCount)
+	score.BoundaryPrecision, score.BoundaryRecall, score.BoundaryF = calcPRF(score.CorrectBoundaryCount, score.PredBoundaryCount, score.GoldBoundaryCount)
+	return score, nil
+}
+
+func calcPRF(correct int, pred int, gold int) (float64, float64, float64) {
+	precision := 0.0
+	if pred != 0 {
+		precision = float64(correct) / float64(pred)
+	}
+	recall := 0.0
+	if gold != 0 {
+		recall = float64(correct) / float64(gold)
+	}
+	f := 0.0
+	if precision+recall != 0.0 {
+		f = 2.0 * precision * recall / (precision + recall)
+	}
+	return precision, recall, f
+}
+
+// UnsegmentedSents returns lowered character sequences of word sequences to input them to UnsupervisedWSM.
+func UnsegmentedSents(wordSeqs [][]string, splitter string) [][]string {
+	sents := make([][]string, len(wordSeqs), len(wordSeqs))
+	for i, wordSeq := range wordSeqs {
+		sents[i] = make([]string, 0, len(wordSeq))
+		for _, word := range wordSeq {
+			if word == "" {
+				continue
+			}
+			sents[i] = append(sents[i], strings.Split(strings.ToLower(word), splitter)...)
+		}
+	}
+	return sents
+}
+
+// EvaluateUnsupervisedWSM segments sentences of gold data and evaluates them.
+// goldDataContainer is made by NewDataContainerFromAnnotatedData, and decode is a decoding method (see TestWordSegmentationWithDecoding).
+func EvaluateUnsupervisedWSM(model UnsupervisedWSM, goldDataContainer *DataContainer, decode string, splitter string, threadsNum int) (SegmentationScore, [][]string, error) {
+	goldWordSeqs := goldDataContainer.GetWordSeqs()
+	predWordSeqs, err := TestWordSegmentationWithDecoding(model, UnsegmentedSents(goldWordSeqs, splitter), nil, decode, splitter, threadsNum)
+	if err != nil {
+		return SegmentationScore{}, nil, err
+	}
+	score, err := EvaluateWordSegmentation(goldWordSeqs, predWordSeqs, splitter)
+	return score, predWordSeqs, err
+}
+
+// PosInductionScore contains scores of induced POS tags compared with gold POS tags.
+// VariationOfInformation is measured in bits.
+type PosInductionScore struct {
+	ManyToOneAccuracy      float64
+	OneToOneAccuracy       float64
+	Homogeneity            float64
+	Completeness           float64
+	VMeasure               float64
+	VariationOfInformation float64
+
+	TokenCount int
+}
+
+// alignPosTags returns the induced POS tag of each gold word.
+// segmentation of gold and prediction may be different, so each gold word takes the tag of the predicted word which overlaps it the most on character spans.
+func alignPosTags(goldWordSeq []string, predWordSeq []string, predPosSeq []int, splitter string) []int {
+	goldSpans := wordSpans(goldWordSeq, splitter)
+	predSpans := make([][2]int, 0, len(predWordSeq))
+	predTags := make([]int, 0, len(predWordSeq))
+	start := 0
+	for i, word := range predWordSeq {
+		if word == "" {
+			continue
+		}
+		end := start + len(strings.Split(word, splitter))
+		predSpans = append(predSpans, [2]int{start, end})
+		predTags = append(predTags, predPosSeq[i])
+		start = end
+	}
+
+	alignedTags := make([]int, len(goldSpans), len(goldSpans))
+	p := 0
+	for i, goldSpan := range goldSpans {
+		maxOverlap := 0
+		for p < len(predSpans) && predSpans[p][1] <= goldSpan[0] {
+			p++
+		}
+		for q := p; q < len(predSpans) && predSpans[q][0] < goldSpan[1]; q++ {
+			overlap := minInt(goldSpan[1], predSpans[q][1]) - maxInt(goldSpan[0], predSpans[q][0])
+			if overlap > maxOverlap {
+				maxOverlap = overlap
+				alignedTags[i] = predTags[q]
+			}
+		}
+	}
+	return alignedTags
+}
+
+// EvaluatePosInduction compares induced POS tags with gold POS tags.
+// POS tags are IDs, and IDs of gold and induced tags need not correspond to each other.
+func EvaluatePosInduction(goldWordSeqs [][]string, goldPosSeqs [][]int, predWordSeqs [][]string, predPosSeqs [][]int, splitter string) (PosInductionScore, error) {
+	if len(goldWordSeqs) != len(predWordSeqs) {
+		return PosInductionScore{}, fmt.Errorf("%w. number of gold sentences (%v) != number of predicted sentences (%v)", ErrInvalidParameter, len(goldWordSeqs), len(predWordSeqs))
+	}
+
+	// counts[goldTag][predTag]
+	goldTag2index := make(map[int]int)
+	predTag2index := make(map[int]int)
+	counts := make([][]float64, 0, 0)
+	tokenCount := 0
+	for i := range goldWordSeqs {
+		goldTags := make([]int, 0, len(goldPosSeqs[i]))
+		for j, word := range goldWordSeqs[i] {
+			if word == "" {
+				continue
+			}
+			goldTags = append(goldTags, goldPosSeqs[i][j])
+		}
+		alignedTags := alignPosTags(goldWordSeqs[i], predWordSeqs[i], predPosSeqs[i], splitter)
+		for j, goldTag := range goldTags {
+			g, ok := goldTag2index[goldTag]
+			if !ok {
+				g = len(goldTag2index)
+				goldTag2index[goldTag] = g
+				counts = append(counts, make([]float64, len(predTag2index), len(predTag2index)))
+			}
+			p, ok := predTag2index[alignedTags[j]]
+			if !ok {
+				p = len(predTag2index)
+				predTag2index[alignedTags[j]] = p
+				for c := range counts {
+					counts[c] = append(counts[c], 0.0)
+				}
+			}
+			counts[g][p]++
+			tokenCount++
+		}
+	}
+
+	score := PosInductionScore{TokenCount: tokenCount}
+	if tokenCount == 0 {
+		return score, nil
+	}
+	n := float64(tokenCount)
+	goldSize := len(goldTag2index)
+	predSize := len(predTag2index)
+
+	// many-to-one
+	manyToOne := 0.0
+	for p := 0; p < predSize; p++ {
+		maxCount := 0.0
+		for g := 0; g < goldSize; g++ {
+			maxCount = math.Max(maxCount, counts[g][p])
+		}
+		manyToOne += maxCount
+	}
+	score.ManyToOneAccuracy = manyToOne / n
+
+	// one-to-one
+	assignment := hungarian(counts)
+	oneToOne := 0.0
+	for g, p := range assignment {
+		if p >= 0 {
+			oneToOne += counts[g][p]
+		}
+	}
+	score.OneToOneAccuracy = oneToOne / n
+
+	// entropies in bits
+	goldCounts := make([]float64, goldSize, goldSize)
+	predCounts := make([]float64, predSize, predSize)
+	for g := 0; g < goldSize; g++ {
+		for p := 0; p < predSize; p++ {
+			goldCounts[g] += counts[g][p]
+			predCounts[p] += counts[g][p]
+		}
+	}
+	entropyGold := 0.0
+	for _, count := range goldCounts {
+		entropyGold -= (count / n) * math.Log2(count/n)
+	}
+	entropyPred := 0.0
+	for _, count := range predCounts {
+		entropyPred -= (count / n) * math.Log2(count/n)
+	}
+	entropyGoldGivenPred := 0.0
+	entropyPredGivenGold := 0.0
+	for g := 0; g < goldSize; g++ {
+		for p := 0; p < predSize; p++ {
+			if counts[g][p] == 0.0 {
+				continue
+			}
+			entropyGoldGivenPred -= (counts[g][p] / n) * math.Log2(counts[g][p]/predCounts[p])
+			entropyPredGivenGold -= (counts[g][p] / n) * math.Log2(counts[g][p]/goldCounts[g])
+		}
+	}
+	score.Homogeneity = 1.0
+	if entropyGold > 0.0 {
+		score.Homogeneity = 1.0 - entropyGoldGivenPred/entropyGold
+	}
+	score.Completeness = 1.0
+	if entropyPred > 0.0 {
+		score.Completeness = 1.0 - entropyPredGivenGold/entropyPred
+	}
+	if score.Homogeneity+score.Completeness > 0.0 {
+		score.VMeasure = 2.0 * score.Homogeneity * score.Completeness / (score.Homogeneity + score.Completeness)
+	}
+	score.VariationOfInformation = entropyGoldGivenPred + entropyPredGivenGold
+	return score, nil
+}
+
+// hungarian returns the assignment from rows to columns which maximizes the sum of weights.
+// rows which are not assigned (when rows are more than columns) have -1.
+func hungarian(weights [][]float64) []int {
+	rowSize := len(weights)
+	colSize := 0
+	maxWeight := 0.0
+	for _, row := range weights {
+		colSize = maxInt(colSize, len(row))
+		for _, weight := range row {
+			maxWeight = math.Max(maxWeight, weight)
+		}
+	}
+	size := maxInt(rowSize, colSize)
+	// cost[i][j] is 1-indexed square matrix for minimization
+	cost := make([][]float64, size+1, size+1)
+	for i := 0; i <= size; i++ {
+		cost[i] = make([]float64, size+1, size+1)
+		for j := 1; j <= size && i >= 1; j++ {
+			cost[i][j] = maxWeight
+			if i-1 < rowSize && j-1 < len(weights[i-1]) {
+				cost[i][j] = maxWeight - weights[i-1][j-1]
+			}
+		}
+	}
+
+	u := make([]float64, size+1, size+1)
+	v := make([]float64, size+1, size+1)
+	match := make([]int, size+1, size+1) // match[j] is the row assigned to column j
+	way := make([]int, size+1, size+1)
+	for i := 1; i <= size; i++ {
+		match[0] = i
+		j0 := 0
+		minv := make([]float64, size+1, size+1)
+		used := make([]bool, size+1, size+1)
+		for j := 0; j <= size; j++ {
+			minv[j] = math.Inf(1)
+		}
+		for {
+			used[j0] = true
+			i0 := match[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= size; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0][j] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= size; j++ {
+				if used[j] {
+					u[match[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if match[j0] == 0 {
+				break
+			}
+		}
+		for {
+			j1 := way[j0]
+			match[j0] = match[j1]
+			j0 = j1
+			if j0 == 0 {
+				break
+			}
+		}
+	}
+
+	assignment := make([]int, rowSize, rowSize)
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for j := 1; j <= size; j++ {
+		if match[j]-1 < rowSize && j-1 < colSize {
+			assignment[match[j]-1] = j - 1
+		}
+	}
+	return assignment
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// EvaluatePYHSMMPosInduction segments and tags sentences of gold data and evaluates them.
+// goldDataContainer is made by NewDataContainerFromAnnotatedDataWithPos.
+func EvaluatePYHSMMPosInduction(pyhsmm *PYHSMM, goldDataContainer *DataContainer, splitter string, threadsNum int) (SegmentationScore, PosInductionScore, error) {
+	goldWordSeqs := goldDataContainer.GetWordSeqs()
+	predWordSeqs, predPosSeqs, err := pyhsmm.TestWordSegmentationAndPOSTagging(UnsegmentedSents(goldWordSeqs, splitter), threadsNum)
+	if err != nil {
+		return SegmentationScore{}, PosInductionScore{}, err
+	}
+	segmentationScore, err := EvaluateWordSegmentation(goldWordSeqs, predWordSeqs, splitter)
+	if err != nil {
+		return SegmentationScore{}, PosInductionScore{}, err
+	}
+	posInductionScore, err := EvaluatePosInduction(goldWordSeqs, goldDataContainer.SamplingPosSeqs[:goldDataContainer.Size], predWordSeqs, predPosSeqs, splitter)
+	return segmentationScore, posInductionScore, err
+}
@@ -0,0 +1,88 @@
+package bayselm
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEvaluateWordSegmentation(t *testing.T) {
+	goldWordSeqs := [][]string{{"これ", "は", "ペン", "です", "。"}, {"それ", "ペン", "？"}}
+	predWordSeqs := [][]string{{"これは", "ペン", "です", "。"}, {"それ", "ペ", "ン？"}}
+	score, err := EvaluateWordSegmentation(goldWordSeqs, predWordSeqs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// correct words: ペン, です, 。, それ
+	if !(score.CorrectWordCount == 4 && score.PredWordCount == 7 && score.GoldWordCount == 8) {
+		t.Error("word counts are wrong", score)
+	}
+	// gold boundaries: 2, 3, 5, 7 and 2, 4. predicted boundaries: 3, 5, 7 and 2, 3
+	if !(score.CorrectBoundaryCount == 4 && score.PredBoundaryCount == 5 && score.GoldBoundaryCount == 6) {
+		t.Error("boundary counts are wrong", score)
+	}
+	if !(math.Abs(score.WordPrecision-4.0/7.0) < 1e-12 && math.Abs(score.WordRecall-4.0/8.0) < 1e-12) {
+		t.Error("word precision or recall is wrong", score)
+	}
+	fCorrect := 2.0 * (4.0 / 5.0) * (4.0 / 6.0) / ((4.0 / 5.0) + (4.0 / 6.0))
+	if !(math.Abs(score.BoundaryF-fCorrect) < 1e-12) {
+		t.Error("score.BoundaryF = ", score.BoundaryF, "fCorrect = ", fCorrect)
+	}
+
+	perfectScore, err := EvaluateWordSegmentation(goldWordSeqs, goldWordSeqs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(perfectScore.WordF == 1.0 && perfectScore.BoundaryF == 1.0) {
+		t.Error("perfectScore = ", perfectScore)
+	}
+}
+
+func TestEvaluatePosInduction(t *testing.T) {
+	goldWordSeqs := [][]string{{"abc", "de", "f"}, {"gh", "ij"}}
+	goldPosSeqs := [][]int{{0, 1, 2}, {1, 0}}
+
+	// induced tags are a relabeling of gold tags
+	predPosSeqs := [][]int{{5, 3, 4}, {3, 5}}
+	score, err := EvaluatePosInduction(goldWordSeqs, goldPosSeqs, goldWordSeqs, predPosSeqs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score.ManyToOneAccuracy != 1.0 || score.OneToOneAccuracy != 1.0 || math.Abs(score.VMeasure-1.0) > 1e-9 || math.Abs(score.VariationOfInformation) > 1e-9 {
+		t.Error("expected = perfect score, but return ", score)
+	}
+
+	// all words have the same induced tag
+	predPosSeqs = [][]int{{0, 0, 0}, {0, 0}}
+	score, err = EvaluatePosInduction(goldWordSeqs, goldPosSeqs, goldWordSeqs, predPosSeqs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score.ManyToOneAccuracy != 0.4 || score.OneToOneAccuracy != 0.4 || score.Homogeneity != 0.0 || score.Completeness != 1.0 {
+		t.Error("expected = (0.4, 0.4, 0.0, 1.0), but return ", score)
+	}
+
+	// segmentation mismatch. "abc" is aligned with "ab" and "def" is aligned with "de" and "f".
+	predWordSeqs := [][]string{{"ab", "c", "def"}, {"gh", "ij"}}
+	predPosSeqs = [][]int{{1, 0, 2}, {2, 1}}
+	score, err = EvaluatePosInduction(goldWordSeqs, goldPosSeqs, predWordSeqs, predPosSeqs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score.TokenCount != 5 || score.ManyToOneAccuracy != 0.8 || score.OneToOneAccuracy != 0.8 {
+		t.Error("expected = (5, 0.8, 0.8), but return ", score)
+	}
+}
+
+func TestHungarian(t *testing.T) {
+	weights := [][]float64{{1, 5, 0}, {4, 4, 1}}
+	assignment := hungarian(weights)
+	if assignment[0] != 1 || assignment[1] != 0 {
+		t.Error("expected = [1 0], but return ", assignment)
+	}
+	weights = [][]float64{{1}, {3}, {2}}
+	assignment = hungarian(weights)
+	if assignment[0] != -1 || assignment[1] != 0 || assignment[2] != -1 {
+		t.Error("expected = [-1 0 -1], but return ", assignment)
+	}
+}
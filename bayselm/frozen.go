@@ -0,0 +1,147 @@
+package bayselm
+
+import (
+	"sort"
+	"strings"
+)
+
+// frozenCount is the counts of word in a frozen restaurant.
+type frozenCount struct {
+	word          int32 // id in the vocabulary of frozenHPYLM
+	customerCount newUint
+	tableCount    newUint
+}
+
+type frozenChild struct {
+	word int32 // id of the previous word of the context
+	rst  *frozenRestaurant
+}
+
+// frozenRestaurant is restaurant without seating arrangements. it has only counts which are needed to calculate probabilities.
+// frozen restaurants are a tree of contexts, and the children of a restaurant are the restaurants of the contexts which are longer by one previous word.
+type frozenRestaurant struct {
+	counts   []frozenCount // sorted by word
+	children []frozenChild // sorted by word
+	exists   bool          // false if the restaurant is only a node of the tree and does not exist in HPYLM
+
+	totalCustomerCount newUint
+	totalTableCount    newUint
+	stop               newUint
+	pass               newUint
+}
+
+func (rst *frozenRestaurant) count(word int32) (newUint, newUint) {
+	i := sort.Search(len(rst.counts), func(i int) bool { return rst.counts[i].word >= word })
+	if i < len(rst.counts) && rst.counts[i].word == word {
+		return rst.counts[i].customerCount, rst.counts[i].tableCount
+	}
+	return 0, 0
+}
+
+func (rst *frozenRestaurant) child(word int32) *frozenRestaurant {
+	i := sort.Search(len(rst.children), func(i int) bool { return rst.children[i].word >= word })
+	if i < len(rst.children) && rst.children[i].word == word {
+		return rst.children[i].rst
+	}
+	return nil
+}
+
+// frozenHPYLM is predictive representation of HPYLM for inference.
+type frozenHPYLM struct {
+	root  *frozenRestaurant
+	vocab *symbolTable // HPYLMs of a model share one vocabulary. it is not changed after freezing, so it can be read by goroutines concurrently
+}
+
+// newFrozenHPYLM returns frozenHPYLM of rsts whose words are the ids in symbols.
+func newFrozenHPYLM(rsts map[string]*restaurant, symbols *symbolTable, vocab *symbolTable) *frozenHPYLM {
+	root := new(frozenRestaurant)
+	childMaps := make(map[*frozenRestaurant]map[int32]*frozenRestaurant)
+	for key, rst := range rsts {
+		u := context{}
+		if key != "" {
+			u = strings.Split(key, concat)
+		}
+		frozenRst := root
+		for i := len(u) - 1; i >= 0; i-- {
+			id := vocab.intern(u[i])
+			if _, ok := childMaps[frozenRst]; !ok {
+				childMaps[frozenRst] = make(map[int32]*frozenRestaurant)
+			}
+			child, ok := childMaps[frozenRst][id]
+			if !ok {
+				child = new(frozenRestaurant)
+				childMaps[frozenRst][id] = child
+			}
+			frozenRst = child
+		}
+
+		frozenRst.exists = true
+		frozenRst.counts = make([]frozenCount, 0, len(rst.customerCount))
+		for word, customerCount := range rst.customerCount {
+			tableCount := rst.totalTableCountForCustomer[word]
+			if customerCount == 0 && tableCount == 0 {
+				continue
+			}
+			frozenRst.counts = append(frozenRst.counts, frozenCount{vocab.intern(symbols.words[word]), customerCount, tableCount})
+		}
+		sort.Slice(frozenRst.counts, func(i, j int) bool { return frozenRst.counts[i].word < frozenRst.counts[j].word })
+		frozenRst.totalCustomerCount = rst.totalCustomerCount
+		frozenRst.totalTableCount = rst.totalTableCount
+		frozenRst.stop = rst.stop
+		frozenRst.pass = rst.pass
+	}
+	for frozenRst, childMap := range childMaps {
+		frozenRst.children = make([]frozenChild, 0, len(childMap))
+		for id, child := range childMap {
+			frozenRst.children = append(frozenRst.children, frozenChild{id, child})
+		}
+		sort.Slice(frozenRst.children, func(i, j int) bool { return frozenRst.children[i].word < frozenRst.children[j].word })
+	}
+	return &frozenHPYLM{root, vocab}
+}
+
+// restaurants returns restaurants of the suffixes of u. the n-th restaurant is that of the suffix whose length is n, and it is nil if the restaurant does not exist.
+func (frozen *frozenHPYLM) restaurants(u context) []*frozenRestaurant {
+	rsts := make([]*frozenRestaurant, len(u)+1, len(u)+1)
+	rst := frozen.root
+	if len(u) == 1 && u[0] == "" {
+		// the key of context {""} is the same as that of the empty context in HPYLM (e.g., POS contexts of PYHSMM)
+		if rst.exists {
+			rsts[0] = rst
+			rsts[1] = rst
+		}
+		return rsts
+	}
+	for n := 0; n <= len(u); n++ {
+		if rst.exists {
+			rsts[n] = rst
+		}
+		if n == len(u) {
+			break
+		}
+		id, ok := frozen.vocab.id(u[len(u)-1-n])
+		if !ok {
+			break
+		}
+		rst = rst.child(id)
+		if rst == nil {
+			break
+		}
+	}
+	return rsts
+}
+
+// isFrozen returns true if model is frozen by Freeze.
+func isFrozen(model interface{}) bool {
+	switch model := model.(type) {
+	case *HPYLM:
+		return model.frozen != nil
+	case *VPYLM:
+		return model.hpylm.frozen != nil
+	case *NPYLM:
+		return model.frozen != nil
+	case *PYHSMM:
+		return model.posHpylm.frozen != nil
+	}
+	return false
+}
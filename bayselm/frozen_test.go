@@ -0,0 +1,121 @@
+package bayselm
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frozen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saveFile := filepath.Join(dir, "model.json")
+	testWordSeqs := []context{{"これ", "は", "ペン", "です", "。"}, {"未知語", "です"}}
+
+	hpylm, err := NewHPYLM(2, 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vpylm, err := NewVPYLM(3, 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 0.01, 1.0, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataContainer, err := NewDataContainerFromAnnotatedData("../data/sample.train.word.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []NgramLM{hpylm, vpylm} {
+		model.SetRandSeed(1)
+		for e := 0; e < 2; e++ {
+			if err := model.Train(dataContainer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wordSeqs := append(testWordSeqs, dataContainer.SamplingWordSeqs...)
+		probs := returnNgramProbsForTest(model, wordSeqs)
+		model.Freeze()
+		if frozenProbs := returnNgramProbsForTest(model, wordSeqs); !reflect.DeepEqual(probs, frozenProbs) {
+			t.Error(ModelName(model), "probabilities of frozen model are different")
+		}
+		if err := model.Train(dataContainer); !errors.Is(err, ErrFrozen) {
+			t.Error(ModelName(model), "expected ErrFrozen, but return ", err)
+		}
+	}
+	if err := hpylm.AddCustomer("a", context{"b"}, hpylm.Base, hpylm.addCustomerBaseNull); !errors.Is(err, ErrFrozen) {
+		t.Error("expected ErrFrozen, but return ", err)
+	}
+	if _, err := vpylm.AddCustomer("a", context{"b"}); !errors.Is(err, ErrFrozen) {
+		t.Error("expected ErrFrozen, but return ", err)
+	}
+
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []UnsupervisedWSM{npylm, pyhsmm} {
+		model.SetRandSeed(1)
+		dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := model.Initialize(dataContainer); err != nil {
+			t.Fatal(err)
+		}
+		if err := model.TrainWordSegmentation(dataContainer, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+		wordSeqs, err := model.TestWordSegmentation(dataContainer.Sents, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		probs := returnNgramProbsForTest(model.(NgramLM), append(testWordSeqs, dataContainer.SamplingWordSeqs...))
+		model.Freeze()
+		frozenWordSeqs, err := model.TestWordSegmentation(dataContainer.Sents, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(wordSeqs, frozenWordSeqs) {
+			t.Error(ModelName(model.(NgramLM)), "segmentations of frozen model are different")
+		}
+		if frozenProbs := returnNgramProbsForTest(model.(NgramLM), append(testWordSeqs, dataContainer.SamplingWordSeqs...)); !reflect.DeepEqual(probs, frozenProbs) {
+			t.Error(ModelName(model.(NgramLM)), "probabilities of frozen model are different")
+		}
+		if err := model.TrainWordSegmentation(dataContainer, 2, 2); !errors.Is(err, ErrFrozen) {
+			t.Error(ModelName(model.(NgramLM)), "expected ErrFrozen, but return ", err)
+		}
+		if err := Save(model.(NgramLM), saveFile, "indent"); !errors.Is(err, ErrFrozen) {
+			t.Error(ModelName(model.(NgramLM)), "expected ErrFrozen, but return ", err)
+		}
+		if err := model.Initialize(dataContainer); !errors.Is(err, ErrFrozen) {
+			t.Error(ModelName(model.(NgramLM)), "expected ErrFrozen, but return ", err)
+		}
+	}
+	if err := AddWordSeqAsCustomerAPI(pyhsmm, &DataContainer{}); !errors.Is(err, ErrFrozen) {
+		t.Error("expected ErrFrozen, but return ", err)
+	}
+}
+
+func returnNgramProbsForTest(model NgramLM, wordSeqs []context) []float64 {
+	probs := make([]float64, 0)
+	for _, wordSeq := range wordSeqs {
+		u := make(context, 0, model.ReturnMaxN()-1)
+		for i := 0; i < model.ReturnMaxN()-1; i++ {
+			u = append(u, bos)
+		}
+		for _, word := range wordSeq {
+			probs = append(probs, model.ReturnNgramProb(word, u))
+			u = append(u[1:], word)
+		}
+	}
+	return probs
+}
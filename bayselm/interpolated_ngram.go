@@ -2,13 +2,13 @@ package bayselm
 
 import (
 	"fmt"
-	"strings"
 )
 
 // Ngram is n-gram struct.
 type Ngram struct {
-	contextToWordCounts map[string]map[string]int
-	contextToCount      map[string]int
+	contexts            *contextTrie
+	contextToWordCounts []map[string]int // context id to word counts
+	contextToCount      []int            // context id to count
 
 	maxN               int
 	interporationRates []float64
@@ -16,91 +16,83 @@ type Ngram struct {
 }
 
 // NewNgram returns new Ngram instance.
-func NewNgram(maxN int, interporationRates []float64, base float64) *Ngram {
+func NewNgram(maxN int, interporationRates []float64, base float64) (*Ngram, error) {
+	if maxN <= 0 {
+		return nil, fmt.Errorf("%w. range of maxN is range 0.0 to inf", ErrInvalidParameter)
+	}
+	if !(len(interporationRates) == maxN) {
+		return nil, fmt.Errorf("%w. length of interporationRates does not match maxN", ErrInvalidParameter)
+	}
 	ngram := new(Ngram)
 	ngram.maxN = maxN
-	ngram.contextToWordCounts = make(map[string]map[string]int)
-	ngram.contextToCount = make(map[string]int)
+	ngram.contexts = newContextTrie()
+	ngram.contextToWordCounts = make([]map[string]int, 0)
+	ngram.contextToCount = make([]int, 0)
 	ngram.interporationRates = make([]float64, ngram.maxN, ngram.maxN)
-	if ngram.maxN <= 0 {
-		panic("range of maxN is range 0.0 to inf")
-	}
-	if !(len(interporationRates) == ngram.maxN) {
-		panic("length of interporationRates does not match maxN")
-	}
 	for i := 0; i < ngram.maxN; i++ {
 		if !(0.0 < interporationRates[i] && interporationRates[i] < 1.0) {
-			panic("range of interporationRates is range 0.0 to 1.0")
+			return nil, fmt.Errorf("%w. range of interporationRates is range 0.0 to 1.0", ErrInvalidParameter)
 		}
 		ngram.interporationRates[i] = interporationRates[i]
 	}
 
 	ngram.Base = base
-	return ngram
+	return ngram, nil
 }
 
 // AddCount add word count and context count when n-gram is given.
-func (ngram *Ngram) AddCount(word string, u context) {
+func (ngram *Ngram) AddCount(word string, u context) error {
 	if len(u) > ngram.maxN-1 {
-		errMsg := fmt.Sprintf("AddCount error. ngram (word = %v, context = %v) is longer than maxN (%v)", word, u, ngram.maxN)
-		panic(errMsg)
-	}
-	_, ok := ngram.contextToCount[strings.Join(u, concat)]
-	if !ok {
-		ngram.contextToCount[strings.Join(u, concat)] = 0
-	}
-	ngram.contextToCount[strings.Join(u, concat)]++
-	wordCounts, ok := ngram.contextToWordCounts[strings.Join(u, concat)]
-	if !ok {
-		ngram.contextToWordCounts[strings.Join(u, concat)] = make(map[string]int)
-		wordCounts, _ = ngram.contextToWordCounts[strings.Join(u, concat)]
-	}
-
-	_, ok = wordCounts[word]
-	if !ok {
-		wordCounts[word] = 0
-	}
-	wordCounts[word]++
-	if len(u) != 0 {
-		ngram.AddCount(word, u[1:])
+		return fmt.Errorf("%w. AddCount error. ngram (word = %v, context = %v) is longer than maxN (%v)", ErrInvalidParameter, word, u, ngram.maxN)
+	}
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	ngram.contexts.add(u, ids)
+	for len(ngram.contextToCount) < ngram.contexts.size() {
+		ngram.contextToCount = append(ngram.contextToCount, 0)
+		ngram.contextToWordCounts = append(ngram.contextToWordCounts, nil)
+	}
+	for _, id := range ids {
+		ngram.contextToCount[id]++
+		wordCounts := ngram.contextToWordCounts[id]
+		if wordCounts == nil {
+			wordCounts = make(map[string]int)
+			ngram.contextToWordCounts[id] = wordCounts
+		}
+		wordCounts[word]++
 	}
-	return
+	return nil
 }
 
 // CalcProb returns n-gram prabability.
-func (ngram *Ngram) CalcProb(word string, u context) float64 {
+func (ngram *Ngram) CalcProb(word string, u context) (float64, error) {
 	if len(u) > ngram.maxN-1 {
-		errMsg := fmt.Sprintf("CalcProb error. ngram (word = %v, context = %v) is longer than maxN (%v)", word, u, ngram.maxN)
-		panic(errMsg)
-	}
-	contextCount := 0
-	contextCount, ok := ngram.contextToCount[strings.Join(u, concat)]
-	if !ok {
-		contextCount = 0
-	}
-	wordCounts, ok := ngram.contextToWordCounts[strings.Join(u, concat)]
-	wordCount, ok := wordCounts[word]
-	if !ok {
-		wordCount = 0
-	}
-	body := float64(0.0)
-	if contextCount != 0 {
-		body = float64(wordCount) / float64(contextCount)
-	}
+		return 0.0, fmt.Errorf("%w. CalcProb error. ngram (word = %v, context = %v) is longer than maxN (%v)", ErrInvalidParameter, word, u, ngram.maxN)
+	}
+	var buf [maxDepthOnStack]contextID
+	ids := contextIDs(u, buf[:])
+	ngram.contexts.lookup(u, ids)
+	p := ngram.Base
+	for n, id := range ids {
+		contextCount := 0
+		wordCount := 0
+		if id != noContext {
+			contextCount = ngram.contextToCount[id]
+			wordCount = ngram.contextToWordCounts[id][word]
+		}
+		body := float64(0.0)
+		if contextCount != 0 {
+			body = float64(wordCount) / float64(contextCount)
+		}
 
-	lambda := ngram.interporationRates[len(u)]
-	smoothing := 0.0
-	if len(u) == 0 {
-		smoothing = ngram.Base
-	} else {
-		smoothing = ngram.CalcProb(word, u[1:])
+		lambda := ngram.interporationRates[n]
+		p = (1.0-lambda)*body + lambda*p
 	}
-	p := (1.0-lambda)*body + lambda*smoothing
-	return p
+	return p, nil
 }
 
 // Train train n-gram parameters from given word sequences.
-func (ngram *Ngram) Train(dataContainer *DataContainer) {
+func (ngram *Ngram) Train(dataContainer *DataContainer) error {
 	for i := 0; i < dataContainer.Size; i++ {
 		wordSeq := dataContainer.SamplingWordSeqs[i]
 		u := make(context, 0, ngram.maxN-1)
@@ -108,17 +100,23 @@ func (ngram *Ngram) Train(dataContainer *DataContainer) {
 			u = append(u, bos)
 		}
 		for _, word := range wordSeq {
-			ngram.AddCount(word, u)
+			if err := ngram.AddCount(word, u); err != nil {
+				return err
+			}
 			u = append(u[1:], word)
 		}
 	}
-	return
+	return nil
 }
 
 // ReturnNgramProb returns n-gram probability.
 // This is used for interface of LmModel.
+// u longer than maxN-1 is truncated to its last maxN-1 words, which are the only words used by n-gram.
 func (ngram *Ngram) ReturnNgramProb(word string, u context) float64 {
-	p := ngram.CalcProb(word, u)
+	if len(u) > ngram.maxN-1 {
+		u = u[len(u)-(ngram.maxN-1):]
+	}
+	p, _ := ngram.CalcProb(word, u)
 	return p
 }
 
@@ -128,16 +126,33 @@ func (ngram *Ngram) ReturnMaxN() int {
 	return ngram.maxN
 }
 
+// SetRandSeed does nothing because Ngram does not sample.
+// This is used for interface of LmModel.
+func (ngram *Ngram) SetRandSeed(seed int64) {
+	return
+}
+
+// Freeze does nothing because Ngram has only counts.
+// This is used for interface of LmModel.
+func (ngram *Ngram) Freeze() {
+	return
+}
+
+// save returns nil because saving Ngram is not implemented.
 func (ngram *Ngram) save() ([]byte, interface{}) {
-	if true {
-		panic("not implemented error")
-	}
 	return nil, nil
 }
 
-func (ngram *Ngram) load([]byte) {
-	if true {
-		panic("not implemented error")
+func (ngram *Ngram) load([]byte) error {
+	return fmt.Errorf("%w. load of Ngram", ErrNotImplemented)
+}
+
+func (ngram *Ngram) saveBinary(bw *binaryWriter) {
+	if bw.err == nil {
+		bw.err = fmt.Errorf("%w. save of Ngram", ErrNotImplemented)
 	}
-	return
+}
+
+func (ngram *Ngram) loadBinary(*binaryReader) error {
+	return fmt.Errorf("%w. load of Ngram", ErrNotImplemented)
 }
@@ -0,0 +1,32 @@
+package bayselm
+
+import (
+	"math"
+	"math/rand"
+)
+
+// AcceptanceStats is the number of proposed and accepted segmentations by Metropolis-Hastings correction in an epoch (see NPYLM.SetMetropolisHastings).
+type AcceptanceStats struct {
+	Proposed int
+	Accepted int
+}
+
+// Rate returns the acceptance rate. it is 1 if nothing is proposed.
+func (stats AcceptanceStats) Rate() float64 {
+	if stats.Proposed == 0 {
+		return 1.0
+	}
+	return float64(stats.Accepted) / float64(stats.Proposed)
+}
+
+// accept returns whether the new sample is accepted instead of the old one, and counts the result.
+// logP are the log probabilities by the current counts, and logQ are the log probabilities that the samples are proposed.
+// the old sample is always replaced if it is never proposed, e.g., the initial segmentation has a word longer than maxWordLength.
+func (stats *AcceptanceStats) accept(logPNew float64, logPOld float64, logQNew float64, logQOld float64, rnd *rand.Rand) bool {
+	stats.Proposed++
+	if math.IsInf(logQOld, -1) || math.Log(rnd.Float64()) < logPNew-logPOld+logQOld-logQNew {
+		stats.Accepted++
+		return true
+	}
+	return false
+}
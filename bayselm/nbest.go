@@ -0,0 +1,31 @@
+package bayselm
+
+import (
+	"sort"
+)
+
+// NbestSegmentation contains a word sequence, its POS sequence (only for PYHSMM) and their joint log probability including eos.
+type NbestSegmentation struct {
+	WordSeq []string
+	PosSeq  []int
+	Score   float64
+}
+
+// nbestEntry is an element of the k-best list of a state in the lattice.
+// prevState and prevRank point to the entry of the previous word, and prevState is -1 at the beginning of the sentence.
+type nbestEntry struct {
+	score     float64
+	prevState int
+	prevRank  int
+}
+
+// selectNbest returns the nbest entries in descending order of scores.
+func selectNbest(entries []nbestEntry, nbest int) []nbestEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].score > entries[j].score
+	})
+	if len(entries) > nbest {
+		entries = entries[:nbest]
+	}
+	return entries
+}
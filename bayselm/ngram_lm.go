@@ -1,9 +1,15 @@
 package bayselm
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
+	"os"
+	"sync"
 )
 
 const concat string = "<concat>"
@@ -15,66 +21,91 @@ type context []string
 
 // UnsupervisedWSM is unsupervised word segmentation model.
 type UnsupervisedWSM interface {
-	TrainWordSegmentation(*DataContainer, int, int)
-	TestWordSegmentation([][]string, int) [][]string
-	CalcTestScore([][]string, int) (float64, float64)
-	Initialize(*DataContainer)
-	InitializeFromAnnotatedData(*DataContainer)
+	TrainWordSegmentation(*DataContainer, int, int) error
+	TrainWordSegmentationInShards(*DataContainer, int, int) error
+	TestWordSegmentation([][]string, int) ([][]string, error)
+	TestWordSegmentationWithConstraints([][]string, []*SentConstraint, int) ([][]string, error)
+	SampleWordSegmentation([][]string, []*SentConstraint, int) ([][]string, error)
+	TestNbestWordSegmentation([][]string, []*SentConstraint, int, int) ([][]NbestSegmentation, error)
+	TestBoundaryMarginals([][]string, []*SentConstraint, int) ([][]float64, error)
+	CalcTestScore([][]string, int) (float64, float64, error)
+	CalcSentScore([]string) float64
+	Initialize(*DataContainer) error
+	InitializeFromAnnotatedData(*DataContainer) error
+	InitializeFromAnnotatedDataWithWeight(*DataContainer, int) error
+	SetDictionary([]DictionaryEntry, float64) error
+	SetCharBaseCacheSize(int) error
+	SetMetropolisHastings(bool)
+	ReturnAcceptanceStats() AcceptanceStats
+	SetTemperature(float64) error
+	SetRandSeed(int64)
+	Freeze()
 	ShowParameters()
 	save() ([]byte, interface{})
-	load([]byte)
+	load([]byte) error
+	saveBinary(*binaryWriter)
+	loadBinary(*binaryReader) error
+	randState() uint64
+	setRandState(uint64)
 }
 
 // GenerateUnsupervisedWSM returns UnsupervisedWSM instance.
-func GenerateUnsupervisedWSM(modelName string, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, PosSize int, base float64, splitter string) (UnsupervisedWSM, bool) {
+func GenerateUnsupervisedWSM(modelName string, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, PosSize int, base float64, splitter string) (UnsupervisedWSM, error) {
 	var model UnsupervisedWSM
-	ok := false
+	var err error
 	switch modelName {
 	case "npylm":
-		model = NewNPYLM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, splitter)
-		ok = true
+		model, err = NewNPYLM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, splitter)
 	case "pyhsmm":
-		model = NewPYHSMM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, PosSize, splitter)
-		ok = true
+		model, err = NewPYHSMM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, PosSize, splitter)
+	default:
+		return nil, fmt.Errorf("%w. %v is not unsupervised word segmentation model", ErrUnknownModel, modelName)
 	}
-	return model, ok
+	if err != nil {
+		return nil, err
+	}
+	return model, nil
 }
 
 // NgramLM is n-gram language model.
 type NgramLM interface {
-	Train(*DataContainer)
+	Train(*DataContainer) error
 	ReturnNgramProb(string, context) float64
 	ReturnMaxN() int
+	SetRandSeed(int64)
+	Freeze()
 	save() ([]byte, interface{})
-	load([]byte)
+	load([]byte) error
+	saveBinary(*binaryWriter)
+	loadBinary(*binaryReader) error
 }
 
 // GenerateNgramLM returns NgramLM instance.
-func GenerateNgramLM(modelName string, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, PosSize int, base float64) (NgramLM, bool) {
+func GenerateNgramLM(modelName string, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, PosSize int, base float64) (NgramLM, error) {
 	var model NgramLM
-	ok := false
+	var err error
 	switch modelName {
 	case "ngram":
 		var interporationRates []float64
 		for i := 0; i < maxNgram; i++ {
 			interporationRates = append(interporationRates, 0.1)
 		}
-		model = NewNgram(maxNgram, interporationRates, base)
-		ok = true
+		model, err = NewNgram(maxNgram, interporationRates, base)
 	case "hpylm":
-		model = NewHPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, base)
-		ok = true
+		model, err = NewHPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, base)
 	case "vpylm":
-		model = NewVPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, base, alpha, beta)
-		ok = true
+		model, err = NewVPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, base, alpha, beta)
 	case "npylm":
-		model = NewNPYLM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, "")
-		ok = true
+		model, err = NewNPYLM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, "")
 	case "pyhsmm":
-		model = NewPYHSMM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, PosSize, "")
-		ok = true
+		model, err = NewPYHSMM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, PosSize, "")
+	default:
+		return nil, fmt.Errorf("%w. %v is not n-gram language model", ErrUnknownModel, modelName)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return model, ok
+	return model, nil
 }
 
 // CalcPerplexity returns perplexity from input word sequence
@@ -102,71 +133,304 @@ func CalcPerplexity(model NgramLM, dataContainer *DataContainer) float64 {
 	return perplexity
 }
 
+// CalcBitsPerCharacter returns bits per character of unsegmented sentences.
+// the probability of each sentence is marginalized over all segmentations, and eos of each sentence is counted as a character like character-level language models.
+func CalcBitsPerCharacter(model UnsupervisedWSM, sents [][]string, threadsNum int) (float64, error) {
+	if threadsNum <= 0 {
+		return 0.0, fmt.Errorf("%w. threadsNum should be bigger than 0", ErrInvalidParameter)
+	}
+	ch := make(chan int, threadsNum)
+	wg := sync.WaitGroup{}
+	scores := make([]float64, len(sents), len(sents))
+	for i := 0; i < len(sents); i++ {
+		ch <- 1
+		wg.Add(1)
+		go func(i int) {
+			scores[i] = model.CalcSentScore(sents[i])
+			<-ch
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	entropy := float64(0.0)
+	countChar := 0
+	for i, score := range scores {
+		entropy += score / math.Ln2
+		countChar += len(sents[i]) + 1
+	}
+	entropy *= -1
+	entropy /= float64(countChar)
+
+	return entropy, nil
+}
+
+// modelFormatVersion is the format version of model files written by Save.
+// it is increased when the format changes incompatibly.
+const modelFormatVersion = 1
+
+// ModelHyperparameters is the summary of hyper-parameters written in the header of model files.
+type ModelHyperparameters struct {
+	MaxNgram      int
+	MaxWordLength int `json:",omitempty"` // npylm and pyhsmm
+	PosSize       int `json:",omitempty"` // pyhsmm
+}
+
+// TrainingMetadata is information of training written in the header of model files.
+type TrainingMetadata struct {
+	TrainFile string `json:",omitempty"`
+	Epoch     int    `json:",omitempty"`
+	RandSeed  int64
+}
+
+// ModelFileHeader is the header of model files.
+type ModelFileHeader struct {
+	FormatVersion   int
+	Model           string // ngram, hpylm, vpylm, npylm or pyhsmm
+	Hyperparameters ModelHyperparameters
+	Metadata        TrainingMetadata
+}
+
+// modelFileJSON is struct of model files. Body is the model saved by save().
+type modelFileJSON struct {
+	ModelFileHeader
+	Body json.RawMessage
+}
+
+// ModelName returns the name of model (e.g., "npylm"). it returns "" if model is unknown.
+func ModelName(model NgramLM) string {
+	switch model.(type) {
+	case *Ngram:
+		return "ngram"
+	case *HPYLM:
+		return "hpylm"
+	case *VPYLM:
+		return "vpylm"
+	case *NPYLM:
+		return "npylm"
+	case *PYHSMM:
+		return "pyhsmm"
+	}
+	return ""
+}
+
+func modelHyperparameters(model NgramLM) ModelHyperparameters {
+	hyperparameters := ModelHyperparameters{MaxNgram: model.ReturnMaxN()}
+	switch model := model.(type) {
+	case *NPYLM:
+		hyperparameters.MaxWordLength = model.maxWordLength
+	case *PYHSMM:
+		hyperparameters.MaxWordLength = model.maxWordLength
+		hyperparameters.PosSize = model.PosSize
+	}
+	return hyperparameters
+}
+
 // Save model.
-func Save(modelNgramLM NgramLM, saveFile string, saveFormat string) {
-	// var modelNgramLM NgramLM
-	// modelNgramLM = model.(NgramLM)
+func Save(modelNgramLM NgramLM, saveFile string, saveFormat string) error {
+	return SaveWithMetadata(modelNgramLM, saveFile, saveFormat, TrainingMetadata{})
+}
+
+// SaveWithMetadata saves model with the header which contains the model name, hyper-parameters and metadata, so Load can detect the model.
+// saveFormat is indent, notindent (json) or binary. binary format is much smaller and faster to load than json format.
+func SaveWithMetadata(modelNgramLM NgramLM, saveFile string, saveFormat string, metadata TrainingMetadata) error {
+	if saveFormat != "indent" && saveFormat != "notindent" && saveFormat != "binary" {
+		return fmt.Errorf("%w. please input corrent saveFormat (%v)", ErrInvalidParameter, saveFormat)
+	}
+	modelName := ModelName(modelNgramLM)
+	if modelName == "" {
+		return fmt.Errorf("%w. %T", ErrUnknownModel, modelNgramLM)
+	}
+	if isFrozen(modelNgramLM) {
+		return fmt.Errorf("%w. save of %v", ErrFrozen, modelName)
+	}
+	header := ModelFileHeader{
+		FormatVersion:   modelFormatVersion,
+		Model:           modelName,
+		Hyperparameters: modelHyperparameters(modelNgramLM),
+		Metadata:        metadata,
+	}
+	if saveFormat == "binary" {
+		return saveBinaryModelFile(modelNgramLM, saveFile, header)
+	}
 	modelJSONByte, modelJSON := modelNgramLM.save()
+	if modelJSON == nil {
+		return fmt.Errorf("%w. save of %T", ErrNotImplemented, modelNgramLM)
+	}
+	modelFile := &modelFileJSON{
+		ModelFileHeader: header,
+		Body:            modelJSONByte,
+	}
+	var modelFileByte []byte
+	var err error
 	if saveFormat == "indent" {
-		var err error
-		modelJSONByte, err = json.MarshalIndent(modelJSON, "", " ")
-		if err != nil {
-			panic("save model error")
-		}
-	} else if saveFormat == "notindent" {
-		// pass
+		modelFileByte, err = json.MarshalIndent(modelFile, "", " ")
 	} else {
-		panic("save model error. please input corrent saveFormat")
+		modelFileByte, err = json.Marshal(modelFile)
 	}
-	err := ioutil.WriteFile(saveFile, modelJSONByte, 0644)
 	if err != nil {
 		panic("save model error")
 	}
-	return
+	err = ioutil.WriteFile(saveFile, modelFileByte, 0644)
+	if err != nil {
+		return fmt.Errorf("%w. cannot write saveFile (%v): %v", ErrFile, saveFile, err)
+	}
+	return nil
 }
 
-// Load model.
-func Load(modelName string, loadFile string) NgramLM {
-	var model NgramLM
-	ok := false
-	// 以下のパラメータは後で更新されるので適当で良い
-	initialTheta := 2.0
-	initialD := 0.1
-	gammaA := 0.1
-	gammaB := 0.1
-	betaA := 0.1
-	betaB := 0.1
-	alpha := 0.1
-	beta := 0.1
-	maxNgram := 2
-	maxWordLength := 10
-	PosSize := 10
-	base := 0.1
-	splitter := ""
+// saveBinaryModelFile writes binaryMagic, the header in json format and model in binary format to saveFile.
+func saveBinaryModelFile(modelNgramLM NgramLM, saveFile string, header ModelFileHeader) error {
+	headerByte, err := json.Marshal(&header)
+	if err != nil {
+		panic("save model error")
+	}
+	f, err := os.Create(saveFile)
+	if err != nil {
+		return fmt.Errorf("%w. cannot write saveFile (%v): %v", ErrFile, saveFile, err)
+	}
+	bw := newBinaryWriter(f)
+	bw.write([]byte(binaryMagic))
+	bw.writeString(string(headerByte))
+	modelNgramLM.saveBinary(bw)
+	err = bw.flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(saveFile)
+		if errors.Is(err, ErrNotImplemented) {
+			return err
+		}
+		return fmt.Errorf("%w. cannot write saveFile (%v): %v", ErrFile, saveFile, err)
+	}
+	return nil
+}
+
+// Load model saved by Save. the model is detected from the header of loadFile.
+func Load(loadFile string) (NgramLM, error) {
+	f, err := os.Open(loadFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w. cannot read loadFile (%v): %v", ErrFile, loadFile, err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if isBinaryModelFile(r) {
+		return loadBinaryModelFile(loadFile, r)
+	}
+	modelFile, _, err := readModelFile(loadFile, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkModelFileHeader(loadFile, &modelFile.ModelFileHeader); err != nil {
+		return nil, err
+	}
+	model, err := newModelToLoad(modelFile.Model)
+	if err != nil {
+		return nil, err
+	}
+	if err := model.load(modelFile.Body); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// loadBinaryModelFile loads model from r which reads model file saved in binary format.
+func loadBinaryModelFile(loadFile string, r *bufio.Reader) (NgramLM, error) {
+	if _, err := r.Discard(len(binaryMagic)); err != nil {
+		return nil, fmt.Errorf("%w. cannot read loadFile (%v): %v", ErrFile, loadFile, err)
+	}
+	br := newBinaryReader(r)
+	headerString := br.readString()
+	if br.err != nil {
+		return nil, fmt.Errorf("%w. loadFile (%v) is not model file: %v", ErrFormat, loadFile, br.err)
+	}
+	header := new(ModelFileHeader)
+	if err := json.Unmarshal([]byte(headerString), header); err != nil {
+		return nil, fmt.Errorf("%w. loadFile (%v) is not model file: %v", ErrFormat, loadFile, err)
+	}
+	if err := checkModelFileHeader(loadFile, header); err != nil {
+		return nil, err
+	}
+	model, err := newModelToLoad(header.Model)
+	if err != nil {
+		return nil, err
+	}
+	if err := model.loadBinary(br); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// checkModelFileHeader returns ErrVersion if the header is not supported.
+func checkModelFileHeader(loadFile string, header *ModelFileHeader) error {
+	if header.FormatVersion == 0 {
+		return fmt.Errorf("%w. loadFile (%v) does not have the header. it may be saved by an older version, so please load it by LoadLegacy", ErrVersion, loadFile)
+	}
+	if header.FormatVersion != modelFormatVersion {
+		return fmt.Errorf("%w. format version of loadFile (%v) is %v, but supported version is %v", ErrVersion, loadFile, header.FormatVersion, modelFormatVersion)
+	}
+	return nil
+}
+
+// isBinaryModelFile returns true if r begins with binaryMagic.
+func isBinaryModelFile(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(binaryMagic))
+	return string(magic) == binaryMagic
+}
+
+// LoadLegacy loads model saved by older versions, which do not have the header. modelName is required because the file does not have it.
+func LoadLegacy(modelName string, loadFile string) (NgramLM, error) {
+	f, err := os.Open(loadFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w. cannot read loadFile (%v): %v", ErrFile, loadFile, err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if isBinaryModelFile(r) {
+		return nil, fmt.Errorf("%w. loadFile (%v) has the header, so please load it by Load", ErrVersion, loadFile)
+	}
+	modelFile, modelJSONByte, err := readModelFile(loadFile, r)
+	if err != nil {
+		return nil, err
+	}
+	if modelFile.FormatVersion != 0 {
+		return nil, fmt.Errorf("%w. loadFile (%v) has the header, so please load it by Load", ErrVersion, loadFile)
+	}
+	model, err := newModelToLoad(modelName)
+	if err != nil {
+		return nil, err
+	}
+	if err := model.load(modelJSONByte); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// readModelFile returns the model file in json format and its bytes read from r.
+func readModelFile(loadFile string, r io.Reader) (*modelFileJSON, []byte, error) {
+	modelFileByte, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w. cannot read loadFile (%v): %v", ErrFile, loadFile, err)
+	}
+	modelFile := new(modelFileJSON)
+	if err := json.Unmarshal(modelFileByte, modelFile); err != nil {
+		return nil, nil, fmt.Errorf("%w. loadFile (%v) is not model file: %v", ErrFormat, loadFile, err)
+	}
+	return modelFile, modelFileByte, nil
+}
+
+// newModelToLoad returns empty model instance whose parameters are set by load.
+func newModelToLoad(modelName string) (NgramLM, error) {
 	switch modelName {
 	case "ngram":
-		model = &Ngram{}
-		ok = true
+		return &Ngram{}, nil
 	case "hpylm":
-		model = NewHPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, base)
-		ok = true
+		return newHPYLMToLoad(), nil
 	case "vpylm":
-		model = NewVPYLM(maxNgram-1, initialTheta, initialD, gammaA, gammaB, betaA, betaB, base, alpha, beta)
-		ok = true
+		return newVPYLMToLoad(), nil
 	case "npylm":
-		model = NewNPYLM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, splitter)
-		ok = true
+		return newNPYLMToLoad(), nil
 	case "pyhsmm":
-		model = NewPYHSMM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, PosSize, splitter)
-		ok = true
-	}
-	if !ok {
-		panic("load model initailize error")
-	}
-	modelJSONByte, err := ioutil.ReadFile(loadFile)
-	if err != nil {
-		panic("load model file error")
+		return newPYHSMMToLoad(), nil
 	}
-	model.load(modelJSONByte)
-	return model
+	return nil, fmt.Errorf("%w. %v", ErrUnknownModel, modelName)
 }
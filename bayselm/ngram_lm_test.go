@@ -0,0 +1,203 @@
+package bayselm
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saveFile := filepath.Join(dir, "model.json")
+	legacyFile := filepath.Join(dir, "legacy.json")
+
+	for _, modelName := range []string{"hpylm", "vpylm", "npylm", "pyhsmm"} {
+		model, err := GenerateNgramLM(modelName, 1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, 2, 0.1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if modelWSM, ok := model.(UnsupervisedWSM); ok {
+			dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+			if err != nil {
+				t.Fatal(err)
+			}
+			modelWSM.Initialize(dataContainer)
+			if err := modelWSM.TrainWordSegmentation(dataContainer, 2, 2); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			dataContainer, err := NewDataContainerFromAnnotatedData("../data/sample.train.word.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := model.Train(dataContainer); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, saveFormat := range []string{"indent", "notindent", "binary"} {
+			if err := SaveWithMetadata(model, saveFile, saveFormat, TrainingMetadata{Epoch: 1}); err != nil {
+				t.Fatal(err)
+			}
+			loadModel, err := Load(saveFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ModelName(loadModel) != modelName {
+				t.Error("expected = ", modelName, "but return ", ModelName(loadModel))
+			}
+			v, _ := model.save()
+			vLoaded, _ := loadModel.save()
+			if string(v) != string(vLoaded) {
+				t.Error(modelName, "loaded model is different from the saved model")
+			}
+		}
+
+		// model files without the header are loaded by LoadLegacy
+		v, _ := model.save()
+		if err := ioutil.WriteFile(legacyFile, v, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(legacyFile); !errors.Is(err, ErrVersion) {
+			t.Error("expected = ", ErrVersion, "but return ", err)
+		}
+		loadModel, err := LoadLegacy(modelName, legacyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vLoaded, _ := loadModel.save(); string(v) != string(vLoaded) {
+			t.Error(modelName, "loaded legacy model is different from the saved model")
+		}
+		if _, err := LoadLegacy(modelName, saveFile); !errors.Is(err, ErrVersion) {
+			t.Error("expected = ", ErrVersion, "but return ", err)
+		}
+	}
+
+	// broken binary file
+	v, err := ioutil.ReadFile(saveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(saveFile, v[:len(v)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(saveFile); !errors.Is(err, ErrFormat) {
+		t.Error("expected = ", ErrFormat, "but return ", err)
+	}
+
+	if err := ioutil.WriteFile(saveFile, []byte(`{"FormatVersion": 100, "Model": "npylm", "Body": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(saveFile); !errors.Is(err, ErrVersion) {
+		t.Error("expected = ", ErrVersion, "but return ", err)
+	}
+	if err := ioutil.WriteFile(saveFile, []byte(`{"FormatVersion": 1, "Model": "unknown", "Body": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(saveFile); !errors.Is(err, ErrUnknownModel) {
+		t.Error("expected = ", ErrUnknownModel, "but return ", err)
+	}
+}
+
+func TestSemiSupervised(t *testing.T) {
+	weight := 2
+	posSize := 2
+	npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, posSize, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []UnsupervisedWSM{npylm, pyhsmm} {
+		model.SetRandSeed(1)
+		dataContainerForGold, err := NewDataContainerFromAnnotatedData("../data/sample.train.word.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range dataContainerForGold.SamplingPosSeqs {
+			for j := range dataContainerForGold.SamplingPosSeqs[i] {
+				dataContainerForGold.SamplingPosSeqs[i][j] = (i + j) % posSize
+			}
+		}
+		dataContainerForTrain, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := model.InitializeFromAnnotatedDataWithWeight(dataContainerForGold, weight); err != nil {
+			t.Fatal(err)
+		}
+		goldWordSeqs := dataContainerForGold.GetWordSeqs()
+		if err := model.Initialize(dataContainerForTrain); err != nil {
+			t.Fatal(err)
+		}
+		for e := 0; e < 2; e++ {
+			if err := model.TrainWordSegmentation(dataContainerForTrain, 2, 2); err != nil {
+				t.Fatal(err)
+			}
+			// only the POS tags of the annotated sentences are resampled
+			if pyhsmm, ok := model.(*PYHSMM); ok {
+				if err := pyhsmm.ResampleAnnotatedPOSTags(dataContainerForGold, weight); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for i, wordSeq := range dataContainerForGold.GetWordSeqs() {
+			if strings.Join(wordSeq, " ") != strings.Join(goldWordSeqs[i], " ") {
+				t.Error(ModelName(model.(NgramLM)), "annotated sentence is resampled", goldWordSeqs[i], wordSeq)
+			}
+		}
+
+		// the annotated sentences are added weight times, so all customers are removed by removing them weight times
+		hpylms := make([]*HPYLM, 0)
+		switch model := model.(type) {
+		case *NPYLM:
+			for i := 0; i < dataContainerForTrain.Size; i++ {
+				if err := model.removeWordSeqAsCustomer(dataContainerForTrain.SamplingWordSeqs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for w := 0; w < weight; w++ {
+				for i := 0; i < dataContainerForGold.Size; i++ {
+					if err := model.removeWordSeqAsCustomer(dataContainerForGold.SamplingWordSeqs[i]); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if !(len(model.word2sampledDepthMemory) == 0) {
+				t.Error("len(word2sampledDepthMemory) is not 0", model.word2sampledDepthMemory)
+			}
+			hpylms = append(hpylms, model.HPYLM)
+		case *PYHSMM:
+			for i := 0; i < dataContainerForTrain.Size; i++ {
+				if err := model.removeWordSeqAsCustomer(dataContainerForTrain.SamplingWordSeqs[i], dataContainerForTrain.SamplingPosSeqs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for w := 0; w < weight; w++ {
+				for i := 0; i < dataContainerForGold.Size; i++ {
+					if err := model.removeWordSeqAsCustomer(dataContainerForGold.SamplingWordSeqs[i], dataContainerForGold.SamplingPosSeqs[i]); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			hpylms = append(hpylms, model.posHpylm)
+			for _, npylm := range model.npylms {
+				hpylms = append(hpylms, npylm.HPYLM)
+			}
+		}
+		for _, hpylm := range hpylms {
+			if hpylm.restaurantCount != 0 {
+				t.Error(ModelName(model.(NgramLM)), "expected no restaurant, but return ", hpylm.restaurantMap())
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package bayselm
+
+import (
+	"math/rand"
+)
+
+// randSource is a random source of distuv distributions (e.g., distuv.Beta.Src) made from *rand.Rand of the model.
+type randSource struct {
+	rnd *rand.Rand
+}
+
+func (src randSource) Uint64() uint64 {
+	return src.rnd.Uint64()
+}
+
+func (src randSource) Seed(seed uint64) {
+	src.rnd.Seed(int64(seed))
+}
+
+// splitMix64 is a random source of models (SplitMix64 generator).
+// unlike the source of rand.NewSource, its state is one integer, so it can be saved in checkpoints to resume training.
+type splitMix64 struct {
+	state uint64
+}
+
+func newSplitMix64(seed int64) *splitMix64 {
+	return &splitMix64{uint64(seed)}
+}
+
+func (src *splitMix64) Seed(seed int64) {
+	src.state = uint64(seed)
+}
+
+func (src *splitMix64) Uint64() uint64 {
+	src.state += 0x9e3779b97f4a7c15
+	z := src.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (src *splitMix64) Int63() int64 {
+	return int64(src.Uint64() >> 1)
+}
+
+// newRandSource returns a random source of a model.
+// its seed is drawn from the global source. use SetRandSeed of the model for reproducible results.
+func newRandSource() *splitMix64 {
+	return newSplitMix64(rand.Int63())
+}
+
+// deriveRands returns n random number generators whose seeds are drawn from rnd in order.
+// *rand.Rand is not safe for concurrent use, so each goroutine samples with its own generator.
+// the results depend on the seed of rnd but not on the order in which goroutines run.
+func deriveRands(rnd *rand.Rand, n int) []*rand.Rand {
+	rnds := make([]*rand.Rand, n, n)
+	for i := 0; i < n; i++ {
+		rnds[i] = rand.New(newSplitMix64(rnd.Int63()))
+	}
+	return rnds
+}
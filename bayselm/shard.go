@@ -0,0 +1,151 @@
+package bayselm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// parallel sampling methods of TrainWordSegmentationWithParallel.
+const (
+	ParallelBatch = "batch"
+	ParallelShard = "shard"
+)
+
+// TrainWordSegmentationWithParallel trains word segmentation model for one epoch by the parallel sampling method.
+// parallel is ParallelBatch (TrainWordSegmentation) or ParallelShard (TrainWordSegmentationInShards).
+func TrainWordSegmentationWithParallel(model UnsupervisedWSM, dataContainer *DataContainer, parallel string, threadsNum int, batchSize int) error {
+	switch parallel {
+	case ParallelBatch:
+		return model.TrainWordSegmentation(dataContainer, threadsNum, batchSize)
+	case ParallelShard:
+		return model.TrainWordSegmentationInShards(dataContainer, threadsNum, batchSize)
+	}
+	return fmt.Errorf("%w. unknown parallel sampling method (%v)", ErrInvalidParameter, parallel)
+}
+
+// shardSample is a segmentation of a sentence. posSeq is nil for NPYLM.
+type shardSample struct {
+	wordSeq context
+	posSeq  []int
+}
+
+// shardDelta is the change of the customers by sampling sentence r in a shard.
+type shardDelta struct {
+	r      int
+	old    shardSample
+	sample shardSample
+}
+
+// shardSampler is a model sampled by trainInShards.
+type shardSampler interface {
+	addShardSample(shardSample)
+	removeShardSample(shardSample) error
+	sampleShardSample([]string, *SentConstraint) shardSample // samples with the random number generator of the model
+	cloneShardSampler(seed int64) (shardSampler, error)
+}
+
+// trainInShards samples segmentations of all sentences once by data-sharded parallel Gibbs sampling like AD-LDA.
+// sentences are divided into threadsNum shards, and each shard is sampled by its own copy of model one by one without waiting for other shards.
+// after each copy samples mergeInterval sentences, their deltas of customers are merged, i.e., model and the other copies remove the old segmentations and add the new ones.
+// so the customers of model and all copies are consistent with the segmentations in dataContainer after merging, although their tables are different.
+// the shards and the copies are made by rnd, and the results depend on the seed of rnd and threadsNum but not on the order in which goroutines run.
+func trainInShards(model shardSampler, dataContainer *DataContainer, threadsNum int, mergeInterval int, rnd *rand.Rand) error {
+	randIndexes := rnd.Perm(dataContainer.Size)
+	samplers := make([]shardSampler, threadsNum, threadsNum)
+	shards := make([][]int, threadsNum, threadsNum)
+	maxShardSize := 0
+	for w := range samplers {
+		sampler, err := model.cloneShardSampler(rnd.Int63())
+		if err != nil {
+			return err
+		}
+		samplers[w] = sampler
+		shards[w] = randIndexes[w*dataContainer.Size/threadsNum : (w+1)*dataContainer.Size/threadsNum]
+		if len(shards[w]) > maxShardSize {
+			maxShardSize = len(shards[w])
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	bar := pb.StartNew(dataContainer.Size)
+	defer bar.Finish()
+	for start := 0; start < maxShardSize; start += mergeInterval {
+		deltas := make([][]shardDelta, threadsNum, threadsNum)
+		errs := make([]error, threadsNum+1, threadsNum+1)
+		for w := range samplers {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := start; i < start+mergeInterval && i < len(shards[w]); i++ {
+					r := shards[w][i]
+					old := shardSample{dataContainer.SamplingWordSeqs[r], dataContainer.SamplingPosSeqs[r]}
+					if err := samplers[w].removeShardSample(old); err != nil {
+						errs[w+1] = err
+						return
+					}
+					sample := samplers[w].sampleShardSample(dataContainer.Sents[r], dataContainer.GetConstraint(r))
+					samplers[w].addShardSample(sample)
+					deltas[w] = append(deltas[w], shardDelta{r, old, sample})
+				}
+			}(w)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+
+		// model is the 0th and the sampler of shard w is the (w+1)th, which skips its own deltas
+		for m, target := range append([]shardSampler{model}, samplers...) {
+			wg.Add(1)
+			go func(m int, target shardSampler) {
+				defer wg.Done()
+				for w, shardDeltas := range deltas {
+					if m == w+1 {
+						continue
+					}
+					for _, delta := range shardDeltas {
+						if err := target.removeShardSample(delta.old); err != nil {
+							errs[m] = err
+							return
+						}
+						target.addShardSample(delta.sample)
+					}
+				}
+			}(m, target)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		for _, shardDeltas := range deltas {
+			for _, delta := range shardDeltas {
+				dataContainer.SamplingWordSeqs[delta.r] = delta.sample.wordSeq
+				if delta.sample.posSeq != nil {
+					dataContainer.SamplingPosSeqs[delta.r] = delta.sample.posSeq
+				}
+			}
+			bar.Add(len(shardDeltas))
+		}
+	}
+	return nil
+}
+
+// cloneByBinary copies model to clone, which is an empty model to load, through the binary format.
+func cloneByBinary(model UnsupervisedWSM, clone UnsupervisedWSM) error {
+	var buf bytes.Buffer
+	bw := newBinaryWriter(&buf)
+	model.saveBinary(bw)
+	if err := bw.flush(); err != nil {
+		return err
+	}
+	return clone.loadBinary(newBinaryReader(bufio.NewReader(&buf)))
+}
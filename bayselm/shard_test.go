@@ -0,0 +1,79 @@
+package bayselm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTrainWordSegmentationInShards(t *testing.T) {
+	newModels := func() []UnsupervisedWSM {
+		npylm, err := NewNPYLM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pyhsmm, err := NewPYHSMM(1.0, 0.1, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2, 4, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []UnsupervisedWSM{npylm, pyhsmm}
+	}
+	train := func(model UnsupervisedWSM) *DataContainer {
+		model.SetRandSeed(1)
+		dataContainer, err := NewDataContainer("../data/sample.txt", "", 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.Initialize(dataContainer)
+		for e := 0; e < 2; e++ {
+			if err := TrainWordSegmentationWithParallel(model, dataContainer, ParallelShard, 3, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dataContainer
+	}
+
+	models := newModels()
+	for i, model := range newModels() {
+		dataContainer := train(model)
+
+		// the same seed and the same number of threads give the same model
+		train(models[i])
+		v1, _ := model.save()
+		v2, _ := models[i].save()
+		if string(v1) != string(v2) {
+			t.Error(ModelName(model.(NgramLM)), "models trained with the same seed are different")
+		}
+
+		// the merged customers are consistent with the segmentations, so all of them are removed and no restaurant remains
+		hpylms := make([]*HPYLM, 0)
+		switch model := model.(type) {
+		case *NPYLM:
+			for r := range dataContainer.SamplingWordSeqs {
+				if err := model.removeWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hpylms = append(hpylms, model.HPYLM, model.vpylm.hpylm)
+		case *PYHSMM:
+			for r := range dataContainer.SamplingWordSeqs {
+				if err := model.removeWordSeqAsCustomer(dataContainer.SamplingWordSeqs[r], dataContainer.SamplingPosSeqs[r]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hpylms = append(hpylms, model.posHpylm, model.npylms[0].vpylm.hpylm)
+			for _, npylm := range model.npylms {
+				hpylms = append(hpylms, npylm.HPYLM)
+			}
+		}
+		for _, hpylm := range hpylms {
+			if hpylm.restaurantCount != 0 {
+				t.Error(ModelName(model.(NgramLM)), "expected no restaurant, but return ", hpylm.restaurantCount)
+			}
+		}
+	}
+
+	model := newModels()[0]
+	if err := TrainWordSegmentationWithParallel(model, nil, "unknown", 3, 2); !errors.Is(err, ErrInvalidParameter) {
+		t.Error("expected ErrInvalidParameter, but return ", err)
+	}
+}
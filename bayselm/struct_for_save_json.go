@@ -50,6 +50,9 @@ type nPYLMJSON struct {
 
 	Word2sampledDepthMemory map[string][][]int
 	Splitter string
+
+	Dictionary       map[string]float64
+	DictionaryWeight float64
 }
 
 type pYHSMMJSON struct {
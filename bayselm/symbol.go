@@ -0,0 +1,214 @@
+package bayselm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// symbolTable gives integer ids to words.
+type symbolTable struct {
+	ids   map[string]int32
+	words []string // id to word
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{ids: make(map[string]int32)}
+}
+
+// id returns id of word. ok is false if word is not in the table.
+func (symbols *symbolTable) id(word string) (int32, bool) {
+	id, ok := symbols.ids[word]
+	return id, ok
+}
+
+// intern returns id of word, and adds word to the table if it is not in the table.
+func (symbols *symbolTable) intern(word string) int32 {
+	id, ok := symbols.ids[word]
+	if !ok {
+		id = int32(len(symbols.words))
+		symbols.ids[word] = id
+		symbols.words = append(symbols.words, word)
+	}
+	return id
+}
+
+// contextID is id of context given by contextTrie.
+type contextID int32
+
+const (
+	rootContext contextID = 0  // id of the empty context
+	noContext   contextID = -1 // id of contexts which have never been added
+)
+
+type contextEdge struct {
+	suffix contextID // id of the context without its first word
+	word   int32     // id of the first word
+}
+
+// contextTrie gives integer ids to contexts instead of string keys made by strings.Join(u, concat), which allocate strings for every lookup.
+// a context is a child of its suffix without the first word, so the ids of all suffixes of u are found by one pass from the last word.
+// the symbol table is also used for the words of customers in restaurants of HPYLM.
+// ids are not removed when restaurants are removed, because restaurants of the same contexts are removed and added again and again in sampling.
+// instead, ids which are no longer used are removed by compact at the end of each epoch, and when most of the ids are no longer used.
+type contextTrie struct {
+	symbols  *symbolTable
+	children map[contextEdge]contextID
+	suffixes []contextID // id to id of the suffix
+	words    []int32     // id to id of the first word
+}
+
+func newContextTrie() *contextTrie {
+	return &contextTrie{
+		symbols:  newSymbolTable(),
+		children: make(map[contextEdge]contextID),
+		suffixes: []contextID{noContext},
+		words:    []int32{-1},
+	}
+}
+
+// size returns the number of context ids.
+func (trie *contextTrie) size() int {
+	return len(trie.suffixes)
+}
+
+// isRootAlias returns true if the string key of u is the same as that of the empty context, e.g., the context of unigram POS probabilities of PYHSMM.
+func isRootAlias(u context) bool {
+	return len(u) == 1 && u[0] == ""
+}
+
+// lookup sets ids[n] to the id of the suffix of u whose length is n. it is noContext if the suffix has never been added.
+// length of ids must be len(u)+1.
+func (trie *contextTrie) lookup(u context, ids []contextID) {
+	ids[0] = rootContext
+	if isRootAlias(u) {
+		ids[1] = rootContext
+		return
+	}
+	id := rootContext
+	for n := 1; n <= len(u); n++ {
+		if id != noContext {
+			if word, ok := trie.symbols.id(u[len(u)-n]); ok {
+				if child, ok := trie.children[contextEdge{id, word}]; ok {
+					id = child
+				} else {
+					id = noContext
+				}
+			} else {
+				id = noContext
+			}
+		}
+		ids[n] = id
+	}
+	return
+}
+
+// add sets ids[n] to the id of the suffix of u whose length is n, and adds the suffixes which have never been added.
+// length of ids must be len(u)+1.
+func (trie *contextTrie) add(u context, ids []contextID) {
+	ids[0] = rootContext
+	if isRootAlias(u) {
+		ids[1] = rootContext
+		return
+	}
+	id := rootContext
+	for n := 1; n <= len(u); n++ {
+		edge := contextEdge{id, trie.symbols.intern(u[len(u)-n])}
+		child, ok := trie.children[edge]
+		if !ok {
+			child = contextID(len(trie.suffixes))
+			trie.children[edge] = child
+			trie.suffixes = append(trie.suffixes, id)
+			trie.words = append(trie.words, edge.word)
+		}
+		id = child
+		ids[n] = id
+	}
+	return
+}
+
+// compact removes the ids of contexts for which keep returns false, except the suffixes of the kept contexts, and the ids of words which are neither in the kept contexts nor kept by keepWord.
+// it returns the new ids of the old ids of contexts and words, which are noContext and -1 for the removed ones. the order of the kept ids is not changed.
+func (trie *contextTrie) compact(keep func(id contextID) bool, keepWord func(word int32) bool) ([]contextID, []int32) {
+	kept := make([]bool, len(trie.suffixes), len(trie.suffixes))
+	kept[rootContext] = true
+	// the id of a suffix is smaller than that of its context, so the suffixes are marked after their contexts
+	for id := len(trie.suffixes) - 1; id > int(rootContext); id-- {
+		if kept[id] || keep(contextID(id)) {
+			kept[id] = true
+			kept[trie.suffixes[id]] = true
+		}
+	}
+
+	keptWords := make([]bool, len(trie.symbols.words), len(trie.symbols.words))
+	for id := int(rootContext) + 1; id < len(trie.suffixes); id++ {
+		if kept[id] {
+			keptWords[trie.words[id]] = true
+		}
+	}
+	compacted := newContextTrie()
+	newWords := make([]int32, len(trie.symbols.words), len(trie.symbols.words))
+	for word, w := range trie.symbols.words {
+		newWords[word] = -1
+		if keptWords[word] || keepWord(int32(word)) {
+			newWords[word] = compacted.symbols.intern(w)
+		}
+	}
+
+	newIDs := make([]contextID, len(trie.suffixes), len(trie.suffixes))
+	newIDs[rootContext] = rootContext
+	for id := int(rootContext) + 1; id < len(trie.suffixes); id++ {
+		if !kept[id] {
+			newIDs[id] = noContext
+			continue
+		}
+		edge := contextEdge{newIDs[trie.suffixes[id]], newWords[trie.words[id]]}
+		newIDs[id] = contextID(len(compacted.suffixes))
+		compacted.children[edge] = newIDs[id]
+		compacted.suffixes = append(compacted.suffixes, edge.suffix)
+		compacted.words = append(compacted.words, edge.word)
+	}
+	*trie = *compacted
+	return newIDs, newWords
+}
+
+// context returns the context of id.
+func (trie *contextTrie) context(id contextID) context {
+	u := make(context, 0)
+	for ; id != rootContext; id = trie.suffixes[id] {
+		u = append(u, trie.symbols.words[trie.words[id]])
+	}
+	return u
+}
+
+// key returns strings.Join(u, concat) of the context of id, which is the key of restaurants in model files.
+func (trie *contextTrie) key(id contextID) string {
+	return strings.Join(trie.context(id), concat)
+}
+
+// maxDepthOnStack is the length of buffers for ids of contexts. contexts shorter than it are looked up without allocation.
+const maxDepthOnStack = 16
+
+// contextIDs returns a slice for ids of the suffixes of u. buf is used if it is long enough, so that lookups in inner loops do not allocate memory.
+func contextIDs(u context, buf []contextID) []contextID {
+	if len(u)+1 <= len(buf) {
+		return buf[:len(u)+1]
+	}
+	return make([]contextID, len(u)+1, len(u)+1)
+}
+
+// posSymbols are the words of POS tags in posHpylm of PYHSMM.
+var posSymbols = func() []string {
+	symbols := make([]string, 256, 256)
+	for pos := range symbols {
+		symbols[pos] = strconv.Itoa(pos)
+	}
+	return symbols
+}()
+
+// posSymbol returns strconv.Itoa(pos) without allocation for usual POS tags.
+func posSymbol(pos int) string {
+	if 0 <= pos && pos < len(posSymbols) {
+		return posSymbols[pos]
+	}
+	return strconv.Itoa(pos)
+}
@@ -0,0 +1,56 @@
+package bayselm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContextTrie(t *testing.T) {
+	trie := newContextTrie()
+	u := context{"a", "b", "c"}
+	ids := make([]contextID, len(u)+1, len(u)+1)
+	trie.add(u, ids)
+	for n, id := range ids {
+		if key := trie.key(id); key != strings.Join(u[len(u)-n:], concat) {
+			t.Error("expected = ", strings.Join(u[len(u)-n:], concat), "but return ", key)
+		}
+	}
+
+	lookupIDs := make([]contextID, len(u)+1, len(u)+1)
+	trie.lookup(context{"x", "b", "c"}, lookupIDs)
+	expected := []contextID{ids[0], ids[1], ids[2], noContext}
+	for n := range expected {
+		if lookupIDs[n] != expected[n] {
+			t.Error("expected = ", expected, "but return ", lookupIDs)
+			break
+		}
+	}
+
+	// the key of context {""} is the same as that of the empty context
+	aliasIDs := make([]contextID, 2, 2)
+	trie.lookup(context{""}, aliasIDs)
+	if aliasIDs[0] != rootContext || aliasIDs[1] != rootContext {
+		t.Error("expected = ", []contextID{rootContext, rootContext}, "but return ", aliasIDs)
+	}
+
+	// compact keeps the suffixes of the kept contexts and removes the others
+	other := context{"x", "y"}
+	otherIDs := make([]contextID, len(other)+1, len(other)+1)
+	trie.add(other, otherIDs)
+	z := trie.symbols.intern("z")
+	newIDs, newWords := trie.compact(func(id contextID) bool { return id == ids[2] }, func(word int32) bool { return word == z })
+	if trie.size() != 3 || newIDs[ids[3]] != noContext || newIDs[otherIDs[1]] != noContext || newIDs[otherIDs[2]] != noContext {
+		t.Error("unexpected ids after compact", newIDs)
+	}
+	for n, id := range ids[:3] {
+		if key := trie.key(newIDs[id]); key != strings.Join(u[len(u)-n:], concat) {
+			t.Error("expected = ", strings.Join(u[len(u)-n:], concat), "but return ", key)
+		}
+	}
+	if _, ok := trie.symbols.id("x"); ok {
+		t.Error("unused word x is not removed")
+	}
+	if newZ, ok := trie.symbols.id("z"); !ok || newWords[z] != newZ {
+		t.Error("kept word z is not kept. new id ", newWords[z])
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"C"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,24 +28,63 @@ var (
 	trainFilePathForLM = lm.Flag("trainFile", "training file path. the texts are segmented space.").Required().String()
 	testFilePathForLM  = lm.Flag("testFile", "test file path. the texts are segmented space.").Required().String()
 
-	ws                 = args.Command("ws", "training word segmentation from unsegmented texts")
-	modelForWS         = ws.Flag("model", "unsupervised word segmentation model").Required().Enum("npylm", "pyhsmm")
-	trainFilePathForWS = ws.Flag("trainFile", "training file path. the texts are unsegmented.").Required().String()
-	testFilePathForWS  = ws.Flag("testFile", "test file path. the texts are unsegmented.").Default("").String()
+	ws                      = args.Command("ws", "training word segmentation from unsegmented texts")
+	modelForWS              = ws.Flag("model", "unsupervised word segmentation model").Required().Enum("npylm", "pyhsmm")
+	trainFilePathForWS      = ws.Flag("trainFile", "training file path. the texts are unsegmented.").Required().String()
+	testFilePathForWS       = ws.Flag("testFile", "test file path. the texts are unsegmented.").Default("").String()
+	goldFilePathForWS       = ws.Flag("goldFile", "gold file path to evaluate word segmentation each epoch. the texts are segmented space.").Default("").String()
+	annotatedFilePathForWS  = ws.Flag("annotatedFile", "annotated file path for semi-supervised training. the texts are segmented space, and they are added once and never resampled.").Default("").String()
+	annotatedWeightForWS    = ws.Flag("annotatedWeight", "number of times each sentence of annotatedFile is added").Default("1").Int()
+	decodeForWS             = ws.Flag("decode", "decoding method of test texts. mbr is minimum Bayes risk decoding for boundary F-score").Default("viterbi").Enum("viterbi", "mbr", "sample")
+	dictionaryForWS         = ws.Flag("dictionary", "user dictionary file path. each line is \"word [POS [count]]\", and dictionary words are preferred by mixing the dictionary into the base measure").Default("").String()
+	dictWeightForWS         = ws.Flag("dictionaryWeight", "weight of the user dictionary in the base measure").Default("0.1").Float64()
+	parallelForWS           = ws.Flag("parallel", "parallel sampling method. batch samples each batch against the counts without the batch, and shard samples shards of texts with copies of the model, whose changes are merged every batch texts of each shard").Default("batch").Enum("batch", "shard")
+	mhForWS                 = ws.Flag("mh", "corrects samples of each batch by Metropolis-Hastings, and shows the acceptance rate every epoch. it is only for --parallel batch").Bool()
+	annealScheduleForWS     = ws.Flag("annealSchedule", "schedule of simulated annealing from annealStart to annealEnd. linear changes the temperature by the same difference every epoch, and exponential by the same ratio").Default("linear").Enum("linear", "exponential")
+	annealStartForWS        = ws.Flag("annealStart", "temperature of sampling at the first epoch. the log probabilities are divided by the temperature, and the higher temperature helps to escape local optima").Default("1.0").Float64()
+	annealEndForWS          = ws.Flag("annealEnd", "temperature of sampling at the last epoch. the temperature of each epoch is also used by --decode sample of test texts, but not by viterbi and mbr").Default("1.0").Float64()
+	constraintForWS         = ws.Flag("constraint", "the train and test texts contain partial annotations. \"|\" forces a word boundary, \"+\" forbids a word boundary and \"[word/POS]\" fixes a word").Bool()
+	checkpointFileForWS     = ws.Flag("checkpointFile", "file path to save checkpoints. a checkpoint contains the model and the sampler state to resume training by --resume").Default("").String()
+	checkpointIntervalForWS = ws.Flag("checkpointInterval", "a checkpoint is saved every this number of epochs").Default("1").Int()
+	resumeForWS             = ws.Flag("resume", "checkpoint file path to resume training. trainFile, annotatedFile, parallel, threads and batch should be the same as the stopped training, and epoch is the total number of epochs").Default("").String()
 
-	wsTest                = args.Command("wsTest", "training word segmentation from unsegmented texts")
-	modelForWSTest        = wsTest.Flag("model", "unsupervised word segmentation model").Required().Enum("npylm", "pyhsmm")
-	testFilePathForWSTest = wsTest.Flag("testFile", "test file path. the texts are unsegmented.").Default("").String()
-	loadFile              = wsTest.Flag("loadFile", "file path to load model").String()
+	wsTest                 = args.Command("wsTest", "training word segmentation from unsegmented texts")
+	modelForWSTest         = wsTest.Flag("model", "unsupervised word segmentation model. it is detected from loadFile, so it is required only for model files saved by older versions").Enum("npylm", "pyhsmm")
+	testFilePathForWSTest  = wsTest.Flag("testFile", "test file path. the texts are unsegmented.").Default("").String()
+	loadFile               = wsTest.Flag("loadFile", "file path to load model").String()
+	decodeForWSTest        = wsTest.Flag("decode", "decoding method. mbr is minimum Bayes risk decoding for boundary F-score").Default("viterbi").Enum("viterbi", "mbr", "sample")
+	marginalForWSTest      = wsTest.Flag("marginal", "output the posterior probabilities of word boundaries (and those of words and their POS tags for pyhsmm) of each sentence as JSON lines").Bool()
+	spanThresholdForWSTest = wsTest.Flag("spanThreshold", "words and their POS tags whose posterior probabilities are smaller than this value are not output with --marginal").Default("0.01").Float()
+	nbestForWSTest         = wsTest.Flag("nbest", "output the nbest segmentations and their log probabilities (and POS tags for pyhsmm) of each sentence. 0 means the best segmentation only").Default("0").Int()
+	dictionaryForWSTest    = wsTest.Flag("dictionary", "user dictionary file path (see ws --dictionary). it replaces the dictionary of the loaded model").Default("").String()
+	dictWeightForWSTest    = wsTest.Flag("dictionaryWeight", "weight of the user dictionary in the base measure").Default("0.1").Float64()
+	constraintForWSTest    = wsTest.Flag("constraint", "the test texts contain partial annotations (see ws --constraint)").Bool()
+	frozenForWSTest        = wsTest.Flag("frozen", "freeze the loaded model to an inference-only representation, which needs much lower memory").Bool()
+
+	eval                = args.Command("eval", "evaluate word segmentation with gold segmented texts")
+	goldFilePathForEval = eval.Flag("goldFile", "gold file path. the texts are segmented space.").Required().String()
+	predFilePathForEval = eval.Flag("predFile", "predicted file path. the texts are segmented space. if it is empty, the texts are segmented by loaded model").Default("").String()
+	modelForEval        = eval.Flag("model", "unsupervised word segmentation model. it is detected from loadFile, so it is required only for model files saved by older versions").Enum("npylm", "pyhsmm")
+	loadFileForEval     = eval.Flag("loadFile", "file path to load model").Default("").String()
+	decodeForEval       = eval.Flag("decode", "decoding method of loaded model. mbr is minimum Bayes risk decoding for boundary F-score").Default("viterbi").Enum("viterbi", "mbr", "sample")
+	posForEval          = eval.Flag("pos", "evaluate POS induction too. tokens of goldFile (and predFile) are word and POS tag joined by posDelimiter").Bool()
+	posDelimiterForEval = eval.Flag("posDelimiter", "delimiter between word and POS tag").Default("/").String()
+
+	export                  = args.Command("export", "export model to other formats")
+	modelForExport          = export.Flag("model", "n-gram model. it is detected from loadFile, so it is required only for model files saved by older versions").Enum("hpylm", "vpylm", "npylm")
+	loadFileForExport       = export.Flag("loadFile", "file path to load model").Required().String()
+	formatForExport         = export.Flag("format", "export format. arpa writes n-gram probabilities and back-off weights in ARPA format").Default("arpa").Enum("arpa")
+	exportFile              = export.Flag("exportFile", "file path to export model").Required().String()
+	charExportFileForExport = export.Flag("charExportFile", "file path to export the character VPYLM of npylm as a separate model. the probability of <unk> in exportFile should be multiplied by the probability of the word by this model").Default("").String()
 
 	api                        = args.Command("api", "launch API for intergrating PYHSMM and discriminative model (semi-Markov CRF)")
 	trainFilePathForAPI        = api.Flag("trainFile", "training file path. the texts are unsegmented.").Required().String()
 	trainGeneralFilePathForAPI = api.Flag("trainGeneralFilePathForAPI", "training file path. the texts are unsegmented.").Required().String()
 	oLabelID                   = api.Flag("oLabelID", "o label id").Required().Int()
 
-	randSeed      = args.Flag("randSeed", "random seed").Default("0").Int64()
+	randSeed      = args.Flag("randSeed", "random seed. training with the same seed and threads gives the same model").Default("0").Int64()
 	maxSentLen    = args.Flag("maxSentLen", "maxSentLen").Default("128").Int()
-	maxNgram      = args.Flag("maxNgram", "hyper-parameter in HPYLM - PYHSMM").Default("2").Int()
+	maxNgram      = args.Flag("maxNgram", "hyper-parameter in HPYLM - PYHSMM. for pyhsmm, (maxWordLength*posSize+1)^(maxNgram-2) should be 4096 or less, e.g., maxNgram is 2 or 3 with the default maxWordLength and posSize").Default("2").Int()
 	initialTheta  = args.Flag("theta", "initial hyper-parameter in HPYLM - PYHSMM").Default("2.0").Float64()
 	initialD      = args.Flag("d", "initial hyper-parameter in HPYLM - PYHSMM").Default("0.9").Float64()
 	gammaA        = args.Flag("gammaA", "hyper-parameter in HPYLM - PYHSMM").Default("1.0").Float64()
@@ -57,53 +99,164 @@ var (
 	epoch         = args.Flag("epoch", "hyper-parameter in HPYLM - PYHSMM").Default("100").Int()
 	batch         = args.Flag("batch", "hyper-parameter in NPYLM - PYHSMM").Default("16").Int()
 	threads       = args.Flag("threads", "hyper-parameter in NPYLM - PYHSMM").Default("8").Int()
+	charCacheSize = args.Flag("charBaseCacheSize", "maximum number of words whose probabilities by the character VPYLM are cached in NPYLM - PYHSMM. 0 disables the cache").Default("0").Int()
 	splitter      = args.Flag("splitter", "hyper-parameter in NPYLM - PYHSMM").Default("").String()
 
 	saveFile   = args.Flag("saveFile", "file path to save model").String()
-	saveFormat = args.Flag("saveFormat", "model save format").Default("notindent").Enum("notindent", "indent")
+	saveFormat = args.Flag("saveFormat", "model save format. binary is much smaller and faster to load than json (notindent and indent)").Default("notindent").Enum("notindent", "indent", "binary")
 )
 
 func trainLanguageModel() {
-	model, ok := bayselm.GenerateNgramLM(*modelForLM, *initialTheta, *initialD, *gammaA, *gammaB, *betaA, *betaB, *alpha, *beta, *maxNgram, *maxWordLength, *posSize, 1.0 / *vocabSize)
-	if !ok {
-		panic("Building model error")
-	}
-	dataContainerForTrain := bayselm.NewDataContainerFromAnnotatedData(*trainFilePathForLM)
-	dataContainerForTest := bayselm.NewDataContainerFromAnnotatedData(*testFilePathForLM)
+	model, err := bayselm.GenerateNgramLM(*modelForLM, *initialTheta, *initialD, *gammaA, *gammaB, *betaA, *betaB, *alpha, *beta, *maxNgram, *maxWordLength, *posSize, 1.0 / *vocabSize)
+	args.FatalIfError(err, "building model error")
+	model.SetRandSeed(*randSeed)
+	dataContainerForTrain, err := bayselm.NewDataContainerFromAnnotatedData(*trainFilePathForLM)
+	args.FatalIfError(err, "")
+	dataContainerForTest, err := bayselm.NewDataContainerFromAnnotatedData(*testFilePathForLM)
+	args.FatalIfError(err, "")
 	time.Sleep(3)
 	for e := 0; e < *epoch; e++ {
-		model.Train(dataContainerForTrain)
+		args.FatalIfError(model.Train(dataContainerForTrain), "training error")
 		perplexity := bayselm.CalcPerplexity(model, dataContainerForTest)
 		fmt.Println("Perplexity = ", perplexity)
 	}
 	if *saveFile != "" {
-		bayselm.Save(model.(bayselm.NgramLM), *saveFile, *saveFormat)
+		metadata := bayselm.TrainingMetadata{TrainFile: *trainFilePathForLM, Epoch: *epoch, RandSeed: *randSeed}
+		args.FatalIfError(bayselm.SaveWithMetadata(model, *saveFile, *saveFormat, metadata), "save model error")
 		// セーブしたものと同じモデルをロードできるかの確認
-		// loadModel := bayselm.Load(*modelForLM, *saveFile)
+		// loadModel, _ := bayselm.Load(*saveFile)
 		// perplexity := bayselm.CalcPerplexity(loadModel, dataContainerForTest)
 		// fmt.Println("Perplexity = ", perplexity)
 	}
 	return
 }
 
-func trainWordSegmentation(modelForWS string, trainFilePathForWS string, testFilePathForWS string, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, posSize int, base float64, epoch int, threads int, batch int, saveFile string, saveFormat string, splitter string, maxSentLen int) {
-	runtime.GOMAXPROCS(threads)
-	model, ok := bayselm.GenerateUnsupervisedWSM(modelForWS, initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, posSize, base, splitter)
+func printSegmentationScore(score bayselm.SegmentationScore) {
+	fmt.Println("wordPrecision = ", score.WordPrecision, "\t", "wordRecall = ", score.WordRecall, "\t", "wordF = ", score.WordF)
+	fmt.Println("boundaryPrecision = ", score.BoundaryPrecision, "\t", "boundaryRecall = ", score.BoundaryRecall, "\t", "boundaryF = ", score.BoundaryF)
+}
+
+func printPosInductionScore(score bayselm.PosInductionScore) {
+	fmt.Println("manyToOne = ", score.ManyToOneAccuracy, "\t", "oneToOne = ", score.OneToOneAccuracy)
+	fmt.Println("homogeneity = ", score.Homogeneity, "\t", "completeness = ", score.Completeness, "\t", "vMeasure = ", score.VMeasure, "\t", "VI = ", score.VariationOfInformation)
+}
+
+// loadNgramLM loads model from loadFile.
+// modelName is used only for model files saved by older versions, which do not have the model name. otherwise it should be empty or the same as the model of loadFile.
+func loadNgramLM(modelName string, loadFile string) (bayselm.NgramLM, error) {
+	model, err := bayselm.Load(loadFile)
+	if errors.Is(err, bayselm.ErrVersion) {
+		if modelName == "" {
+			return nil, fmt.Errorf("%w. please specify --model for model files saved by older versions", err)
+		}
+		model, err = bayselm.LoadLegacy(modelName, loadFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if modelName != "" && bayselm.ModelName(model) != modelName {
+		return nil, fmt.Errorf("loadFile (%v) is %v, not %v", loadFile, bayselm.ModelName(model), modelName)
+	}
+	return model, nil
+}
+
+// loadUnsupervisedWSM loads unsupervised word segmentation model from loadFile. modelName is the same as loadNgramLM.
+func loadUnsupervisedWSM(modelName string, loadFile string) (bayselm.UnsupervisedWSM, error) {
+	loadModel, err := loadNgramLM(modelName, loadFile)
+	if err != nil {
+		return nil, err
+	}
+	model, ok := loadModel.(bayselm.UnsupervisedWSM)
 	if !ok {
-		panic("Building model error")
+		return nil, fmt.Errorf("loadFile (%v) is %v, not unsupervised word segmentation model", loadFile, bayselm.ModelName(loadModel))
+	}
+	return model, nil
+}
+
+// newDataContainer returns DataContainer instance of unsegmented texts. if constraint is true, the texts contain partial annotations.
+func newDataContainer(filePath string, constraint bool, splitter string, maxSentLen int) (*bayselm.DataContainer, error) {
+	if constraint {
+		return bayselm.NewDataContainerWithConstraints(filePath, splitter, maxSentLen)
+	}
+	return bayselm.NewDataContainer(filePath, splitter, maxSentLen)
+}
+
+func trainWordSegmentation(modelForWS string, trainFilePathForWS string, testFilePathForWS string, goldFilePathForWS string, annotatedFilePathForWS string, annotatedWeight int, decode string, parallel string, mh bool, annealSchedule string, annealStart float64, annealEnd float64, constraint bool, dictionaryFilePath string, dictionaryWeight float64, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, posSize int, base float64, epoch int, threads int, charCacheSize int, batch int, saveFile string, saveFormat string, checkpointFile string, checkpointInterval int, resumeFile string, splitter string, maxSentLen int, randSeed int64) {
+	runtime.GOMAXPROCS(threads)
+	if checkpointInterval <= 0 {
+		args.Fatalf("checkpointInterval should be bigger than 0")
 	}
-	dataContainer := bayselm.NewDataContainer(trainFilePathForWS, splitter, maxSentLen)
+	if mh && parallel != bayselm.ParallelBatch {
+		args.Fatalf("--mh is only for --parallel batch")
+	}
+	dataContainer, err := newDataContainer(trainFilePathForWS, constraint, splitter, maxSentLen)
+	args.FatalIfError(err, "")
 	// dataContainer := bayselm.NewDataContainerFromAnnotatedData(trainFilePathForWS)
 	if testFilePathForWS == "" {
 		testFilePathForWS = trainFilePathForWS
 	}
-	model.Initialize(dataContainer)
-	// model.InitializeFromAnnotatedData(dataContainer)
-	dataContainerForTest := bayselm.NewDataContainer(testFilePathForWS, splitter, maxSentLen)
-	for e := 0; e < epoch; e++ {
-		model.TrainWordSegmentation(dataContainer, threads, batch)
+	var dataContainerForAnnotated *bayselm.DataContainer
+	if annotatedFilePathForWS != "" {
+		dataContainerForAnnotated, err = bayselm.NewDataContainerFromAnnotatedData(annotatedFilePathForWS)
+		args.FatalIfError(err, "")
+	}
+	var model bayselm.UnsupervisedWSM
+	startEpoch := 0
+	if resumeFile != "" {
+		// the checkpoint contains the model (with the dictionary and annotatedFile), the segmentations of trainFile and annotatedFile and the random number generator
+		model, startEpoch, err = bayselm.LoadCheckpoint(modelForWS, resumeFile, dataContainer, dataContainerForAnnotated)
+		args.FatalIfError(err, "resume error")
+	} else {
+		model, err = bayselm.GenerateUnsupervisedWSM(modelForWS, initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, posSize, base, splitter)
+		args.FatalIfError(err, "building model error")
+		model.SetRandSeed(randSeed)
+		if dictionaryFilePath != "" {
+			entries, err := bayselm.LoadDictionary(dictionaryFilePath)
+			args.FatalIfError(err, "")
+			args.FatalIfError(model.SetDictionary(entries, dictionaryWeight), "")
+		}
+		args.FatalIfError(model.Initialize(dataContainer), "")
+		// model.InitializeFromAnnotatedData(dataContainer)
+		if dataContainerForAnnotated != nil {
+			if modelForWS == "pyhsmm" {
+				// annotatedFile does not have POS tags, so they are initialized randomly and resampled every epoch
+				posRand := rand.New(rand.NewSource(randSeed))
+				for i := range dataContainerForAnnotated.SamplingPosSeqs {
+					for j := range dataContainerForAnnotated.SamplingPosSeqs[i] {
+						dataContainerForAnnotated.SamplingPosSeqs[i][j] = posRand.Intn(posSize)
+					}
+				}
+			}
+			args.FatalIfError(model.InitializeFromAnnotatedDataWithWeight(dataContainerForAnnotated, annotatedWeight), "")
+		}
+	}
+	args.FatalIfError(model.SetCharBaseCacheSize(charCacheSize), "")
+	model.SetMetropolisHastings(mh)
+	dataContainerForTest, err := newDataContainer(testFilePathForWS, constraint, splitter, maxSentLen)
+	args.FatalIfError(err, "")
+	var dataContainerForGold *bayselm.DataContainer
+	if goldFilePathForWS != "" {
+		dataContainerForGold, err = bayselm.NewDataContainerFromAnnotatedData(goldFilePathForWS)
+		args.FatalIfError(err, "")
+	}
+	for e := startEpoch; e < epoch; e++ {
+		temperature, err := bayselm.AnnealingTemperature(annealSchedule, annealStart, annealEnd, e, epoch)
+		args.FatalIfError(err, "")
+		args.FatalIfError(model.SetTemperature(temperature), "")
+		if annealStart != 1.0 || annealEnd != 1.0 {
+			fmt.Println("temperature = ", temperature)
+		}
+		args.FatalIfError(bayselm.TrainWordSegmentationWithParallel(model, dataContainer, parallel, threads, batch), "training error")
+		if pyhsmm, ok := model.(*bayselm.PYHSMM); ok && dataContainerForAnnotated != nil {
+			args.FatalIfError(pyhsmm.ResampleAnnotatedPOSTags(dataContainerForAnnotated, annotatedWeight), "training error")
+		}
+		if mh {
+			stats := model.ReturnAcceptanceStats()
+			fmt.Println("acceptance rate of Metropolis-Hastings = ", stats.Rate(), "\t", "accepted = ", stats.Accepted, "\t", "proposed = ", stats.Proposed)
+		}
 		testSize := dataContainerForTest.Size
-		wordSeqs := model.TestWordSegmentation(dataContainerForTest.Sents[:testSize], threads)
+		wordSeqs, err := bayselm.TestWordSegmentationWithDecoding(model, dataContainerForTest.Sents[:testSize], dataContainerForTest.Constraints, decode, splitter, threads)
+		args.FatalIfError(err, "")
 		for i := 0; i < testSize; i++ {
 			if splitter == "" {
 				fmt.Println(e, "test", wordSeqs[i])
@@ -111,14 +264,34 @@ func trainWordSegmentation(modelForWS string, trainFilePathForWS string, testFil
 				fmt.Println(e, "test", strings.Join(wordSeqs[i], "_"))
 			}
 		}
-		scoreDivWordSize, scoreDivSentSize := model.CalcTestScore(wordSeqs, threads)
+		scoreDivWordSize, scoreDivSentSize, err := model.CalcTestScore(wordSeqs, threads)
+		args.FatalIfError(err, "")
 		fmt.Println("scoreDivWordSize = ", scoreDivWordSize, "\t", "scoreDivSentSize = ", scoreDivSentSize)
+		bitsPerCharacter, err := bayselm.CalcBitsPerCharacter(model, dataContainerForTest.Sents[:testSize], threads)
+		args.FatalIfError(err, "")
+		fmt.Println("bitsPerCharacter = ", bitsPerCharacter)
+		if pyhsmm, ok := model.(*bayselm.PYHSMM); ok {
+			posSeqs, err := pyhsmm.TestPOSTagging(wordSeqs, threads)
+			args.FatalIfError(err, "")
+			jointScoreDivWordSize, jointScoreDivSentSize, err := pyhsmm.CalcTestScoreWithPOS(wordSeqs, posSeqs, threads)
+			args.FatalIfError(err, "")
+			fmt.Println("jointScoreDivWordSize = ", jointScoreDivWordSize, "\t", "jointScoreDivSentSize = ", jointScoreDivSentSize)
+		}
+		if dataContainerForGold != nil {
+			segmentationScore, _, err := bayselm.EvaluateUnsupervisedWSM(model, dataContainerForGold, decode, splitter, threads)
+			args.FatalIfError(err, "")
+			printSegmentationScore(segmentationScore)
+		}
 		model.ShowParameters()
+		if checkpointFile != "" && (e+1)%checkpointInterval == 0 {
+			args.FatalIfError(bayselm.SaveCheckpoint(modelForWS, model, dataContainer, dataContainerForAnnotated, e+1, checkpointFile), "save checkpoint error")
+		}
 	}
 	if saveFile != "" {
-		bayselm.Save(model.(bayselm.NgramLM), saveFile, saveFormat)
+		metadata := bayselm.TrainingMetadata{TrainFile: trainFilePathForWS, Epoch: epoch, RandSeed: randSeed}
+		args.FatalIfError(bayselm.SaveWithMetadata(model.(bayselm.NgramLM), saveFile, saveFormat, metadata), "save model error")
 		// セーブしたものと同じモデルをロードできるかの確認
-		// var loadModel bayselm.UnsupervisedWSM = bayselm.Load(modelForWS, saveFile).(bayselm.UnsupervisedWSM)
+		// loadModel, _ := loadUnsupervisedWSM(modelForWS, saveFile)
 		// testSize := 10
 		// wordSeqs := loadModel.TestWordSegmentation(dataContainer.Sents[:testSize], threads)
 		// for i := 0; i < testSize; i++ {
@@ -136,11 +309,95 @@ func trainWordSegmentation(modelForWS string, trainFilePathForWS string, testFil
 	return
 }
 
-func testWordSegmentation(modelForWS string, testFilePathForWS string, loadFile string, threads int, splitter string, maxSentLen int) {
-	var model bayselm.UnsupervisedWSM = bayselm.Load(modelForWS, loadFile).(bayselm.UnsupervisedWSM)
-	dataContainerForTest := bayselm.NewDataContainer(testFilePathForWS, splitter, maxSentLen)
+type spanPosMarginalForOutput struct {
+	Start int     `json:"start"`
+	End   int     `json:"end"`
+	Word  string  `json:"word"`
+	Pos   int     `json:"pos"`
+	Prob  float64 `json:"prob"`
+}
+
+type marginalsForOutput struct {
+	WordSeq           []string                   `json:"wordSeq"`
+	BoundaryMarginals []float64                  `json:"boundaryMarginals"`
+	SpanPosMarginals  []spanPosMarginalForOutput `json:"spanPosMarginals,omitempty"`
+}
+
+func testWordSegmentation(modelForWS string, testFilePathForWS string, loadFile string, decode string, constraint bool, dictionaryFilePath string, dictionaryWeight float64, frozen bool, nbest int, marginal bool, spanThreshold float64, threads int, charCacheSize int, splitter string, maxSentLen int, randSeed int64) {
+	model, err := loadUnsupervisedWSM(modelForWS, loadFile)
+	args.FatalIfError(err, "load model error")
+	model.SetRandSeed(randSeed)
+	if dictionaryFilePath != "" {
+		entries, err := bayselm.LoadDictionary(dictionaryFilePath)
+		args.FatalIfError(err, "")
+		args.FatalIfError(model.SetDictionary(entries, dictionaryWeight), "")
+	}
+	args.FatalIfError(model.SetCharBaseCacheSize(charCacheSize), "")
+	if frozen {
+		model.Freeze()
+	}
+	dataContainerForTest, err := newDataContainer(testFilePathForWS, constraint, splitter, maxSentLen)
+	args.FatalIfError(err, "")
 	testSize := dataContainerForTest.Size
-	wordSeqs := model.TestWordSegmentation(dataContainerForTest.Sents[:testSize], threads)
+	constraints := dataContainerForTest.Constraints
+	if marginal {
+		// boundaryMarginals[t] is the probability of a word boundary after t-th character.
+		// start and end of spanPosMarginals are character indexes of a word, i.e., the word is sent[start:end].
+		sents := dataContainerForTest.Sents[:testSize]
+		wordSeqs, err := bayselm.TestWordSegmentationWithDecoding(model, sents, constraints, decode, splitter, threads)
+		args.FatalIfError(err, "")
+		var boundaryMarginals [][]float64
+		var spanPosMarginals [][][][]float64
+		if pyhsmm, ok := model.(*bayselm.PYHSMM); ok {
+			boundaryMarginals, spanPosMarginals, err = pyhsmm.TestMarginals(sents, constraints, threads)
+		} else {
+			boundaryMarginals, err = model.TestBoundaryMarginals(sents, constraints, threads)
+		}
+		args.FatalIfError(err, "")
+		for i := 0; i < testSize; i++ {
+			output := marginalsForOutput{WordSeq: wordSeqs[i], BoundaryMarginals: boundaryMarginals[i]}
+			if spanPosMarginals != nil {
+				output.SpanPosMarginals = make([]spanPosMarginalForOutput, 0, 0)
+				for t := range spanPosMarginals[i] {
+					for k := range spanPosMarginals[i][t] {
+						for pos, prob := range spanPosMarginals[i][t][k] {
+							if prob < spanThreshold {
+								continue
+							}
+							word := strings.Join(sents[i][t-k:t+1], splitter)
+							output.SpanPosMarginals = append(output.SpanPosMarginals, spanPosMarginalForOutput{t - k, t + 1, word, pos, prob})
+						}
+					}
+				}
+			}
+			outputJSON, err := json.Marshal(output)
+			if err != nil {
+				panic("marshal error of marginals")
+			}
+			fmt.Println(string(outputJSON))
+		}
+		return
+	}
+	if nbest > 0 {
+		// format: sentence index \t rank \t log probability \t segmented text (word/POS for pyhsmm)
+		nbestSegmentations, err := model.TestNbestWordSegmentation(dataContainerForTest.Sents[:testSize], constraints, nbest, threads)
+		args.FatalIfError(err, "")
+		for i := 0; i < testSize; i++ {
+			for n, nbestSegmentation := range nbestSegmentations[i] {
+				tokens := make([]string, len(nbestSegmentation.WordSeq), len(nbestSegmentation.WordSeq))
+				for j, word := range nbestSegmentation.WordSeq {
+					tokens[j] = word
+					if nbestSegmentation.PosSeq != nil {
+						tokens[j] += "/" + strconv.Itoa(nbestSegmentation.PosSeq[j])
+					}
+				}
+				fmt.Printf("%v\t%v\t%v\t%v\n", i, n+1, nbestSegmentation.Score, strings.Join(tokens, " "))
+			}
+		}
+		return
+	}
+	wordSeqs, err := bayselm.TestWordSegmentationWithDecoding(model, dataContainerForTest.Sents[:testSize], constraints, decode, splitter, threads)
+	args.FatalIfError(err, "")
 	for i := 0; i < testSize; i++ {
 		var newline string
 		for _, token := range wordSeqs[i] {
@@ -150,11 +407,71 @@ func testWordSegmentation(modelForWS string, testFilePathForWS string, loadFile
 	}
 }
 
-func launchAPI(trainFilePathForAPI string, trainGeneralFilePathForAPI string, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, posSize int, base float64, splitter string, threads int, oLabelID int, maxSentLen int) {
+func evaluateWordSegmentation(goldFilePathForEval string, predFilePathForEval string, modelForEval string, loadFile string, decode string, pos bool, posDelimiter string, threads int, splitter string) {
+	if pos {
+		evaluatePosInduction(goldFilePathForEval, predFilePathForEval, modelForEval, loadFile, posDelimiter, threads, splitter)
+		return
+	}
+	dataContainerForGold, err := bayselm.NewDataContainerFromAnnotatedData(goldFilePathForEval)
+	args.FatalIfError(err, "")
+	var segmentationScore bayselm.SegmentationScore
+	if predFilePathForEval != "" {
+		dataContainerForPred, err := bayselm.NewDataContainerFromAnnotatedData(predFilePathForEval)
+		args.FatalIfError(err, "")
+		segmentationScore, err = bayselm.EvaluateWordSegmentation(dataContainerForGold.GetWordSeqs(), dataContainerForPred.GetWordSeqs(), splitter)
+		args.FatalIfError(err, "")
+	} else {
+		if loadFile == "" {
+			args.Fatalf("please input predFile or loadFile")
+		}
+		model, err := loadUnsupervisedWSM(modelForEval, loadFile)
+		args.FatalIfError(err, "load model error")
+		segmentationScore, _, err = bayselm.EvaluateUnsupervisedWSM(model, dataContainerForGold, decode, splitter, threads)
+		args.FatalIfError(err, "")
+	}
+	printSegmentationScore(segmentationScore)
+}
+
+func evaluatePosInduction(goldFilePathForEval string, predFilePathForEval string, modelForEval string, loadFile string, posDelimiter string, threads int, splitter string) {
+	dataContainerForGold, _, err := bayselm.NewDataContainerFromAnnotatedDataWithPos(goldFilePathForEval, posDelimiter)
+	args.FatalIfError(err, "")
+	var segmentationScore bayselm.SegmentationScore
+	var posInductionScore bayselm.PosInductionScore
+	if predFilePathForEval != "" {
+		dataContainerForPred, _, err := bayselm.NewDataContainerFromAnnotatedDataWithPos(predFilePathForEval, posDelimiter)
+		args.FatalIfError(err, "")
+		goldWordSeqs := dataContainerForGold.GetWordSeqs()
+		predWordSeqs := dataContainerForPred.GetWordSeqs()
+		segmentationScore, err = bayselm.EvaluateWordSegmentation(goldWordSeqs, predWordSeqs, splitter)
+		args.FatalIfError(err, "")
+		posInductionScore, err = bayselm.EvaluatePosInduction(goldWordSeqs, dataContainerForGold.SamplingPosSeqs, predWordSeqs, dataContainerForPred.SamplingPosSeqs, splitter)
+		args.FatalIfError(err, "")
+	} else {
+		if loadFile == "" {
+			args.Fatalf("please input predFile or loadFile")
+		}
+		loadModel, err := loadUnsupervisedWSM(modelForEval, loadFile)
+		args.FatalIfError(err, "load model error")
+		model, ok := loadModel.(*bayselm.PYHSMM)
+		if !ok {
+			args.Fatalf("POS induction is evaluated only for pyhsmm")
+		}
+		segmentationScore, posInductionScore, err = bayselm.EvaluatePYHSMMPosInduction(model, dataContainerForGold, splitter, threads)
+		args.FatalIfError(err, "")
+	}
+	printSegmentationScore(segmentationScore)
+	printPosInductionScore(posInductionScore)
+}
+
+func launchAPI(trainFilePathForAPI string, trainGeneralFilePathForAPI string, initialTheta float64, initialD float64, gammaA float64, gammaB float64, betaA float64, betaB float64, alpha float64, beta float64, maxNgram int, maxWordLength int, posSize int, base float64, splitter string, threads int, oLabelID int, maxSentLen int, randSeed int64) {
 	runtime.GOMAXPROCS(threads)
-	model := bayselm.NewPYHSMM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, posSize, splitter)
-	dataContainer := bayselm.NewDataContainer(trainFilePathForAPI, splitter, maxSentLen)
-	dataContainerGeneralDomain := bayselm.NewDataContainer(trainGeneralFilePathForAPI, splitter, maxSentLen)
+	model, err := bayselm.NewPYHSMM(initialTheta, initialD, gammaA, gammaB, betaA, betaB, alpha, beta, maxNgram, maxWordLength, posSize, splitter)
+	args.FatalIfError(err, "building model error")
+	model.SetRandSeed(randSeed)
+	dataContainer, err := bayselm.NewDataContainer(trainFilePathForAPI, splitter, maxSentLen)
+	args.FatalIfError(err, "")
+	dataContainerGeneralDomain, err := bayselm.NewDataContainer(trainGeneralFilePathForAPI, splitter, maxSentLen)
+	args.FatalIfError(err, "")
 
 	engine := gin.Default()
 	engine.GET("/GetPYHSMMFeatsAPI", func(c *gin.Context) {
@@ -163,7 +480,11 @@ func launchAPI(trainFilePathForAPI string, trainGeneralFilePathForAPI string, in
 			c.JSON(http.StatusBadRequest, gin.H{"status": "BadRequest"})
 			return
 		}
-		gfeatsSlice := bayselm.GetPYHSMMFeatsAPI(model, dataContainer, apiParam)
+		gfeatsSlice, err := bayselm.GetPYHSMMFeatsAPI(model, dataContainer, apiParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "BadRequest", "error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"gFeatsSlice": gfeatsSlice})
 	})
 	engine.GET("/GetPYHSMMFeatsFromSentsAPI", func(c *gin.Context) {
@@ -172,7 +493,11 @@ func launchAPI(trainFilePathForAPI string, trainGeneralFilePathForAPI string, in
 			c.JSON(http.StatusBadRequest, gin.H{"status": "BadRequest"})
 			return
 		}
-		gfeatsSlice := bayselm.GetPYHSMMFeatsFromSentsAPI(model, dataContainer, apiParam)
+		gfeatsSlice, err := bayselm.GetPYHSMMFeatsFromSentsAPI(model, dataContainer, apiParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "BadRequest", "error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"gFeatsSlice": gfeatsSlice})
 	})
 	engine.POST("/AddCustomerUsingForwardScoreAPI", func(c *gin.Context) {
@@ -181,7 +506,10 @@ func launchAPI(trainFilePathForAPI string, trainGeneralFilePathForAPI string, in
 			c.JSON(http.StatusBadRequest, gin.H{"status": "BadRequest"})
 			return
 		}
-		bayselm.AddCustomerUsingForwardScoreAPI(model, dataContainer, apiParam)
+		if err := bayselm.AddCustomerUsingForwardScoreAPI(model, dataContainer, apiParam); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "BadRequest", "error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "pong"})
 	})
 	engine.DELETE("/RemoveCustomerAPI", func(c *gin.Context) {
@@ -190,15 +518,24 @@ func launchAPI(trainFilePathForAPI string, trainGeneralFilePathForAPI string, in
 			c.JSON(http.StatusBadRequest, gin.H{"status": "BadRequest"})
 			return
 		}
-		bayselm.RemoveCustomerAPI(model, dataContainer, apiParam)
+		if err := bayselm.RemoveCustomerAPI(model, dataContainer, apiParam); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "BadRequest", "error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "pong"})
 	})
 	engine.POST("/TrainGeneralDomainAPI", func(c *gin.Context) {
-		bayselm.TrainFromAnnotatedCorpus(model, dataContainerGeneralDomain)
+		if err := bayselm.TrainFromAnnotatedCorpus(model, dataContainerGeneralDomain); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "InternalServerError", "error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "pong"})
 	})
 	engine.POST("/InitializeAPI", func(c *gin.Context) {
-		model.Initialize(dataContainer)
+		if err := model.Initialize(dataContainer); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "InternalServerError", "error": err.Error()})
+			return
+		}
 		for i, sent := range dataContainerGeneralDomain.Sents {
 			dataContainerGeneralDomain.SamplingWordSeqs[i] = sent
 			dataContainerGeneralDomain.SamplingPosSeqs[i] = make([]int, len(sent), len(sent))
@@ -206,12 +543,27 @@ func launchAPI(trainFilePathForAPI string, trainGeneralFilePathForAPI string, in
 				dataContainerGeneralDomain.SamplingPosSeqs[i][j] = oLabelID
 			}
 		}
-		bayselm.AddWordSeqAsCustomerAPI(model, dataContainerGeneralDomain)
+		if err := bayselm.AddWordSeqAsCustomerAPI(model, dataContainerGeneralDomain); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "InternalServerError", "error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "pong"})
 	})
 	engine.Run(":3000")
 }
 
+func exportModel(modelForExport string, loadFile string, format string, exportFile string, charExportFile string) {
+	model, err := loadNgramLM(modelForExport, loadFile)
+	args.FatalIfError(err, "load model error")
+	switch format {
+	case "arpa":
+		args.FatalIfError(bayselm.ExportARPA(model, exportFile), "export error")
+		if charExportFile != "" {
+			args.FatalIfError(bayselm.ExportCharARPA(model, charExportFile), "export error")
+		}
+	}
+}
+
 func main() {
 	rand.Seed(0)
 	switch kingpin.MustParse(args.Parse(os.Args[1:])) {
@@ -220,13 +572,17 @@ func main() {
 		trainLanguageModel()
 	case ws.FullCommand():
 		rand.Seed(*randSeed)
-		trainWordSegmentation(*modelForWS, *trainFilePathForWS, *testFilePathForWS, *initialTheta, *initialD, *gammaA, *gammaB, *betaA, *betaB, *alpha, *beta, *maxNgram, *maxWordLength, *posSize, 1.0 / *vocabSize, *epoch, *threads, *batch, *saveFile, *saveFormat, *splitter, *maxSentLen)
+		trainWordSegmentation(*modelForWS, *trainFilePathForWS, *testFilePathForWS, *goldFilePathForWS, *annotatedFilePathForWS, *annotatedWeightForWS, *decodeForWS, *parallelForWS, *mhForWS, *annealScheduleForWS, *annealStartForWS, *annealEndForWS, *constraintForWS, *dictionaryForWS, *dictWeightForWS, *initialTheta, *initialD, *gammaA, *gammaB, *betaA, *betaB, *alpha, *beta, *maxNgram, *maxWordLength, *posSize, 1.0 / *vocabSize, *epoch, *threads, *charCacheSize, *batch, *saveFile, *saveFormat, *checkpointFileForWS, *checkpointIntervalForWS, *resumeForWS, *splitter, *maxSentLen, *randSeed)
 	case wsTest.FullCommand():
 		rand.Seed(*randSeed)
-		testWordSegmentation(*modelForWSTest, *testFilePathForWSTest, *loadFile, *threads, *splitter, *maxSentLen)
+		testWordSegmentation(*modelForWSTest, *testFilePathForWSTest, *loadFile, *decodeForWSTest, *constraintForWSTest, *dictionaryForWSTest, *dictWeightForWSTest, *frozenForWSTest, *nbestForWSTest, *marginalForWSTest, *spanThresholdForWSTest, *threads, *charCacheSize, *splitter, *maxSentLen, *randSeed)
+	case eval.FullCommand():
+		evaluateWordSegmentation(*goldFilePathForEval, *predFilePathForEval, *modelForEval, *loadFileForEval, *decodeForEval, *posForEval, *posDelimiterForEval, *threads, *splitter)
+	case export.FullCommand():
+		exportModel(*modelForExport, *loadFileForExport, *formatForExport, *exportFile, *charExportFileForExport)
 	case api.FullCommand():
 		rand.Seed(*randSeed)
-		launchAPI(*trainFilePathForAPI, *trainGeneralFilePathForAPI, *initialTheta, *initialD, *gammaA, *gammaB, *betaA, *betaB, *alpha, *beta, *maxNgram, *maxWordLength, *posSize, 1.0 / *vocabSize, *splitter, *threads, *oLabelID, *maxSentLen)
+		launchAPI(*trainFilePathForAPI, *trainGeneralFilePathForAPI, *initialTheta, *initialD, *gammaA, *gammaB, *betaA, *betaB, *alpha, *beta, *maxNgram, *maxWordLength, *posSize, 1.0 / *vocabSize, *splitter, *threads, *oLabelID, *maxSentLen, *randSeed)
 	}
 	return
 }